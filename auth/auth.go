@@ -2,12 +2,12 @@ package auth
 
 import (
 	"fmt"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	ErrNotConnected = fmt.Errorf("database not connected")
+	ErrUserNotFound = fmt.Errorf("user not found")
+	ErrUserExists   = fmt.Errorf("user already exists")
 )
 
 // AuthStore contacts the backend to query about the users. It is used for database interaction only.
@@ -30,14 +30,17 @@ type AuthStore interface {
 	DeleteUser(username string) error
 }
 
-// CheckPassword checks if the hash was the result of hashing this specific plainPassword
+// CheckPassword checks if the hash was the result of hashing this specific plainPassword,
+// with any of the registered hashers
 func CheckPassword(plainPassword, hash []byte) bool {
-	return bcrypt.CompareHashAndPassword(hash, plainPassword) == nil
+	ok, _ := VerifyPassword(string(plainPassword), string(hash))
+	return ok
 }
 
-// HashPassword hashes the plainPassword using the bcrypt.DefaultCost
+// HashPassword hashes the plainPassword using the default hasher
 func HashPassword(plainPassword []byte) ([]byte, error) {
-	return bcrypt.GenerateFromPassword(plainPassword, bcrypt.DefaultCost)
+	hash, err := Hash(string(plainPassword))
+	return []byte(hash), err
 }
 
 var _ AuthStore = DummyAuthBackend{}
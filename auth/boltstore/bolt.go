@@ -1,70 +1,350 @@
-// Package boltstore holds an implementation of github.com/alienscience/imapsrv/auth - AuthStore, using
+// Package boltstore holds an implementation of github.com/rakoo/unpeu/auth - AuthStore, using
 // github.com/boltdb/bolt - DB.
 package boltstore
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"github.com/alienscience/imapsrv/auth"
+	"time"
+
 	"github.com/boltdb/bolt"
-	"os"
+	"github.com/rakoo/unpeu/auth"
 )
 
 type BoltAuthStore struct {
 	connection *bolt.DB
+	// Hasher hashes new passwords. Users logging in with a hash of another
+	// scheme or an outdated one get a new hash. It is the default hasher
+	// of the auth package if nil.
+	Hasher auth.Hasher
 }
 
 var (
 	usersBucket = []byte("users")
+
+	// errWrongPassword aborts the transaction of a failed login
+	errWrongPassword = fmt.Errorf("wrong password")
 )
 
+// UserInfo is what is known about a user, besides their password
+type UserInfo struct {
+	Username string
+	// Created is when the user was created. It is zero for users created
+	// before it was recorded.
+	Created time.Time
+	// LastLogin is when the user last logged in successfully, or zero
+	LastLogin time.Time
+	// Disabled users can't log in
+	Disabled bool
+}
+
+// userRecord is the value stored for each user. Older versions stored
+// the bare bcrypt hash; those are converted when the store is opened.
+type userRecord struct {
+	Hash        []byte             `json:"hash"`
+	Created     time.Time          `json:"created"`
+	LastLogin   time.Time          `json:"last_login"`
+	Disabled    bool               `json:"disabled"`
+	Credentials []credentialRecord `json:"credentials,omitempty"`
+}
+
+// credentialRecord is an additional password of a user
+type credentialRecord struct {
+	Name     string       `json:"name"`
+	Hash     []byte       `json:"hash"`
+	Created  time.Time    `json:"created"`
+	LastUsed time.Time    `json:"last_used"`
+	Scopes   []auth.Scope `json:"scopes,omitempty"`
+}
+
+func (c *credentialRecord) credential() auth.Credential {
+	return auth.Credential{
+		Name:     c.Name,
+		Created:  c.Created,
+		LastUsed: c.LastUsed,
+		Scopes:   append([]auth.Scope(nil), c.Scopes...),
+	}
+}
+
+// decodeUser reads a stored user, in either format
+func decodeUser(value []byte) (*userRecord, error) {
+	if !bytes.HasPrefix(value, []byte("{")) {
+		return &userRecord{Hash: append([]byte(nil), value...)}, nil
+	}
+	record := &userRecord{}
+	err := json.Unmarshal(value, record)
+	return record, err
+}
+
 // NewBoltAuthStore creates a new auth store using BoltDB, at the specified file location
 func NewBoltAuthStore(filename string) (*BoltAuthStore, error) {
 	// Open database
-	c, err := bolt.Open(filename, os.FileMode(600), nil)
+	c, err := bolt.Open(filename, 0600, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	// Make sure the Buckets exist
+	// Make sure the Buckets exist, and that users are in the current
+	// format
 	err = c.Update(func(tx *bolt.Tx) (e error) {
-		_, e = tx.CreateBucketIfNotExists(usersBucket)
+		buck, e := tx.CreateBucketIfNotExists(usersBucket)
 		if e != nil {
 			return
 		}
 
+		legacy := make(map[string][]byte)
+		e = buck.ForEach(func(k, v []byte) error {
+			if !bytes.HasPrefix(v, []byte("{")) {
+				legacy[string(k)] = v
+			}
+			return nil
+		})
+		if e != nil {
+			return
+		}
+		for username, hash := range legacy {
+			value, err := json.Marshal(&userRecord{Hash: hash})
+			if err != nil {
+				return err
+			}
+			if err := buck.Put([]byte(username), value); err != nil {
+				return err
+			}
+		}
 		return
 	})
 	if err != nil {
+		c.Close()
 		return nil, err
 	}
 
-	store := &BoltAuthStore{c}
+	store := &BoltAuthStore{connection: c}
 
 	return store, nil
 }
 
-// Authenticate attempts to authenticate the given credentials
+// hasher returns the hasher of new passwords
+func (b *BoltAuthStore) hasher() auth.Hasher {
+	if b.Hasher == nil {
+		return auth.DefaultHasher()
+	}
+	return b.Hasher
+}
+
+// hash hashes a new password
+func (b *BoltAuthStore) hash(plainPassword string) ([]byte, error) {
+	hash, err := b.hasher().Hash(plainPassword)
+	return []byte(hash), err
+}
+
+// Close closes the database
+func (b *BoltAuthStore) Close() error {
+	if b.connection == nil {
+		return auth.ErrNotConnected
+	}
+	return b.connection.Close()
+}
+
+// updateUser runs f on the record of an existing user, and stores it
+func (b *BoltAuthStore) updateUser(username string, f func(record *userRecord) error) error {
+	if b.connection == nil {
+		return auth.ErrNotConnected
+	}
+
+	return b.connection.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(usersBucket)
+		value := buck.Get([]byte(username))
+		if value == nil {
+			return auth.ErrUserNotFound
+		}
+		record, err := decodeUser(value)
+		if err != nil {
+			return err
+		}
+		if err := f(record); err != nil {
+			return err
+		}
+		value, err = json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return buck.Put([]byte(username), value)
+	})
+}
+
+var _ auth.CredentialStore = &BoltAuthStore{}
+
+// Authenticate attempts to authenticate the given credentials, with the
+// main password or any other credential
 func (b *BoltAuthStore) Authenticate(username, plainPassword string) (success bool, err error) {
+	credential, err := b.AuthenticateCredential(username, plainPassword)
+	return credential != nil, err
+}
+
+// AuthenticateCredential attempts to authenticate the given credentials,
+// and returns the credential the password is for
+func (b *BoltAuthStore) AuthenticateCredential(username, plainPassword string) (*auth.Credential, error) {
 	// TODO: do we want this check here, or in a separate "IsAvailable" method in the interface?
 	if b.connection == nil {
-		return false, auth.ErrNotConnected
+		return nil, auth.ErrNotConnected
 	}
 
-	var hashedPassword []byte
+	// Passwords are slow to check on purpose: they are checked in a read
+	// transaction, so that guesses don't hold the only writer
+	var credential *auth.Credential
+	var checked []byte
+	err := b.connection.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(usersBucket).Get([]byte(username))
+		if value == nil {
+			return auth.ErrUserNotFound
+		}
+		record, err := decodeUser(value)
+		if err != nil {
+			return err
+		}
+		if record.Disabled {
+			return errWrongPassword
+		}
 
-	err = b.connection.View(func(tx *bolt.Tx) error {
-		buck := tx.Bucket(usersBucket)
-		hashedPassword = buck.Get([]byte(username))
+		// Find the password among the main one and the credentials
+		if auth.CheckPassword([]byte(plainPassword), record.Hash) {
+			credential, checked = &auth.Credential{}, record.Hash
+			return nil
+		}
+		for _, c := range record.Credentials {
+			if auth.CheckPassword([]byte(plainPassword), c.Hash) {
+				found := c.credential()
+				credential, checked = &found, c.Hash
+				return nil
+			}
+		}
+		return errWrongPassword
+	})
+	if err == errWrongPassword {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Upgrade the hash while the password is known
+	var rehashed []byte
+	if auth.NeedsRehash(string(checked), b.hasher()) {
+		rehashed, _ = b.hash(plainPassword)
+	}
+
+	// The record may have changed since: the new hash only replaces the
+	// one that was checked, so that a password reset in between isn't
+	// undone
+	now := time.Now().UTC()
+	err = b.updateUser(username, func(record *userRecord) error {
+		if record.Disabled {
+			return errWrongPassword
+		}
+		record.LastLogin = now
+		hash := &record.Hash
+		if credential.Name != "" {
+			hash = nil
+			for i := range record.Credentials {
+				if c := &record.Credentials[i]; c.Name == credential.Name {
+					c.LastUsed = now
+					hash = &c.Hash
+				}
+			}
+			if hash == nil {
+				// Revoked in the meantime
+				return errWrongPassword
+			}
+		}
+		if rehashed != nil && bytes.Equal(*hash, checked) {
+			*hash = rehashed
+		}
+		return nil
+	})
+	if err == errWrongPassword {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if credential.Name != "" {
+		credential.LastUsed = now
+	}
+	return credential, nil
+}
+
+// AddCredential adds a credential to a user, and returns its generated
+// password
+func (b *BoltAuthStore) AddCredential(username, name string, scopes ...auth.Scope) (plainPassword string, err error) {
+	if name == "" {
+		return "", auth.ErrCredentialName
+	}
+	plainPassword, err = auth.GeneratePassword()
+	if err != nil {
+		return "", err
+	}
+	hash, err := b.hash(plainPassword)
+	if err != nil {
+		return "", err
+	}
+	err = b.updateUser(username, func(record *userRecord) error {
+		for _, c := range record.Credentials {
+			if c.Name == name {
+				return auth.ErrCredentialExists
+			}
+		}
+		record.Credentials = append(record.Credentials, credentialRecord{
+			Name:    name,
+			Hash:    hash,
+			Created: time.Now().UTC(),
+			Scopes:  scopes,
+		})
 		return nil
 	})
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	if len(hashedPassword) == 0 {
-		return false, fmt.Errorf("user %s not found", username)
+	return plainPassword, nil
+}
+
+// ListCredentials lists the credentials of a user, in the order they were
+// added
+func (b *BoltAuthStore) ListCredentials(username string) ([]auth.Credential, error) {
+	if b.connection == nil {
+		return nil, auth.ErrNotConnected
 	}
 
-	return auth.CheckPassword([]byte(plainPassword), hashedPassword), nil
+	credentials := make([]auth.Credential, 0)
+	err := b.connection.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(usersBucket).Get([]byte(username))
+		if value == nil {
+			return auth.ErrUserNotFound
+		}
+		record, err := decodeUser(value)
+		if err != nil {
+			return err
+		}
+		for _, c := range record.Credentials {
+			credentials = append(credentials, c.credential())
+		}
+		return nil
+	})
+	return credentials, err
+}
+
+// RevokeCredential removes a credential of a user. Its password can't be
+// used anymore.
+func (b *BoltAuthStore) RevokeCredential(username, name string) error {
+	return b.updateUser(username, func(record *userRecord) error {
+		for i, c := range record.Credentials {
+			if c.Name == name {
+				record.Credentials = append(record.Credentials[:i], record.Credentials[i+1:]...)
+				return nil
+			}
+		}
+		return auth.ErrCredentialNotFound
+	})
 }
 
 // CreateUser creates a user with the given username
@@ -73,36 +353,83 @@ func (b *BoltAuthStore) CreateUser(username, plainPassword string) error {
 		return auth.ErrNotConnected
 	}
 
-	hashedPassword, err := auth.HashPassword([]byte(plainPassword))
+	hashedPassword, err := b.hash(plainPassword)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(&userRecord{
+		Hash:    hashedPassword,
+		Created: time.Now().UTC(),
+	})
 	if err != nil {
 		return err
 	}
 
 	err = b.connection.Update(func(tx *bolt.Tx) error {
 		buck := tx.Bucket(usersBucket)
-		return buck.Put([]byte(username), hashedPassword)
+		if buck.Get([]byte(username)) != nil {
+			return auth.ErrUserExists
+		}
+		return buck.Put([]byte(username), value)
 	})
 	return err
 }
 
 // ResetPassword resets the password for the given username
 func (b *BoltAuthStore) ResetPassword(username, plainPassword string) error {
-	if b.connection == nil {
-		return auth.ErrNotConnected
+	hashedPassword, err := b.hash(plainPassword)
+	if err != nil {
+		return err
 	}
-	// TODO: implement
-	return nil
+	return b.updateUser(username, func(record *userRecord) error {
+		record.Hash = hashedPassword
+		return nil
+	})
 }
 
-// ListUsers lists all information about the users
-// TODO: this could be very neat for the sysadmin, but probably a lot of metadata
-// 		 about users is desired, and not just the usernames.
+// SetDisabled disables or enables the given username. Disabled users keep
+// their password, but can't log in.
+func (b *BoltAuthStore) SetDisabled(username string, disabled bool) error {
+	return b.updateUser(username, func(record *userRecord) error {
+		record.Disabled = disabled
+		return nil
+	})
+}
+
+// ListUsers lists the usernames, in order
 func (b *BoltAuthStore) ListUsers() (usernames []string, err error) {
+	users, err := b.ListUserInfos()
+	usernames = make([]string, 0, len(users))
+	for _, user := range users {
+		usernames = append(usernames, user.Username)
+	}
+	return usernames, err
+}
+
+// ListUserInfos lists all information about the users, ordered by
+// username
+func (b *BoltAuthStore) ListUserInfos() ([]UserInfo, error) {
 	if b.connection == nil {
-		return []string{}, auth.ErrNotConnected
+		return []UserInfo{}, auth.ErrNotConnected
 	}
-	// TODO: implement
-	return []string{}, nil
+
+	users := make([]UserInfo, 0)
+	err := b.connection.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			record, err := decodeUser(v)
+			if err != nil {
+				return err
+			}
+			users = append(users, UserInfo{
+				Username:  string(k),
+				Created:   record.Created,
+				LastLogin: record.LastLogin,
+				Disabled:  record.Disabled,
+			})
+			return nil
+		})
+	})
+	return users, err
 }
 
 // DeleteUser removes the username from the database entirely
@@ -110,6 +437,12 @@ func (b *BoltAuthStore) DeleteUser(username string) error {
 	if b.connection == nil {
 		return auth.ErrNotConnected
 	}
-	// TODO: implement
-	return nil
+
+	return b.connection.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(usersBucket)
+		if buck.Get([]byte(username)) == nil {
+			return auth.ErrUserNotFound
+		}
+		return buck.Delete([]byte(username))
+	})
 }
@@ -0,0 +1,238 @@
+package boltstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/rakoo/unpeu/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBoltAuthStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unpeu-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "users.db")
+
+	// A user in the format of older versions
+	db, err := bolt.Open(filename, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := auth.BcryptHasher{Cost: bcrypt.MinCost}.Hash("old")
+	err = db.Update(func(tx *bolt.Tx) error {
+		buck, err := tx.CreateBucket(usersBucket)
+		if err != nil {
+			return err
+		}
+		return buck.Put([]byte("legacy"), []byte(hash))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewBoltAuthStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Invalid permissions: %v (%v)", info.Mode(), err)
+	}
+	if ok, err := store.Authenticate("legacy", "old"); !ok || err != nil {
+		t.Errorf("Legacy user can't log in: %v", err)
+	}
+	// The bcrypt hash was upgraded to the default scheme
+	store.connection.View(func(tx *bolt.Tx) error {
+		record, err := decodeUser(tx.Bucket(usersBucket).Get([]byte("legacy")))
+		if err != nil || !bytes.HasPrefix(record.Hash, []byte("$argon2id$")) {
+			t.Errorf("Hash wasn't upgraded: %s (%v)", record.Hash, err)
+		}
+		return nil
+	})
+	if ok, err := store.Authenticate("legacy", "old"); !ok || err != nil {
+		t.Errorf("Legacy user can't log in after the upgrade: %v", err)
+	}
+
+	if err := store.CreateUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser("alice", "other"); err != auth.ErrUserExists {
+		t.Errorf("Created alice twice: %v", err)
+	}
+	if ok, _ := store.Authenticate("alice", "wrong"); ok {
+		t.Error("Logged in with a wrong password")
+	}
+	if err := store.ResetPassword("alice", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.Authenticate("alice", "new"); !ok || err != nil {
+		t.Errorf("Can't log in after a reset: %v", err)
+	}
+
+	if err := store.SetDisabled("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Authenticate("alice", "new"); ok {
+		t.Error("A disabled user logged in")
+	}
+
+	users, err := store.ListUserInfos()
+	if err != nil || len(users) != 2 {
+		t.Fatalf("Invalid users: %+v (%v)", users, err)
+	}
+	alice, legacy := users[0], users[1]
+	if alice.Username != "alice" || alice.Created.IsZero() || alice.LastLogin.Before(alice.Created) || !alice.Disabled {
+		t.Errorf("Invalid alice: %+v", alice)
+	}
+	if legacy.Username != "legacy" || !legacy.Created.IsZero() || legacy.LastLogin.IsZero() {
+		t.Errorf("Invalid legacy: %+v", legacy)
+	}
+
+	for _, err := range []error{
+		store.ResetPassword("bob", "secret"),
+		store.SetDisabled("bob", true),
+		store.DeleteUser("bob"),
+	} {
+		if err != auth.ErrUserNotFound {
+			t.Errorf("Changed a user that doesn't exist: %v", err)
+		}
+	}
+	if err := store.DeleteUser("legacy"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := store.ListUsers(); err != nil || !reflect.DeepEqual(names, []string{"alice"}) {
+		t.Errorf("Invalid users after delete: %v (%v)", names, err)
+	}
+}
+
+func TestBoltCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unpeu-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewBoltAuthStore(filepath.Join(dir, "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.Hasher = auth.BcryptHasher{Cost: bcrypt.MinCost}
+
+	if err := store.CreateUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	phone, err := store.AddCredential("alice", "phone", auth.ScopeReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, err := store.AddCredential("alice", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddCredential("alice", "phone"); err != auth.ErrCredentialExists {
+		t.Errorf("Added phone twice: %v", err)
+	}
+	if _, err := store.AddCredential("bob", "phone"); err != auth.ErrUserNotFound {
+		t.Errorf("Added a credential to a user that doesn't exist: %v", err)
+	}
+
+	credential, err := store.AuthenticateCredential("alice", phone)
+	if err != nil || credential == nil || credential.Name != "phone" || !credential.HasScope(auth.ScopeReadOnly) {
+		t.Errorf("Invalid phone credential: %+v (%v)", credential, err)
+	}
+	credential, err = store.AuthenticateCredential("alice", "secret")
+	if err != nil || credential == nil || credential.Name != "" || len(credential.Scopes) != 0 {
+		t.Errorf("Invalid main credential: %+v (%v)", credential, err)
+	}
+	if ok, err := store.Authenticate("alice", laptop); !ok || err != nil {
+		t.Errorf("Can't log in with the laptop password: %v", err)
+	}
+	if credential, _ := store.AuthenticateCredential("alice", "wrong"); credential != nil {
+		t.Errorf("Logged in with a wrong password: %+v", credential)
+	}
+
+	credentials, err := store.ListCredentials("alice")
+	if err != nil || len(credentials) != 2 {
+		t.Fatalf("Invalid credentials: %+v (%v)", credentials, err)
+	}
+	if c := credentials[0]; c.Name != "phone" || c.Created.IsZero() || c.LastUsed.Before(c.Created) {
+		t.Errorf("Invalid phone credential: %+v", c)
+	}
+	if c := credentials[1]; c.Name != "laptop" || len(c.Scopes) != 0 {
+		t.Errorf("Invalid laptop credential: %+v", c)
+	}
+
+	if err := store.RevokeCredential("alice", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeCredential("alice", "phone"); err != auth.ErrCredentialNotFound {
+		t.Errorf("Revoked phone twice: %v", err)
+	}
+	if ok, _ := store.Authenticate("alice", phone); ok {
+		t.Error("Logged in with a revoked password")
+	}
+	if ok, err := store.Authenticate("alice", laptop); !ok || err != nil {
+		t.Errorf("Can't log in with the laptop password after revoking phone: %v", err)
+	}
+}
+
+// resettingHasher resets the password of a user the first time it hashes
+type resettingHasher struct {
+	auth.Hasher
+	store *BoltAuthStore
+	reset bool
+}
+
+func (h *resettingHasher) Hash(plainPassword string) (string, error) {
+	if !h.reset {
+		h.reset = true
+		if err := h.store.ResetPassword("legacy", "reset"); err != nil {
+			return "", err
+		}
+	}
+	return h.Hasher.Hash(plainPassword)
+}
+
+func TestBoltRehashRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unpeu-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltAuthStore(filepath.Join(dir, "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.CreateUser("legacy", "old"); err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := auth.BcryptHasher{Cost: bcrypt.MinCost}.Hash("old")
+	store.updateUser("legacy", func(record *userRecord) error {
+		record.Hash = []byte(hash)
+		return nil
+	})
+
+	// The password is reset while the old one is being upgraded: the
+	// login goes through, but the upgrade must not undo the reset
+	store.Hasher = &resettingHasher{Hasher: auth.DefaultHasher(), store: store}
+	if ok, err := store.Authenticate("legacy", "old"); !ok || err != nil {
+		t.Errorf("Can't log in: %v", err)
+	}
+	if ok, _ := store.Authenticate("legacy", "old"); ok {
+		t.Error("The upgrade undid the reset")
+	}
+	if ok, err := store.Authenticate("legacy", "reset"); !ok || err != nil {
+		t.Errorf("Can't log in after the reset: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var (
+	ErrCredentialNotFound = fmt.Errorf("credential not found")
+	ErrCredentialExists   = fmt.Errorf("credential already exists")
+	ErrCredentialName     = fmt.Errorf("credentials need a name")
+)
+
+// Scope limits what a session logged in with a credential can do
+type Scope string
+
+const (
+	// ScopeReadOnly sessions select mailboxes read-only, as with EXAMINE,
+	// and can't change flags or append messages
+	ScopeReadOnly Scope = "read-only"
+	// ScopeNoAppend sessions can't append messages
+	ScopeNoAppend Scope = "no-append"
+)
+
+// Credential is one of the passwords of a user, besides their main
+// password, such as an app-specific password for their phone
+type Credential struct {
+	// Name identifies the credential among those of the user. It is
+	// empty for the main password.
+	Name     string
+	Created  time.Time
+	LastUsed time.Time
+	Scopes   []Scope
+}
+
+// HasScope returns whether the credential has the given scope
+func (c *Credential) HasScope(scope Scope) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CredentialStore is an AuthStore that keeps several named, revocable
+// passwords per user
+type CredentialStore interface {
+	AuthStore
+
+	// AuthenticateCredential attempts to authenticate the given
+	// credentials, and returns the credential the password is for. It
+	// returns nil if the password is wrong. The main password gives a
+	// credential with no name and no scopes.
+	AuthenticateCredential(username, plainPassword string) (*Credential, error)
+
+	// AddCredential adds a credential to a user, and returns its
+	// password, generated by the store
+	AddCredential(username, name string, scopes ...Scope) (plainPassword string, err error)
+
+	// ListCredentials lists the credentials of a user, without the main
+	// password
+	ListCredentials(username string) ([]Credential, error)
+
+	// RevokeCredential removes a credential of a user
+	RevokeCredential(username, name string) error
+}
+
+// AuthenticateCredential authenticates with the store, and returns the
+// credential the password is for, or nil if it is wrong. Stores that
+// aren't CredentialStores only have main passwords.
+func AuthenticateCredential(store AuthStore, username, plainPassword string) (*Credential, error) {
+	if c, ok := store.(CredentialStore); ok {
+		return c.AuthenticateCredential(username, plainPassword)
+	}
+	success, err := store.Authenticate(username, plainPassword)
+	if !success {
+		return nil, err
+	}
+	return &Credential{}, err
+}
+
+// passwordAlphabet has no letters that look like others
+const passwordAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// GeneratePassword returns a random password to give to the user, such as
+// for a new credential: 4 groups of 4 characters separated by dashes
+func GeneratePassword() (string, error) {
+	b := make([]byte, 0, 19)
+	for i := 0; i < 16; i++ {
+		if i > 0 && i%4 == 0 {
+			b = append(b, '-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(passwordAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b = append(b, passwordAlphabet[n.Int64()])
+	}
+	return string(b), nil
+}
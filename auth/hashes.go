@@ -0,0 +1,496 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	// ErrUnknownHash is returned when a stored hash isn't in a known format
+	ErrUnknownHash = fmt.Errorf("unknown password hash format")
+	// ErrVerifyOnly is returned when hashing with a scheme that is only
+	// kept to check legacy hashes
+	ErrVerifyOnly = fmt.Errorf("password hash scheme can only verify")
+)
+
+// Hasher hashes passwords with a scheme, and checks the hashes of that
+// scheme. Hashes are PHC strings, such as $argon2id$v=19$m=...$salt$hash,
+// or the modular crypt format for the schemes that predate it.
+type Hasher interface {
+	// Hash hashes a new password
+	Hash(plainPassword string) (string, error)
+	// Identify returns whether the hash is of this scheme
+	Identify(hash string) bool
+	// Verify checks a password against a hash of this scheme
+	Verify(plainPassword, hash string) (bool, error)
+	// Outdated returns whether the hash is of this scheme, but weaker than
+	// what Hash makes now: a lower cost, or older parameters
+	Outdated(hash string) bool
+}
+
+// The registered hashers, and the name of the default one
+var hashers = struct {
+	sync.RWMutex
+	byName      map[string]Hasher
+	defaultName string
+}{
+	byName: map[string]Hasher{
+		"argon2id":     Argon2Hasher{Memory: 64 * 1024, Time: 3, Threads: 4},
+		"bcrypt":       BcryptHasher{Cost: bcrypt.DefaultCost},
+		"scrypt":       ScryptHasher{LogN: 15, R: 8, P: 1},
+		"sha512-crypt": SHA512CryptHasher{},
+	},
+	defaultName: "argon2id",
+}
+
+// RegisterHasher adds a hasher under the given name, or replaces the one
+// with that name, such as to change the parameters of argon2id. The
+// hashers built in are argon2id, bcrypt, scrypt and sha512-crypt.
+func RegisterHasher(name string, h Hasher) {
+	hashers.Lock()
+	defer hashers.Unlock()
+	hashers.byName[name] = h
+}
+
+// SetDefaultHasher sets the hasher used for new passwords, and to which
+// older hashes are upgraded. It is argon2id by default.
+func SetDefaultHasher(name string) error {
+	hashers.Lock()
+	defer hashers.Unlock()
+	h, ok := hashers.byName[name]
+	if !ok {
+		return ErrUnknownHash
+	}
+	if _, ok := h.(SHA512CryptHasher); ok {
+		return ErrVerifyOnly
+	}
+	hashers.defaultName = name
+	return nil
+}
+
+// DefaultHasher returns the hasher used for new passwords
+func DefaultHasher() Hasher {
+	hashers.RLock()
+	defer hashers.RUnlock()
+	return hashers.byName[hashers.defaultName]
+}
+
+// Hash hashes a password with the default hasher
+func Hash(plainPassword string) (string, error) {
+	return DefaultHasher().Hash(plainPassword)
+}
+
+// identify returns the hasher of a hash, without its scheme prefix
+func identify(hash string) Hasher {
+	hashers.RLock()
+	defer hashers.RUnlock()
+	for _, h := range hashers.byName {
+		if h.Identify(hash) {
+			return h
+		}
+	}
+	return nil
+}
+
+// splitScheme splits the dovecot {SCHEME} prefix from a hash
+func splitScheme(hash string) (scheme, rest string) {
+	if strings.HasPrefix(hash, "{") {
+		if end := strings.Index(hash, "}"); end > 0 {
+			return strings.ToUpper(hash[1:end]), hash[end+1:]
+		}
+	}
+	return "", hash
+}
+
+// DovecotScheme prefixes a hash with its dovecot {SCHEME}, for files and
+// tables that dovecot reads too. It returns "" for hashes dovecot has no
+// scheme for, and prefixed hashes unchanged.
+func DovecotScheme(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "{"):
+		return hash
+	case strings.HasPrefix(hash, "$2"):
+		return "{BLF-CRYPT}" + hash
+	case strings.HasPrefix(hash, "$6$"):
+		return "{SHA512-CRYPT}" + hash
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return "{ARGON2ID}" + hash
+	case strings.HasPrefix(hash, "$argon2i$"):
+		return "{ARGON2I}" + hash
+	}
+	return ""
+}
+
+// VerifyPassword checks a password against a hash of one of the
+// registered hashers. Hashes may carry a dovecot scheme prefix such as
+// {SHA512-CRYPT}, which is required for the salted and unsalted SHA1 of
+// {SSHA} and {SHA}.
+func VerifyPassword(plainPassword, hash string) (bool, error) {
+	scheme, hash := splitScheme(hash)
+	if scheme == "SSHA" || scheme == "SHA" {
+		return verifySha1(plainPassword, hash, scheme == "SSHA")
+	}
+	if h := identify(hash); h != nil {
+		return h.Verify(plainPassword, hash)
+	}
+	return false, ErrUnknownHash
+}
+
+// NeedsRehash returns whether a hash should be replaced by a new hash of
+// the password made by h, because it is of another scheme or it is
+// outdated. Stores call it after a successful login, when they still
+// have the password.
+func NeedsRehash(hash string, h Hasher) bool {
+	_, hash = splitScheme(hash)
+	return !h.Identify(hash) || h.Outdated(hash)
+}
+
+// verifySha1 checks a password against the base64 of its SHA1, followed
+// by the salt if there is one
+func verifySha1(plainPassword, hash string, salted bool) (bool, error) {
+	decoded, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil || len(decoded) < sha1.Size || (!salted && len(decoded) != sha1.Size) {
+		return false, ErrUnknownHash
+	}
+	sum := sha1.Sum(append([]byte(plainPassword), decoded[sha1.Size:]...))
+	return subtle.ConstantTimeCompare(sum[:], decoded[:sha1.Size]) == 1, nil
+}
+
+// salt returns n random bytes
+func salt(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// BcryptHasher hashes with bcrypt: $2a$, $2b$ and $2y$
+type BcryptHasher struct {
+	Cost int
+}
+
+func (b BcryptHasher) Hash(plainPassword string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plainPassword), b.Cost)
+	return string(hash), err
+}
+
+func (b BcryptHasher) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "$2")
+}
+
+func (b BcryptHasher) Verify(plainPassword, hash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plainPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b BcryptHasher) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < b.Cost
+}
+
+// Argon2Hasher hashes with argon2id, in the PHC format:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>. It also verifies argon2i
+// hashes, which are always outdated.
+type Argon2Hasher struct {
+	// Memory is in KiB
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// maxArgon2Memory is the most memory a stored argon2 hash can ask for, in
+// KiB, so that a bad hash can't exhaust the memory of the server
+const maxArgon2Memory = 1024 * 1024
+
+// argon2Params are the parts of an argon2 hash
+type argon2Params struct {
+	variant        string
+	memory, time   uint32
+	threads        uint8
+	salt, expected []byte
+}
+
+func parseArgon2(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return nil, ErrUnknownHash
+	}
+	p := &argon2Params{variant: parts[1]}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil || p.time < 1 || p.threads < 1 || p.memory > maxArgon2Memory {
+		return nil, ErrUnknownHash
+	}
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, ErrUnknownHash
+	}
+	p.expected, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(p.expected) == 0 {
+		return nil, ErrUnknownHash
+	}
+	return p, nil
+}
+
+func (a Argon2Hasher) Hash(plainPassword string) (string, error) {
+	salt, err := salt(16)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(plainPassword), salt, a.Time, a.Memory, a.Threads, 32)
+	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s", a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a Argon2Hasher) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2i$") || strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (a Argon2Hasher) Verify(plainPassword, hash string) (bool, error) {
+	p, err := parseArgon2(hash)
+	if err != nil {
+		return false, err
+	}
+	var key []byte
+	switch p.variant {
+	case "argon2id":
+		key = argon2.IDKey([]byte(plainPassword), p.salt, p.time, p.memory, p.threads, uint32(len(p.expected)))
+	case "argon2i":
+		key = argon2.Key([]byte(plainPassword), p.salt, p.time, p.memory, p.threads, uint32(len(p.expected)))
+	default:
+		return false, ErrUnknownHash
+	}
+	return subtle.ConstantTimeCompare(key, p.expected) == 1, nil
+}
+
+func (a Argon2Hasher) Outdated(hash string) bool {
+	p, err := parseArgon2(hash)
+	return err != nil || p.variant != "argon2id" || p.memory < a.Memory || p.time < a.Time
+}
+
+// ScryptHasher hashes with scrypt, in the PHC format used by passlib:
+// $scrypt$ln=15,r=8,p=1$<salt>$<hash>
+type ScryptHasher struct {
+	// LogN is the log2 of the CPU/memory cost N
+	LogN int
+	R, P int
+}
+
+// scryptParams are the parts of a scrypt hash
+type scryptParams struct {
+	logN, r, p     int
+	salt, expected []byte
+}
+
+func parseScrypt(hash string) (*scryptParams, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return nil, ErrUnknownHash
+	}
+	p := &scryptParams{}
+	_, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.logN, &p.r, &p.p)
+	if err != nil || p.logN < 1 || p.logN > 30 {
+		return nil, ErrUnknownHash
+	}
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, ErrUnknownHash
+	}
+	p.expected, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(p.expected) == 0 {
+		return nil, ErrUnknownHash
+	}
+	return p, nil
+}
+
+func (s ScryptHasher) Hash(plainPassword string) (string, error) {
+	salt, err := salt(16)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(plainPassword), salt, 1<<uint(s.LogN), s.R, s.P, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", s.LogN, s.R, s.P,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (s ScryptHasher) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "$scrypt$")
+}
+
+func (s ScryptHasher) Verify(plainPassword, hash string) (bool, error) {
+	p, err := parseScrypt(hash)
+	if err != nil {
+		return false, err
+	}
+	key, err := scrypt.Key([]byte(plainPassword), p.salt, 1<<uint(p.logN), p.r, p.p, len(p.expected))
+	if err != nil {
+		return false, ErrUnknownHash
+	}
+	return subtle.ConstantTimeCompare(key, p.expected) == 1, nil
+}
+
+func (s ScryptHasher) Outdated(hash string) bool {
+	p, err := parseScrypt(hash)
+	return err != nil || p.logN < s.LogN || p.r < s.R || p.p < s.P
+}
+
+// SHA512CryptHasher verifies the SHA512-CRYPT hashes of existing user
+// databases: $6$[rounds=<n>$]<salt>$<hash>. It doesn't make new ones, and
+// its hashes are always outdated.
+type SHA512CryptHasher struct{}
+
+func (SHA512CryptHasher) Hash(plainPassword string) (string, error) {
+	return "", ErrVerifyOnly
+}
+
+func (SHA512CryptHasher) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "$6$")
+}
+
+func (SHA512CryptHasher) Verify(plainPassword, hash string) (bool, error) {
+	return verifySha512Crypt(plainPassword, hash)
+}
+
+func (SHA512CryptHasher) Outdated(hash string) bool {
+	return true
+}
+
+// verifySha512Crypt checks a password against a SHA512-CRYPT hash:
+// $6$[rounds=<n>$]<salt>$<hash>
+func verifySha512Crypt(plainPassword, hash string) (bool, error) {
+	parts := strings.Split(hash[len("$6$"):], "$")
+	rounds, customRounds := 5000, false
+	if len(parts) == 3 && strings.HasPrefix(parts[0], "rounds=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(parts[0], "rounds="))
+		if err != nil {
+			return false, ErrUnknownHash
+		}
+		rounds, customRounds = n, true
+		parts = parts[1:]
+	}
+	if len(parts) != 2 {
+		return false, ErrUnknownHash
+	}
+	computed := sha512Crypt([]byte(plainPassword), []byte(parts[0]), rounds, customRounds)
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+}
+
+// cryptAlphabet is the base64 alphabet of crypt(3)
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512Crypt computes a SHA512-CRYPT hash as specified by Ulrich Drepper
+// in "Unix crypt using SHA-256 and SHA-512"
+func sha512Crypt(password, salt []byte, rounds int, customRounds bool) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	if rounds < 1000 {
+		rounds = 1000
+	} else if rounds > 999999999 {
+		rounds = 999999999
+	}
+
+	// repeat returns sum repeated up to n bytes
+	repeat := func(sum []byte, n int) []byte {
+		out := make([]byte, 0, n)
+		for len(out)+len(sum) <= n {
+			out = append(out, sum...)
+		}
+		return append(out, sum[:n-len(out)]...)
+	}
+
+	b := sha512.New()
+	b.Write(password)
+	b.Write(salt)
+	b.Write(password)
+	bSum := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(password)
+	a.Write(salt)
+	a.Write(repeat(bSum, len(password)))
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(bSum)
+		} else {
+			a.Write(password)
+		}
+	}
+	aSum := a.Sum(nil)
+
+	dp := sha512.New()
+	for i := 0; i < len(password); i++ {
+		dp.Write(password)
+	}
+	p := repeat(dp.Sum(nil), len(password))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(aSum[0]); i++ {
+		ds.Write(salt)
+	}
+	s := repeat(ds.Sum(nil), len(salt))
+
+	c := aSum
+	for i := 0; i < rounds; i++ {
+		h := sha512.New()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	out := []byte("$6$")
+	if customRounds {
+		out = append(out, "rounds="+strconv.Itoa(rounds)+"$"...)
+	}
+	out = append(out, salt...)
+	out = append(out, '$')
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			out = append(out, cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for i := 0; i < 21; i++ {
+		// The bytes are shuffled in groups of three: 0 21 42, 22 43 1, ...
+		x, y, z := i, i+21, i+42
+		switch i % 3 {
+		case 1:
+			x, y, z = i+21, i+42, i
+		case 2:
+			x, y, z = i+42, i, i+21
+		}
+		encode(c[x], c[y], c[z], 4)
+	}
+	encode(0, 0, c[63], 2)
+	return string(out)
+}
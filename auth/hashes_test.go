@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, _ := BcryptHasher{Cost: bcrypt.MinCost}.Hash("secret")
+	salt := []byte("somesaltsomesalt")
+	argon2Hash := "$argon2id$v=19$m=1024,t=2,p=1$" + base64.RawStdEncoding.EncodeToString(salt) +
+		"$" + base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), salt, 2, 1024, 1, 32))
+	sum := sha1.Sum([]byte("secret" + "salt"))
+	sshaHash := "{SSHA}" + base64.StdEncoding.EncodeToString(append(sum[:], "salt"...))
+
+	vectors := []struct {
+		password string
+		hash     string
+		ok       bool
+	}{
+		{"secret", bcryptHash, true},
+		{"wrong", bcryptHash, false},
+		{"secret", "{BLF-CRYPT}" + bcryptHash, true},
+		// From "Unix crypt using SHA-256 and SHA-512"
+		{"Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", true},
+		{"Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.", true},
+		{"we have a short salt string but not a short password", "{SHA512-CRYPT}$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0", true},
+		{"Hello world", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", false},
+		{"secret", argon2Hash, true},
+		{"wrong", argon2Hash, false},
+		{"secret", "{ARGON2ID}" + argon2Hash, true},
+		{"secret", sshaHash, true},
+		{"wrong", sshaHash, false},
+		// htpasswd -s
+		{"secret", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", true},
+	}
+	for _, v := range vectors {
+		ok, err := VerifyPassword(v.password, v.hash)
+		if err != nil || ok != v.ok {
+			t.Errorf("Verifying %q against %s: got %v (%v)", v.password, v.hash, ok, err)
+		}
+	}
+
+	if _, err := VerifyPassword("secret", "5ebe2294ecd0e0f08eab7690d2a6ee69"); err != ErrUnknownHash {
+		t.Errorf("Unknown hash accepted: %v", err)
+	}
+
+	// Bad argon2 parameters are refused instead of crashing argon2
+	for _, params := range []string{"m=1024,t=0,p=1", "m=1024,t=2,p=0", "m=4294967295,t=2,p=1"} {
+		hash := strings.Replace(argon2Hash, "m=1024,t=2,p=1", params, 1)
+		if _, err := VerifyPassword("secret", hash); err != ErrUnknownHash {
+			t.Errorf("Hash with %s accepted: %v", params, err)
+		}
+	}
+}
+
+func TestHashers(t *testing.T) {
+	bcryptHasher := BcryptHasher{Cost: bcrypt.MinCost + 1}
+	argon2Hasher := Argon2Hasher{Memory: 1024, Time: 2, Threads: 1}
+	scryptHasher := ScryptHasher{LogN: 4, R: 8, P: 1}
+	for _, h := range []Hasher{bcryptHasher, argon2Hasher, scryptHasher} {
+		hash, err := h.Hash("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.Identify(hash) || NeedsRehash(hash, h) {
+			t.Errorf("%T doesn't know its hash %s", h, hash)
+		}
+		if ok, err := h.Verify("secret", hash); !ok || err != nil {
+			t.Errorf("%T can't verify %s: %v", h, hash, err)
+		}
+		if ok, err := h.Verify("wrong", hash); ok || err != nil {
+			t.Errorf("%T verified a wrong password: %v", h, err)
+		}
+	}
+
+	weakBcrypt, _ := BcryptHasher{Cost: bcrypt.MinCost}.Hash("secret")
+	weakArgon2, _ := Argon2Hasher{Memory: 512, Time: 2, Threads: 1}.Hash("secret")
+	weakScrypt, _ := ScryptHasher{LogN: 2, R: 8, P: 1}.Hash("secret")
+	salt := []byte("somesaltsomesalt")
+	argon2i := "$argon2i$v=19$m=1024,t=2,p=1$" + base64.RawStdEncoding.EncodeToString(salt) +
+		"$" + base64.RawStdEncoding.EncodeToString(argon2.Key([]byte("secret"), salt, 2, 1024, 1, 32))
+	for _, v := range []struct {
+		hash string
+		h    Hasher
+	}{
+		{weakBcrypt, bcryptHasher},
+		{weakArgon2, argon2Hasher},
+		{weakScrypt, scryptHasher},
+		{argon2i, argon2Hasher},
+		{"{BLF-CRYPT}" + weakBcrypt, argon2Hasher},
+		{"{SSHA}c2FsdHNhbHRzYWx0c2FsdHNhbHQ=", argon2Hasher},
+	} {
+		if !NeedsRehash(v.hash, v.h) {
+			t.Errorf("%s isn't outdated for %T", v.hash, v.h)
+		}
+	}
+
+	if _, err := (SHA512CryptHasher{}).Hash("secret"); err != ErrVerifyOnly {
+		t.Errorf("Hashed with SHA512-CRYPT: %v", err)
+	}
+	if err := SetDefaultHasher("sha512-crypt"); err != ErrVerifyOnly {
+		t.Errorf("SHA512-CRYPT became the default: %v", err)
+	}
+	if err := SetDefaultHasher("md5"); err != ErrUnknownHash {
+		t.Errorf("Unknown default: %v", err)
+	}
+
+	RegisterHasher("scrypt", scryptHasher)
+	defer RegisterHasher("scrypt", ScryptHasher{LogN: 15, R: 8, P: 1})
+	if err := SetDefaultHasher("scrypt"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDefaultHasher("argon2id")
+	if hash, err := Hash("secret"); err != nil || !strings.HasPrefix(hash, "$scrypt$ln=4,") {
+		t.Errorf("Invalid hash with the default hasher: %s (%v)", hash, err)
+	}
+}
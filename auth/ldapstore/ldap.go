@@ -0,0 +1,292 @@
+// Package ldapstore holds an implementation of github.com/rakoo/unpeu/auth - AuthStore, on
+// an LDAP directory, using github.com/go-ldap/ldap.
+//
+// Users are found with a search, and their password is checked by binding
+// as them. The directory is managed elsewhere: users can't be created,
+// reset or deleted through the store.
+package ldapstore
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rakoo/unpeu/auth"
+)
+
+// ErrUnsupported is returned for the operations that would change the
+// directory
+var ErrUnsupported = fmt.Errorf("operation not supported by the LDAP directory")
+
+// Options configure the connection to the directory and how users are found
+type Options struct {
+	// URL of the server, such as ldap://ldap.example.org or
+	// ldaps://ldap.example.org:636
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS before binding
+	StartTLS bool
+	// TLSConfig is used for ldaps:// and StartTLS. The system roots are
+	// used if it is nil.
+	TLSConfig *tls.Config
+	// Timeout of dialing and of every request. Zero means no timeout.
+	Timeout time.Duration
+
+	// BindDN and BindPassword are the account used to search the
+	// directory. Searches are anonymous if BindDN is empty.
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is where users are searched, in the whole subtree
+	BaseDN string
+	// Filter finds a user. %s is replaced by the escaped username. It is
+	// (uid=%s) by default.
+	Filter string
+	// UsernameAttribute holds the username of the entries found by Filter,
+	// for ListUsers. It is uid by default.
+	UsernameAttribute string
+
+	// GroupDN, if set, is a group users must be members of to log in
+	GroupDN string
+	// GroupFilter checks that a user is a member of GroupDN. %s is
+	// replaced by the escaped DN of the user. It is (member=%s) by
+	// default; use (memberUid=%s) with the username for posixGroups.
+	GroupFilter string
+	// GroupFilterUsername makes GroupFilter use the username instead of
+	// the DN of the user
+	GroupFilterUsername bool
+
+	// PoolSize is the number of idle connections kept open. It is 4 by
+	// default.
+	PoolSize int
+}
+
+type LDAPAuthStore struct {
+	opts Options
+	// Idle connections, bound as BindDN or anonymous
+	pool chan *ldap.Conn
+}
+
+// NewLDAPAuthStore creates a new auth store on the directory. It connects
+// once, to check the options.
+func NewLDAPAuthStore(opts Options) (*LDAPAuthStore, error) {
+	if opts.Filter == "" {
+		opts.Filter = "(uid=%s)"
+	}
+	if opts.UsernameAttribute == "" {
+		opts.UsernameAttribute = "uid"
+	}
+	if opts.GroupFilter == "" {
+		opts.GroupFilter = "(member=%s)"
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 4
+	}
+	l := &LDAPAuthStore{
+		opts: opts,
+		pool: make(chan *ldap.Conn, opts.PoolSize),
+	}
+
+	conn, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	l.put(conn, nil)
+	return l, nil
+}
+
+// Close closes the idle connections
+func (l *LDAPAuthStore) Close() error {
+	for {
+		select {
+		case conn := <-l.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// dial opens a new connection, bound as the search account
+func (l *LDAPAuthStore) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(l.opts.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: l.opts.Timeout}),
+		ldap.DialWithTLSConfig(l.opts.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	if l.opts.Timeout > 0 {
+		conn.SetTimeout(l.opts.Timeout)
+	}
+	if l.opts.StartTLS && strings.HasPrefix(strings.ToLower(l.opts.URL), "ldap://") {
+		config := l.opts.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if u, err := url.Parse(l.opts.URL); err == nil && config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+		if err := conn.StartTLS(config); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := l.bindSearch(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// bindSearch binds the connection as the search account
+func (l *LDAPAuthStore) bindSearch(conn *ldap.Conn) error {
+	if l.opts.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(l.opts.BindDN, l.opts.BindPassword)
+}
+
+// get returns an idle connection, or a new one
+func (l *LDAPAuthStore) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-l.pool:
+			if conn.IsClosing() {
+				conn.Close()
+				continue
+			}
+			return conn, nil
+		default:
+			return l.dial()
+		}
+	}
+}
+
+// put gives back a connection after it was used. It is closed if the
+// pool is full, or if err is a network error.
+func (l *LDAPAuthStore) put(conn *ldap.Conn, err error) {
+	if conn.IsClosing() || (err != nil && ldap.IsErrorWithCode(err, ldap.ErrorNetwork)) {
+		conn.Close()
+		return
+	}
+	select {
+	case l.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// search runs a search on a connection from the pool
+func (l *LDAPAuthStore) search(baseDN string, scope int, filter string, attributes ...string) ([]*ldap.Entry, error) {
+	conn, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(baseDN, scope, ldap.NeverDerefAliases,
+		0, 0, false, filter, attributes, nil))
+	l.put(conn, err)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result.Entries, nil
+}
+
+// userDN returns the DN of a user
+func (l *LDAPAuthStore) userDN(username string) (string, error) {
+	filter := strings.Replace(l.opts.Filter, "%s", ldap.EscapeFilter(username), -1)
+	entries, err := l.search(l.opts.BaseDN, ldap.ScopeWholeSubtree, filter, "dn")
+	if err != nil {
+		return "", err
+	}
+	switch len(entries) {
+	case 0:
+		return "", auth.ErrUserNotFound
+	case 1:
+		return entries[0].DN, nil
+	}
+	return "", fmt.Errorf("%d LDAP entries for user %q", len(entries), username)
+}
+
+// isMember checks that a user is in the group of GroupDN
+func (l *LDAPAuthStore) isMember(username, dn string) (bool, error) {
+	member := dn
+	if l.opts.GroupFilterUsername {
+		member = username
+	}
+	filter := strings.Replace(l.opts.GroupFilter, "%s", ldap.EscapeFilter(member), -1)
+	entries, err := l.search(l.opts.GroupDN, ldap.ScopeBaseObject, filter, "dn")
+	return len(entries) > 0, err
+}
+
+// Authenticate attempts to authenticate the given credentials
+func (l *LDAPAuthStore) Authenticate(username, plainPassword string) (success bool, err error) {
+	// An empty password would be an unauthenticated bind, which succeeds
+	if username == "" || plainPassword == "" {
+		return false, nil
+	}
+	dn, err := l.userDN(username)
+	if err != nil {
+		return false, err
+	}
+
+	conn, err := l.get()
+	if err != nil {
+		return false, err
+	}
+	err = conn.Bind(dn, plainPassword)
+	// Back to the search account before the connection is reused
+	if bindErr := l.bindSearch(conn); bindErr != nil {
+		conn.Close()
+	} else {
+		l.put(conn, nil)
+	}
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if l.opts.GroupDN == "" {
+		return true, nil
+	}
+	return l.isMember(username, dn)
+}
+
+// CreateUser isn't supported: users are created in the directory
+func (l *LDAPAuthStore) CreateUser(username, plainPassword string) error {
+	return ErrUnsupported
+}
+
+// ResetPassword isn't supported: passwords are changed in the directory
+func (l *LDAPAuthStore) ResetPassword(username, plainPassword string) error {
+	return ErrUnsupported
+}
+
+// ListUsers lists the usernames of the entries found by the filter
+func (l *LDAPAuthStore) ListUsers() (usernames []string, err error) {
+	usernames = []string{}
+	filter := strings.Replace(l.opts.Filter, "%s", "*", -1)
+	entries, err := l.search(l.opts.BaseDN, ldap.ScopeWholeSubtree, filter, l.opts.UsernameAttribute)
+	if err != nil {
+		return usernames, err
+	}
+	for _, entry := range entries {
+		if username := entry.GetAttributeValue(l.opts.UsernameAttribute); username != "" {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames, nil
+}
+
+// DeleteUser isn't supported: users are deleted in the directory
+func (l *LDAPAuthStore) DeleteUser(username string) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,329 @@
+package ldapstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/rakoo/unpeu/auth"
+)
+
+// A directory for the stand-in server: DN -> attribute -> values
+var directory = map[string]map[string][]string{
+	"cn=service,dc=example,dc=org": {
+		"cn":           {"service"},
+		"userPassword": {"service-secret"},
+	},
+	"uid=alice,ou=people,dc=example,dc=org": {
+		"objectClass":  {"person"},
+		"uid":          {"alice"},
+		"userPassword": {"alice-secret"},
+	},
+	"uid=bob,ou=people,dc=example,dc=org": {
+		"objectClass":  {"person"},
+		"uid":          {"bob"},
+		"userPassword": {"bob-secret"},
+	},
+	"cn=mail,ou=groups,dc=example,dc=org": {
+		"objectClass": {"groupOfNames"},
+		"member":      {"uid=alice,ou=people,dc=example,dc=org"},
+	},
+}
+
+// ldapServer is an in-process stand-in for an LDAP server. It knows simple
+// binds, searches with the filters used by the store, and StartTLS.
+// Searches need to be bound as the service account, and binds need TLS.
+type ldapServer struct {
+	l        net.Listener
+	tls      *tls.Config
+	accepted int32
+}
+
+func newLDAPServer(t *testing.T, config *tls.Config, implicitTLS bool) *ldapServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if implicitTLS {
+		l = tls.NewListener(l, config)
+	}
+	s := &ldapServer{l: l, tls: config}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.accepted, 1)
+			go s.serve(conn, implicitTLS)
+		}
+	}()
+	return s
+}
+
+func (s *ldapServer) serve(conn net.Conn, secure bool) {
+	defer conn.Close()
+	var bound string
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		id := request.Children[0].Value.(int64)
+		op := request.Children[1]
+		var responses []*ber.Packet
+		switch op.Tag {
+		case 0: // Bind
+			name := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := 0
+			switch {
+			case name == "" && password == "":
+			case !secure:
+				code = 13 // confidentialityRequired
+			case len(directory[name]["userPassword"]) == 0 || directory[name]["userPassword"][0] != password:
+				code = 49 // invalidCredentials
+			}
+			if code == 0 {
+				bound = name
+			} else {
+				bound = ""
+			}
+			responses = append(responses, result(1, code))
+		case 2: // Unbind
+			return
+		case 3: // Search
+			if bound != "cn=service,dc=example,dc=org" {
+				responses = append(responses, result(5, 50)) // insufficientAccessRights
+				break
+			}
+			base := strings.ToLower(op.Children[0].Data.String())
+			scope := op.Children[1].Value.(int64)
+			var dns []string
+			for dn, attributes := range directory {
+				inScope := dn == base || (scope == 2 && strings.HasSuffix(dn, ","+base))
+				if inScope && match(op.Children[6], attributes) {
+					dns = append(dns, dn)
+				}
+			}
+			sort.Strings(dns)
+			for _, dn := range dns {
+				responses = append(responses, entry(dn, directory[dn]))
+			}
+			responses = append(responses, result(5, 0))
+		case 23: // Extended: StartTLS
+			responses = append(responses, result(24, 0))
+		default:
+			responses = append(responses, result(1, 2)) // protocolError
+		}
+		for _, response := range responses {
+			packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			packet.AppendChild(response)
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return
+			}
+		}
+		if op.Tag == 23 {
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+		}
+	}
+}
+
+// match evaluates the filters used by the store
+func match(filter *ber.Packet, attributes map[string][]string) bool {
+	switch filter.Tag {
+	case 0: // and
+		for _, child := range filter.Children {
+			if !match(child, attributes) {
+				return false
+			}
+		}
+		return true
+	case 3: // equalityMatch
+		values := attributes[filter.Children[0].Data.String()]
+		for _, value := range values {
+			if strings.EqualFold(value, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+	case 7: // present
+		return len(attributes[filter.Data.String()]) > 0
+	}
+	return false
+}
+
+func result(tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return op
+}
+
+func entry(dn string, attributes map[string][]string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, values := range attributes {
+		if name == "userPassword" {
+			continue
+		}
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		}
+		attribute.AppendChild(set)
+		list.AppendChild(attribute)
+	}
+	op.AppendChild(list)
+	return op
+}
+
+// testTLS returns a server configuration with a self-signed certificate
+// for 127.0.0.1, and a client configuration trusting it
+func testTLS(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldap test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: pool}
+}
+
+func TestLDAPAuthStore(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	server := newLDAPServer(t, serverTLS, true)
+	defer server.l.Close()
+
+	opts := Options{
+		URL:          "ldaps://" + server.l.Addr().String(),
+		TLSConfig:    clientTLS,
+		Timeout:      5 * time.Second,
+		BindDN:       "cn=service,dc=example,dc=org",
+		BindPassword: "service-secret",
+		BaseDN:       "ou=people,dc=example,dc=org",
+		Filter:       "(&(objectClass=person)(uid=%s))",
+		PoolSize:     1,
+	}
+	store, err := NewLDAPAuthStore(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for _, v := range []struct {
+		username, password string
+		ok                 bool
+		err                error
+	}{
+		{"alice", "alice-secret", true, nil},
+		{"bob", "bob-secret", true, nil},
+		{"alice", "wrong", false, nil},
+		// Would be an unauthenticated bind
+		{"alice", "", false, nil},
+		{"carol", "secret", false, auth.ErrUserNotFound},
+		{"*", "alice-secret", false, auth.ErrUserNotFound},
+	} {
+		ok, err := store.Authenticate(v.username, v.password)
+		if ok != v.ok || err != v.err {
+			t.Errorf("Authenticating %s with %q: got %v (%v)", v.username, v.password, ok, err)
+		}
+	}
+
+	names, err := store.ListUsers()
+	if err != nil || !reflect.DeepEqual(names, []string{"alice", "bob"}) {
+		t.Errorf("Invalid users: %v (%v)", names, err)
+	}
+	if err := store.CreateUser("carol", "secret"); err != ErrUnsupported {
+		t.Errorf("Created a user: %v", err)
+	}
+	if n := atomic.LoadInt32(&server.accepted); n != 1 {
+		t.Errorf("%d connections were opened instead of one", n)
+	}
+
+	// Only members of the group
+	opts.GroupDN = "cn=mail,ou=groups,dc=example,dc=org"
+	groupStore, err := NewLDAPAuthStore(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer groupStore.Close()
+	if ok, err := groupStore.Authenticate("alice", "alice-secret"); !ok || err != nil {
+		t.Errorf("Member can't log in: %v", err)
+	}
+	if ok, err := groupStore.Authenticate("bob", "bob-secret"); ok || err != nil {
+		t.Errorf("Non-member logged in: %v", err)
+	}
+
+	opts.BindPassword = "wrong"
+	if _, err := NewLDAPAuthStore(opts); err == nil {
+		t.Error("Created a store with a wrong search password")
+	}
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	server := newLDAPServer(t, serverTLS, false)
+	defer server.l.Close()
+
+	opts := Options{
+		URL:          "ldap://" + server.l.Addr().String(),
+		TLSConfig:    clientTLS,
+		BindDN:       "cn=service,dc=example,dc=org",
+		BindPassword: "service-secret",
+		BaseDN:       "dc=example,dc=org",
+	}
+	if _, err := NewLDAPAuthStore(opts); err == nil {
+		t.Error("Bound without TLS")
+	}
+
+	opts.StartTLS = true
+	store, err := NewLDAPAuthStore(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if ok, err := store.Authenticate("alice", "alice-secret"); !ok || err != nil {
+		t.Errorf("Can't log in with StartTLS: %v", err)
+	}
+}
@@ -0,0 +1,306 @@
+// Package passwdfile holds an implementation of github.com/rakoo/unpeu/auth - AuthStore, on
+// a flat file in the dovecot passwd-file or the htpasswd format.
+//
+// Both formats have a line per user, starting with the username and the
+// password hash, separated by a colon:
+//
+//	alice:{SHA512-CRYPT}$6$...:1000:1000::/home/alice::userdb_quota_rule=*:storage=1G
+//	bob:$2y$05$...
+//
+// dovecot passwd-files have more fields, which are kept as they are.
+// Empty lines and lines starting with # are ignored, and kept too.
+package passwdfile
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rakoo/unpeu/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidUsername is returned when creating a user whose name can't be
+// written in the file
+var ErrInvalidUsername = fmt.Errorf("invalid username for a passwd-file")
+
+// Format is the format of the file
+type Format int
+
+const (
+	// Dovecot is the dovecot passwd-file format. New hashes are written
+	// with their scheme, such as {BLF-CRYPT}.
+	Dovecot Format = iota
+	// Htpasswd is the Apache htpasswd format. New hashes are written bare.
+	Htpasswd
+)
+
+type PasswdFileAuthStore struct {
+	filename string
+	format   Format
+	// Hasher hashes the passwords of new users and of resets. Users
+	// logging in with a hash of another scheme or an outdated one get a
+	// new hash. It is the default hasher of the auth package for dovecot
+	// files, and bcrypt for htpasswd files, which only know bcrypt among
+	// the strong schemes.
+	Hasher auth.Hasher
+
+	l sync.Mutex
+	// The lines of the file, as read
+	lines []string
+	// The line of each user
+	users map[string]int
+	// The file as it was when read, to notice changes
+	modTime time.Time
+	size    int64
+}
+
+// NewPasswdFileAuthStore creates a new auth store on the given file. The
+// file is created when the first user is, if it doesn't exist yet. It is
+// read again whenever it changes.
+func NewPasswdFileAuthStore(filename string, format Format) (*PasswdFileAuthStore, error) {
+	p := &PasswdFileAuthStore{
+		filename: filename,
+		format:   format,
+	}
+	if format == Htpasswd {
+		p.Hasher = auth.BcryptHasher{Cost: bcrypt.DefaultCost}
+	}
+	p.l.Lock()
+	defer p.l.Unlock()
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reload reads the file again if it changed since it was last read. The
+// lock must be held.
+func (p *PasswdFileAuthStore) reload() error {
+	info, err := os.Stat(p.filename)
+	if os.IsNotExist(err) {
+		p.lines, p.users = nil, make(map[string]int)
+		p.modTime, p.size = time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if p.users != nil && info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return nil
+	}
+
+	f, err := os.Open(p.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	users := make(map[string]int)
+	for i, line := range lines {
+		if username, _, ok := splitLine(line); ok {
+			users[username] = i
+		}
+	}
+	p.lines, p.users = lines, users
+	p.modTime, p.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// splitLine returns the username and the password hash of a line, and
+// false if the line isn't about a user
+func splitLine(line string) (username, hash string, ok bool) {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	fields := strings.SplitN(line, ":", 3)
+	if len(fields) < 2 || fields[0] == "" {
+		return "", "", false
+	}
+	return fields[0], fields[1], true
+}
+
+// write replaces the file with the given lines, atomically. The lock must
+// be held.
+func (p *PasswdFileAuthStore) write(lines []string) error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(p.filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p.filename), "."+filepath.Base(p.filename)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, line := range lines {
+		w.WriteString(line)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p.filename); err != nil {
+		return err
+	}
+
+	// Read back, so that the state matches the new file
+	p.users = nil
+	return p.reload()
+}
+
+// hasher returns the hasher of new passwords
+func (p *PasswdFileAuthStore) hasher() auth.Hasher {
+	if p.Hasher == nil {
+		return auth.DefaultHasher()
+	}
+	return p.Hasher
+}
+
+// hash returns the hash of the password to write in the file
+func (p *PasswdFileAuthStore) hash(plainPassword string) (string, error) {
+	hash, err := p.hasher().Hash(plainPassword)
+	if err != nil {
+		return "", err
+	}
+	if p.format == Dovecot {
+		if prefixed := auth.DovecotScheme(hash); prefixed != "" {
+			hash = prefixed
+		}
+	}
+	return hash, nil
+}
+
+// Authenticate attempts to authenticate the given credentials
+func (p *PasswdFileAuthStore) Authenticate(username, plainPassword string) (success bool, err error) {
+	p.l.Lock()
+	err = p.reload()
+	var hash string
+	if i, ok := p.users[username]; ok && err == nil {
+		_, hash, _ = splitLine(p.lines[i])
+	} else if err == nil {
+		err = auth.ErrUserNotFound
+	}
+	p.l.Unlock()
+	if err != nil {
+		return false, err
+	}
+	success, err = auth.VerifyPassword(plainPassword, hash)
+	if success && auth.NeedsRehash(hash, p.hasher()) {
+		// Upgrade the hash while the password is known, unless it was
+		// changed since it was checked. The login succeeds even if this
+		// fails.
+		if rehashed, err := p.hash(plainPassword); err == nil {
+			p.setHash(username, rehashed, hash)
+		}
+	}
+	return success, err
+}
+
+// CreateUser creates a user with the given username
+func (p *PasswdFileAuthStore) CreateUser(username, plainPassword string) error {
+	if username == "" || strings.ContainsAny(username, ":\n") || strings.HasPrefix(username, "#") {
+		return ErrInvalidUsername
+	}
+	hash, err := p.hash(plainPassword)
+	if err != nil {
+		return err
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	if err := p.reload(); err != nil {
+		return err
+	}
+	if _, ok := p.users[username]; ok {
+		return auth.ErrUserExists
+	}
+	lines := append(append([]string(nil), p.lines...), username+":"+hash)
+	return p.write(lines)
+}
+
+// ResetPassword resets the password for the given username
+func (p *PasswdFileAuthStore) ResetPassword(username, plainPassword string) error {
+	hash, err := p.hash(plainPassword)
+	if err != nil {
+		return err
+	}
+	return p.setHash(username, hash, "")
+}
+
+// setHash replaces the hash of the user. If old isn't empty, the hash is
+// only replaced if it is still old.
+func (p *PasswdFileAuthStore) setHash(username, hash, old string) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if err := p.reload(); err != nil {
+		return err
+	}
+	i, ok := p.users[username]
+	if !ok {
+		return auth.ErrUserNotFound
+	}
+	if _, current, _ := splitLine(p.lines[i]); old != "" && current != old {
+		return nil
+	}
+	lines := append([]string(nil), p.lines...)
+	fields := strings.SplitN(lines[i], ":", 3)
+	fields[1] = hash
+	lines[i] = strings.Join(fields, ":")
+	return p.write(lines)
+}
+
+// ListUsers lists the usernames, in order
+func (p *PasswdFileAuthStore) ListUsers() (usernames []string, err error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	usernames = []string{}
+	if err := p.reload(); err != nil {
+		return usernames, err
+	}
+	for username := range p.users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames, nil
+}
+
+// DeleteUser removes the username from the file
+func (p *PasswdFileAuthStore) DeleteUser(username string) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if err := p.reload(); err != nil {
+		return err
+	}
+	i, ok := p.users[username]
+	if !ok {
+		return auth.ErrUserNotFound
+	}
+	lines := append(append([]string(nil), p.lines[:i]...), p.lines[i+1:]...)
+	return p.write(lines)
+}
@@ -0,0 +1,156 @@
+package passwdfile
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rakoo/unpeu/auth"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswdFileAuthStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unpeu-passwdfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "users")
+
+	hasher := auth.BcryptHasher{Cost: bcrypt.MinCost}
+	bcryptHash, _ := hasher.Hash("bcrypt")
+	salt := []byte("somesaltsomesalt")
+	argon2Hash := "$argon2id$v=19$m=1024,t=2,p=1$" + base64.RawStdEncoding.EncodeToString(salt) +
+		"$" + base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("argon2"), salt, 2, 1024, 1, 32))
+	sum := sha1.Sum([]byte("ssha" + "salt"))
+	sshaHash := base64.StdEncoding.EncodeToString(append(sum[:], "salt"...))
+	content := strings.Join([]string{
+		"# users of example.org",
+		"blf:{BLF-CRYPT}" + bcryptHash + ":1000:1000::/home/blf::userdb_quota_rule=*:storage=1G",
+		"sha512:{SHA512-CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		"",
+		"ssha:{SSHA}" + sshaHash + "::::::",
+		"argon2:{ARGON2ID}" + argon2Hash,
+	}, "\n") + "\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewPasswdFileAuthStore(filename, Dovecot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Hasher = hasher
+	for username, password := range map[string]string{
+		"blf":    "bcrypt",
+		"sha512": "Hello world!",
+		"ssha":   "ssha",
+		"argon2": "argon2",
+	} {
+		if ok, err := store.Authenticate(username, password); !ok || err != nil {
+			t.Errorf("%s can't log in: %v", username, err)
+		}
+		if ok, _ := store.Authenticate(username, "wrong"); ok {
+			t.Errorf("%s logged in with a wrong password", username)
+		}
+	}
+	if _, err := store.Authenticate("nobody", "secret"); err != auth.ErrUserNotFound {
+		t.Errorf("Unknown user: %v", err)
+	}
+
+	// Changes made by others are seen
+	err = ioutil.WriteFile(filename, []byte(content+"bob:{SSHA}"+sshaHash+"\n"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filename, future, future)
+	if ok, err := store.Authenticate("bob", "ssha"); !ok || err != nil {
+		t.Errorf("Added user can't log in: %v", err)
+	}
+
+	if err := store.CreateUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser("bob", "secret"); err != auth.ErrUserExists {
+		t.Errorf("Created bob twice: %v", err)
+	}
+	if err := store.CreateUser("eve:0", "secret"); err != ErrInvalidUsername {
+		t.Errorf("Created an invalid user: %v", err)
+	}
+	if err := store.ResetPassword("blf", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteUser("sha512"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		store.ResetPassword("sha512", "secret"),
+		store.DeleteUser("sha512"),
+	} {
+		if err != auth.ErrUserNotFound {
+			t.Errorf("Changed a user that doesn't exist: %v", err)
+		}
+	}
+
+	names, err := store.ListUsers()
+	if err != nil || !reflect.DeepEqual(names, []string{"alice", "argon2", "blf", "bob", "ssha"}) {
+		t.Errorf("Invalid users: %v (%v)", names, err)
+	}
+	if ok, err := store.Authenticate("blf", "new"); !ok || err != nil {
+		t.Errorf("Can't log in after a reset: %v", err)
+	}
+	// An upgrade of a hash that was reset since it was checked is lost
+	if err := store.setHash("blf", "{SSHA}"+sshaHash, "stale hash"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.Authenticate("blf", "new"); !ok || err != nil {
+		t.Errorf("Can't log in after a stale upgrade: %v", err)
+	}
+
+	// The file was rewritten with everything else kept
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	if len(lines) != 8 || lines[0] != "# users of example.org" || lines[2] != "" {
+		t.Errorf("Invalid file:\n%s", data)
+	}
+	if !strings.HasPrefix(lines[1], "blf:{BLF-CRYPT}$2") || !strings.HasSuffix(lines[1], ":1000:1000::/home/blf::userdb_quota_rule=*:storage=1G") {
+		t.Errorf("Invalid reset line: %s", lines[1])
+	}
+	// bob's hash was upgraded when he logged in
+	if !strings.HasPrefix(lines[5], "bob:{BLF-CRYPT}$2") {
+		t.Errorf("Hash wasn't upgraded: %s", lines[5])
+	}
+	if !strings.HasPrefix(lines[6], "alice:{BLF-CRYPT}$2") {
+		t.Errorf("Invalid created line: %s", lines[6])
+	}
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("Invalid permissions: %v (%v)", info.Mode(), err)
+	}
+
+	// htpasswd files have bare hashes
+	htpasswd, err := NewPasswdFileAuthStore(filepath.Join(dir, "htpasswd"), Htpasswd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := htpasswd.CreateUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "htpasswd"))
+	if !strings.HasPrefix(string(data), "alice:$2") {
+		t.Errorf("Invalid htpasswd file: %s", data)
+	}
+	if ok, err := htpasswd.Authenticate("alice", "secret"); !ok || err != nil {
+		t.Errorf("Can't log in with htpasswd: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+// Package sqlstore holds an implementation of github.com/rakoo/unpeu/auth - AuthStore, on
+// any database/sql driver. Drivers aren't imported here: import the one
+// of your database, such as github.com/go-sql-driver/mysql,
+// github.com/lib/pq or github.com/mattn/go-sqlite3.
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rakoo/unpeu/auth"
+)
+
+// ErrUnsupported is returned for operations that have no query
+var ErrUnsupported = fmt.Errorf("operation not supported by this user table")
+
+// Dialect is the flavour of SQL of a database. Queries are written with ?
+// placeholders, which the dialect rewrites if the database uses others.
+type Dialect struct {
+	Name string
+	// placeholder returns the i-th placeholder, starting at 1
+	placeholder func(i int) string
+}
+
+var (
+	MySQL      = Dialect{Name: "mysql", placeholder: func(int) string { return "?" }}
+	SQLite     = Dialect{Name: "sqlite", placeholder: func(int) string { return "?" }}
+	PostgreSQL = Dialect{Name: "postgres", placeholder: func(i int) string { return "$" + strconv.Itoa(i) }}
+)
+
+// rebind rewrites the ? placeholders of a query for the dialect
+func (d Dialect) rebind(query string) string {
+	var out strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			out.WriteString(d.placeholder(n))
+			continue
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// Queries are the queries run by the store, with ? placeholders for their
+// arguments. An empty query makes the matching operation fail with
+// ErrUnsupported.
+type Queries struct {
+	// Password selects the password hash of a user. Argument: username.
+	Password string
+	// Create inserts a user. Arguments: username, hash.
+	Create string
+	// Reset changes the password hash of a user. Arguments: hash,
+	// username.
+	Reset string
+	// Rehash upgrades the password hash of a user logging in, if it is
+	// still the one that was checked. Arguments: new hash, username, old
+	// hash. Hashes aren't upgraded without it.
+	Rehash string
+	// List selects all the usernames, in order
+	List string
+	// Delete removes a user. Argument: username.
+	Delete string
+}
+
+// TableQueries returns the queries for a table holding a username and a
+// password column
+func TableQueries(table, usernameColumn, passwordColumn string) Queries {
+	return Queries{
+		Password: fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", passwordColumn, table, usernameColumn),
+		Create:   fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES (?, ?)", table, usernameColumn, passwordColumn),
+		Reset:    fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", table, passwordColumn, usernameColumn),
+		Rehash:   fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ? AND %s = ?", table, passwordColumn, usernameColumn, passwordColumn),
+		List:     fmt.Sprintf("SELECT %s FROM %s ORDER BY %s", usernameColumn, table, usernameColumn),
+		Delete:   fmt.Sprintf("DELETE FROM %s WHERE %s = ?", table, usernameColumn),
+	}
+}
+
+// PostfixAdminQueries are the queries for the mailbox table of
+// postfixadmin. Only active mailboxes can log in. Mailboxes are created
+// and deleted from postfixadmin, which fills many more columns. Hashes
+// aren't upgraded on login, as postfixadmin may not know the new scheme.
+var PostfixAdminQueries = Queries{
+	Password: "SELECT password FROM mailbox WHERE username = ? AND active = '1'",
+	Reset:    "UPDATE mailbox SET password = ? WHERE username = ?",
+	List:     "SELECT username FROM mailbox ORDER BY username",
+}
+
+type SQLAuthStore struct {
+	db      *sql.DB
+	dialect Dialect
+	queries Queries
+	// Hasher hashes the passwords of new users and of resets. Users
+	// logging in with a hash of another scheme or an outdated one get a
+	// new hash, if there is a Rehash query. It is the default hasher of
+	// the auth package if nil.
+	Hasher auth.Hasher
+}
+
+// NewSQLAuthStore creates a new auth store on an open database
+func NewSQLAuthStore(db *sql.DB, dialect Dialect, queries Queries) *SQLAuthStore {
+	return &SQLAuthStore{
+		db:      db,
+		dialect: dialect,
+		queries: queries,
+	}
+}
+
+// hasher returns the hasher of new passwords
+func (s *SQLAuthStore) hasher() auth.Hasher {
+	if s.Hasher == nil {
+		return auth.DefaultHasher()
+	}
+	return s.Hasher
+}
+
+// exec runs a query that changes a user, and checks that the user was
+// there
+func (s *SQLAuthStore) exec(query string, args ...interface{}) error {
+	if s.db == nil {
+		return auth.ErrNotConnected
+	}
+	if query == "" {
+		return ErrUnsupported
+	}
+	result, err := s.db.Exec(s.dialect.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		return auth.ErrUserNotFound
+	}
+	return err
+}
+
+// hash returns the stored hash of the user's password
+func (s *SQLAuthStore) hash(username string) (string, error) {
+	if s.db == nil {
+		return "", auth.ErrNotConnected
+	}
+	if s.queries.Password == "" {
+		return "", ErrUnsupported
+	}
+	var hash string
+	err := s.db.QueryRow(s.dialect.rebind(s.queries.Password), username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", auth.ErrUserNotFound
+	}
+	return hash, err
+}
+
+// Authenticate attempts to authenticate the given credentials
+func (s *SQLAuthStore) Authenticate(username, plainPassword string) (success bool, err error) {
+	hash, err := s.hash(username)
+	if err != nil {
+		return false, err
+	}
+	success, err = auth.VerifyPassword(plainPassword, hash)
+	if success && s.queries.Rehash != "" && auth.NeedsRehash(hash, s.hasher()) {
+		// Upgrade the hash while the password is known. The login
+		// succeeds even if this fails.
+		s.rehash(username, plainPassword, hash)
+	}
+	return success, err
+}
+
+// rehash replaces the hash of the user by a new hash of the password, if
+// it is still the old one. The new hash has a dovecot {SCHEME} prefix if
+// the old one had one, since the table may be read by dovecot too.
+func (s *SQLAuthStore) rehash(username, plainPassword, old string) error {
+	rehashed, err := s.hasher().Hash(plainPassword)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(old, "{") {
+		if rehashed = auth.DovecotScheme(rehashed); rehashed == "" {
+			return fmt.Errorf("no dovecot scheme for the hasher")
+		}
+	}
+	return s.exec(s.queries.Rehash, rehashed, username, old)
+}
+
+// CreateUser creates a user with the given username
+func (s *SQLAuthStore) CreateUser(username, plainPassword string) error {
+	if s.queries.Create == "" {
+		return ErrUnsupported
+	}
+	_, err := s.hash(username)
+	switch err {
+	case nil:
+		return auth.ErrUserExists
+	case auth.ErrUserNotFound, ErrUnsupported:
+	default:
+		return err
+	}
+
+	hash, err := s.hasher().Hash(plainPassword)
+	if err != nil {
+		return err
+	}
+	return s.exec(s.queries.Create, username, hash)
+}
+
+// ResetPassword resets the password for the given username
+func (s *SQLAuthStore) ResetPassword(username, plainPassword string) error {
+	if s.queries.Reset == "" {
+		return ErrUnsupported
+	}
+	hash, err := s.hasher().Hash(plainPassword)
+	if err != nil {
+		return err
+	}
+	return s.exec(s.queries.Reset, hash, username)
+}
+
+// ListUsers lists the usernames
+func (s *SQLAuthStore) ListUsers() (usernames []string, err error) {
+	usernames = []string{}
+	if s.db == nil {
+		return usernames, auth.ErrNotConnected
+	}
+	if s.queries.List == "" {
+		return usernames, ErrUnsupported
+	}
+	rows, err := s.db.Query(s.dialect.rebind(s.queries.List))
+	if err != nil {
+		return usernames, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return usernames, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// DeleteUser removes the username from the database entirely
+func (s *SQLAuthStore) DeleteUser(username string) error {
+	return s.exec(s.queries.Delete, username)
+}
@@ -0,0 +1,123 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rakoo/unpeu/auth"
+)
+
+func TestRebind(t *testing.T) {
+	query := "UPDATE users SET password = ? WHERE username = ?"
+	if rebound := PostgreSQL.rebind(query); rebound != "UPDATE users SET password = $1 WHERE username = $2" {
+		t.Errorf("Invalid PostgreSQL query: %s", rebound)
+	}
+	if rebound := MySQL.rebind(query); rebound != query {
+		t.Errorf("Invalid MySQL query: %s", rebound)
+	}
+}
+
+func TestSQLAuthStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE accounts (login TEXT PRIMARY KEY, pass TEXT NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An existing user, with a hash from another system
+	_, err = db.Exec(`INSERT INTO accounts VALUES ('legacy', '{SHA512-CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewSQLAuthStore(db, SQLite, TableQueries("accounts", "login", "pass"))
+	if ok, err := store.Authenticate("legacy", "Hello world!"); !ok || err != nil {
+		t.Errorf("Legacy user can't log in: %v", err)
+	}
+	// The legacy hash was upgraded to the default scheme, keeping the
+	// dovecot prefix
+	var hash string
+	if err := db.QueryRow(`SELECT pass FROM accounts WHERE login = 'legacy'`).Scan(&hash); err != nil || !strings.HasPrefix(hash, "{ARGON2ID}$argon2id$") {
+		t.Errorf("Hash wasn't upgraded: %s (%v)", hash, err)
+	}
+	if ok, err := store.Authenticate("legacy", "Hello world!"); !ok || err != nil {
+		t.Errorf("Legacy user can't log in after the upgrade: %v", err)
+	}
+	if err := store.CreateUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser("alice", "secret"); err != auth.ErrUserExists {
+		t.Errorf("Created alice twice: %v", err)
+	}
+	if ok, _ := store.Authenticate("alice", "wrong"); ok {
+		t.Error("Logged in with a wrong password")
+	}
+	if err := store.ResetPassword("alice", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.Authenticate("alice", "new"); !ok || err != nil {
+		t.Errorf("Can't log in after a reset: %v", err)
+	}
+	// An upgrade of a hash that was reset since it was checked is lost
+	if err := store.rehash("alice", "secret", "stale hash"); err != auth.ErrUserNotFound {
+		t.Errorf("Upgraded a stale hash: %v", err)
+	}
+	if ok, err := store.Authenticate("alice", "new"); !ok || err != nil {
+		t.Errorf("Can't log in after a stale upgrade: %v", err)
+	}
+	if users, err := store.ListUsers(); err != nil || !reflect.DeepEqual(users, []string{"alice", "legacy"}) {
+		t.Errorf("Invalid users: %v (%v)", users, err)
+	}
+
+	if _, err := store.Authenticate("bob", "secret"); err != auth.ErrUserNotFound {
+		t.Errorf("Authenticated a user that doesn't exist: %v", err)
+	}
+	if err := store.ResetPassword("bob", "secret"); err != auth.ErrUserNotFound {
+		t.Errorf("Reset a user that doesn't exist: %v", err)
+	}
+	if err := store.DeleteUser("legacy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteUser("legacy"); err != auth.ErrUserNotFound {
+		t.Errorf("Deleted a user twice: %v", err)
+	}
+
+	readOnly := NewSQLAuthStore(db, SQLite, Queries{Password: "SELECT pass FROM accounts WHERE login = ?"})
+	if err := readOnly.CreateUser("bob", "secret"); err != ErrUnsupported {
+		t.Errorf("Created a user without a query: %v", err)
+	}
+}
+
+func TestPostfixAdminQueries(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE mailbox (username TEXT PRIMARY KEY, password TEXT NOT NULL, active TEXT NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const legacy = "{SHA512-CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+	if _, err = db.Exec(`INSERT INTO mailbox VALUES ('alice', ?, '1')`, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewSQLAuthStore(db, SQLite, PostfixAdminQueries)
+	if ok, err := store.Authenticate("alice", "Hello world!"); !ok || err != nil {
+		t.Errorf("Can't log in: %v", err)
+	}
+	// postfixadmin's hash is left alone
+	var hash string
+	if err := db.QueryRow(`SELECT password FROM mailbox WHERE username = 'alice'`).Scan(&hash); err != nil || hash != legacy {
+		t.Errorf("Hash was changed: %s (%v)", hash, err)
+	}
+}
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLocked is returned while a username or an address is locked out
+	// after too many failures
+	ErrLocked = fmt.Errorf("too many authentication failures, try again later")
+	// ErrDenied is returned for addresses in the deny list
+	ErrDenied = fmt.Errorf("authentication not allowed from this address")
+)
+
+// RemoteAuthStore is an AuthStore that takes into account the address
+// the client connects from. The server uses AuthenticateRemote when the
+// store has it.
+type RemoteAuthStore interface {
+	AuthStore
+	// AuthenticateRemote attempts to authenticate the given credentials,
+	// sent from the given address. Like AuthenticateCredential, it returns
+	// the credential the password is for, or nil if it is wrong.
+	AuthenticateRemote(remote net.IP, username, plainPassword string) (*Credential, error)
+}
+
+// ThrottleOptions configure a Throttle. Zero fields take the default.
+type ThrottleOptions struct {
+	// BaseDelay is how long the answer to the first failure is delayed.
+	// The delay doubles with every failure. 1s by default.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay. 30s by default.
+	MaxDelay time.Duration
+	// LockoutFailures is the number of failures after which the username
+	// or address is locked out. 10 by default.
+	LockoutFailures int
+	// LockoutDuration is how long a lockout lasts. 15 minutes by default.
+	LockoutDuration time.Duration
+	// Forget is how long failures are remembered after the last one. 1
+	// hour by default.
+	Forget time.Duration
+
+	// Allow are networks that are never throttled
+	Allow []*net.IPNet
+	// Deny are networks that can't authenticate at all
+	Deny []*net.IPNet
+}
+
+// failures is what is known of the failures of a username or an address
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// Throttle wraps an AuthStore and slows down password guessing: failures
+// are counted per username and per address, and their answers delayed
+// exponentially. After too many failures, the username or the address is
+// locked out for a while, whatever the password.
+type Throttle struct {
+	AuthStore
+	opts ThrottleOptions
+
+	l       sync.Mutex
+	records map[string]*failures
+	pruned  time.Time
+
+	// For tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+var _ RemoteAuthStore = &Throttle{}
+
+// NewThrottle wraps the store with the options
+func NewThrottle(store AuthStore, opts ThrottleOptions) *Throttle {
+	if opts.BaseDelay == 0 {
+		opts.BaseDelay = time.Second
+	}
+	if opts.MaxDelay == 0 {
+		opts.MaxDelay = 30 * time.Second
+	}
+	if opts.LockoutFailures == 0 {
+		opts.LockoutFailures = 10
+	}
+	if opts.LockoutDuration == 0 {
+		opts.LockoutDuration = 15 * time.Minute
+	}
+	if opts.Forget == 0 {
+		opts.Forget = time.Hour
+	}
+	return &Throttle{
+		AuthStore: store,
+		opts:      opts,
+		records:   make(map[string]*failures),
+		now:       time.Now,
+		sleep:     time.Sleep,
+	}
+}
+
+// ParseNetworks parses a list of CIDR networks such as 192.168.0.0/16 or
+// 2001:db8::/32, for the Allow and Deny options. Plain addresses are
+// networks of a single address.
+func ParseNetworks(cidrs ...string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// contains returns whether one of the networks contains the address
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// keys returns the keys of the records of a username and an address
+func keys(remote net.IP, username string) []string {
+	k := []string{"user:" + username}
+	if remote != nil {
+		k = append(k, "ip:"+remote.String())
+	}
+	return k
+}
+
+// Authenticate attempts to authenticate the given credentials, counting
+// failures for the username only
+func (t *Throttle) Authenticate(username, plainPassword string) (success bool, err error) {
+	credential, err := t.AuthenticateRemote(nil, username, plainPassword)
+	return credential != nil, err
+}
+
+// AuthenticateRemote attempts to authenticate the given credentials, sent
+// from the given address. It may be delayed, and fails with ErrLocked
+// during a lockout or ErrDenied for denied addresses.
+func (t *Throttle) AuthenticateRemote(remote net.IP, username, plainPassword string) (*Credential, error) {
+	if remote != nil {
+		if contains(t.opts.Deny, remote) {
+			return nil, ErrDenied
+		}
+		if contains(t.opts.Allow, remote) {
+			return AuthenticateCredential(t.AuthStore, username, plainPassword)
+		}
+	}
+
+	if t.locked(keys(remote, username)) {
+		return nil, ErrLocked
+	}
+	credential, err := AuthenticateCredential(t.AuthStore, username, plainPassword)
+	if credential != nil {
+		// Only the username is forgiven: a sprayer with one valid
+		// account mustn't clear the failures of its address. Those
+		// expire with Forget.
+		t.reset(keys(nil, username))
+		return credential, err
+	}
+	if delay := t.fail(keys(remote, username)); delay > 0 {
+		t.sleep(delay)
+	}
+	return nil, err
+}
+
+// locked returns whether one of the keys is locked out
+func (t *Throttle) locked(keys []string) bool {
+	t.l.Lock()
+	defer t.l.Unlock()
+	now := t.now()
+	for _, key := range keys {
+		if r, ok := t.records[key]; ok && now.Before(r.lockedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// reset forgets the failures of the keys
+func (t *Throttle) reset(keys []string) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	for _, key := range keys {
+		delete(t.records, key)
+	}
+}
+
+// fail counts a failure for each key, and returns how long to delay the
+// answer
+func (t *Throttle) fail(keys []string) time.Duration {
+	t.l.Lock()
+	defer t.l.Unlock()
+	now := t.now()
+	t.prune(now)
+
+	count := 0
+	for _, key := range keys {
+		r, ok := t.records[key]
+		if !ok || now.Sub(r.last) > t.opts.Forget {
+			r = &failures{}
+			t.records[key] = r
+		}
+		r.count++
+		r.last = now
+		if r.count >= t.opts.LockoutFailures {
+			r.count = 0
+			r.lockedUntil = now.Add(t.opts.LockoutDuration)
+		}
+		if r.count > count {
+			count = r.count
+		}
+	}
+
+	if count == 0 {
+		// Just locked out: the next attempts won't even be tried
+		return 0
+	}
+	delay := t.opts.BaseDelay
+	for i := 1; i < count && delay < t.opts.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.opts.MaxDelay {
+		delay = t.opts.MaxDelay
+	}
+	return delay
+}
+
+// prune forgets the records that are too old, from time to time
+func (t *Throttle) prune(now time.Time) {
+	if now.Sub(t.pruned) < t.opts.Forget {
+		return
+	}
+	t.pruned = now
+	for key, r := range t.records {
+		if now.Sub(r.last) > t.opts.Forget && now.After(r.lockedUntil) {
+			delete(t.records, key)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// passwordStore accepts a single password for everyone
+type passwordStore struct {
+	DummyAuthBackend
+	password string
+	calls    int
+}
+
+func (p *passwordStore) Authenticate(username, plainPassword string) (bool, error) {
+	p.calls++
+	return plainPassword == p.password, nil
+}
+
+func TestThrottle(t *testing.T) {
+	allow, _ := ParseNetworks("10.0.0.0/8")
+	deny, err := ParseNetworks("192.0.2.1", "2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &passwordStore{password: "secret"}
+	throttle := NewThrottle(store, ThrottleOptions{
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Second,
+		LockoutFailures: 5,
+		LockoutDuration: time.Minute,
+		Allow:           allow,
+		Deny:            deny,
+	})
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var delays []time.Duration
+	throttle.now = func() time.Time { return now }
+	throttle.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	attacker := net.ParseIP("198.51.100.1")
+	for i := 0; i < 4; i++ {
+		if credential, err := throttle.AuthenticateRemote(attacker, "alice", "wrong"); credential != nil || err != nil {
+			t.Fatalf("Invalid failure: %v %v", credential, err)
+		}
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	if len(delays) != len(expected) {
+		t.Fatalf("Invalid delays: %v", delays)
+	}
+	for i := range expected {
+		if delays[i] != expected[i] {
+			t.Errorf("Invalid delays: %v", delays)
+		}
+	}
+
+	// The fifth failure locks alice and the attacker out
+	throttle.AuthenticateRemote(attacker, "alice", "wrong")
+	calls := store.calls
+	if _, err := throttle.AuthenticateRemote(net.ParseIP("198.51.100.2"), "alice", "secret"); err != ErrLocked {
+		t.Errorf("alice isn't locked: %v", err)
+	}
+	if _, err := throttle.Authenticate("bob", "secret"); err != nil {
+		t.Errorf("bob is locked: %v", err)
+	}
+	if _, err := throttle.AuthenticateRemote(attacker, "bob", "secret"); err != ErrLocked {
+		t.Errorf("The attacker isn't locked: %v", err)
+	}
+	if store.calls != calls+1 {
+		t.Errorf("The store was asked during a lockout")
+	}
+
+	// Allowed networks aren't throttled, denied ones can't log in
+	if credential, err := throttle.AuthenticateRemote(net.ParseIP("10.1.2.3"), "alice", "secret"); credential == nil || err != nil {
+		t.Errorf("Allowed address can't log in: %v", err)
+	}
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		if _, err := throttle.AuthenticateRemote(net.ParseIP(ip), "bob", "secret"); err != ErrDenied {
+			t.Errorf("Denied address %s can log in: %v", ip, err)
+		}
+	}
+
+	// After the lockout, a success forgets the failures of the username
+	now = now.Add(2 * time.Minute)
+	if credential, err := throttle.AuthenticateRemote(attacker, "alice", "secret"); credential == nil || err != nil {
+		t.Errorf("alice can't log in after the lockout: %v", err)
+	}
+	delays = nil
+	throttle.AuthenticateRemote(attacker, "alice", "wrong")
+	if len(delays) != 1 || delays[0] != time.Second {
+		t.Errorf("Failures weren't forgotten: %v", delays)
+	}
+}
+
+// TestThrottleSpraying tests that logging into a valid account doesn't
+// forgive the failures of the address on other accounts
+func TestThrottleSpraying(t *testing.T) {
+	store := &passwordStore{password: "secret"}
+	throttle := NewThrottle(store, ThrottleOptions{
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Second,
+		LockoutFailures: 5,
+		LockoutDuration: time.Minute,
+	})
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var delays []time.Duration
+	throttle.now = func() time.Time { return now }
+	throttle.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	sprayer := net.ParseIP("198.51.100.1")
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		if _, err := throttle.AuthenticateRemote(sprayer, username, "wrong"); err != nil {
+			t.Fatalf("Invalid failure: %v", err)
+		}
+		if credential, err := throttle.AuthenticateRemote(sprayer, "mallory", "secret"); credential == nil || err != nil {
+			t.Fatalf("mallory can't log in: %v", err)
+		}
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("Invalid delays: %v", delays)
+	}
+
+	// The fifth failure locks the address out, even for mallory
+	throttle.AuthenticateRemote(sprayer, "erin", "wrong")
+	if _, err := throttle.AuthenticateRemote(sprayer, "mallory", "secret"); err != ErrLocked {
+		t.Errorf("The sprayer isn't locked: %v", err)
+	}
+	if credential, err := throttle.AuthenticateRemote(net.ParseIP("198.51.100.2"), "mallory", "secret"); credential == nil || err != nil {
+		t.Errorf("mallory can't log in from elsewhere: %v", err)
+	}
+}
@@ -0,0 +1,377 @@
+package unpeu
+
+import (
+	lru "container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A mailstore that remembers the items of a message that never change,
+// so that they are computed once instead of reparsing the message for
+// each FETCH: ENVELOPE, BODYSTRUCTURE and RFC822.SIZE.
+//
+// Items are keyed by mailbox, UIDVALIDITY and UID. The UIDVALIDITY of a
+// mailbox is learned when it is looked up with GetMailbox, as SELECT
+// does; mailboxes that weren't looked up aren't cached. A message keeps
+// its UID until it is expunged, so entries are only dropped when the
+// least recently used ones make room, when the UIDVALIDITY changes, and
+// when messages are expunged. Mailstores with an OnExpunge method tell
+// the cache themselves; for the others, Expunged must be called.
+
+var _ Mailstore = &CachingMailstore{}
+
+// cachedItems are the items of FETCH that are cached
+var cachedItems = map[string]bool{
+	"ENVELOPE":      true,
+	"BODYSTRUCTURE": true,
+	"RFC822.SIZE":   true,
+}
+
+// cacheKey identifies a message for as long as it exists
+type cacheKey struct {
+	mbox        Id
+	uidValidity uint32
+	uid         int
+}
+
+// cacheEntry holds the cached items of a message, by key
+type cacheEntry struct {
+	key   cacheKey
+	items map[string]string
+}
+
+// CachingMailstore wraps a mailstore and caches the immutable items of
+// its messages
+type CachingMailstore struct {
+	Mailstore
+
+	l       sync.Mutex
+	size    int
+	order   *lru.List
+	entries map[cacheKey]*lru.Element
+	// The UIDVALIDITY of the mailboxes that were looked up
+	uidValidities map[Id]uint32
+	// The directory of the on-disk cache of this mailstore, if any
+	dir string
+	// Whether the wrapped mailstore reports expunged messages
+	notified bool
+}
+
+// NewCachingMailstore returns a mailstore that keeps the items of up to
+// size messages in memory. If dir isn't empty, items are also stored
+// there and survive restarts, under name: mailstores that share a
+// directory, such as those of different users, must have different
+// names.
+func NewCachingMailstore(m Mailstore, size int, dir, name string) (*CachingMailstore, error) {
+	if dir != "" {
+		if name == "" {
+			return nil, fmt.Errorf("The cache in %s needs a name", dir)
+		}
+		dir = filepath.Join(dir, url.PathEscape(name))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	cs := &CachingMailstore{
+		Mailstore:     m,
+		size:          size,
+		order:         lru.New(),
+		entries:       make(map[cacheKey]*lru.Element),
+		uidValidities: make(map[Id]uint32),
+		dir:           dir,
+	}
+	if notifier, ok := m.(interface {
+		OnExpunge(handler ExpungeHandler)
+	}); ok {
+		notifier.OnExpunge(func(mbox Id, uids []int) {
+			cs.Expunged(mbox, uids...)
+		})
+		cs.notified = true
+	}
+	return cs, nil
+}
+
+func (cs *CachingMailstore) GetMailbox(path []string) (*Mailbox, error) {
+	mbox, err := cs.Mailstore.GetMailbox(path)
+	if err != nil || mbox == nil || mbox.UidValidity == 0 {
+		return mbox, err
+	}
+
+	cs.l.Lock()
+	defer cs.l.Unlock()
+	previous, known := cs.uidValidities[mbox.Id]
+	cs.uidValidities[mbox.Id] = mbox.UidValidity
+	if known && previous != mbox.UidValidity {
+		// Every UID of the mailbox is now meaningless
+		for key, elem := range cs.entries {
+			if key.mbox == mbox.Id {
+				cs.order.Remove(elem)
+				delete(cs.entries, key)
+			}
+		}
+		if cs.dir != "" {
+			os.RemoveAll(cs.mailboxDir(mbox.Id))
+		}
+	}
+	return mbox, nil
+}
+
+// Expunged drops the cached items of the messages with the given UIDs.
+// Unless the wrapped mailstore has OnExpunge, it must be called when
+// messages are expunged from the mailbox, or the items of a new message
+// with a reused UID could be wrong.
+func (cs *CachingMailstore) Expunged(mbox Id, uids ...int) {
+	cs.l.Lock()
+	defer cs.l.Unlock()
+	for key, elem := range cs.entries {
+		if key.mbox != mbox {
+			continue
+		}
+		for _, uid := range uids {
+			if key.uid == uid {
+				cs.order.Remove(elem)
+				delete(cs.entries, key)
+				break
+			}
+		}
+	}
+	if cs.dir == "" {
+		return
+	}
+	dirs, _ := filepath.Glob(filepath.Join(cs.mailboxDir(mbox), "*"))
+	for _, dir := range dirs {
+		for _, uid := range uids {
+			os.Remove(filepath.Join(dir, strconv.Itoa(uid)))
+		}
+	}
+}
+
+// Expunge expunges the messages of the wrapped mailstore, if it can, and
+// drops their cached items
+func (cs *CachingMailstore) Expunge(mbox Id) ([]int, error) {
+	expunger, ok := cs.Mailstore.(interface {
+		Expunge(mbox Id) ([]int, error)
+	})
+	if !ok {
+		return nil, nil
+	}
+	if cs.notified {
+		// The mailstore reports the expunged UIDs itself
+		return expunger.Expunge(mbox)
+	}
+	args, err := aggregateSearchArguments([]byte("DELETED"))
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := cs.Mailstore.Search(mbox, args, true, false)
+	if err != nil {
+		return nil, err
+	}
+	expunged, err := expunger.Expunge(mbox)
+	if err != nil {
+		return nil, err
+	}
+	uids := make([]int, 0, len(deleted))
+	for _, member := range deleted {
+		uids = append(uids, member.id)
+	}
+	cs.Expunged(mbox, uids...)
+	return expunged, nil
+}
+
+// ClearRecent forgets the recent messages of the wrapped mailstore, if it
+// keeps them
+func (cs *CachingMailstore) ClearRecent(mbox Id) error {
+	clearer, ok := cs.Mailstore.(interface {
+		ClearRecent(mbox Id) error
+	})
+	if !ok {
+		return nil
+	}
+	return clearer.ClearRecent(mbox)
+}
+
+// mailboxDir returns the directory of the on-disk cache of a mailbox
+func (cs *CachingMailstore) mailboxDir(mbox Id) string {
+	return filepath.Join(cs.dir, url.PathEscape(string(mbox)))
+}
+
+// entryPath returns the file of the on-disk cache of a message
+func (cs *CachingMailstore) entryPath(key cacheKey) string {
+	return filepath.Join(cs.mailboxDir(key.mbox), strconv.FormatUint(uint64(key.uidValidity), 10), strconv.Itoa(key.uid))
+}
+
+// lookup returns the cached items of a message. The cache lock must be
+// held.
+func (cs *CachingMailstore) lookup(key cacheKey) map[string]string {
+	if elem, ok := cs.entries[key]; ok {
+		cs.order.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).items
+	}
+	if cs.dir == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(cs.entryPath(key))
+	if err != nil {
+		return nil
+	}
+	var items map[string]string
+	if json.Unmarshal(content, &items) != nil {
+		return nil
+	}
+	return cs.insert(key, items)
+}
+
+// insert adds the items of a message to the memory cache, evicting the
+// least recently used entries if needed, and returns all the known items
+// of the message. The cache lock must be held.
+func (cs *CachingMailstore) insert(key cacheKey, items map[string]string) map[string]string {
+	if elem, ok := cs.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		for k, v := range items {
+			entry.items[k] = v
+		}
+		cs.order.MoveToFront(elem)
+		return entry.items
+	}
+	cs.entries[key] = cs.order.PushFront(&cacheEntry{key: key, items: items})
+	for cs.order.Len() > cs.size {
+		oldest := cs.order.Back()
+		cs.order.Remove(oldest)
+		delete(cs.entries, oldest.Value.(*cacheEntry).key)
+	}
+	return items
+}
+
+// store adds the items of a message to the cache, and to the disk if
+// there is one, and returns all the known items of the message. The cache
+// lock must be held.
+func (cs *CachingMailstore) store(key cacheKey, items map[string]string) map[string]string {
+	items = cs.insert(key, items)
+	if cs.dir == "" {
+		return items
+	}
+	content, err := json.Marshal(items)
+	if err != nil {
+		return items
+	}
+	path := cs.entryPath(key)
+	if os.MkdirAll(filepath.Dir(path), 0700) != nil {
+		return items
+	}
+	// Written aside then renamed, so that a crash never leaves half an
+	// entry
+	tmp := path + ".tmp"
+	if ioutil.WriteFile(tmp, content, 0600) == nil {
+		os.Rename(tmp, path)
+	}
+	return items
+}
+
+func (cs *CachingMailstore) Fetch(mbox Id, sequenceSet string, args []fetchArgument, useUids bool) ([]messageFetchResponse, error) {
+	cs.l.Lock()
+	uidValidity, known := cs.uidValidities[mbox]
+	cs.l.Unlock()
+
+	var cached, others []fetchArgument
+	wantsUid := false
+	for _, arg := range args {
+		switch {
+		case cachedItems[arg.text]:
+			cached = append(cached, arg)
+		case arg.text == "UID":
+			wantsUid = true
+		default:
+			others = append(others, arg)
+		}
+	}
+	if !known || len(cached) == 0 {
+		return cs.Mailstore.Fetch(mbox, sequenceSet, args, useUids)
+	}
+
+	// The UIDs are needed to look the messages up
+	responses, err := cs.Mailstore.Fetch(mbox, sequenceSet, append(others, fetchArgument{text: "UID"}), useUids)
+	if err != nil {
+		return nil, err
+	}
+	uids := make([]int, len(responses))
+	for i, response := range responses {
+		for _, item := range response.items {
+			if item.key == "UID" {
+				uids[i], _ = strconv.Atoi(item.value)
+			}
+		}
+	}
+
+	// Look up the messages, and fetch what's missing all at once
+	cs.l.Lock()
+	found := make([]map[string]string, len(responses))
+	missing := make(map[int]bool)
+	for i, uid := range uids {
+		found[i] = cs.lookup(cacheKey{mbox, uidValidity, uid})
+		for _, arg := range cached {
+			if _, ok := found[i][arg.text]; !ok {
+				missing[uid] = true
+			}
+		}
+	}
+	cs.l.Unlock()
+
+	if len(missing) > 0 {
+		set := make([]string, 0, len(missing))
+		for uid := range missing {
+			set = append(set, strconv.Itoa(uid))
+		}
+		fetched, err := cs.Mailstore.Fetch(mbox, strings.Join(set, ","), append(cached, fetchArgument{text: "UID"}), true)
+		if err != nil {
+			return nil, err
+		}
+
+		cs.l.Lock()
+		byUid := make(map[int]map[string]string)
+		for _, response := range fetched {
+			uid := 0
+			items := make(map[string]string)
+			for _, item := range response.items {
+				if item.key == "UID" {
+					uid, _ = strconv.Atoi(item.value)
+				} else if cachedItems[item.key] {
+					items[item.key] = item.value
+				}
+			}
+			byUid[uid] = cs.store(cacheKey{mbox, uidValidity, uid}, items)
+		}
+		for i, uid := range uids {
+			if missing[uid] {
+				found[i] = byUid[uid]
+			}
+		}
+		cs.l.Unlock()
+	}
+
+	// The cached items go last, as fetchMessage does with parsed items
+	cs.l.Lock()
+	defer cs.l.Unlock()
+	for i := range responses {
+		items := make([]fetchItem, 0, len(responses[i].items)+len(cached))
+		for _, item := range responses[i].items {
+			if item.key != "UID" || wantsUid {
+				items = append(items, item)
+			}
+		}
+		for _, arg := range cached {
+			if value, ok := found[i][arg.text]; ok {
+				items = append(items, fetchItem{key: arg.text, value: value})
+			}
+		}
+		responses[i].items = items
+	}
+	return responses, nil
+}
@@ -0,0 +1,107 @@
+package unpeu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// countingMailstore counts the messages it had to parse for cached items
+type countingMailstore struct {
+	*MemoryMailstore
+	parsed int
+}
+
+func (cm *countingMailstore) Fetch(mbox Id, sequenceSet string, args []fetchArgument, useUids bool) ([]messageFetchResponse, error) {
+	responses, err := cm.MemoryMailstore.Fetch(mbox, sequenceSet, args, useUids)
+	for _, arg := range args {
+		if cachedItems[arg.text] {
+			cm.parsed += len(responses)
+			break
+		}
+	}
+	return responses, err
+}
+
+func TestCachingMailstore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unpeu-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ms := NewMemoryMailstore()
+	files, _ := filepath.Glob(filepath.Join("testdata", "maildir", "cur", "*"))
+	if err := ms.SeedFiles("INBOX", files...); err != nil {
+		t.Fatal("Couldn't seed:", err)
+	}
+	counting := &countingMailstore{MemoryMailstore: ms}
+	if _, err := NewCachingMailstore(counting, 2, dir, ""); err == nil {
+		t.Error("A cache on disk without a name")
+	}
+	cs, err := NewCachingMailstore(counting, 2, dir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := cs.GetMailbox([]string{"INBOX"})
+	if err != nil || mbox == nil {
+		t.Fatalf("Invalid INBOX: %+v (%v)", mbox, err)
+	}
+
+	args := []fetchArgument{{text: "RFC822.SIZE"}, {text: "FLAGS"}, {text: "ENVELOPE"}}
+	expected, _ := ms.Fetch(mbox.Id, "1:3", args, false)
+	for i := 0; i < 2; i++ {
+		fetched, err := cs.Fetch(mbox.Id, "1:3", args, false)
+		if err != nil {
+			t.Fatal("Couldn't fetch:", err)
+		}
+		if !reflect.DeepEqual(fetched, expected) {
+			t.Errorf("Invalid fetch: got %q, expected %q", fetched, expected)
+		}
+	}
+	if counting.parsed != 3 {
+		t.Errorf("Parsed %d messages instead of 3", counting.parsed)
+	}
+
+	// Items that aren't in memory anymore are still on disk
+	cs, _ = NewCachingMailstore(counting, 10, dir, "alice")
+	cs.GetMailbox([]string{"INBOX"})
+	fetched, err := cs.Fetch(mbox.Id, "1:3", append(args, fetchArgument{text: "UID"}), true)
+	if err != nil || len(fetched) != 3 || len(fetched[0].items) != 4 {
+		t.Fatalf("Invalid fetch: %q (%v)", fetched, err)
+	}
+	if counting.parsed != 3 {
+		t.Errorf("Parsed %d messages instead of 3", counting.parsed)
+	}
+
+	ms.Flag(ADD, mbox.Id, "2", true, []string{"\\Deleted"})
+	if _, err := cs.Expunge(mbox.Id); err != nil {
+		t.Fatal("Couldn't expunge:", err)
+	}
+	if _, err := os.Stat(cs.entryPath(cacheKey{mbox.Id, mbox.UidValidity, 2})); !os.IsNotExist(err) {
+		t.Errorf("The expunged message is still cached: %v", err)
+	}
+	if _, ok := cs.entries[cacheKey{mbox.Id, mbox.UidValidity, 2}]; ok {
+		t.Error("The expunged message is still cached in memory")
+	}
+	if _, err := os.Stat(cs.entryPath(cacheKey{mbox.Id, mbox.UidValidity, 3})); err != nil {
+		t.Errorf("Another message was dropped: %v", err)
+	}
+
+	// Messages expunged without the cache are dropped too
+	ms.Flag(ADD, mbox.Id, "3", true, []string{"\\Deleted"})
+	if _, err := ms.Expunge(mbox.Id); err != nil {
+		t.Fatal("Couldn't expunge:", err)
+	}
+	if _, err := os.Stat(cs.entryPath(cacheKey{mbox.Id, mbox.UidValidity, 3})); !os.IsNotExist(err) {
+		t.Errorf("The message expunged behind the cache is still cached: %v", err)
+	}
+
+	// Another user's cache in the same directory has its own entries
+	other, _ := NewCachingMailstore(&countingMailstore{MemoryMailstore: ms}, 10, dir, "bob")
+	if path := other.entryPath(cacheKey{mbox.Id, mbox.UidValidity, 1}); path == cs.entryPath(cacheKey{mbox.Id, mbox.UidValidity, 1}) {
+		t.Errorf("Both users are cached in %s", path)
+	}
+}
@@ -2,12 +2,16 @@ package unpeu
 
 import (
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"net/textproto"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/rakoo/unpeu/auth"
 )
 
 // command represents an IMAP command
@@ -69,6 +73,10 @@ func (c *capability) execute(s *session) *response {
 	case tlsLevel:
 		commands = append(commands, "AUTH=PLAIN")
 	}
+	if s.encryption == tlsLevel && s.listener.clientCAs != nil {
+		commands = append(commands, "AUTH=EXTERNAL")
+	}
+	commands = append(commands, "SASL-IR")
 
 	commands = append(commands, "THREAD")
 	commands = append(commands, "THREAD=REFS")
@@ -85,9 +93,9 @@ type starttls struct {
 }
 
 func (c *starttls) execute(sess *session) *response {
-	sess.conn.Write([]byte(fmt.Sprintf("%s Begin TLS negotiation now", c.tag)))
+	sess.conn.Write([]byte(fmt.Sprintf("%s OK Begin TLS negotiation now\r\n", c.tag)))
 
-	sess.conn = tls.Server(sess.conn, &tls.Config{Certificates: sess.listener.certificates})
+	sess.conn = tls.Server(sess.conn, sess.listener.tlsConfig())
 	textConn := textproto.NewConn(sess.conn)
 
 	sess.encryption = tlsLevel
@@ -113,16 +121,156 @@ func (c *login) execute(sess *session) *response {
 		return bad(c.tag, message)
 	}
 
-	auth, err := sess.server.config.authBackend.Authenticate(c.userId, c.password)
+	// Master users log in as "user*master"
+	authzid, authcid := "", c.userId
+	if i := strings.LastIndex(c.userId, masterSeparator); i >= 0 && sess.config.masterUsers != nil {
+		authzid, authcid = c.userId[:i], c.userId[i+len(masterSeparator):]
+	}
+	return passwordLogin(sess, c.tag, "LOGIN", authzid, authcid, c.password)
+}
+
+// masterSeparator separates the user from the master user in LOGIN
+const masterSeparator = "*"
 
-	if auth {
-		sess.st = authenticated
-		return ok(c.tag, "LOGIN completed")
+// passwordLogin logs authcid in with a password, as authzid if it isn't
+// empty. Only master users can log in as another user.
+func passwordLogin(sess *session, tag, command, authzid, authcid, password string) *response {
+	if authzid == "" || authzid == authcid {
+		credential, err := sess.authenticate(authcid, password)
+		if credential == nil {
+			sess.log(command, " failure for ", authcid, ": ", err)
+			return loginFailure(sess, tag, command+" failure")
+		}
+		if err := sess.login(authcid); err != nil {
+			return loginUnavailable(sess, tag, command, authcid, err)
+		}
+		sess.credential = credential
+		return ok(tag, command+" completed")
 	}
-	log.Println("Login request:", auth, err)
 
-	// Fail by default
-	return no(c.tag, "LOGIN failure")
+	credential, err := sess.authenticateMaster(authcid, password)
+	if credential == nil {
+		sess.log(command, " failure for master user ", authcid, " as ", authzid, ": ", err)
+		return loginFailure(sess, tag, command+" failure")
+	}
+	if err := sess.impersonate(authzid, authcid); err != nil {
+		return loginUnavailable(sess, tag, command, authzid, err)
+	}
+	sess.credential = credential
+	return ok(tag, command+" completed")
+}
+
+// loginUnavailable returns the NO response to a user with the right
+// credentials who can't log in, because they have too many sessions or
+// their mailstore can't be opened
+func loginUnavailable(sess *session, tag, command, username string, err error) *response {
+	if err == errTooManySessions {
+		sess.log(command, " refused for ", username, ": ", err)
+		return no(tag, "[LIMIT] "+err.Error())
+	}
+	sess.log("Couldn't open the mailstore of ", username, ": ", err)
+	return no(tag, "[UNAVAILABLE] "+command+" failure")
+}
+
+// loginFailure counts a failed login, and returns a NO response. The
+// connection is closed after too many failures.
+func loginFailure(sess *session, tag string, message string) *response {
+	res := no(tag, message)
+	sess.loginFailures++
+	if max := sess.config.maxLoginFailures; max > 0 && sess.loginFailures >= max {
+		res.extra("BYE Too many login failures").shouldClose()
+	}
+	return res
+}
+
+//------------------------------------------------------------------------------
+
+// authenticate is an AUTHENTICATE command
+type authenticate struct {
+	l         *lexer
+	tag       string
+	mechanism string
+	// The SASL response, decoded from base64, and whether it was received
+	response    []byte
+	hasResponse bool
+	// Whether the continuation request was sent
+	ready bool
+}
+
+// execute an AUTHENTICATE command
+func (c *authenticate) execute(sess *session) *response {
+
+	// Has the user already logged in?
+	if sess.st > notAuthenticated {
+		message := "AUTHENTICATE already logged in"
+		sess.log(message)
+		return bad(c.tag, message)
+	}
+
+	mechanism := strings.ToUpper(c.mechanism)
+	switch mechanism {
+	case "PLAIN", "EXTERNAL":
+	default:
+		return no(c.tag, "AUTHENTICATE unsupported mechanism")
+	}
+
+	// Get the response, if it wasn't sent with the command
+	if !c.hasResponse {
+		if !c.ready {
+			c.ready = true
+			return continuation("")
+		}
+		line, err := c.l.rawLine()
+		if err != nil {
+			return bad(c.tag, "AUTHENTICATE "+err.Error())
+		}
+		if line == "*" {
+			return bad(c.tag, "AUTHENTICATE cancelled")
+		}
+		c.response, err = base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return bad(c.tag, "AUTHENTICATE invalid response")
+		}
+	}
+
+	if mechanism == "PLAIN" {
+		return c.plain(sess)
+	}
+	return c.external(sess)
+}
+
+// plain logs in with a password (RFC 4616). The response is the identity
+// to log in as, which may be empty, the user and their password.
+func (c *authenticate) plain(sess *session) *response {
+	fields := strings.Split(string(c.response), "\x00")
+	if len(fields) != 3 {
+		return bad(c.tag, "AUTHENTICATE invalid response")
+	}
+	return passwordLogin(sess, c.tag, "AUTHENTICATE", fields[0], fields[1], fields[2])
+}
+
+// external logs in with the verified client certificate. The response is
+// the identity to log in as, which may be empty.
+func (c *authenticate) external(sess *session) *response {
+	cert := sess.peerCertificate()
+	if cert == nil {
+		return loginFailure(sess, c.tag, "[AUTHENTICATIONFAILED] No verified client certificate")
+	}
+	username, err := sess.config.certificateMapper(cert)
+	if err != nil {
+		sess.log("AUTHENTICATE EXTERNAL failure: ", err)
+		return loginFailure(sess, c.tag, "[AUTHENTICATIONFAILED] AUTHENTICATE failure")
+	}
+	if len(c.response) > 0 && string(c.response) != username {
+		sess.log("AUTHENTICATE EXTERNAL failure: ", username, " can't log in as ", string(c.response))
+		return loginFailure(sess, c.tag, "[AUTHORIZATIONFAILED] AUTHENTICATE failure")
+	}
+
+	if err := sess.login(username); err != nil {
+		return loginUnavailable(sess, c.tag, "AUTHENTICATE", username, err)
+	}
+	sess.credential = &auth.Credential{}
+	return ok(c.tag, "AUTHENTICATE completed")
 }
 
 //------------------------------------------------------------------------------
@@ -171,6 +319,9 @@ func (c *selectMailbox) execute(sess *session) *response {
 
 	// Build a response that includes mailbox information
 	res := ok(c.tag, "[READ-WRITE] SELECT completed")
+	if sess.hasScope(auth.ScopeReadOnly) {
+		res = ok(c.tag, "[READ-ONLY] SELECT completed")
+	}
 
 	err = sess.addMailboxInfo(res)
 
@@ -178,6 +329,17 @@ func (c *selectMailbox) execute(sess *session) *response {
 		return internalError(sess, c.tag, "SELECT", err)
 	}
 
+	// The recent messages were reported to this session, they aren't
+	// recent to the next ones. A read-only session leaves them alone.
+	clearer, ok := sess.mailstore.(interface {
+		ClearRecent(mbox Id) error
+	})
+	if ok && !sess.hasScope(auth.ScopeReadOnly) {
+		if err := clearer.ClearRecent(sess.mailbox.Id); err != nil {
+			return internalError(sess, c.tag, "SELECT", err)
+		}
+	}
+
 	return res
 }
 
@@ -241,7 +403,7 @@ func (c *list) execute(sess *session) *response {
 	// the delimiter and the root name of the reference
 	if c.mboxPattern == "" {
 		res := ok(c.tag, "LIST completed")
-		res.extra(fmt.Sprintf(`LIST () "%s" %s`, pathDelimiter, c.reference))
+		res.extra(fmt.Sprintf(`LIST () "%s" %s`, string(pathDelimiter), c.reference))
 		return res
 	}
 
@@ -305,6 +467,9 @@ func (ac *appendCmd) execute(s *session) *response {
 
 	switch ac.ready {
 	case false:
+		if s.hasScope(auth.ScopeReadOnly) || s.hasScope(auth.ScopeNoAppend) {
+			return no(ac.tag, "[CANNOT] APPEND not allowed with this password")
+		}
 		res = continuation("Ready for literal data")
 		ac.ready = true
 	case true:
@@ -313,6 +478,9 @@ func (ac *appendCmd) execute(s *session) *response {
 			return no(ac.tag, fmt.Sprintf("Couldn't read message: %s", err))
 		}
 		err = s.append(ac.mailbox, ac.flags, ac.dateTime, message)
+		if err == ErrCannotAppend {
+			return no(ac.tag, "[CANNOT] APPEND not allowed in this mailbox")
+		}
 		if err != nil {
 			log.Println("Couldn't append message:", err)
 			return bad(ac.tag, "Couldn't APPENDing message")
@@ -462,11 +630,11 @@ func (fc *fetchCmd) execute(s *session) *response {
 
 	res := ok(fc.tag, "FETCH")
 	for _, arg := range fc.args {
-		if arg.text == "BODY" {
-			mailstore := s.config.mailstore
+		if setsSeen(arg) && !s.hasScope(auth.ScopeReadOnly) {
+			mailstore := s.mailstore
 			flagResults, err := mailstore.Flag(ADD, s.mailbox.Id, fc.sequenceSet, fc.useUids, []string{"\\Seen"})
 			if err != nil {
-				log.Printf("Error removing \\Seen flag after BODY[]: %s\n", err)
+				log.Printf("Error setting \\Seen flag after FETCH: %s\n", err)
 				return bad(fc.tag, "FETCH internal error")
 			}
 
@@ -506,7 +674,10 @@ const (
 )
 
 func (sc *storeCmd) execute(s *session) *response {
-	mailstore := s.config.mailstore
+	if s.hasScope(auth.ScopeReadOnly) {
+		return no(sc.tag, "STORE not allowed: mailbox is read-only")
+	}
+	mailstore := s.mailstore
 	var mode flagMode
 	switch strings.Split(sc.itemName, ".")[0] {
 	case "FLAGS":
@@ -601,6 +772,7 @@ func joinMailboxFlags(m *Mailbox) string {
 		}
 	}
 
-	// Return a joined string
-	return strings.Join(flags, ",")
+	// Return a joined string, in a stable order
+	sort.Strings(flags)
+	return strings.Join(flags, " ")
 }
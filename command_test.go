@@ -1,13 +1,20 @@
 package unpeu
 
 import (
+	"bufio"
+	"bytes"
+	"log"
+	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/rakoo/unpeu/auth"
 )
 import "fmt"
 
 func setupTest() (*Server, *session) {
-	m := &TestMailstore{}
+	m := NewMemoryMailstore()
 	s := NewServer(
 		StoreOption(m),
 	)
@@ -16,95 +23,6 @@ func setupTest() (*Server, *session) {
 	return s, sess
 }
 
-// TestMailstore is a dummy mailstore
-type TestMailstore struct {
-}
-
-// GetMailbox gets dummy Mailbox information
-func (m *TestMailstore) GetMailbox(path []string) (*Mailbox, error) {
-	return &Mailbox{
-		Name: "inbox",
-		Id:   "1",
-	}, nil
-}
-
-// GetMailboxes lists dummy Mailboxes
-func (m *TestMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
-	if len(path) == 0 {
-		// Root
-		return []*Mailbox{
-			{
-				Name: "inbox",
-				Path: []string{"inbox"},
-				Id:   "1",
-			},
-			{
-				Name: "spam",
-				Path: []string{"spam"},
-				Id:   "2",
-			},
-		}, nil
-	} else if len(path) == 1 && path[0] == "inbox" {
-		return []*Mailbox{
-			{
-				Name: "starred",
-				Path: []string{"inbox", "stared"},
-				Id:   "3",
-			},
-		}, nil
-	} else {
-		return []*Mailbox{}, nil
-	}
-}
-
-// FirstUnseen gets a dummy number of first unseen messages in an IMAP mailbox
-func (m *TestMailstore) FirstUnseen(mbox Id) (int64, error) {
-	return 4, nil
-}
-
-// TotalMessages gets a dummy number of messages in an IMAP mailbox
-func (m *TestMailstore) TotalMessages(mbox Id) (int64, error) {
-	return 8, nil
-}
-
-// RecentMessages gets a dummy number of unread messages in an IMAP mailbox
-func (m *TestMailstore) RecentMessages(mbox Id) (int64, error) {
-	return 4, nil
-}
-
-// NextUid gets a dummy next-uid in an IMAP mailbox
-func (m *TestMailstore) NextUid(mbox Id) (int64, error) {
-	return 9, nil
-}
-
-// CountUnseen gets a dummy next-uid in an IMAP mailbox
-func (m *TestMailstore) CountUnseen(mbox Id) (int64, error) {
-	return 9, nil
-}
-
-// AppendMessage appends the message to an IMAP mailbox
-func (m *TestMailstore) AppendMessage(mailbox string, flags []string, dateTime time.Time, message string) error {
-	return nil
-}
-
-// Search searches messages in an IMAP mailbox
-// The output sequenceSet doesn't contain any '*'
-func (m *TestMailstore) Search(mbox Id, args []searchArgument, returnUid, returnThreads bool) (ids []threadMember, err error) {
-	return nil, nil
-}
-
-// Fetch fetches information on the selected messages in the given
-// mailbox.
-// The output is a list of list. The first level has one element by
-// message, the second level has one element per desired field in the message
-func (m *TestMailstore) Fetch(mailbox Id, sequenceSet string, args []fetchArgument, returnUid bool) ([]messageFetchResponse, error) {
-	return nil, nil
-}
-
-func (m *TestMailstore) Flag(mode flagMode, mbox Id, sequenceSet string, useUids bool, flags []string) ([]messageFetchResponse, error) {
-	return nil, nil
-}
-
 // TestCapabilityCommand tests the correctness of the CAPABILITY command
 func _TestCapabilityCommand(t *testing.T) {
 	_, session := setupTest()
@@ -265,3 +183,346 @@ func TestSearch(t *testing.T) {
 		}
 	}
 }
+
+// tagTreeMailstore serves the mailbox hierarchy of a set of notmuch tags
+type tagTreeMailstore struct {
+	MemoryMailstore
+	tags map[string]struct{}
+}
+
+func (m *tagTreeMailstore) GetMailbox(path []string) (*Mailbox, error) {
+	return lookupTagMailbox(m.tags, path), nil
+}
+
+func (m *tagTreeMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
+	return tagMailboxChildren(m.tags, path), nil
+}
+
+// TestListHierarchy tests LIST patterns on nested mailboxes
+func TestListHierarchy(t *testing.T) {
+	s := NewServer(StoreOption(&tagTreeMailstore{tags: testTags}))
+	sess := createSession("1", s.config, s, nil, nil)
+	sess.st = authenticated
+
+	vectors := []struct {
+		reference string
+		pattern   string
+		output    []string
+	}{
+		{"", "%", []string{
+			`LIST () "/" INBOX`,
+			`LIST (\Noselect) "/" lists`,
+			`LIST () "/" unread`,
+		}},
+		{"", "*", []string{
+			`LIST () "/" INBOX`,
+			`LIST () "/" INBOX/later`,
+			`LIST (\Noselect) "/" lists`,
+			`LIST (\Noselect) "/" lists/golang`,
+			`LIST () "/" lists/golang/dev`,
+			`LIST () "/" lists/golang/nuts`,
+			`LIST () "/" lists/notmuch`,
+			`LIST () "/" unread`,
+		}},
+		{"lists/", "%", []string{
+			`LIST (\Noselect) "/" lists/golang`,
+			`LIST () "/" lists/notmuch`,
+		}},
+		{"", "lists/%/dev", []string{
+			`LIST () "/" lists/golang/dev`,
+		}},
+		{"", "inbox/*", []string{
+			`LIST () "/" INBOX/later`,
+		}},
+		{"", "lists/golang", []string{
+			`LIST (\Noselect) "/" lists/golang`,
+		}},
+		{"", "lists/nothing", []string{}},
+	}
+
+	for _, v := range vectors {
+		cmd := &list{tag: "A1", reference: v.reference, mboxPattern: v.pattern}
+		resp := cmd.execute(sess)
+		if len(v.output) == 0 {
+			if resp.condition != "NO" {
+				t.Errorf("LIST %q %q: expected NO, got %s %v", v.reference, v.pattern, resp.condition, resp.untagged)
+			}
+			continue
+		}
+		if resp.condition != "OK" || fmt.Sprint(resp.untagged) != fmt.Sprint(v.output) {
+			t.Errorf("LIST %q %q: got %s %q, expected %q", v.reference, v.pattern, resp.condition, resp.untagged, v.output)
+		}
+	}
+
+	// Intermediate levels can't be selected
+	sel := &selectMailbox{tag: "A2", mailbox: "lists/golang"}
+	if resp := sel.execute(sess); resp.condition != "NO" {
+		t.Errorf("Selecting a \\Noselect mailbox: got %s %s", resp.condition, resp.message)
+	}
+}
+
+// readOnlyMailstore refuses new messages
+type readOnlyMailstore struct {
+	MemoryMailstore
+}
+
+func (m *readOnlyMailstore) AppendMessage(mailbox string, flags []string, dateTime time.Time, message string) error {
+	return ErrCannotAppend
+}
+
+// TestAppendRefused tests the response to an APPEND the mailstore refuses
+func TestAppendRefused(t *testing.T) {
+	s := NewServer(StoreOption(&readOnlyMailstore{}))
+	sess := createSession("1", s.config, s, nil, nil)
+	sess.st = authenticated
+
+	p := createParser(bufio.NewReader(strings.NewReader("A1 APPEND Queries/recent {5}\r\nhello\r\n")))
+	cmd, err := p.next()
+	if err != nil {
+		t.Fatal("Couldn't parse APPEND:", err)
+	}
+	cmd.execute(sess)
+	resp := cmd.execute(sess)
+	if resp.condition != "NO" || !strings.HasPrefix(resp.message, "[CANNOT]") {
+		t.Errorf("Invalid response to refused APPEND: %s %s", resp.condition, resp.message)
+	}
+}
+
+// TestRecentCleared tests that a message is only recent to the first
+// session that selects its mailbox
+func TestRecentCleared(t *testing.T) {
+	m := NewMemoryMailstore()
+	if err := m.AppendMessage("INBOX", nil, time.Time{}, "Subject: hi\r\n\r\nhello\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(StoreOption(m))
+
+	for _, expected := range []string{"1 RECENT", "0 RECENT"} {
+		sess := createSession("1", s.config, s, nil, nil)
+		sess.st = authenticated
+		resp := (&selectMailbox{tag: "A1", mailbox: "INBOX"}).execute(sess)
+		if resp.condition != "OK" {
+			t.Fatalf("Can't select: %s %s", resp.condition, resp.message)
+		}
+		found := false
+		for _, line := range resp.untagged {
+			found = found || line == expected
+		}
+		if !found {
+			t.Errorf("Expected %s: %q", expected, resp.untagged)
+		}
+	}
+}
+
+// TestMailstoreFactory tests that each user gets their own mailstore
+func TestMailstoreFactory(t *testing.T) {
+	mailstores := map[string]*MemoryMailstore{
+		"alice": NewMemoryMailstore(),
+		"bob":   NewMemoryMailstore(),
+	}
+	s := NewServer(MailstoreFactoryOption(func(username string) (Mailstore, error) {
+		if m, ok := mailstores[username]; ok {
+			return m, nil
+		}
+		return nil, fmt.Errorf("No mailstore for %s", username)
+	}))
+
+	sessions := make(map[string]*session)
+	for _, user := range []string{"alice", "bob", "eve"} {
+		sess := createSession(user, s.config, s, nil, nil)
+		resp := (&login{tag: "A1", userId: user, password: "secret"}).execute(sess)
+		if user == "eve" {
+			if resp.condition != "NO" || sess.st != notAuthenticated {
+				t.Errorf("Logged in without a mailstore: %s %s", resp.condition, resp.message)
+			}
+			continue
+		}
+		if resp.condition != "OK" || sess.mailstore != mailstores[user] {
+			t.Fatalf("Invalid login of %s: %s %s", user, resp.condition, resp.message)
+		}
+		sessions[user] = sess
+	}
+
+	err := sessions["alice"].append("INBOX", nil, time.Time{}, "Subject: hi\r\n\r\nhello\r\n")
+	if err != nil {
+		t.Fatal("Couldn't append:", err)
+	}
+	for user, expected := range map[string]int64{"alice": 1, "bob": 0} {
+		if total, _ := mailstores[user].TotalMessages("INBOX"); total != expected {
+			t.Errorf("%s has %d messages, expected %d", user, total, expected)
+		}
+	}
+}
+
+// rejectingAuthStore refuses every login
+type rejectingAuthStore struct {
+	auth.DummyAuthBackend
+}
+
+func (rejectingAuthStore) Authenticate(username, password string) (bool, error) {
+	return false, nil
+}
+
+// TestLoginFailures tests that clients are disconnected after too many
+// failed logins
+func TestLoginFailures(t *testing.T) {
+	s := NewServer(StoreOption(NewMemoryMailstore()), AuthStoreOption(rejectingAuthStore{}))
+	sess := createSession("1", s.config, s, nil, nil)
+	for i := 1; i <= 3; i++ {
+		resp := (&login{tag: "A1", userId: "alice", password: "wrong"}).execute(sess)
+		if resp.condition != "NO" || resp.closeConnection != (i == 3) {
+			t.Errorf("Invalid response to failure %d: %s %s %v", i, resp.condition, resp.message, resp.untagged)
+		}
+	}
+
+	s = NewServer(StoreOption(NewMemoryMailstore()), AuthStoreOption(rejectingAuthStore{}), MaxLoginFailuresOption(0))
+	sess = createSession("1", s.config, s, nil, nil)
+	for i := 1; i <= 5; i++ {
+		if resp := (&login{tag: "A1", userId: "alice", password: "wrong"}).execute(sess); resp.closeConnection {
+			t.Fatalf("Disconnected after %d failures without a limit", i)
+		}
+	}
+}
+
+// scopedAuthStore gives each password a credential with its scopes
+type scopedAuthStore struct {
+	auth.DummyAuthBackend
+	credentials map[string]*auth.Credential
+}
+
+func (s scopedAuthStore) AuthenticateCredential(username, password string) (*auth.Credential, error) {
+	return s.credentials[password], nil
+}
+
+func (s scopedAuthStore) AddCredential(username, name string, scopes ...auth.Scope) (string, error) {
+	return "", nil
+}
+
+func (s scopedAuthStore) ListCredentials(username string) ([]auth.Credential, error) {
+	return nil, nil
+}
+
+func (s scopedAuthStore) RevokeCredential(username, name string) error {
+	return nil
+}
+
+// TestCredentialScopes tests that sessions are limited by the scopes of
+// the password they logged in with
+func TestCredentialScopes(t *testing.T) {
+	m := NewMemoryMailstore()
+	if err := m.AppendMessage("INBOX", nil, time.Time{}, "Subject: hi\r\n\r\nhello\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(StoreOption(m), AuthStoreOption(scopedAuthStore{credentials: map[string]*auth.Credential{
+		"main":   {},
+		"phone":  {Name: "phone", Scopes: []auth.Scope{auth.ScopeReadOnly}},
+		"laptop": {Name: "laptop", Scopes: []auth.Scope{auth.ScopeNoAppend}},
+	}}))
+
+	for _, v := range []struct {
+		password string
+		selected string
+		store    string
+		append   string
+		seen     bool
+	}{
+		{"main", "[READ-WRITE] SELECT completed", "OK", "+", true},
+		{"phone", "[READ-ONLY] SELECT completed", "NO", "NO", false},
+		{"laptop", "[READ-WRITE] SELECT completed", "OK", "NO", true},
+	} {
+		sess := createSession("1", s.config, s, nil, nil)
+		if resp := (&login{tag: "A1", userId: "alice", password: v.password}).execute(sess); resp.condition != "OK" {
+			t.Fatalf("Can't log in with %s: %s %s", v.password, resp.condition, resp.message)
+		}
+		if resp := (&selectMailbox{tag: "A2", mailbox: "INBOX"}).execute(sess); resp.message != v.selected {
+			t.Errorf("SELECT with %s: got %s %s", v.password, resp.condition, resp.message)
+		}
+		store := &storeCmd{tag: "A3", itemName: "+FLAGS.SILENT", sequenceSet: "1", flags: []string{`\Flagged`}}
+		if resp := store.execute(sess); resp.condition != v.store {
+			t.Errorf("STORE with %s: got %s %s", v.password, resp.condition, resp.message)
+		}
+		appendCmd := &appendCmd{tag: "A4", mailbox: "INBOX", messageLength: 5}
+		if resp := appendCmd.execute(sess); resp.condition != v.append && resp.tag != v.append {
+			t.Errorf("APPEND with %s: got %s %s %s", v.password, resp.tag, resp.condition, resp.message)
+		}
+		fetch := &fetchCmd{tag: "A5", sequenceSet: "1", args: []fetchArgument{{text: "RFC822"}}}
+		if resp := fetch.execute(sess); resp.condition != "OK" {
+			t.Errorf("FETCH with %s: got %s %s", v.password, resp.condition, resp.message)
+		}
+		if unseen, _ := m.CountUnseen("INBOX"); (unseen == 0) != v.seen {
+			t.Errorf("FETCH RFC822 with %s: %d unseen", v.password, unseen)
+		}
+		m.Flag(REMOVE, "INBOX", "1", false, []string{"\\Seen"})
+	}
+}
+
+// passwordAuthStore checks passwords against a map of users
+type passwordAuthStore struct {
+	auth.DummyAuthBackend
+	passwords map[string]string
+}
+
+func (s passwordAuthStore) Authenticate(username, password string) (bool, error) {
+	expected, ok := s.passwords[username]
+	return ok && expected == password, nil
+}
+
+// TestMasterUsers tests that master users can log in as other users, and
+// that it is logged
+func TestMasterUsers(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	users := passwordAuthStore{passwords: map[string]string{"alice": "alice-pw"}}
+	masters := passwordAuthStore{passwords: map[string]string{"support": "support-pw"}}
+	factory := MailstoreFactoryOption(func(username string) (Mailstore, error) {
+		return NewMemoryMailstore(), nil
+	})
+	plain := func(authzid, authcid, password string) *authenticate {
+		return &authenticate{tag: "A1", mechanism: "PLAIN", hasResponse: true,
+			response: []byte(authzid + "\x00" + authcid + "\x00" + password)}
+	}
+
+	s := NewServer(factory, AuthStoreOption(users), MasterUsersOption(masters))
+	for _, v := range []struct {
+		cmd       command
+		condition string
+		master    string
+	}{
+		{&login{tag: "A1", userId: "alice", password: "alice-pw"}, "OK", ""},
+		{&login{tag: "A1", userId: "alice*support", password: "support-pw"}, "OK", "support"},
+		{&login{tag: "A1", userId: "alice*support", password: "alice-pw"}, "NO", ""},
+		{&login{tag: "A1", userId: "bob*alice", password: "alice-pw"}, "NO", ""},
+		{plain("", "alice", "alice-pw"), "OK", ""},
+		{plain("alice", "alice", "alice-pw"), "OK", ""},
+		{plain("alice", "support", "support-pw"), "OK", "support"},
+		{plain("bob", "alice", "alice-pw"), "NO", ""},
+		{plain("support", "support", "support-pw"), "NO", ""},
+	} {
+		sess := createSession("1", s.config, s, nil, nil)
+		resp := v.cmd.execute(sess)
+		if resp.condition != v.condition || sess.master != v.master {
+			t.Errorf("%+v: got %s %s as %q by %q", v.cmd, resp.condition, resp.message, sess.username, sess.master)
+		}
+		if resp.condition == "OK" && sess.username != "alice" {
+			t.Errorf("%+v: logged in as %q", v.cmd, sess.username)
+		}
+		sess.close()
+	}
+	for _, line := range []string{
+		"AUDIT master user support logged in as alice",
+		"AUDIT master user support logged out of alice",
+	} {
+		if strings.Count(logged.String(), line) != 2 {
+			t.Errorf("%q isn't logged for each impersonation:\n%s", line, logged.String())
+		}
+	}
+
+	// Without master users, the separator is part of the username
+	s = NewServer(factory, AuthStoreOption(passwordAuthStore{passwords: map[string]string{"alice*support": "pw"}}))
+	sess := createSession("1", s.config, s, nil, nil)
+	if resp := (&login{tag: "A1", userId: "alice*support", password: "pw"}).execute(sess); resp.condition != "OK" || sess.username != "alice*support" {
+		t.Errorf("Invalid login without master users: %s %s as %q", resp.condition, resp.message, sess.username)
+	}
+}
@@ -0,0 +1,457 @@
+package unpeu
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fetchableMessage is the view of a message needed to answer FETCH from
+// its raw content. A Mailstore that can read its messages gets a complete
+// FETCH by implementing it and calling fetchMessage on each message.
+type fetchableMessage interface {
+	// Flags returns the IMAP flags of the message
+	Flags() []string
+	// InternalDate returns the date at which the message was received
+	InternalDate() time.Time
+	// Uid returns the UID of the message
+	Uid() int
+	// Raw returns the whole message, as stored. The reader is closed once
+	// the fetch is done with it.
+	Raw() (io.ReadCloser, error)
+}
+
+// fetchMessage returns the items asked for in args
+func fetchMessage(msg fetchableMessage, args []fetchArgument) ([]fetchItem, error) {
+	result := make([]fetchItem, 0, len(args))
+	messageParsers := make([]messageParser, 0)
+
+	for _, arg := range args {
+		switch arg.text {
+		case "UID":
+			result = append(result, fetchItem{key: "UID", value: strconv.Itoa(msg.Uid())})
+		case "FLAGS":
+			result = append(result, fetchItem{key: "FLAGS", value: "(" + strings.Join(msg.Flags(), " ") + ")"})
+		case "INTERNALDATE":
+			outDate := msg.InternalDate().Format("02-Jan-2006 15:04:05 -0700")
+			result = append(result, fetchItem{key: "INTERNALDATE", value: quote(outDate)})
+		case "RFC822.SIZE":
+			messageParsers = append(messageParsers, &rfc822sizeParser{})
+		case "ENVELOPE":
+			messageParsers = append(messageParsers, &envelopeParser{})
+		case "BODYSTRUCTURE":
+			raw, err := msg.Raw()
+			if err != nil {
+				return nil, err
+			}
+			structure, err := messageStructure(raw)
+			raw.Close()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, fetchItem{key: "BODYSTRUCTURE", value: structure})
+		default:
+			mapping := map[string]string{
+				"RFC822.HEADER": "HEADER",
+				"RFC822.TEXT":   "TEXT",
+				"RFC822":        "",
+			}
+			section, isRFC822 := mapping[arg.text]
+			if arg.text != "BODY" && arg.text != "BODY.PEEK" && !isRFC822 {
+				log.Printf("%s is not handled yet\n", arg.text)
+				continue
+			}
+			bodyArg := arg
+			if isRFC822 {
+				bodyArg = fetchArgument{section: section, offset: -1}
+			}
+
+			raw, err := msg.Raw()
+			if err != nil {
+				return nil, err
+			}
+			item, err := fetchBody(bodyArg, raw)
+			raw.Close()
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if isRFC822 {
+				item.key = arg.text
+			}
+			result = append(result, item)
+		}
+	}
+
+	if len(messageParsers) > 0 {
+		raw, err := msg.Raw()
+		if err != nil {
+			return nil, err
+		}
+		items, err := runMessageParsers(raw, messageParsers)
+		raw.Close()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, items...)
+	}
+	return result, nil
+}
+
+// messageStructure returns the BODYSTRUCTURE of the raw message
+func messageStructure(raw io.Reader) (string, error) {
+	rd := bufio.NewReader(raw)
+	hdr, err := textproto.NewReader(rd).ReadMIMEHeader()
+	if err != nil {
+		return "", err
+	}
+
+	mediaType := "text/plain"
+	var params map[string]string
+	if hdr.Get("Content-Type") != "" {
+		mediaType, params, err = mime.ParseMediaType(hdr.Get("Content-Type"))
+		if err != nil {
+			return "", err
+		}
+	}
+	body, err := parse(rd, mediaType, params)
+	if err != nil {
+		return "", err
+	}
+	return body.structure(), nil
+}
+
+// runMessageParsers feeds the raw message to all the parsers at once and
+// returns their items
+func runMessageParsers(raw io.Reader, messageParsers []messageParser) ([]fetchItem, error) {
+	writers := make([]io.Writer, 0, len(messageParsers))
+	dones := make([]chan error, 0, len(messageParsers))
+
+	for _, mp := range messageParsers {
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		dones = append(dones, done)
+		go func(mp messageParser) {
+			done <- mp.read(pr)
+			// A message parser may stop reading before the end, finish it
+			// off
+			io.Copy(ioutil.Discard, pr)
+			close(done)
+		}(mp)
+		writers = append(writers, pw)
+	}
+
+	_, err := io.Copy(io.MultiWriter(writers...), raw)
+	for i, done := range dones {
+		writers[i].(*io.PipeWriter).CloseWithError(err)
+		parseErr := <-done
+		if err == nil && parseErr != nil {
+			err = fmt.Errorf("Error extracting field %q: %s", messageParsers[i].getKey(), parseErr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]fetchItem, 0, len(messageParsers))
+	for _, mp := range messageParsers {
+		items = append(items, fetchItem{key: mp.getKey(), value: mp.getValue()})
+	}
+	return items, nil
+}
+
+// fetchBody returns the BODY[...] item of the raw message
+func fetchBody(arg fetchArgument, raw io.Reader) (fetchItem, error) {
+	var rd io.Reader = bufio.NewReader(raw)
+
+	// Skip to relevant part
+	if len(arg.part) > 0 {
+		msg, err := mail.ReadMessage(rd)
+		if err != nil {
+			return fetchItem{}, err
+		}
+
+		contentType := msg.Header.Get("Content-Type")
+		for parts := arg.part; len(parts) > 0; parts = parts[1:] {
+			mediaType, params, err := mime.ParseMediaType(contentType)
+			if err != nil {
+				return fetchItem{}, err
+			}
+			if !strings.HasPrefix(mediaType, "multipart/") {
+				// Special-case:
+				// Every message has at least one part, even if it is not multipart/*
+				// We deal with the case where messages are not multipart/*, but a
+				// client still asks for BODY[1], which is valid as per RFC, and
+				// returns the whole text
+				if len(arg.part) == 1 && arg.part[0] == 1 {
+					break
+				}
+				return fetchItem{}, fmt.Errorf("Invalid hierarchy")
+			}
+			partReader := multipart.NewReader(msg.Body, params["boundary"])
+
+			for part := parts[0]; part > 0; part-- {
+				p, err := partReader.NextPart()
+				if err != nil {
+					return fetchItem{}, err
+				}
+				rd = p
+				contentType = p.Header.Get("Content-Type")
+
+				// Same as upstream for quoted-printable, if
+				// Content-Transfer-Encoding is base64 we silently replace the
+				// reader with one that decodes on-the-fly
+				//
+				// See https://golang.org/src/mime/multipart/multipart.go?s=3209:3362#L98
+
+				const cte = "Content-Transfer-Encoding"
+				if p.Header.Get(cte) == "base64" {
+					p.Header.Del(cte)
+					rd = base64.NewDecoder(base64.StdEncoding, rd)
+				}
+			}
+		}
+	}
+
+	/*
+		if arg.section != "" && arg.section != "MIME" {
+			_, ok := container.(Message)
+			if !ok {
+				return fetchItem{}, fmt.Errorf("Invalid fetch of %s on a non-message", arg.section)
+			}
+		}
+	*/
+
+	keyPattern := bodyKeyPattern(arg)
+
+	var key string
+	var value string
+	switch arg.section {
+	case "":
+		key = fmt.Sprintf(keyPattern, "")
+
+		fullBody, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return fetchItem{}, err
+		}
+		value = string(fullBody)
+	case "HEADER":
+		key = fmt.Sprintf(keyPattern, "HEADER")
+
+		var hdr bytes.Buffer
+		buf := bufio.NewReader(io.TeeReader(rd, &hdr))
+		headerReader := textproto.NewReader(buf)
+		_, err := headerReader.ReadMIMEHeader()
+		if err != nil {
+			return fetchItem{}, err
+		}
+
+		// Don't forget to elide the last bytes that were read but are not
+		// part of the header
+		value = string(hdr.Bytes()[:hdr.Len()-buf.Buffered()])
+
+	case "HEADER.FIELDS":
+		key = fmt.Sprintf(keyPattern, "HEADER.FIELDS ("+strings.Join(arg.fields, " ")+")")
+
+		// Build a fake header with only the given fields
+		headerReader := textproto.NewReader(bufio.NewReader(rd))
+		hdr, err := headerReader.ReadMIMEHeader()
+		if err != nil {
+			return fetchItem{}, err
+		}
+
+		fakeHeader := make([]string, 0, len(arg.fields)+1)
+		for _, field := range arg.fields {
+			vals := hdr[textproto.CanonicalMIMEHeaderKey(field)]
+			if len(vals) > 0 {
+				fakeHeader = append(fakeHeader, fmt.Sprintf("%s: %s", field, strings.Join(vals, ", ")))
+			}
+		}
+		fakeHeader = append(fakeHeader, "\n")
+		value = strings.Join(fakeHeader, "\n")
+	case "HEADER.FIELDS.NOT":
+		key = fmt.Sprintf(keyPattern, "HEADER.FIELDS.NOT ("+strings.Join(arg.fields, " ")+")")
+
+		// Build a real header and remove the keys we don't want
+		headerReader := textproto.NewReader(bufio.NewReader(rd))
+		hdr, err := headerReader.ReadMIMEHeader()
+		if err != nil {
+			return fetchItem{}, err
+		}
+
+		for _, field := range arg.fields {
+			hdr.Del(field)
+		}
+		serialized := make([]string, 0, len(hdr)+1)
+		for k, values := range hdr {
+			value := strings.Join(values, ", ")
+			serialized = append(serialized, fmt.Sprintf("%s: %s", k, value))
+		}
+		serialized = append(serialized, "\n")
+		value = strings.Join(serialized, "\n")
+	case "TEXT":
+		key = fmt.Sprintf(keyPattern, "TEXT")
+
+		buf := bufio.NewReader(rd)
+		headerReader := textproto.NewReader(buf)
+		_, err := headerReader.ReadMIMEHeader()
+		if err != nil {
+			return fetchItem{}, err
+		}
+
+		// Write the bytes that have been buffered but are not part of the
+		// header
+		var text bytes.Buffer
+		_, err = io.Copy(&text, buf)
+		if err != nil {
+			return fetchItem{}, err
+		}
+		_, err = io.Copy(&text, rd)
+		if err != nil {
+			return fetchItem{}, err
+		}
+		value = string(text.Bytes())
+	case "MIME":
+		return fetchItem{}, fmt.Errorf("MIME is unsupported")
+	}
+
+	item := fetchItem{
+		key:   key,
+		value: partialValue(arg, value),
+	}
+	return item, nil
+}
+
+// setsSeen returns whether fetching the argument marks the message as
+// \Seen: BODY[...], RFC822 and RFC822.TEXT do, BODY.PEEK[...] and the
+// bodystructure of a bare BODY don't. Only the server sets the flag, so
+// that it can be refused to read-only sessions; mailstores never do.
+func setsSeen(arg fetchArgument) bool {
+	switch arg.text {
+	case "RFC822", "RFC822.TEXT":
+		return true
+	case "BODY":
+		return !arg.bare
+	}
+	return false
+}
+
+// bodyKeyPattern returns the key of a BODY item, with a %s for the
+// section text
+func bodyKeyPattern(arg fetchArgument) string {
+	partStrings := make([]string, len(arg.part))
+	for i := range arg.part {
+		partStrings[i] = strconv.Itoa(arg.part[i])
+	}
+	keyPattern := "BODY["
+	if len(partStrings) > 0 {
+		keyPattern += strings.Join(partStrings, ".")
+	}
+	if arg.section == "" || len(partStrings) == 0 {
+		keyPattern += "%s]"
+	} else {
+		keyPattern += ".%s]"
+	}
+	if arg.offset >= 0 {
+		keyPattern += "<" + strconv.Itoa(arg.offset)
+	}
+	if arg.length > 0 {
+		keyPattern += "." + strconv.Itoa(arg.length)
+	}
+	if strings.Contains(keyPattern, "<") {
+		keyPattern += ">"
+	}
+	return keyPattern
+}
+
+// partialValue returns the literal of the part of the value asked for
+func partialValue(arg fetchArgument, value string) string {
+	// Subset value with offset and length
+	from := 0
+	if arg.offset != -1 {
+		from = arg.offset
+	}
+	if from > len(value) {
+		from = len(value)
+	}
+	to := len(value)
+	if arg.length != 0 && from+arg.length < to {
+		to = from + arg.length
+	}
+	if to == from {
+		return `""`
+	}
+	return literalify(value[from:to])
+}
+
+// -----------------
+//  Message parsers
+// -----------------
+
+// A parser that needs the full body of the message to work
+type messageParser interface {
+	read(io.Reader) error
+
+	getKey() string
+
+	// Valid only after the full message has been written
+	getValue() string
+}
+
+// RFC822.SIZE
+type rfc822sizeParser struct {
+	size int
+}
+
+func (sp *rfc822sizeParser) read(r io.Reader) error {
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return err
+	}
+	sp.size = int(n)
+	return nil
+}
+
+func (sp *rfc822sizeParser) getKey() string   { return "RFC822.SIZE" }
+func (sp *rfc822sizeParser) getValue() string { return strconv.Itoa(sp.size) }
+
+// ENVELOPE
+type envelopeParser struct {
+	envelope string
+}
+
+func (ep *envelopeParser) read(r io.Reader) error {
+	tpReader := textproto.NewReader(bufio.NewReader(r))
+	hdr, err := tpReader.ReadMIMEHeader()
+	if err != nil {
+		return err
+	}
+
+	messageId := hdr.Get("Message-Id")
+	if len(messageId) > 1 && messageId[0] == lessThan && messageId[len(messageId)-1] == moreThan {
+		messageId = messageId[1 : len(messageId)-1]
+	}
+	// Technically if a field doesn't exist the corresponding value should
+	// be NIL; only if it exists AND is empty should it be set to "".
+	fields := []string{
+		quote(hdr.Get("Date")), literalify(hdr.Get("Subject")),
+		addresses(hdr, "From"), addresses(hdr, "Sender"), addresses(hdr, "Reply-To"), addresses(hdr, "To"), addresses(hdr, "Cc"), addresses(hdr, "Bcc"),
+		quote(hdr.Get("In-Reply-To")), quote(messageId),
+	}
+	ep.envelope = `(` + strings.Join(fields, " ") + `)`
+	return nil
+}
+
+func (ep *envelopeParser) getKey() string   { return "ENVELOPE" }
+func (ep *envelopeParser) getValue() string { return ep.envelope }
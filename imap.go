@@ -4,10 +4,12 @@ package unpeu
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
 
 	"github.com/rakoo/unpeu/auth"
 )
@@ -17,11 +19,26 @@ const DefaultListener = "0.0.0.0:143"
 
 // config is an IMAP server configuration
 type config struct {
+	// Connections beyond maxClients are refused, if not zero
 	maxClients uint
-	listeners  []listener
-	mailstore  Mailstore
+	// Connections from an address beyond maxClientsPerIP are refused, if
+	// not zero
+	maxClientsPerIP uint
+	// Logins beyond maxSessionsPerUser sessions of a user are refused, if
+	// not zero
+	maxSessionsPerUser uint
+	listeners          []listener
+	mailstore          Mailstore
+	// If set, gives each user their own mailstore
+	mailstoreFactory MailstoreFactory
 
 	authBackend auth.AuthStore
+	// masterUsers may log in as any user, if set
+	masterUsers auth.AuthStore
+	// Sessions are closed after this many failed logins, if not zero
+	maxLoginFailures uint
+	// certificateMapper gives the username of a client certificate
+	certificateMapper CertificateMapper
 }
 
 type Option func(*Server) error
@@ -31,15 +48,64 @@ type listener struct {
 	addr         string
 	encryption   encryptionLevel
 	certificates []tls.Certificate
-	listener     net.Listener
+	// Client certificates are verified against clientCAs, if set
+	clientCAs  *x509.CertPool
+	clientAuth tls.ClientAuthType
+	listener   net.Listener
+}
+
+// ListenerOption configures a TLS listener
+type ListenerOption func(*listener)
+
+// ClientCertificateOption makes a TLS listener ask for client
+// certificates, verified against the CAs of the pool. The mode is
+// tls.VerifyClientCertIfGiven to let clients log in with a password too,
+// or tls.RequireAndVerifyClientCert. Clients with a verified certificate
+// can log in with AUTHENTICATE EXTERNAL.
+func ClientCertificateOption(pool *x509.CertPool, mode tls.ClientAuthType) ListenerOption {
+	return func(l *listener) {
+		l.clientCAs = pool
+		l.clientAuth = mode
+	}
+}
+
+// tlsConfig returns the TLS configuration of the listener
+func (l *listener) tlsConfig() *tls.Config {
+	config := &tls.Config{Certificates: l.certificates}
+	if l.clientCAs != nil {
+		config.ClientCAs = l.clientCAs
+		config.ClientAuth = l.clientAuth
+	}
+	return config
+}
+
+// CertificateMapper returns the username of the owner of a verified client
+// certificate
+type CertificateMapper func(cert *x509.Certificate) (username string, err error)
+
+// DefaultCertificateMapper uses the first email address of the
+// certificate's subject alternative names, or else the common name of its
+// subject
+func DefaultCertificateMapper(cert *x509.Certificate) (string, error) {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0], nil
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, nil
+	}
+	return "", fmt.Errorf("No username in the certificate of %s", cert.Subject)
 }
 
 // Server is an IMAP Server
 type Server struct {
 	// Server configuration
 	config *config
-	// Number of active clients
-	activeClients uint
+	// Number of active clients, in total and per address, and of logged in
+	// sessions per user
+	activeClients   uint
+	clientsPerIP    map[string]uint
+	sessionsPerUser map[string]uint
+	limitsMutex     sync.Mutex
 
 	// context object to signal end of life
 	done chan struct{}
@@ -61,8 +127,9 @@ type client struct {
 // defaultConfig returns the default server configuration
 func defaultConfig() *config {
 	return &config{
-		listeners:  make([]listener, 0, 4),
-		maxClients: 8,
+		listeners:        make([]listener, 0, 4),
+		maxClients:       8,
+		maxLoginFailures: 3,
 	}
 }
 
@@ -75,6 +142,15 @@ func StoreOption(m Mailstore) Option {
 	}
 }
 
+// MailstoreFactoryOption gives each user the mailstore returned by f when
+// they log in, instead of the mailstore of StoreOption
+func MailstoreFactoryOption(f MailstoreFactory) Option {
+	return func(s *Server) error {
+		s.config.mailstoreFactory = f
+		return nil
+	}
+}
+
 // AuthStoreOption adds an authenticaton backend
 func AuthStoreOption(a auth.AuthStore) Option {
 	return func(s *Server) error {
@@ -83,6 +159,17 @@ func AuthStoreOption(a auth.AuthStore) Option {
 	}
 }
 
+// MasterUsersOption lets the users of the store log in as any user, such
+// as support staff debugging a mailbox. A master user logs in with LOGIN as
+// "user*master" and their own password, or with AUTHENTICATE PLAIN with
+// the user as the authorization identity. Impersonated sessions are logged.
+func MasterUsersOption(a auth.AuthStore) Option {
+	return func(s *Server) error {
+		s.config.masterUsers = a
+		return nil
+	}
+}
+
 // ListenOption adds an interface to listen to
 func ListenOption(Addr string) Option {
 	return func(s *Server) error {
@@ -95,7 +182,18 @@ func ListenOption(Addr string) Option {
 }
 
 // ListenSTARTTLSOption enables STARTTLS with the given certificate and keyfile
-func ListenSTARTTLSOption(Addr, certFile, keyFile string) Option {
+func ListenSTARTTLSOption(Addr, certFile, keyFile string, options ...ListenerOption) Option {
+	return listenTLS(Addr, certFile, keyFile, starttlsLevel, options)
+}
+
+// ListenTLSOption adds an interface where connections start with TLS
+// (implicit TLS, as on port 993), with the given certificate and keyfile
+func ListenTLSOption(Addr, certFile, keyFile string, options ...ListenerOption) Option {
+	return listenTLS(Addr, certFile, keyFile, tlsLevel, options)
+}
+
+// listenTLS adds a listener using TLS
+func listenTLS(Addr, certFile, keyFile string, encryption encryptionLevel, options []ListenerOption) Option {
 	return func(s *Server) error {
 		// Load the ceritificates
 		var err error
@@ -108,15 +206,19 @@ func ListenSTARTTLSOption(Addr, certFile, keyFile string) Option {
 		// Set up the listener
 		l := listener{
 			addr:         Addr,
-			encryption:   starttlsLevel,
+			encryption:   encryption,
 			certificates: certs,
 		}
+		for _, option := range options {
+			option(&l)
+		}
 		s.config.listeners = append(s.config.listeners, l)
 		return nil
 	}
 }
 
-// MaxClientsOption sets the MaxClients config
+// MaxClientsOption sets the maximum number of connections. Clients
+// beyond it are sent a BYE. It is 8 by default, and 0 means no limit.
 func MaxClientsOption(max uint) Option {
 	return func(s *Server) error {
 		s.config.maxClients = max
@@ -124,11 +226,50 @@ func MaxClientsOption(max uint) Option {
 	}
 }
 
+// MaxClientsPerIPOption sets the maximum number of connections from a
+// single address. There is no limit by default.
+func MaxClientsPerIPOption(max uint) Option {
+	return func(s *Server) error {
+		s.config.maxClientsPerIP = max
+		return nil
+	}
+}
+
+// MaxSessionsPerUserOption sets the maximum number of sessions a user can
+// be logged in with at once. Logins beyond it fail. There is no limit by
+// default.
+func MaxSessionsPerUserOption(max uint) Option {
+	return func(s *Server) error {
+		s.config.maxSessionsPerUser = max
+		return nil
+	}
+}
+
+// MaxLoginFailuresOption sets how many failed logins a client can make
+// before being disconnected. Zero means no limit.
+func MaxLoginFailuresOption(max uint) Option {
+	return func(s *Server) error {
+		s.config.maxLoginFailures = max
+		return nil
+	}
+}
+
+// CertificateMapperOption sets how the usernames of clients logging in
+// with a certificate are found. It is DefaultCertificateMapper by default.
+func CertificateMapperOption(m CertificateMapper) Option {
+	return func(s *Server) error {
+		s.config.certificateMapper = m
+		return nil
+	}
+}
+
 // NewServer creates a new server with the given options
 func NewServer(options ...Option) *Server {
 	// set the default config
 	s := &Server{
-		done: make(chan struct{}),
+		done:            make(chan struct{}),
+		clientsPerIP:    make(map[string]uint),
+		sessionsPerUser: make(map[string]uint),
 	}
 	s.config = defaultConfig()
 
@@ -139,6 +280,12 @@ func NewServer(options ...Option) *Server {
 			log.Fatal(err)
 		}
 	}
+	if s.config.authBackend == nil {
+		s.config.authBackend = auth.DummyAuthBackend{}
+	}
+	if s.config.certificateMapper == nil {
+		s.config.certificateMapper = DefaultCertificateMapper
+	}
 
 	return s
 }
@@ -150,10 +297,7 @@ func (s *Server) Start() error {
 		s.config.listeners = append(s.config.listeners,
 			listener{addr: DefaultListener})
 	}
-	if s.config.authBackend == nil {
-		s.config.authBackend = auth.DummyAuthBackend{}
-	}
-	if s.config.mailstore == nil {
+	if s.config.mailstore == nil && s.config.mailstoreFactory == nil {
 		log.Fatal("Can't run without a mailstore")
 	}
 
@@ -165,6 +309,9 @@ func (s *Server) Start() error {
 			log.Printf("IMAP cannot listen on %s, %v", iface.addr, err)
 			return err
 		}
+		if iface.encryption == tlsLevel {
+			s.config.listeners[i].listener = tls.NewListener(s.config.listeners[i].listener, iface.tlsConfig())
+		}
 	}
 
 	// Start the server on each port
@@ -223,12 +370,35 @@ func (s *Server) runListener(done chan struct{}, listener listener, id int) {
 
 }
 
+// ServeConn serves IMAP on an already established connection, such as
+// one end of a pipe, until the client logs out or the connection is
+// closed
+func (s *Server) ServeConn(conn net.Conn) {
+	c := &client{
+		conn:   conn,
+		bufin:  bufio.NewReader(conn),
+		bufout: bufio.NewWriter(conn),
+		id:     "conn/" + conn.RemoteAddr().String(),
+		config: s.config,
+	}
+	c.handle(s)
+}
+
 // handle requests from an IMAP client
 func (c *client) handle(s *Server) {
 
 	// Close the client on exit from this function
 	defer c.close()
 
+	// Refuse the client if there are too many
+	ip := remoteIP(c.conn)
+	if err := s.acquireClient(ip); err != nil {
+		c.logError(err)
+		fatalResponse(c.bufout, err)
+		return
+	}
+	defer s.releaseClient(ip)
+
 	// Create a parser
 	parser := createParser(c.bufin)
 
@@ -242,6 +412,7 @@ func (c *client) handle(s *Server) {
 
 	//  Create a session
 	sess := createSession(c.id, c.config, s, &c.listener, c.conn)
+	defer sess.close()
 
 	for {
 		// Get the next IMAP command
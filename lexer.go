@@ -209,6 +209,10 @@ type fetchArgument struct {
 	// response will be different
 	offset int
 	length int
+
+	// BODY without brackets: the body structure, not a section of the
+	// body
+	bare bool
 }
 
 func (l *lexer) fetchArguments() (sequenceSet string, args []fetchArgument, err error) {
@@ -265,12 +269,12 @@ accum:
 			args = append(args, fetchArgument{text: "INTERNALDATE"})
 			args = append(args, fetchArgument{text: "RFC822.SIZE"})
 			args = append(args, fetchArgument{text: "ENVELOPE"})
-			args = append(args, fetchArgument{text: "BODY"})
+			args = append(args, fetchArgument{text: "BODY", bare: true})
 		case "BODY", "BODY.PEEK":
 			c := l.current()
-			if c == space {
+			if c == space || c == rightParenthesis || c == lf {
 				if next == "BODY" {
-					args = append(args, fetchArgument{text: next})
+					args = append(args, fetchArgument{text: next, bare: true})
 					continue
 				} else {
 					return sequenceSet, args, fmt.Errorf("Unexpected space after " + next)
@@ -577,6 +581,21 @@ func (l *lexer) literalRest(length int64) (string, error) {
 	return string(out), err
 }
 
+// rawLine reads the next line whole, such as a response to a continuation
+// request
+func (l *lexer) rawLine() (string, error) {
+	err := l.newLine()
+	if err == io.EOF {
+		// An empty line is an empty response
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	l.done = true
+	return string(l.line), nil
+}
+
 // nonquoted reads a non-quoted string
 func (l *lexer) nonquoted(name string, exceptions []byte) (bool, string) {
 
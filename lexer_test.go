@@ -371,13 +371,20 @@ func TestFetchArguments(t *testing.T) {
 		{"10 ALL", "10", []fetchArgument{{text: "FLAGS"}, {text: "INTERNALDATE"}, {text: "RFC822.SIZE"}, {text: "ENVELOPE"}}},
 
 		{"10 BODY[1]", "10", []fetchArgument{{text: "BODY", offset: -1, part: []int{1}}}},
+
+		// Bare BODY, which BODY[]<0.10> must not be mistaken for
+		{"10 BODY", "10", []fetchArgument{{text: "BODY", bare: true}}},
+		{"10 (FLAGS BODY)", "10", []fetchArgument{{text: "FLAGS"}, {text: "BODY", bare: true}}},
+		{"10 BODY[]<0.10>", "10", []fetchArgument{{text: "BODY", length: 10}}},
+		{"10 FULL", "10", []fetchArgument{{text: "FLAGS"}, {text: "INTERNALDATE"}, {text: "RFC822.SIZE"}, {text: "ENVELOPE"}, {text: "BODY", bare: true}}},
 	}
 
 	compareFetchArgument := func(actual, expected fetchArgument) bool {
 		if actual.text != expected.text ||
 			actual.section != expected.section ||
 			actual.offset != expected.offset ||
-			actual.length != expected.length {
+			actual.length != expected.length ||
+			actual.bare != expected.bare {
 			return false
 		}
 		if len(actual.fields) != len(expected.fields) {
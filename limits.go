@@ -0,0 +1,81 @@
+package unpeu
+
+import (
+	"fmt"
+	"net"
+)
+
+var (
+	errTooManyClients   = fmt.Errorf("Too many connections")
+	errTooManyClientsIP = fmt.Errorf("Too many connections from your address")
+	errTooManySessions  = fmt.Errorf("Too many sessions for this user")
+)
+
+// acquireClient counts a new client from the given address, which may be
+// nil. It fails if there are too many clients, in total or from that
+// address; otherwise releaseClient must be called when the client leaves.
+func (s *Server) acquireClient(ip net.IP) error {
+	s.limitsMutex.Lock()
+	defer s.limitsMutex.Unlock()
+
+	if max := s.config.maxClients; max > 0 && s.activeClients >= max {
+		return errTooManyClients
+	}
+	if ip != nil {
+		if max := s.config.maxClientsPerIP; max > 0 && s.clientsPerIP[ip.String()] >= max {
+			return errTooManyClientsIP
+		}
+		s.clientsPerIP[ip.String()]++
+	}
+	s.activeClients++
+	return nil
+}
+
+// releaseClient forgets a client counted by acquireClient
+func (s *Server) releaseClient(ip net.IP) {
+	s.limitsMutex.Lock()
+	defer s.limitsMutex.Unlock()
+
+	s.activeClients--
+	if ip != nil {
+		if s.clientsPerIP[ip.String()]--; s.clientsPerIP[ip.String()] == 0 {
+			delete(s.clientsPerIP, ip.String())
+		}
+	}
+}
+
+// acquireUser counts a new session of the user. It fails if the user has
+// too many sessions; otherwise releaseUser must be called when the
+// session ends.
+func (s *Server) acquireUser(username string) error {
+	s.limitsMutex.Lock()
+	defer s.limitsMutex.Unlock()
+
+	if max := s.config.maxSessionsPerUser; max > 0 && s.sessionsPerUser[username] >= max {
+		return errTooManySessions
+	}
+	s.sessionsPerUser[username]++
+	return nil
+}
+
+// releaseUser forgets a session counted by acquireUser
+func (s *Server) releaseUser(username string) {
+	s.limitsMutex.Lock()
+	defer s.limitsMutex.Unlock()
+
+	if s.sessionsPerUser[username]--; s.sessionsPerUser[username] == 0 {
+		delete(s.sessionsPerUser, username)
+	}
+}
+
+// remoteIP returns the address of the other end of the connection, or nil
+// if it isn't known
+func remoteIP(conn net.Conn) net.IP {
+	if conn == nil {
+		return nil
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
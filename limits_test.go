@@ -0,0 +1,97 @@
+package unpeu
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dial connects to the server, and returns the connection and its
+// greeting
+func dial(t *testing.T, addr string) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	return conn, r, exchange(t, r, conn, "", "*")
+}
+
+// dialUntil connects to the server until it is greeted with the prefix,
+// as connections are only forgotten once the server notices they closed
+func dialUntil(t *testing.T, addr, prefix string) (net.Conn, *bufio.Reader) {
+	for i := 0; i < 100; i++ {
+		conn, r, greeting := dial(t, addr)
+		if strings.HasPrefix(greeting, prefix) {
+			return conn, r
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Never greeted with %q", prefix)
+	return nil, nil
+}
+
+// TestMaxClients tests that connections beyond the limits are refused
+func TestMaxClients(t *testing.T) {
+	for _, v := range []struct {
+		option   Option
+		greeting string
+	}{
+		{MaxClientsOption(2), "* BYE Too many connections"},
+		{MaxClientsPerIPOption(2), "* BYE Too many connections from your address"},
+	} {
+		addr, _ := startServer(t, ListenOption("127.0.0.1:0"), v.option)
+
+		first, _ := dialUntil(t, addr, "* OK")
+		second, _ := dialUntil(t, addr, "* OK")
+		third, _, greeting := dial(t, addr)
+		third.Close()
+		if greeting != v.greeting {
+			t.Errorf("Invalid greeting beyond the limit: %s", greeting)
+		}
+
+		// Closed connections don't count
+		first.Close()
+		conn, _ := dialUntil(t, addr, "* OK")
+		conn.Close()
+		second.Close()
+	}
+}
+
+// TestMaxSessionsPerUser tests that users can't log in more than
+// MaxSessionsPerUserOption times at once
+func TestMaxSessionsPerUser(t *testing.T) {
+	addr, _ := startServer(t, ListenOption("127.0.0.1:0"), MaxSessionsPerUserOption(1))
+
+	first, r1 := dialUntil(t, addr, "* OK")
+	defer first.Close()
+	if got := exchange(t, r1, first, "A1 LOGIN alice pw", "A1"); got != "A1 OK LOGIN completed" {
+		t.Fatalf("Can't log in: %s", got)
+	}
+	second, r2 := dialUntil(t, addr, "* OK")
+	defer second.Close()
+	if got := exchange(t, r2, second, "A1 LOGIN alice pw", "A1"); got != "A1 NO [LIMIT] Too many sessions for this user" {
+		t.Errorf("Logged in twice: %s", got)
+	}
+	if got := exchange(t, r2, second, "A2 LOGIN bob pw", "A2"); got != "A2 OK LOGIN completed" {
+		t.Errorf("Other users can't log in: %s", got)
+	}
+
+	// Sessions are forgotten when the client logs out
+	exchange(t, r1, first, "A2 LOGOUT", "A2")
+	for i := 0; ; i++ {
+		third, r3 := dialUntil(t, addr, "* OK")
+		got := exchange(t, r3, third, "A1 LOGIN alice pw", "A1")
+		third.Close()
+		if got == "A1 OK LOGIN completed" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Can't log in after logging out: %s", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,746 @@
+package unpeu
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Maildir++ tree: the root is the INBOX, and every other folder is a
+// directory of the root named after its path, with levels separated by
+// dots: the mailbox lists/golang is in .lists.golang. Levels that don't
+// have a directory of their own are \Noselect mailboxes.
+//
+// Flags are the letters of the ":2," info suffix of file names; keywords
+// are lowercase letters, see maildir_uidlist.go.
+const (
+	maildirInfo      = ":2,"
+	maildirDelimiter = "."
+)
+
+// System flags by info letter, in the order they must appear in the
+// suffix
+var maildirFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', "\\Draft"},
+	{'F', "\\Flagged"},
+	{'R', "\\Answered"},
+	{'S', "\\Seen"},
+	{'T', "\\Deleted"},
+}
+
+var _ Mailstore = &MaildirMailstore{}
+
+// MaildirMailstore serves a Maildir++ tree
+type MaildirMailstore struct {
+	expungeHandlers
+
+	root string
+
+	// Scans and renames are serialized within the process; other
+	// processes are kept out by the lock of each folder
+	l sync.Mutex
+	// Messages this process moved out of new/, by base name. They are the
+	// \Recent ones.
+	recent map[Id]map[string]struct{}
+}
+
+// NewMaildirMailstore returns a mailstore for the Maildir++ tree at root
+func NewMaildirMailstore(root string) *MaildirMailstore {
+	return &MaildirMailstore{
+		root:   root,
+		recent: make(map[Id]map[string]struct{}),
+	}
+}
+
+// maildirFolder is the content of a folder at the time it was scanned
+type maildirFolder struct {
+	dir         string
+	uidValidity uint32
+	uidNext     int
+	keywords    []string
+
+	// In UID order
+	messages []*maildirMessage
+}
+
+// maildirMessage is a message of a folder, as a searchableMessage and a
+// fetchableMessage
+type maildirMessage struct {
+	folder *maildirFolder
+	base   string // The file name without the info suffix
+	name   string // The file name in cur/
+	uid    int
+	seq    int
+	recent bool
+
+	stat os.FileInfo
+}
+
+// folderDir returns the directory of the folder
+func (md *MaildirMailstore) folderDir(mbox Id) (string, error) {
+	if mbox == "INBOX" {
+		return md.root, nil
+	}
+	name := string(mbox)
+	if !strings.HasPrefix(name, maildirDelimiter) || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return "", fmt.Errorf("Invalid maildir folder %q", mbox)
+	}
+	return filepath.Join(md.root, name), nil
+}
+
+// folderId returns the Id of the folder with the given tree name, as
+// handled by lookupTagMailbox
+func folderId(name string) Id {
+	if name == "inbox" {
+		return "INBOX"
+	}
+	return Id(maildirDelimiter + strings.Replace(name, tagDelimiter, maildirDelimiter, -1))
+}
+
+// folderNames returns the names of all the folders, with levels
+// separated by tagDelimiter so that they can be used as a tree of tags
+func (md *MaildirMailstore) folderNames() (map[string]struct{}, error) {
+	entries, err := ioutil.ReadDir(md.root)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]struct{}{"inbox": {}}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, maildirDelimiter) || name == "." || name == ".." {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(md.root, name, "cur")); err != nil {
+			continue
+		}
+		levels := strings.Split(name[1:], maildirDelimiter)
+		if strings.EqualFold(levels[0], "INBOX") {
+			// The INBOX is the root
+			continue
+		}
+		names[strings.Join(levels, tagDelimiter)] = struct{}{}
+	}
+	return names, nil
+}
+
+// lookupFolder returns the mailbox at the given path, or nil if there is
+// none
+func (md *MaildirMailstore) lookupFolder(path []string) (*Mailbox, error) {
+	names, err := md.folderNames()
+	if err != nil {
+		return nil, err
+	}
+	mbox := lookupTagMailbox(names, path)
+	if mbox != nil {
+		mbox.Id = folderId(string(mbox.Id))
+	}
+	return mbox, nil
+}
+
+func (md *MaildirMailstore) GetMailbox(path []string) (*Mailbox, error) {
+	mbox, err := md.lookupFolder(path)
+	if err != nil || mbox == nil || mbox.Flags&Noselect != 0 {
+		return mbox, err
+	}
+
+	folder, err := md.scan(mbox.Id)
+	if err != nil {
+		return nil, err
+	}
+	mbox.UidValidity = folder.uidValidity
+	return mbox, nil
+}
+
+func (md *MaildirMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
+	names, err := md.folderNames()
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := tagMailboxChildren(names, path)
+	for _, mbox := range mailboxes {
+		mbox.Id = folderId(string(mbox.Id))
+	}
+	return mailboxes, nil
+}
+
+func (md *MaildirMailstore) FirstUnseen(mbox Id) (int64, error) {
+	folder, err := md.scan(mbox)
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range folder.messages {
+		if !hasFlag(msg, "\\Seen") {
+			return int64(msg.seq), nil
+		}
+	}
+	return 0, nil
+}
+
+func (md *MaildirMailstore) TotalMessages(mbox Id) (int64, error) {
+	folder, err := md.scan(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(folder.messages)), nil
+}
+
+func (md *MaildirMailstore) RecentMessages(mbox Id) (int64, error) {
+	folder, err := md.scan(mbox)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, msg := range folder.messages {
+		if msg.recent {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ClearRecent forgets that the messages of the mailbox are recent, once a
+// session was told about them
+func (md *MaildirMailstore) ClearRecent(mbox Id) error {
+	md.l.Lock()
+	defer md.l.Unlock()
+	delete(md.recent, mbox)
+	return nil
+}
+
+func (md *MaildirMailstore) NextUid(mbox Id) (int64, error) {
+	folder, err := md.scan(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int64(folder.uidNext), nil
+}
+
+func (md *MaildirMailstore) CountUnseen(mbox Id) (int64, error) {
+	folder, err := md.scan(mbox)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, msg := range folder.messages {
+		if !hasFlag(msg, "\\Seen") {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// deliveryCounter makes file names unique within the process
+var deliveryCounter uint64
+
+// uniqueName returns a new file name for a message, following the
+// Maildir naming rules
+func uniqueName() string {
+	now := time.Now()
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.Replace(host, "/", "\\057", -1)
+	host = strings.Replace(host, ":", "\\072", -1)
+	n := atomic.AddUint64(&deliveryCounter, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, host)
+}
+
+func (md *MaildirMailstore) AppendMessage(mailbox string, flags []string, dateTime time.Time, message string) error {
+	mbox, err := md.lookupFolder(pathToSlice(mailbox))
+	if err != nil {
+		return err
+	}
+	if mbox == nil || mbox.Flags&Noselect != 0 {
+		return fmt.Errorf("No mailbox %s", mailbox)
+	}
+	dir, err := md.folderDir(mbox.Id)
+	if err != nil {
+		return err
+	}
+
+	// The message is written in tmp/ and only moved to new/ once complete,
+	// so that no one ever sees half of it
+	name := uniqueName()
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, message)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !dateTime.IsZero() {
+		// The modification time is the internal date
+		err = os.Chtimes(tmp, dateTime, dateTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, "new", name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if len(flags) == 0 {
+		return nil
+	}
+
+	// Messages in new/ can't have flags: the message must go to cur/ with
+	// them
+	md.l.Lock()
+	defer md.l.Unlock()
+	unlock, err := lockFolder(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	keywords, err := readKeywords(dir)
+	if err != nil {
+		return err
+	}
+	info, keywords, err := flagsInfo(flags, keywords)
+	if err != nil {
+		return err
+	}
+	err = writeKeywords(dir, keywords)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(filepath.Join(dir, "new", name), filepath.Join(dir, "cur", name+maildirInfo+info))
+	if os.IsNotExist(err) {
+		// Someone else moved it to cur/ already; it will have its flags
+		// on the next STORE
+		return nil
+	}
+	return err
+}
+
+func (md *MaildirMailstore) Search(mbox Id, args []searchArgument, returnUid, returnThreads bool) ([]threadMember, error) {
+	if returnThreads {
+		return nil, fmt.Errorf("THREAD is not supported by the maildir mailstore")
+	}
+	folder, err := md.scan(mbox)
+	if err != nil {
+		return nil, err
+	}
+	message := func(i int) searchableMessage { return folder.messages[i] }
+	return matchMessages(len(folder.messages), message, args, returnUid)
+}
+
+func (md *MaildirMailstore) Fetch(mbox Id, sequenceSet string, args []fetchArgument, useUids bool) ([]messageFetchResponse, error) {
+	folder, err := md.scan(mbox)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := folder.selectMessages(sequenceSet, useUids)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]messageFetchResponse, 0, len(messages))
+	for _, msg := range messages {
+		items, err := fetchMessage(msg, args)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't fetch %s: %s", msg.base, err)
+		}
+		results = append(results, messageFetchResponse{id: strconv.Itoa(msg.seq), items: items})
+	}
+	return results, nil
+}
+
+func (md *MaildirMailstore) Flag(mode flagMode, mbox Id, sequenceSet string, useUids bool, flags []string) ([]messageFetchResponse, error) {
+	folder, err := md.scan(mbox)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := folder.selectMessages(sequenceSet, useUids)
+	if err != nil {
+		return nil, err
+	}
+
+	md.l.Lock()
+	defer md.l.Unlock()
+	unlock, err := lockFolder(folder.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Keywords may have been added since the scan
+	keywords, err := readKeywords(folder.dir)
+	if err != nil {
+		return nil, err
+	}
+	known := len(keywords)
+
+	results := make([]messageFetchResponse, 0, len(messages))
+	for _, msg := range messages {
+		updated := updatedFlags(mode, msg.storedFlags(keywords), flags)
+		var info string
+		info, keywords, err = flagsInfo(updated, keywords)
+		if err != nil {
+			return nil, err
+		}
+		err = msg.rename(msg.base + maildirInfo + info)
+		if err != nil {
+			return nil, err
+		}
+		msg.folder.keywords = keywords
+		results = append(results, flagsResponse(msg.seq, msg.Flags()))
+	}
+	if len(keywords) != known {
+		err = writeKeywords(folder.dir, keywords)
+	}
+	return results, err
+}
+
+// scan brings the UIDs of the folder up to date with its content: new
+// messages are moved to cur/ and numbered, and messages that were removed
+// lose their UID
+func (md *MaildirMailstore) scan(mbox Id) (*maildirFolder, error) {
+	dir, err := md.folderDir(mbox)
+	if err != nil {
+		return nil, err
+	}
+
+	md.l.Lock()
+	defer md.l.Unlock()
+	unlock, err := lockFolder(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	ul, err := readUidlist(dir)
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	if ul.uidValidity == 0 {
+		ul.uidValidity = uint32(time.Now().Unix())
+		changed = true
+	}
+
+	recent := md.recent[mbox]
+	if recent == nil {
+		recent = make(map[string]struct{})
+		md.recent[mbox] = recent
+	}
+	newNames, err := readDirNames(filepath.Join(dir, "new"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range newNames {
+		err := os.Rename(filepath.Join(dir, "new", name), filepath.Join(dir, "cur", name+maildirInfo))
+		if os.IsNotExist(err) {
+			// Another reader moved it first
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		recent[maildirBase(name)] = struct{}{}
+	}
+
+	names, err := readDirNames(filepath.Join(dir, "cur"))
+	if err != nil {
+		return nil, err
+	}
+	// File names start with the delivery time, which is the right order
+	// to number them
+	sort.Strings(names)
+
+	folder := &maildirFolder{dir: dir, uidValidity: ul.uidValidity}
+	folder.keywords, err = readKeywords(dir)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		base := maildirBase(name)
+		present[base] = struct{}{}
+		uid, ok := ul.uids[base]
+		if !ok {
+			uid = ul.uidNext
+			ul.uids[base] = uid
+			ul.uidNext++
+			changed = true
+		}
+		_, isRecent := recent[base]
+		folder.messages = append(folder.messages, &maildirMessage{
+			folder: folder,
+			base:   base,
+			name:   name,
+			uid:    uid,
+			recent: isRecent,
+		})
+	}
+	var removed []int
+	for base, uid := range ul.uids {
+		if _, ok := present[base]; !ok {
+			removed = append(removed, uid)
+			delete(ul.uids, base)
+			delete(recent, base)
+			changed = true
+		}
+	}
+	if changed {
+		err = ul.write(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Ints(removed)
+	md.expunged(mbox, removed)
+
+	sort.Sort(maildirByUid(folder.messages))
+	for i, msg := range folder.messages {
+		msg.seq = i + 1
+	}
+	folder.uidNext = ul.uidNext
+	return folder, nil
+}
+
+type maildirByUid []*maildirMessage
+
+func (m maildirByUid) Len() int           { return len(m) }
+func (m maildirByUid) Less(i, j int) bool { return m[i].uid < m[j].uid }
+func (m maildirByUid) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// readDirNames returns the names of the messages in a directory of a
+// folder. Hidden files aren't messages.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	all, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	names := all[:0]
+	for _, name := range all {
+		if !strings.HasPrefix(name, ".") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// maildirBase returns the file name without its info suffix
+func maildirBase(name string) string {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// selectMessages returns the messages of the sequence set
+func (folder *maildirFolder) selectMessages(sequenceSet string, useUids bool) ([]*maildirMessage, error) {
+	uid := func(i int) int { return folder.messages[i].uid }
+	indexes, err := selectIndexes(len(folder.messages), uid, sequenceSet, useUids)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*maildirMessage, 0, len(indexes))
+	for _, i := range indexes {
+		messages = append(messages, folder.messages[i])
+	}
+	return messages, nil
+}
+
+// flagsInfo returns the info suffix of the flags, adding the keywords
+// that don't have a letter yet
+func flagsInfo(flags []string, keywords []string) (string, []string, error) {
+	letters := make(map[byte]struct{})
+flags:
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, "\\") {
+			for _, f := range maildirFlags {
+				if strings.EqualFold(flag, f.flag) {
+					letters[f.letter] = struct{}{}
+				}
+			}
+			// \Recent can't be set, and other system flags don't exist
+			continue
+		}
+		for i, keyword := range keywords {
+			if strings.EqualFold(flag, keyword) {
+				letters[byte('a'+i)] = struct{}{}
+				continue flags
+			}
+		}
+		if len(keywords) == maxKeywords {
+			return "", nil, fmt.Errorf("Too many keywords, can't add %s", flag)
+		}
+		letters[byte('a'+len(keywords))] = struct{}{}
+		keywords = append(keywords, flag)
+	}
+
+	info := make([]byte, 0, len(letters))
+	for letter := range letters {
+		info = append(info, letter)
+	}
+	sort.Sort(byteSlice(info))
+	return string(info), keywords, nil
+}
+
+type byteSlice []byte
+
+func (b byteSlice) Len() int           { return len(b) }
+func (b byteSlice) Less(i, j int) bool { return b[i] < b[j] }
+func (b byteSlice) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// storedFlags returns the flags in the file name of the message
+func (msg *maildirMessage) storedFlags(keywords []string) []string {
+	i := strings.Index(msg.name, maildirInfo)
+	if i < 0 {
+		return nil
+	}
+	var flags []string
+	for _, letter := range []byte(msg.name[i+len(maildirInfo):]) {
+		for _, f := range maildirFlags {
+			if f.letter == letter {
+				flags = append(flags, f.flag)
+			}
+		}
+		if letter >= 'a' && letter <= 'z' && int(letter-'a') < len(keywords) && keywords[letter-'a'] != "" {
+			flags = append(flags, keywords[letter-'a'])
+		}
+	}
+	return flags
+}
+
+// rename gives a new name to the message in cur/
+func (msg *maildirMessage) rename(name string) error {
+	cur := filepath.Join(msg.folder.dir, "cur")
+	for attempt := 0; ; attempt++ {
+		err := os.Rename(filepath.Join(cur, msg.name), filepath.Join(cur, name))
+		if err == nil {
+			msg.name = name
+			return nil
+		}
+		if !os.IsNotExist(err) || attempt > 0 {
+			return err
+		}
+		// Another process changed its flags since the scan
+		err = msg.refreshName()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// refreshName looks for the current name of the message in cur/
+func (msg *maildirMessage) refreshName() error {
+	names, err := readDirNames(filepath.Join(msg.folder.dir, "cur"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if maildirBase(name) == msg.base {
+			msg.name = name
+			return nil
+		}
+	}
+	return fmt.Errorf("Message %s was removed", msg.base)
+}
+
+func (msg *maildirMessage) Flags() []string {
+	flags := msg.storedFlags(msg.folder.keywords)
+	if msg.recent {
+		flags = append(flags, "\\Recent")
+	}
+	return flags
+}
+
+func (msg *maildirMessage) Raw() (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(msg.folder.dir, "cur", msg.name))
+	if os.IsNotExist(err) {
+		err = msg.refreshName()
+		if err != nil {
+			return nil, err
+		}
+		f, err = os.Open(filepath.Join(msg.folder.dir, "cur", msg.name))
+	}
+	return f, err
+}
+
+func (msg *maildirMessage) fileInfo() (os.FileInfo, error) {
+	if msg.stat != nil {
+		return msg.stat, nil
+	}
+	f, err := msg.Raw()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	msg.stat, err = f.(*os.File).Stat()
+	return msg.stat, err
+}
+
+func (msg *maildirMessage) InternalDate() time.Time {
+	stat, err := msg.fileInfo()
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
+
+func (msg *maildirMessage) Size() (int64, error) {
+	stat, err := msg.fileInfo()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (msg *maildirMessage) Header() (mail.Header, error) {
+	f, err := msg.Raw()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := mail.ReadMessage(f)
+	if err != nil {
+		return nil, err
+	}
+	return m.Header, nil
+}
+
+func (msg *maildirMessage) Body() (io.ReadCloser, error) {
+	f, err := msg.Raw()
+	if err != nil {
+		return nil, err
+	}
+	m, err := mail.ReadMessage(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{m.Body, f}, nil
+}
+
+func (msg *maildirMessage) Uid() int        { return msg.uid }
+func (msg *maildirMessage) SequenceId() int { return msg.seq }
@@ -0,0 +1,251 @@
+package unpeu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const maildirTestMessage = "From: alice@example.com\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Lunch\r\n" +
+	"Date: Mon, 2 Mar 2015 12:00:00 +0000\r\n" +
+	"\r\n" +
+	"Noon at the usual place?\r\n"
+
+// setupMaildir creates a Maildir++ tree with an INBOX, Archive and
+// lists/golang
+func setupMaildir(t *testing.T) string {
+	root, err := ioutil.TempDir("", "unpeu-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, folder := range []string{"", ".Archive", ".lists.golang"} {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			err := os.MkdirAll(filepath.Join(root, folder, sub), 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return root
+}
+
+// deliver drops a message in new/, as an MDA would
+func deliver(t *testing.T, dir, name, message string) {
+	err := ioutil.WriteFile(filepath.Join(dir, "new", name), []byte(message), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func maildirSearch(t *testing.T, md *MaildirMailstore, mbox Id, query string) []int {
+	args, err := aggregateSearchArguments([]byte(query))
+	if err != nil {
+		t.Fatalf("Invalid search %q: %s", query, err)
+	}
+	members, err := md.Search(mbox, args, true, false)
+	if err != nil {
+		t.Fatalf("Couldn't search %q: %s", query, err)
+	}
+	uids := make([]int, 0, len(members))
+	for _, member := range members {
+		uids = append(uids, member.id)
+	}
+	return uids
+}
+
+func TestMaildirMailboxes(t *testing.T) {
+	root := setupMaildir(t)
+	defer os.RemoveAll(root)
+	md := NewMaildirMailstore(root)
+
+	mailboxes, err := md.GetMailboxes([]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := make([]string, 0)
+	for _, mbox := range mailboxes {
+		actual = append(actual, fmt.Sprintf("%s %s %d", mbox.Name, mbox.Id, mbox.Flags))
+	}
+	expected := []string{
+		"Archive .Archive 0",
+		"INBOX INBOX 0",
+		fmt.Sprintf("lists .lists %d", Noselect),
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Invalid mailboxes: got %v, expected %v", actual, expected)
+	}
+
+	mbox, err := md.GetMailbox([]string{"lists", "golang"})
+	if err != nil || mbox == nil {
+		t.Fatalf("No lists/golang: %v", err)
+	}
+	if mbox.Id != ".lists.golang" || mbox.UidValidity == 0 {
+		t.Errorf("Invalid lists/golang: %+v", mbox)
+	}
+	if mbox, _ := md.GetMailbox([]string{"lists", "rust"}); mbox != nil {
+		t.Errorf("Unexpected mailbox: %+v", mbox)
+	}
+	if err := md.AppendMessage("lists", nil, time.Now(), maildirTestMessage); err == nil {
+		t.Error("APPEND to a \\Noselect mailbox was accepted")
+	}
+}
+
+func TestMaildirMessages(t *testing.T) {
+	root := setupMaildir(t)
+	defer os.RemoveAll(root)
+	md := NewMaildirMailstore(root)
+
+	// A message delivered from outside is numbered and moved to cur/
+	deliver(t, root, "1000.M1P1Q1.mx", maildirTestMessage)
+	total, err := md.TotalMessages("INBOX")
+	if err != nil || total != 1 {
+		t.Fatalf("Invalid total: %d (%v)", total, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "cur", "1000.M1P1Q1.mx:2,")); err != nil {
+		t.Error("Delivered message wasn't moved to cur/:", err)
+	}
+	if recent, _ := md.RecentMessages("INBOX"); recent != 1 {
+		t.Errorf("Invalid recent count: %d", recent)
+	}
+
+	date := time.Date(2015, 3, 2, 14, 0, 0, 0, time.UTC)
+	err = md.AppendMessage("INBOX", []string{"\\Seen", "work"}, date, maildirTestMessage)
+	if err != nil {
+		t.Fatal("Couldn't append:", err)
+	}
+	names, _ := readDirNames(filepath.Join(root, "cur"))
+	var appended string
+	for _, name := range names {
+		if strings.HasSuffix(name, ":2,Sa") {
+			appended = name
+		}
+	}
+	if appended == "" {
+		t.Fatalf("Appended message has no flags: %v", names)
+	}
+	keywords, _ := readKeywords(root)
+	if !reflect.DeepEqual(keywords, []string{"work"}) {
+		t.Errorf("Invalid keywords: %v", keywords)
+	}
+
+	fetched, err := md.Fetch("INBOX", "2", []fetchArgument{
+		{text: "UID"},
+		{text: "FLAGS"},
+		{text: "INTERNALDATE"},
+		{text: "BODY.PEEK", section: "HEADER.FIELDS", fields: []string{"Subject"}, offset: -1},
+	}, true)
+	if err != nil || len(fetched) != 1 {
+		t.Fatalf("Couldn't fetch: %v (%v)", fetched, err)
+	}
+	items := make([]string, 0)
+	for _, item := range fetched[0].items {
+		items = append(items, item.key+" "+item.value)
+	}
+	expectedItems := []string{
+		"UID 2",
+		"FLAGS (\\Seen work)",
+		`INTERNALDATE "02-Mar-2015 14:00:00 +0000"`,
+		"BODY[HEADER.FIELDS (Subject)] {16}\r\nSubject: Lunch\n\n",
+	}
+	if fetched[0].id != "2" || !reflect.DeepEqual(items, expectedItems) {
+		t.Errorf("Invalid fetch: %s %q", fetched[0].id, items)
+	}
+
+	if uids := maildirSearch(t, md, "INBOX", "UNSEEN"); !reflect.DeepEqual(uids, []int{1}) {
+		t.Errorf("Invalid UNSEEN: %v", uids)
+	}
+	if uids := maildirSearch(t, md, "INBOX", "KEYWORD work SUBJECT lunch"); !reflect.DeepEqual(uids, []int{2}) {
+		t.Errorf("Invalid KEYWORD: %v", uids)
+	}
+
+	// Another client changes the flags behind our back
+	renamed := strings.TrimSuffix(appended, "Sa") + "RSa"
+	err = os.Rename(filepath.Join(root, "cur", appended), filepath.Join(root, "cur", renamed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagged, err := md.Flag(REMOVE, "INBOX", "2", true, []string{"\\Seen"})
+	if err != nil || len(flagged) != 1 || flagged[0].items[0].value != "(\\Answered work)" {
+		t.Fatalf("Invalid STORE result: %v (%v)", flagged, err)
+	}
+	flagged, err = md.Flag(ADD, "INBOX", "1:*", false, []string{"\\Flagged", "urgent"})
+	if err != nil || len(flagged) != 2 {
+		t.Fatalf("Invalid STORE result: %v (%v)", flagged, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "cur", strings.TrimSuffix(appended, "Sa")+"FRab")); err != nil {
+		t.Error("Flags weren't stored in the file name:", err)
+	}
+
+	// UIDs survive a restart and a removal
+	err = os.Remove(filepath.Join(root, "cur", "1000.M1P1Q1.mx:2,Fb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md = NewMaildirMailstore(root)
+	var expunged []int
+	md.OnExpunge(func(mbox Id, uids []int) {
+		expunged = append(expunged, uids...)
+	})
+	folder, err := md.scan("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folder.messages) != 1 || folder.messages[0].uid != 2 || folder.uidNext != 3 {
+		t.Errorf("Invalid UIDs after restart: %d messages, next is %d", len(folder.messages), folder.uidNext)
+	}
+	if !reflect.DeepEqual(expunged, []int{1}) {
+		t.Errorf("Invalid expunged UIDs: %v", expunged)
+	}
+}
+
+func TestMaildirConcurrentDeliveries(t *testing.T) {
+	root := setupMaildir(t)
+	defer os.RemoveAll(root)
+	md := NewMaildirMailstore(root)
+	other := NewMaildirMailstore(root)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			err := md.AppendMessage("Archive", nil, time.Time{}, maildirTestMessage)
+			if err != nil {
+				t.Error("Couldn't append:", err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			name := filepath.Join(root, ".Archive", "new", fmt.Sprintf("2000.M%dP2Q1.mx", i))
+			if err := ioutil.WriteFile(name, []byte(maildirTestMessage), 0600); err != nil {
+				t.Error(err)
+			}
+			// A second server scans the same folder meanwhile
+			if _, err := other.scan(".Archive"); err != nil {
+				t.Error("Couldn't scan:", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	folder, err := md.scan(".Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folder.messages) != 20 || folder.uidNext != 21 {
+		t.Fatalf("Invalid folder: %d messages, next UID is %d", len(folder.messages), folder.uidNext)
+	}
+	for i, msg := range folder.messages {
+		if msg.uid != i+1 {
+			t.Errorf("Invalid UID for message %d: %d", i+1, msg.uid)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package unpeu
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UIDs and keywords of a Maildir folder are kept in the same files as
+// dovecot, so that both can serve the same tree. dovecot-uidlist holds a
+// header line with the UIDVALIDITY and the next UID, followed by one
+// "<uid> :<base name>" line per message. dovecot-keywords holds one
+// "<index> <keyword>" line per keyword, the keyword being the letter
+// 'a'+index in the info suffix of file names. Both are only written with
+// dovecot-uidlist.lock held.
+const (
+	uidlistFile  = "dovecot-uidlist"
+	keywordsFile = "dovecot-keywords"
+	uidlistLock  = "dovecot-uidlist.lock"
+
+	// A lock older than this was left by a dead process
+	staleLockAge = 2 * time.Minute
+	// How long to wait for the lock before giving up
+	lockTimeout = 10 * time.Second
+
+	// There are as many keywords as lowercase letters
+	maxKeywords = 26
+)
+
+// uidlist is the content of dovecot-uidlist
+type uidlist struct {
+	uidValidity uint32
+	uidNext     int
+	uids        map[string]int // base name -> UID
+}
+
+// readUidlist reads the uidlist of the folder. A missing file gives an
+// empty list, without UIDVALIDITY.
+func readUidlist(dir string) (*uidlist, error) {
+	ul := &uidlist{uidNext: 1, uids: make(map[string]int)}
+	f, err := os.Open(filepath.Join(dir, uidlistFile))
+	if os.IsNotExist(err) {
+		return ul, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return ul, scanner.Err()
+	}
+	header := strings.Fields(scanner.Text())
+	if len(header) == 0 || (header[0] != "1" && header[0] != "3") {
+		return nil, fmt.Errorf("Unsupported uidlist version in %s", dir)
+	}
+	if header[0] == "1" {
+		// Version 1 is "1 <uidvalidity> <uidnext>"
+		if len(header) < 3 {
+			return nil, fmt.Errorf("Invalid uidlist header in %s", dir)
+		}
+		header = []string{"1", "V" + header[1], "N" + header[2]}
+	}
+	for _, field := range header[1:] {
+		if len(field) < 2 {
+			continue
+		}
+		switch field[0] {
+		case 'V':
+			v, err := strconv.ParseUint(field[1:], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid uidlist header in %s", dir)
+			}
+			ul.uidValidity = uint32(v)
+		case 'N':
+			n, err := strconv.Atoi(field[1:])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid uidlist header in %s", dir)
+			}
+			ul.uidNext = n
+		}
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		// "<uid> [<extension>...] :<file name>", or "<uid> <file name>"
+		// for version 1
+		sep := strings.IndexByte(line, ' ')
+		if sep < 0 {
+			continue
+		}
+		uid, err := strconv.Atoi(line[:sep])
+		if err != nil {
+			continue
+		}
+		name := line[sep+1:]
+		if i := strings.Index(name, " :"); i >= 0 {
+			name = name[i+2:]
+		} else if strings.HasPrefix(name, ":") {
+			name = name[1:]
+		}
+		ul.uids[maildirBase(name)] = uid
+		if uid >= ul.uidNext {
+			ul.uidNext = uid + 1
+		}
+	}
+	return ul, scanner.Err()
+}
+
+// write replaces the uidlist of the folder. The lock must be held.
+func (ul *uidlist) write(dir string) error {
+	uidToName := make(map[int]string, len(ul.uids))
+	uids := make([]int, 0, len(ul.uids))
+	for name, uid := range ul.uids {
+		uidToName[uid] = name
+		uids = append(uids, uid)
+	}
+	sort.Ints(uids)
+
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "3 V%d N%d\n", ul.uidValidity, ul.uidNext)
+	for _, uid := range uids {
+		fmt.Fprintf(&w, "%d :%s\n", uid, uidToName[uid])
+	}
+	return writeFileAtomic(filepath.Join(dir, uidlistFile), w.Bytes())
+}
+
+// readKeywords returns the keywords of the folder, by index
+func readKeywords(dir string) ([]string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, keywordsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keywords := make([]string, maxKeywords)
+	max := -1
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || i < 0 || i >= maxKeywords {
+			continue
+		}
+		keywords[i] = parts[1]
+		if i > max {
+			max = i
+		}
+	}
+	return keywords[:max+1], nil
+}
+
+// writeKeywords replaces the keywords of the folder. The lock must be
+// held.
+func writeKeywords(dir string, keywords []string) error {
+	var w bytes.Buffer
+	for i, keyword := range keywords {
+		if keyword != "" {
+			fmt.Fprintf(&w, "%d %s\n", i, keyword)
+		}
+	}
+	return writeFileAtomic(filepath.Join(dir, keywordsFile), w.Bytes())
+}
+
+// writeFileAtomic replaces the file, so that readers see either the old
+// or the new content
+func writeFileAtomic(path string, content []byte) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	err := ioutil.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// lockFolder takes the uidlist lock of the folder, the same dotlock
+// dovecot uses, and returns the function releasing it
+func lockFolder(dir string) (func(), error) {
+	return dotlock(filepath.Join(dir, uidlistLock))
+}
+
+// dotlock creates the lock file, waiting for whoever holds it, and returns
+// the function releasing it
+func dotlock(path string) (func(), error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Couldn't lock %s: timeout", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,12 +1,60 @@
 package unpeu
 
 import (
-	"log"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// ErrCannotAppend is returned by AppendMessage when the mailbox exists but
+// can't receive messages
+var ErrCannotAppend = errors.New("Mailbox doesn't accept new messages")
+
 type Id string
 
+// ExpungeHandler is told the UIDs of messages that left a mailbox, whether
+// they were expunged through the mailstore or removed behind its back.
+// It is called with the mailstore locked, and must not call it back.
+//
+// Mailstores that know when messages leave have an OnExpunge method to
+// register handlers:
+//
+//	OnExpunge(handler ExpungeHandler)
+type ExpungeHandler func(mbox Id, uids []int)
+
+// expungeHandlers holds the handlers registered with OnExpunge. The zero
+// value has none.
+type expungeHandlers struct {
+	l        sync.Mutex
+	handlers []ExpungeHandler
+}
+
+// OnExpunge registers a handler called when messages leave a mailbox
+func (h *expungeHandlers) OnExpunge(handler ExpungeHandler) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.handlers = append(h.handlers, handler)
+}
+
+// expunged tells the handlers that messages left a mailbox
+func (h *expungeHandlers) expunged(mbox Id, uids []int) {
+	if len(uids) == 0 {
+		return
+	}
+	h.l.Lock()
+	handlers := h.handlers
+	h.l.Unlock()
+	for _, handler := range handlers {
+		handler(mbox, uids)
+	}
+}
+
+// MailstoreFactory returns the mailstore of a user. It is called when the
+// user logs in, and the mailstore is used for the rest of the session.
+type MailstoreFactory func(username string) (Mailstore, error)
+
 // Mailbox represents an IMAP mailbox
 type Mailbox struct {
 	Name        string   // The name of the mailbox
@@ -60,7 +108,8 @@ type Mailstore interface {
 	NextUid(mbox Id) (int64, error)
 	// CountUnseen counts the number of unseen messages in an IMAP mailbox
 	CountUnseen(mbox Id) (int64, error)
-	// AppendMessage appends the message to an IMAP mailbox
+	// AppendMessage appends the message to an IMAP mailbox, or returns
+	// ErrCannotAppend if the mailbox doesn't take messages
 	AppendMessage(mailbox string, flags []string, dateTime time.Time, message string) error
 	// Search searches messages in an IMAP mailbox
 	// The output ids are sorted by date
@@ -77,72 +126,43 @@ type Mailstore interface {
 	Flag(mode flagMode, mbox Id, sequenceSet string, useUids bool, flags []string) ([]messageFetchResponse, error)
 }
 
-// DummyMailstore is used for demonstrating the IMAP server
-type dummyMailstore struct {
-}
-
-// GetMailbox gets mailbox information
-func (m *dummyMailstore) GetMailbox(path []string) (*Mailbox, error) {
-	return &Mailbox{
-		Name: "inbox",
-		Path: []string{"inbox"},
-	}, nil
-}
-
-// GetMailboxes gets a list of mailboxes at the given path
-func (m *dummyMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
-	log.Printf("GetMailboxes %v", path)
-
-	if len(path) == 0 {
-		// Root
-		return []*Mailbox{
-			{
-				Name: "inbox",
-				Path: []string{"inbox"},
-			},
-			{
-				Name: "spam",
-				Path: []string{"spam"},
-			},
-		}, nil
-	} else if len(path) == 1 && path[0] == "inbox" {
-		return []*Mailbox{
-			{
-				Name: "starred",
-				Path: []string{"inbox", "stared"},
-			},
-		}, nil
-	} else {
-		return []*Mailbox{}, nil
+// updatedFlags returns the flags of a message once changed by a STORE:
+// without duplicates, compared without case, and without \Recent, which
+// only the server sets
+func updatedFlags(mode flagMode, current, flags []string) []string {
+	var updated []string
+	switch mode {
+	case SET:
+		updated = flags
+	case ADD:
+		updated = append(append([]string{}, current...), flags...)
+	case REMOVE:
+		updated = current
 	}
-}
-
-// FirstUnseen gets the sequence number of the first unseen message in an IMAP mailbox
-func (m *dummyMailstore) FirstUnseen(mbox int64) (int64, error) {
-	return 4, nil
-}
 
-// TotalMessages gets the total number of messages in an IMAP mailbox
-func (m *dummyMailstore) TotalMessages(mbox int64) (int64, error) {
-	return 8, nil
-}
-
-// RecentMessages gets the total number of unread messages in an IMAP mailbox
-func (m *dummyMailstore) RecentMessages(mbox int64) (int64, error) {
-	return 4, nil
-}
-
-// DummyMailstore gets the next available uid in an IMAP mailbox
-func (m *dummyMailstore) NextUid(mbox int64) (int64, error) {
-	return 9, nil
-}
-
-// CountUnseen counts the number of unseen messages in an IMAP mailbox
-func (m *dummyMailstore) CountUnseen(mbox int64) (int64, error) {
-	return 0, nil
+	// Remove duplicates, and the flags to remove
+	seen := make(map[string]struct{})
+	if mode == REMOVE {
+		for _, flag := range flags {
+			seen[strings.ToLower(flag)] = struct{}{}
+		}
+	}
+	var newFlags []string
+	for _, flag := range updated {
+		key := strings.ToLower(flag)
+		if _, ok := seen[key]; ok || key == "\\recent" {
+			continue
+		}
+		seen[key] = struct{}{}
+		newFlags = append(newFlags, flag)
+	}
+	return newFlags
 }
 
-// AppendMessage appends the message to an IMAP mailbox
-func (m *dummyMailstore) AppendMessage(mailbox string, flags []string, dateTime time.Time, message string) error {
-	return nil
+// flagsResponse is the answer to a STORE for one message
+func flagsResponse(seq int, flags []string) messageFetchResponse {
+	return messageFetchResponse{
+		id:    strconv.Itoa(seq),
+		items: []fetchItem{{key: "FLAGS", value: "(" + strings.Join(flags, " ") + ")"}},
+	}
 }
@@ -0,0 +1,637 @@
+package unpeu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A tree of mbox files: every file under the root is a mailbox named
+// after its path, and directories are the levels of the hierarchy. The
+// INBOX is the file named INBOX at the root, in any case.
+//
+// Each mbox has an index saved next to it, in a hidden file, so that
+// messages are read by seeking to them. The index holds the flags too:
+// Status, X-Status and X-Keywords headers are only read when a message is
+// indexed, the mbox is never rewritten.
+
+// mboxIndexSuffix is the suffix of the hidden index of an mbox
+const mboxIndexSuffix = ".unpeu-index"
+
+var _ Mailstore = &MboxMailstore{}
+
+// MboxMailstore serves a tree of mbox files
+type MboxMailstore struct {
+	root   string
+	format mboxFormat
+
+	// Protects the indexes, which are only read from disk once
+	l       sync.Mutex
+	indexes map[Id]*mboxIndex
+}
+
+// NewMboxMailstore returns a mailstore for the mbox files under root,
+// in the given format
+func NewMboxMailstore(root string, format mboxFormat) *MboxMailstore {
+	return &MboxMailstore{
+		root:    root,
+		format:  format,
+		indexes: make(map[Id]*mboxIndex),
+	}
+}
+
+// mboxPath returns the path of the mbox file of the mailbox
+func (ms *MboxMailstore) mboxPath(mbox Id) (string, error) {
+	if mbox == "INBOX" {
+		for _, name := range []string{"INBOX", "Inbox", "inbox"} {
+			path := filepath.Join(ms.root, name)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+		return filepath.Join(ms.root, "INBOX"), nil
+	}
+	for _, level := range strings.Split(string(mbox), tagDelimiter) {
+		if level == "" || level == "." || level == ".." || strings.HasPrefix(level, ".") {
+			return "", fmt.Errorf("Invalid mbox %q", mbox)
+		}
+	}
+	return filepath.Join(ms.root, filepath.FromSlash(string(mbox))), nil
+}
+
+// indexPath returns the path of the index of an mbox file
+func indexPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+mboxIndexSuffix)
+}
+
+// mboxNames returns the names of all the mbox files, with levels
+// separated by tagDelimiter so that they can be used as a tree of tags
+func (ms *MboxMailstore) mboxNames() (map[string]struct{}, error) {
+	names := map[string]struct{}{"inbox": {}}
+	err := filepath.Walk(ms.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == ms.root {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(info.Name(), ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(ms.root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.EqualFold(name, "INBOX") {
+			name = "inbox"
+		}
+		names[name] = struct{}{}
+		return nil
+	})
+	return names, err
+}
+
+// mboxId returns the Id of the mailbox with the given tree name, as
+// handled by lookupTagMailbox
+func mboxId(name string) Id {
+	if name == "inbox" {
+		return "INBOX"
+	}
+	return Id(name)
+}
+
+func (ms *MboxMailstore) GetMailbox(path []string) (*Mailbox, error) {
+	names, err := ms.mboxNames()
+	if err != nil {
+		return nil, err
+	}
+	mbox := lookupTagMailbox(names, path)
+	if mbox == nil || mbox.Flags&Noselect != 0 {
+		return mbox, nil
+	}
+	mbox.Id = mboxId(string(mbox.Id))
+
+	idx, err := ms.index(mbox.Id)
+	if err != nil {
+		return nil, err
+	}
+	mbox.UidValidity = idx.UidValidity
+	return mbox, nil
+}
+
+func (ms *MboxMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
+	names, err := ms.mboxNames()
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := tagMailboxChildren(names, path)
+	for _, mbox := range mailboxes {
+		mbox.Id = mboxId(string(mbox.Id))
+	}
+	return mailboxes, nil
+}
+
+func (ms *MboxMailstore) FirstUnseen(mbox Id) (int64, error) {
+	messages, err := ms.messages(mbox)
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range messages {
+		if !hasFlag(msg, "\\Seen") {
+			return int64(msg.seq), nil
+		}
+	}
+	return 0, nil
+}
+
+func (ms *MboxMailstore) TotalMessages(mbox Id) (int64, error) {
+	idx, err := ms.index(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(idx.Messages)), nil
+}
+
+func (ms *MboxMailstore) RecentMessages(mbox Id) (int64, error) {
+	idx, err := ms.index(mbox)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, entry := range idx.Messages {
+		if entry.Recent {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *MboxMailstore) NextUid(mbox Id) (int64, error) {
+	idx, err := ms.index(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int64(idx.UidNext), nil
+}
+
+func (ms *MboxMailstore) CountUnseen(mbox Id) (int64, error) {
+	messages, err := ms.messages(mbox)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, msg := range messages {
+		if !hasFlag(msg, "\\Seen") {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *MboxMailstore) AppendMessage(mailbox string, flags []string, dateTime time.Time, message string) error {
+	names, err := ms.mboxNames()
+	if err != nil {
+		return err
+	}
+	mbox := lookupTagMailbox(names, pathToSlice(mailbox))
+	if mbox == nil || mbox.Flags&Noselect != 0 {
+		return fmt.Errorf("No mailbox %s", mailbox)
+	}
+	id := mboxId(string(mbox.Id))
+	path, err := ms.mboxPath(id)
+	if err != nil {
+		return err
+	}
+	offset, err := ms.appendToMbox(path, dateTime, message)
+	if err != nil {
+		return err
+	}
+
+	// The flags are kept in the index
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	idx, err := ms.refreshIndex(id)
+	if err != nil {
+		return err
+	}
+	for _, entry := range idx.Messages {
+		if entry.Offset != offset {
+			continue
+		}
+		entry.Flags = updatedFlags(SET, nil, flags)
+	}
+	return idx.write(indexPath(path))
+}
+
+// appendToMbox writes the message at the end of the mbox, and returns
+// the offset of its "From " line
+func (ms *MboxMailstore) appendToMbox(path string, dateTime time.Time, message string) (int64, error) {
+	if dateTime.IsZero() {
+		dateTime = time.Now()
+	}
+
+	// Lock the way other mbox tools do: dotlock, then fcntl
+	unlock, err := dotlock(path + ".lock")
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	err = lockMboxFile(f, true)
+	if err != nil {
+		return 0, err
+	}
+	defer unlockMboxFile(f)
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	offset := info.Size()
+
+	// Messages are separated by an empty line
+	var separator string
+	if offset > 0 {
+		tail := make([]byte, 2)
+		if offset == 1 {
+			tail = tail[1:]
+		}
+		_, err = f.ReadAt(tail, offset-int64(len(tail)))
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case string(tail) == "\n\n":
+		case tail[len(tail)-1] == '\n':
+			separator = "\n"
+		default:
+			separator = "\n\n"
+		}
+	}
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+	fromLine := "From MAILER-DAEMON " + dateTime.UTC().Format(time.ANSIC) + "\n"
+	_, err = f.WriteAt([]byte(separator+fromLine+ms.format.escape(message)+"\n"), offset)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// Don't leave half a message behind
+		f.Truncate(offset)
+		return 0, err
+	}
+	return offset + int64(len(separator)), nil
+}
+
+func (ms *MboxMailstore) Search(mbox Id, args []searchArgument, returnUid, returnThreads bool) ([]threadMember, error) {
+	if returnThreads {
+		return nil, fmt.Errorf("THREAD is not supported by the mbox mailstore")
+	}
+	messages, err := ms.messages(mbox)
+	if err != nil {
+		return nil, err
+	}
+	message := func(i int) searchableMessage { return messages[i] }
+	return matchMessages(len(messages), message, args, returnUid)
+}
+
+func (ms *MboxMailstore) Fetch(mbox Id, sequenceSet string, args []fetchArgument, useUids bool) ([]messageFetchResponse, error) {
+	messages, err := ms.messages(mbox)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selectMboxMessages(messages, sequenceSet, useUids)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]messageFetchResponse, 0, len(selected))
+	for _, i := range selected {
+		msg := messages[i]
+		items := make([]fetchItem, 0, len(args))
+		var others []fetchArgument
+		for _, arg := range args {
+			item, ok, err := msg.fetchRange(arg)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				items = append(items, item)
+			} else {
+				others = append(others, arg)
+			}
+		}
+		if len(others) > 0 {
+			otherItems, err := fetchMessage(msg, others)
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't fetch message %d: %s", msg.entry.Uid, err)
+			}
+			items = append(items, otherItems...)
+		}
+		results = append(results, messageFetchResponse{id: strconv.Itoa(msg.seq), items: items})
+	}
+	return results, nil
+}
+
+func (ms *MboxMailstore) Flag(mode flagMode, mbox Id, sequenceSet string, useUids bool, flags []string) ([]messageFetchResponse, error) {
+	path, err := ms.mboxPath(mbox)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	idx, err := ms.refreshIndex(mbox)
+	if err != nil {
+		return nil, err
+	}
+	messages := ms.wrap(path, idx)
+	selected, err := selectMboxMessages(messages, sequenceSet, useUids)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]messageFetchResponse, 0, len(selected))
+	for _, i := range selected {
+		msg := messages[i]
+		idx.Messages[i].Flags = updatedFlags(mode, msg.entry.Flags, flags)
+		msg.entry.Flags = idx.Messages[i].Flags
+		results = append(results, flagsResponse(msg.seq, msg.Flags()))
+	}
+	return results, idx.write(indexPath(path))
+}
+
+// index returns the index of the mailbox, brought up to date
+func (ms *MboxMailstore) index(mbox Id) (*mboxIndex, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	return ms.refreshIndex(mbox)
+}
+
+// refreshIndex brings the index of the mailbox up to date with its mbox.
+// Messages appended since last time are indexed; any other change means
+// the file was rewritten, and it is indexed again under a new
+// UIDVALIDITY. The lock must be held.
+func (ms *MboxMailstore) refreshIndex(mbox Id) (*mboxIndex, error) {
+	path, err := ms.mboxPath(mbox)
+	if err != nil {
+		return nil, err
+	}
+	idx := ms.indexes[mbox]
+	if idx == nil {
+		idx, err = readMboxIndex(indexPath(path))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && mbox == "INBOX" {
+		// The INBOX exists even before its first message
+		if idx == nil || len(idx.Messages) > 0 {
+			idx = &mboxIndex{UidValidity: uint32(time.Now().Unix()), UidNext: 1}
+		}
+		ms.indexes[mbox] = idx
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = lockMboxFile(f, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockMboxFile(f)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if idx != nil && idx.Size == info.Size() && idx.ModTime.Equal(info.ModTime()) {
+		ms.indexes[mbox] = idx
+		return idx, nil
+	}
+
+	if idx != nil && info.Size() > idx.Size && ms.appendedTo(f, idx) {
+		// Index again from the last message, which may have grown
+		var from int64
+		kept := idx.Messages
+		if len(kept) > 0 {
+			from = kept[len(kept)-1].Offset
+			kept = kept[:len(kept)-1]
+		}
+		entries, err := indexMbox(f, from, info.Size(), ms.format)
+		if err != nil {
+			return nil, err
+		}
+		for i, entry := range entries {
+			if i == 0 && len(kept) < len(idx.Messages) {
+				last := idx.Messages[len(kept)]
+				entry.Uid, entry.Flags, entry.Recent = last.Uid, last.Flags, last.Recent
+				continue
+			}
+			entry.Uid = idx.UidNext
+			idx.UidNext++
+		}
+		idx.Messages = append(kept, entries...)
+	} else {
+		entries, err := indexMbox(f, 0, info.Size(), ms.format)
+		if err != nil {
+			return nil, err
+		}
+		uidValidity := uint32(time.Now().Unix())
+		if idx != nil && uidValidity <= idx.UidValidity {
+			uidValidity = idx.UidValidity + 1
+		}
+		idx = &mboxIndex{UidValidity: uidValidity, UidNext: 1, Messages: entries}
+		for _, entry := range entries {
+			entry.Uid = idx.UidNext
+			idx.UidNext++
+		}
+	}
+	idx.Size = info.Size()
+	idx.ModTime = info.ModTime()
+	ms.indexes[mbox] = idx
+	return idx, idx.write(indexPath(path))
+}
+
+// appendedTo returns true if the mbox still has the indexed messages, so
+// that it only needs the end indexed. The last indexed message must still
+// be where it was, with the same "From " line and header. Indexes from
+// before checksums are always indexed again.
+func (ms *MboxMailstore) appendedTo(f *os.File, idx *mboxIndex) bool {
+	if len(idx.Messages) == 0 {
+		return idx.Size == 0
+	}
+	last := idx.Messages[len(idx.Messages)-1]
+	if last.Checksum == "" {
+		return false
+	}
+	checksum, err := headerChecksum(f, last)
+	return err == nil && checksum == last.Checksum
+}
+
+// messages returns the messages of the mailbox, in UID order
+func (ms *MboxMailstore) messages(mbox Id) ([]*mboxMessage, error) {
+	path, err := ms.mboxPath(mbox)
+	if err != nil {
+		return nil, err
+	}
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	idx, err := ms.refreshIndex(mbox)
+	if err != nil {
+		return nil, err
+	}
+	return ms.wrap(path, idx), nil
+}
+
+// wrap returns the messages of the index. The lock must be held.
+func (ms *MboxMailstore) wrap(path string, idx *mboxIndex) []*mboxMessage {
+	messages := make([]*mboxMessage, len(idx.Messages))
+	for i, entry := range idx.Messages {
+		// Entries change under the lock, messages are read without it.
+		// Flags are always replaced, never modified in place, so a shallow
+		// copy is enough.
+		copied := *entry
+		messages[i] = &mboxMessage{path: path, format: ms.format, entry: &copied, seq: i + 1}
+	}
+	return messages
+}
+
+// selectMboxMessages returns the indexes of the messages of the sequence
+// set
+func selectMboxMessages(messages []*mboxMessage, sequenceSet string, useUids bool) ([]int, error) {
+	uid := func(i int) int { return messages[i].entry.Uid }
+	return selectIndexes(len(messages), uid, sequenceSet, useUids)
+}
+
+// mboxMessage is a message of an mbox, as a searchableMessage and a
+// fetchableMessage
+type mboxMessage struct {
+	path   string
+	format mboxFormat
+	entry  *mboxEntry
+	seq    int
+}
+
+// section returns a reader on the bytes of the file between from and to
+func (msg *mboxMessage) section(from, to int64) (io.ReadCloser, error) {
+	f, err := os.Open(msg.path)
+	if err != nil {
+		return nil, err
+	}
+	return &mboxReader{
+		rd:     bufio.NewReader(io.NewSectionReader(f, from, to-from)),
+		format: msg.format,
+		Closer: f,
+	}, nil
+}
+
+// fetchRange answers BODY[], BODY[HEADER] and BODY[TEXT], and their
+// partial forms, by reading only the bytes asked for. It returns false
+// for any other item, or if the message has escaped lines and offsets in
+// the file don't match offsets in the message.
+func (msg *mboxMessage) fetchRange(arg fetchArgument) (fetchItem, bool, error) {
+	if (arg.text != "BODY" && arg.text != "BODY.PEEK") || len(arg.part) > 0 || msg.entry.Escapes > 0 {
+		return fetchItem{}, false, nil
+	}
+	from, to := msg.entry.Start, msg.entry.End
+	switch arg.section {
+	case "":
+	case "HEADER":
+		to = msg.entry.Text
+	case "TEXT":
+		from = msg.entry.Text
+	default:
+		return fetchItem{}, false, nil
+	}
+
+	if arg.offset > 0 {
+		from += int64(arg.offset)
+	}
+	if from > to {
+		from = to
+	}
+	if arg.length > 0 && from+int64(arg.length) < to {
+		to = from + int64(arg.length)
+	}
+	value := make([]byte, to-from)
+	f, err := os.Open(msg.path)
+	if err != nil {
+		return fetchItem{}, false, err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(value, from)
+	if err != nil {
+		return fetchItem{}, false, err
+	}
+
+	literal := `""`
+	if len(value) > 0 {
+		literal = literalify(string(value))
+	}
+	return fetchItem{key: fmt.Sprintf(bodyKeyPattern(arg), arg.section), value: literal}, true, nil
+}
+
+func (msg *mboxMessage) Flags() []string {
+	flags := append([]string{}, msg.entry.Flags...)
+	if msg.entry.Recent {
+		flags = append(flags, "\\Recent")
+	}
+	return flags
+}
+
+func (msg *mboxMessage) InternalDate() time.Time {
+	if !msg.entry.Date.IsZero() {
+		return msg.entry.Date
+	}
+	date, _ := sentDate(msg)
+	return date
+}
+
+func (msg *mboxMessage) Size() (int64, error) { return msg.entry.Size, nil }
+
+func (msg *mboxMessage) Raw() (io.ReadCloser, error) {
+	return msg.section(msg.entry.Start, msg.entry.End)
+}
+
+func (msg *mboxMessage) Header() (mail.Header, error) {
+	rd, err := msg.section(msg.entry.Start, msg.entry.Text)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	m, err := mail.ReadMessage(rd)
+	if err != nil {
+		return nil, err
+	}
+	return m.Header, nil
+}
+
+func (msg *mboxMessage) Body() (io.ReadCloser, error) {
+	return msg.section(msg.entry.Text, msg.entry.End)
+}
+
+func (msg *mboxMessage) Uid() int        { return msg.entry.Uid }
+func (msg *mboxMessage) SequenceId() int { return msg.seq }
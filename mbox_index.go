@@ -0,0 +1,285 @@
+package unpeu
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// mboxFormat is the way "From " lines in bodies are escaped
+type mboxFormat int
+
+const (
+	// Mboxo escapes "From " lines with a '>', which can't be told apart
+	// from a real ">From " line
+	Mboxo mboxFormat = iota
+	// Mboxrd escapes "From " and ">From " lines alike, with one more '>'
+	Mboxrd
+)
+
+// mboxIndex is where each message of an mbox file is, along with the
+// state the mbox itself can't hold. It is saved next to the mbox.
+type mboxIndex struct {
+	// The mbox file when it was indexed; if it changed the index must be
+	// updated
+	Size    int64
+	ModTime time.Time
+
+	UidValidity uint32
+	UidNext     int
+	Messages    []*mboxEntry
+}
+
+// mboxEntry is a message of an mbox file
+type mboxEntry struct {
+	Uid int
+
+	Offset int64 // The "From " line
+	Start  int64 // The first header line
+	Text   int64 // After the blank line ending the header
+	End    int64 // Before the blank line separating it from the next one
+
+	// The number of escaped "From " lines, each one byte longer in the
+	// file than in the message
+	Escapes int
+	Size    int64
+
+	// Of the "From " line and the header, to recognize the message
+	// when the mbox changed
+	Checksum string
+
+	Date  time.Time // From the "From " line
+	Flags []string
+	// Only the server that indexed the message first sees it as recent
+	Recent bool `json:"-"`
+}
+
+// readMboxIndex reads the saved index, or returns nil if there is none
+func readMboxIndex(path string) (*mboxIndex, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var idx mboxIndex
+	err = json.Unmarshal(content, &idx)
+	if err != nil {
+		// A broken index is rebuilt, at the cost of the UIDs
+		return nil, nil
+	}
+	return &idx, nil
+}
+
+// write saves the index
+func (idx *mboxIndex) write(path string) error {
+	content, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+// headerChecksum returns the checksum of the "From " line and the header
+// of the entry in the mbox, as indexMbox computes it
+func headerChecksum(rd io.ReaderAt, entry *mboxEntry) (string, error) {
+	sum := sha256.New()
+	_, err := io.Copy(sum, io.NewSectionReader(rd, entry.Offset, entry.Text-entry.Offset))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// isEscaped returns true if the line is an escaped "From " line
+func (format mboxFormat) isEscaped(line []byte) bool {
+	if format == Mboxo {
+		return bytes.HasPrefix(line, []byte(">From "))
+	}
+	unquoted := bytes.TrimLeft(line, ">")
+	return len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From "))
+}
+
+// escape returns the message with its "From " lines escaped
+func (format mboxFormat) escape(message string) string {
+	lines := strings.SplitAfter(message, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "From ") || (format == Mboxrd && format.isEscaped([]byte(line))) {
+			lines[i] = ">" + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// mboxReader reads a message from an mbox file, unescaping its "From "
+// lines
+type mboxReader struct {
+	rd     *bufio.Reader
+	format mboxFormat
+	line   []byte
+	io.Closer
+}
+
+func (mr *mboxReader) Read(p []byte) (int, error) {
+	if len(mr.line) == 0 {
+		line, err := mr.rd.ReadBytes('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		if mr.format.isEscaped(line) {
+			line = line[1:]
+		}
+		mr.line = line
+	}
+	n := copy(p, mr.line)
+	mr.line = mr.line[n:]
+	return n, nil
+}
+
+// isBlank returns true for an empty line
+func isBlank(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// fromLineDate returns the date of a "From sender date" line, or the zero
+// time if it can't be read
+func fromLineDate(line []byte) time.Time {
+	fields := strings.SplitN(strings.TrimSpace(string(line)), " ", 3)
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+	for _, layout := range []string{time.ANSIC, "Mon Jan _2 15:04:05 2006 -0700", "Mon Jan _2 15:04:05 MST 2006"} {
+		if date, err := time.Parse(layout, fields[2]); err == nil {
+			return date
+		}
+	}
+	return time.Time{}
+}
+
+// headerFlags records the flags held by a Status, X-Status or X-Keywords
+// header in the entry
+func headerFlags(name string, value string, entry *mboxEntry) {
+	switch strings.ToLower(name) {
+	case "status":
+		if strings.ContainsRune(value, 'R') {
+			entry.Flags = append(entry.Flags, "\\Seen")
+		}
+		if strings.ContainsRune(value, 'O') {
+			entry.Recent = false
+		}
+	case "x-status":
+		for _, f := range []struct {
+			letter rune
+			flag   string
+		}{{'A', "\\Answered"}, {'F', "\\Flagged"}, {'T', "\\Draft"}, {'D', "\\Deleted"}} {
+			if strings.ContainsRune(value, f.letter) {
+				entry.Flags = append(entry.Flags, f.flag)
+			}
+		}
+	case "x-keywords":
+		for _, keyword := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' }) {
+			entry.Flags = append(entry.Flags, keyword)
+		}
+	}
+}
+
+// indexMbox returns the messages of the mbox from offset on, which must
+// be the start of a "From " line, up to size
+func indexMbox(rd io.ReaderAt, offset, size int64, format mboxFormat) ([]*mboxEntry, error) {
+	buf := bufio.NewReader(io.NewSectionReader(rd, offset, size-offset))
+	var entries []*mboxEntry
+	var current *mboxEntry
+	// The checksum of the current entry, up to its body
+	var sum hash.Hash
+	inHeader := false
+	// Where the last line started if it was blank, -1 otherwise
+	blank := int64(-1)
+
+	finish := func(end int64) {
+		if current == nil {
+			return
+		}
+		current.End = end
+		if current.Text == 0 {
+			// No body
+			current.Text = end
+		}
+		current.Size = current.End - current.Start - int64(current.Escapes)
+		current.Checksum = hex.EncodeToString(sum.Sum(nil))
+		entries = append(entries, current)
+	}
+
+	pos := offset
+	for {
+		line, err := buf.ReadBytes('\n')
+		if len(line) == 0 {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		start := pos
+		pos += int64(len(line))
+		if bytes.HasPrefix(line, []byte("From ")) && (current == nil || blank >= 0) {
+			end := start
+			if blank >= 0 {
+				end = blank
+			}
+			finish(end)
+			current = &mboxEntry{
+				Offset: start,
+				Start:  pos,
+				Date:   fromLineDate(line),
+				Recent: true,
+			}
+			sum = sha256.New()
+			sum.Write(line)
+			inHeader = true
+			blank = -1
+			continue
+		}
+
+		if current == nil {
+			// Garbage before the first message
+			continue
+		}
+		if isBlank(line) {
+			blank = start
+			if inHeader {
+				sum.Write(line)
+				current.Text = pos
+				inHeader = false
+			}
+			continue
+		}
+		blank = -1
+
+		if inHeader {
+			sum.Write(line)
+			if i := bytes.IndexByte(line, ':'); i > 0 {
+				headerFlags(string(line[:i]), strings.TrimSpace(string(line[i+1:])), current)
+			}
+			continue
+		}
+		if format.isEscaped(line) {
+			current.Escapes++
+		}
+	}
+
+	end := pos
+	if blank >= 0 {
+		end = blank
+	}
+	finish(end)
+	return entries, nil
+}
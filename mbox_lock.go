@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package unpeu
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockMboxFile takes an fcntl lock on the whole mbox, as mutt, procmail
+// and the like do along with the dotlock
+func lockMboxFile(f *os.File, exclusive bool) error {
+	lock := syscall.Flock_t{Type: syscall.F_RDLCK}
+	if exclusive {
+		lock.Type = syscall.F_WRLCK
+	}
+	for {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &lock)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// unlockMboxFile releases the lock taken by lockMboxFile
+func unlockMboxFile(f *os.File) error {
+	lock := syscall.Flock_t{Type: syscall.F_UNLCK}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+}
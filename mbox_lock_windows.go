@@ -0,0 +1,9 @@
+package unpeu
+
+import "os"
+
+// There are no fcntl locks on Windows; the dotlock is the only lock
+
+func lockMboxFile(f *os.File, exclusive bool) error { return nil }
+
+func unlockMboxFile(f *os.File) error { return nil }
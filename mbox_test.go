@@ -0,0 +1,213 @@
+package unpeu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMbox = "From alice@example.com Mon Mar  2 12:00:00 2015\n" +
+	"From: alice@example.com\n" +
+	"Subject: Lunch\n" +
+	"Status: RO\n" +
+	"X-Status: F\n" +
+	"\n" +
+	"Noon?\n" +
+	">From the cafeteria, of course.\n" +
+	"\n" +
+	"From bob@example.com Tue Mar  3 08:30:00 2015\n" +
+	"From: bob@example.com\n" +
+	"Subject: Report\n" +
+	"\n" +
+	"Attached.\n" +
+	"\n"
+
+// setupMbox creates an INBOX with testMbox and an empty lists/golang
+func setupMbox(t *testing.T) string {
+	root, err := ioutil.TempDir("", "unpeu-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "INBOX"), []byte(testMbox), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(root, "lists"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "lists", "golang"), nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func mboxFetch(t *testing.T, ms *MboxMailstore, sequenceSet string, args ...fetchArgument) []string {
+	fetched, err := ms.Fetch("INBOX", sequenceSet, args, true)
+	if err != nil {
+		t.Fatal("Couldn't fetch:", err)
+	}
+	items := make([]string, 0)
+	for _, response := range fetched {
+		for _, item := range response.items {
+			items = append(items, item.key+" "+item.value)
+		}
+	}
+	return items
+}
+
+func TestMboxMailstore(t *testing.T) {
+	root := setupMbox(t)
+	defer os.RemoveAll(root)
+	ms := NewMboxMailstore(root, Mboxrd)
+
+	mailboxes, err := ms.GetMailboxes([]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, mbox := range mailboxes {
+		names = append(names, fmt.Sprintf("%s %s %d", mbox.Name, mbox.Id, mbox.Flags))
+	}
+	expectedNames := []string{"INBOX INBOX 0", fmt.Sprintf("lists lists %d", Noselect)}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("Invalid mailboxes: got %v, expected %v", names, expectedNames)
+	}
+	inbox, err := ms.GetMailbox([]string{"INBOX"})
+	if err != nil || inbox == nil || inbox.UidValidity == 0 {
+		t.Fatalf("Invalid INBOX: %v (%v)", inbox, err)
+	}
+
+	items := mboxFetch(t, ms, "1:*", fetchArgument{text: "FLAGS"}, fetchArgument{text: "RFC822.SIZE"}, fetchArgument{text: "INTERNALDATE"})
+	expected := []string{
+		"FLAGS (\\Seen \\Flagged)",
+		`INTERNALDATE "02-Mar-2015 12:00:00 +0000"`,
+		"RFC822.SIZE 100",
+		"FLAGS (\\Recent)",
+		`INTERNALDATE "03-Mar-2015 08:30:00 +0000"`,
+		"RFC822.SIZE 49",
+	}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("Invalid items: got %q, expected %q", items, expected)
+	}
+
+	// Escaped lines are unescaped; other ranges are read in place
+	items = mboxFetch(t, ms, "1", fetchArgument{text: "BODY.PEEK", section: "TEXT", offset: -1})
+	if len(items) != 1 || !strings.HasSuffix(items[0], "\nFrom the cafeteria, of course.\n") {
+		t.Errorf("Invalid BODY[TEXT]: %q", items)
+	}
+	items = mboxFetch(t, ms, "2", fetchArgument{text: "BODY.PEEK", section: "TEXT", offset: 0, length: 6}, fetchArgument{text: "BODY.PEEK", section: "HEADER", offset: -1})
+	expected = []string{
+		"BODY[TEXT]<0.6> {6}\r\nAttach",
+		"BODY[HEADER] {39}\r\nFrom: bob@example.com\nSubject: Report\n\n",
+	}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("Invalid ranges: got %q, expected %q", items, expected)
+	}
+
+	args, _ := aggregateSearchArguments([]byte("FLAGGED"))
+	found, err := ms.Search("INBOX", args, true, false)
+	if err != nil || len(found) != 1 || found[0].id != 1 {
+		t.Errorf("Invalid search: %v (%v)", found, err)
+	}
+
+	date := time.Date(2015, 3, 4, 10, 0, 0, 0, time.UTC)
+	err = ms.AppendMessage("INBOX", []string{"\\Seen", "work"}, date, "From: carol@example.com\r\n\r\nFrom now on, it's CRLF.\r\n")
+	if err != nil {
+		t.Fatal("Couldn't append:", err)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(root, "INBOX"))
+	if !strings.HasSuffix(string(content), "\n\nFrom MAILER-DAEMON Wed Mar  4 10:00:00 2015\nFrom: carol@example.com\r\n\r\n>From now on, it's CRLF.\r\n\n") {
+		t.Errorf("Invalid appended message: %q", content)
+	}
+	flagged, err := ms.Flag(ADD, "INBOX", "3", true, []string{"\\Flagged"})
+	if err != nil || len(flagged) != 1 || flagged[0].items[0].value != "(\\Seen work \\Flagged \\Recent)" {
+		t.Errorf("Invalid STORE: %v (%v)", flagged, err)
+	}
+
+	// A new instance reuses the index, and the messages aren't recent
+	// anymore
+	ms = NewMboxMailstore(root, Mboxrd)
+	reopened, _ := ms.GetMailbox([]string{"INBOX"})
+	if reopened.UidValidity != inbox.UidValidity {
+		t.Errorf("UIDVALIDITY changed from %d to %d", inbox.UidValidity, reopened.UidValidity)
+	}
+	items = mboxFetch(t, ms, "3", fetchArgument{text: "FLAGS"}, fetchArgument{text: "RFC822.TEXT"})
+	expected = []string{"FLAGS (\\Seen work \\Flagged)", "RFC822.TEXT {25}\r\nFrom now on, it's CRLF.\r\n"}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("Invalid items: got %q, expected %q", items, expected)
+	}
+
+	// Rewriting the mbox invalidates the UIDs
+	err = ioutil.WriteFile(filepath.Join(root, "INBOX"), content[strings.Index(string(content), "From bob"):], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten, _ := ms.GetMailbox([]string{"INBOX"})
+	if rewritten.UidValidity == inbox.UidValidity {
+		t.Error("UIDVALIDITY didn't change after a rewrite")
+	}
+	if total, _ := ms.TotalMessages("INBOX"); total != 2 {
+		t.Errorf("Invalid total after rewrite: %d", total)
+	}
+}
+
+// TestMboxReplacedTail tests that replacing the last message with a
+// longer one isn't taken for an append
+func TestMboxReplacedTail(t *testing.T) {
+	root := setupMbox(t)
+	defer os.RemoveAll(root)
+	ms := NewMboxMailstore(root, Mboxrd)
+	inbox, _ := ms.GetMailbox([]string{"INBOX"})
+
+	// Growing the last message keeps the UIDs
+	path := filepath.Join(root, "INBOX")
+	grown := testMbox + "More attachments.\n\n"
+	if err := ioutil.WriteFile(path, []byte(grown), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if mbox, _ := ms.GetMailbox([]string{"INBOX"}); mbox.UidValidity != inbox.UidValidity {
+		t.Error("UIDVALIDITY changed after the last message grew")
+	}
+
+	// Another message where the last one was doesn't
+	replaced := testMbox[:strings.Index(testMbox, "From bob")] +
+		"From carol@example.com Wed Mar  4 10:00:00 2015\n" +
+		"From: carol@example.com\n" +
+		"Subject: Something else entirely\n" +
+		"\n" +
+		"Nothing to do with the report.\n" +
+		"\n"
+	if err := ioutil.WriteFile(path, []byte(replaced), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if mbox, _ := ms.GetMailbox([]string{"INBOX"}); mbox.UidValidity == inbox.UidValidity {
+		t.Error("UIDVALIDITY didn't change after the last message was replaced")
+	}
+	items := mboxFetch(t, ms, "1:*", fetchArgument{text: "UID"}, fetchArgument{text: "ENVELOPE"})
+	if len(items) != 4 || !strings.Contains(items[3], "Something else entirely") {
+		t.Errorf("Invalid messages after replacement: %q", items)
+	}
+}
+
+func TestMboxEscaping(t *testing.T) {
+	message := "From the start\n>From quoted\n>>From twice\nFrom: header-like\n"
+	vectors := []struct {
+		format  mboxFormat
+		escaped string
+	}{
+		{Mboxo, ">From the start\n>From quoted\n>>From twice\nFrom: header-like\n"},
+		{Mboxrd, ">From the start\n>>From quoted\n>>>From twice\nFrom: header-like\n"},
+	}
+	for _, v := range vectors {
+		if escaped := v.format.escape(message); escaped != v.escaped {
+			t.Errorf("Invalid escaping for %d: %q", v.format, escaped)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package unpeu
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A mailstore that lives in memory, for tests and for applications that
+// embed the server. Mailboxes are a tree of tags, as for the other
+// mailstores: "inbox" or "lists/golang", and their Ids are the same names
+// with the INBOX in upper case.
+
+var _ Mailstore = &MemoryMailstore{}
+
+// MemoryMailstore keeps mailboxes and messages in memory. The zero value
+// is an empty mailstore with an INBOX.
+type MemoryMailstore struct {
+	expungeHandlers
+
+	l         sync.Mutex
+	mailboxes map[string]*memoryMailbox
+}
+
+type memoryMailbox struct {
+	uidValidity uint32
+	uidNext     int
+	messages    []*memoryMessage
+}
+
+// NewMemoryMailstore returns an empty mailstore with an INBOX
+func NewMemoryMailstore() *MemoryMailstore {
+	return &MemoryMailstore{}
+}
+
+// init creates the INBOX on first use. The lock must be held.
+func (ms *MemoryMailstore) init() {
+	if ms.mailboxes == nil {
+		ms.mailboxes = map[string]*memoryMailbox{
+			"inbox": {uidValidity: uint32(time.Now().Unix()), uidNext: 1},
+		}
+	}
+}
+
+// memoryName returns the name of the mailbox in the tree
+func memoryName(mbox Id) string {
+	if strings.EqualFold(string(mbox), "INBOX") {
+		return "inbox"
+	}
+	return string(mbox)
+}
+
+// memoryId returns the Id of the mailbox with the given name
+func memoryId(name string) Id {
+	if name == "inbox" {
+		return "INBOX"
+	}
+	return Id(name)
+}
+
+// CreateMailbox creates a mailbox at the given path
+func (ms *MemoryMailstore) CreateMailbox(path []string) error {
+	name := mailboxTag(path)
+	for _, level := range strings.Split(name, tagDelimiter) {
+		if level == "" {
+			return fmt.Errorf("Invalid mailbox name %q", name)
+		}
+	}
+
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	ms.init()
+	if _, ok := ms.mailboxes[name]; ok {
+		return fmt.Errorf("Mailbox %s already exists", strings.Join(path, string(pathDelimiter)))
+	}
+	ms.mailboxes[name] = &memoryMailbox{uidValidity: uint32(time.Now().Unix()), uidNext: 1}
+	return nil
+}
+
+// SeedFiles appends the RFC 5322 messages in the given files to the
+// mailbox, which is created if needed. Their internal date is the date of
+// their Date header, or the modification time of the file.
+func (ms *MemoryMailstore) SeedFiles(mailbox string, paths ...string) error {
+	path := pathToSlice(mailbox)
+	if mbox, _ := ms.GetMailbox(path); mbox == nil {
+		if err := ms.CreateMailbox(path); err != nil {
+			return err
+		}
+	}
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		msg := &memoryMessage{content: content}
+		date, err := sentDate(msg)
+		if err != nil || date.IsZero() {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			date = info.ModTime()
+		}
+		err = ms.AppendMessage(mailbox, nil, date, string(content))
+		if err != nil {
+			return fmt.Errorf("Couldn't seed %s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// mailboxNames returns the names of all the mailboxes. The lock must be
+// held.
+func (ms *MemoryMailstore) mailboxNames() map[string]struct{} {
+	ms.init()
+	names := make(map[string]struct{}, len(ms.mailboxes))
+	for name := range ms.mailboxes {
+		names[name] = struct{}{}
+	}
+	return names
+}
+
+// mailbox returns the mailbox with the given Id. The lock must be held.
+func (ms *MemoryMailstore) mailbox(mbox Id) (*memoryMailbox, error) {
+	ms.init()
+	m, ok := ms.mailboxes[memoryName(mbox)]
+	if !ok {
+		return nil, fmt.Errorf("No mailbox %s", mbox)
+	}
+	return m, nil
+}
+
+func (ms *MemoryMailstore) GetMailbox(path []string) (*Mailbox, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	mbox := lookupTagMailbox(ms.mailboxNames(), path)
+	if mbox == nil || mbox.Flags&Noselect != 0 {
+		return mbox, nil
+	}
+	mbox.Id = memoryId(string(mbox.Id))
+	mbox.UidValidity = ms.mailboxes[memoryName(mbox.Id)].uidValidity
+	return mbox, nil
+}
+
+func (ms *MemoryMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	mailboxes := tagMailboxChildren(ms.mailboxNames(), path)
+	for _, mbox := range mailboxes {
+		mbox.Id = memoryId(string(mbox.Id))
+	}
+	return mailboxes, nil
+}
+
+func (ms *MemoryMailstore) FirstUnseen(mbox Id) (int64, error) {
+	messages, err := ms.messages(mbox)
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range messages {
+		if !hasFlag(msg, "\\Seen") {
+			return int64(msg.seq), nil
+		}
+	}
+	return 0, nil
+}
+
+func (ms *MemoryMailstore) TotalMessages(mbox Id) (int64, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	m, err := ms.mailbox(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(m.messages)), nil
+}
+
+func (ms *MemoryMailstore) RecentMessages(mbox Id) (int64, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	m, err := ms.mailbox(mbox)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, msg := range m.messages {
+		if msg.recent {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ClearRecent forgets that the messages of the mailbox are recent, once a
+// session was told about them
+func (ms *MemoryMailstore) ClearRecent(mbox Id) error {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	m, err := ms.mailbox(mbox)
+	if err != nil {
+		return err
+	}
+	for _, msg := range m.messages {
+		msg.recent = false
+	}
+	return nil
+}
+
+func (ms *MemoryMailstore) NextUid(mbox Id) (int64, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	m, err := ms.mailbox(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int64(m.uidNext), nil
+}
+
+func (ms *MemoryMailstore) CountUnseen(mbox Id) (int64, error) {
+	messages, err := ms.messages(mbox)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, msg := range messages {
+		if !hasFlag(msg, "\\Seen") {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *MemoryMailstore) AppendMessage(mailbox string, flags []string, dateTime time.Time, message string) error {
+	if dateTime.IsZero() {
+		dateTime = time.Now()
+	}
+	stored := updatedFlags(SET, nil, flags)
+
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	mbox := lookupTagMailbox(ms.mailboxNames(), pathToSlice(mailbox))
+	if mbox == nil || mbox.Flags&Noselect != 0 {
+		return fmt.Errorf("No mailbox %s", mailbox)
+	}
+	m := ms.mailboxes[string(mbox.Id)]
+	m.messages = append(m.messages, &memoryMessage{
+		uid:     m.uidNext,
+		date:    dateTime,
+		flags:   stored,
+		recent:  true,
+		content: []byte(message),
+	})
+	m.uidNext++
+	return nil
+}
+
+// Expunge removes the messages flagged \Deleted from the mailbox. It
+// returns their sequence ids, highest first, so that each one is still
+// valid when the previous ones are reported in EXPUNGE responses.
+func (ms *MemoryMailstore) Expunge(mbox Id) ([]int, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	m, err := ms.mailbox(mbox)
+	if err != nil {
+		return nil, err
+	}
+
+	var expunged, uids []int
+	kept := make([]*memoryMessage, 0, len(m.messages))
+	for i, msg := range m.messages {
+		if hasFlag(msg, "\\Deleted") {
+			expunged = append([]int{i + 1}, expunged...)
+			uids = append(uids, msg.uid)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	m.messages = kept
+	ms.expunged(mbox, uids)
+	return expunged, nil
+}
+
+func (ms *MemoryMailstore) Search(mbox Id, args []searchArgument, returnUid, returnThreads bool) ([]threadMember, error) {
+	if returnThreads {
+		return nil, fmt.Errorf("THREAD is not supported by the memory mailstore")
+	}
+	messages, err := ms.messages(mbox)
+	if err != nil {
+		return nil, err
+	}
+	message := func(i int) searchableMessage { return messages[i] }
+	return matchMessages(len(messages), message, args, returnUid)
+}
+
+func (ms *MemoryMailstore) Fetch(mbox Id, sequenceSet string, args []fetchArgument, useUids bool) ([]messageFetchResponse, error) {
+	messages, err := ms.messages(mbox)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selectMemoryMessages(messages, sequenceSet, useUids)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]messageFetchResponse, 0, len(selected))
+	for _, i := range selected {
+		msg := messages[i]
+		items, err := fetchMessage(msg, args)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't fetch message %d: %s", msg.uid, err)
+		}
+		results = append(results, messageFetchResponse{id: strconv.Itoa(msg.seq), items: items})
+	}
+	return results, nil
+}
+
+func (ms *MemoryMailstore) Flag(mode flagMode, mbox Id, sequenceSet string, useUids bool, flags []string) ([]messageFetchResponse, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	m, err := ms.mailbox(mbox)
+	if err != nil {
+		return nil, err
+	}
+	messages := m.snapshot()
+	selected, err := selectMemoryMessages(messages, sequenceSet, useUids)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]messageFetchResponse, 0, len(selected))
+	for _, i := range selected {
+		msg := messages[i]
+		msg.flags = updatedFlags(mode, msg.flags, flags)
+		m.messages[i].flags = msg.flags
+		results = append(results, flagsResponse(msg.seq, msg.Flags()))
+	}
+	return results, nil
+}
+
+// messages returns a snapshot of the messages of the mailbox, in UID
+// order
+func (ms *MemoryMailstore) messages(mbox Id) ([]*memoryMessage, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	m, err := ms.mailbox(mbox)
+	if err != nil {
+		return nil, err
+	}
+	return m.snapshot(), nil
+}
+
+// snapshot returns copies of the messages, numbered. Flags are always
+// replaced, never modified in place, and contents never change, so
+// shallow copies are enough. The lock must be held.
+func (m *memoryMailbox) snapshot() []*memoryMessage {
+	messages := make([]*memoryMessage, len(m.messages))
+	for i, msg := range m.messages {
+		copied := *msg
+		copied.seq = i + 1
+		messages[i] = &copied
+	}
+	return messages
+}
+
+// selectMemoryMessages returns the indexes of the messages of the
+// sequence set
+func selectMemoryMessages(messages []*memoryMessage, sequenceSet string, useUids bool) ([]int, error) {
+	uid := func(i int) int { return messages[i].uid }
+	return selectIndexes(len(messages), uid, sequenceSet, useUids)
+}
+
+// memoryMessage is a message in memory, as a searchableMessage and a
+// fetchableMessage
+type memoryMessage struct {
+	uid     int
+	seq     int
+	date    time.Time
+	flags   []string
+	recent  bool
+	content []byte
+}
+
+func (msg *memoryMessage) Flags() []string {
+	flags := append([]string{}, msg.flags...)
+	if msg.recent {
+		flags = append(flags, "\\Recent")
+	}
+	return flags
+}
+
+func (msg *memoryMessage) InternalDate() time.Time { return msg.date }
+
+func (msg *memoryMessage) Size() (int64, error) { return int64(len(msg.content)), nil }
+
+func (msg *memoryMessage) Raw() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(msg.content)), nil
+}
+
+func (msg *memoryMessage) Header() (mail.Header, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg.content))
+	if err != nil {
+		return nil, err
+	}
+	return m.Header, nil
+}
+
+func (msg *memoryMessage) Body() (io.ReadCloser, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg.content))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(m.Body), nil
+}
+
+func (msg *memoryMessage) Uid() int        { return msg.uid }
+func (msg *memoryMessage) SequenceId() int { return msg.seq }
@@ -0,0 +1,84 @@
+package unpeu
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func memorySearch(t *testing.T, ms *MemoryMailstore, mbox Id, query string) []int {
+	args, err := aggregateSearchArguments([]byte(query))
+	if err != nil {
+		t.Fatalf("Invalid search %q: %s", query, err)
+	}
+	members, err := ms.Search(mbox, args, true, false)
+	if err != nil {
+		t.Fatalf("Couldn't search %q: %s", query, err)
+	}
+	uids := make([]int, 0, len(members))
+	for _, member := range members {
+		uids = append(uids, member.id)
+	}
+	return uids
+}
+
+func TestMemoryMailstore(t *testing.T) {
+	ms := NewMemoryMailstore()
+	files, err := filepath.Glob(filepath.Join("testdata", "maildir", "cur", "*"))
+	if err != nil || len(files) != 5 {
+		t.Fatalf("Invalid fixtures: %v (%v)", files, err)
+	}
+	if err := ms.SeedFiles("Archive/2012", files...); err != nil {
+		t.Fatal("Couldn't seed:", err)
+	}
+
+	mailboxes, _ := ms.GetMailboxes([]string{})
+	names := make([]string, 0)
+	for _, mbox := range mailboxes {
+		names = append(names, mbox.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"Archive", "INBOX"}) {
+		t.Errorf("Invalid mailboxes: %v", names)
+	}
+	mbox, _ := ms.GetMailbox([]string{"Archive", "2012"})
+	if mbox == nil || mbox.Id != "Archive/2012" {
+		t.Fatalf("Invalid Archive/2012: %+v", mbox)
+	}
+	if total, _ := ms.TotalMessages(mbox.Id); total != 5 {
+		t.Errorf("Invalid total: %d", total)
+	}
+
+	if uids := memorySearch(t, ms, mbox.Id, `SUBJECT "hello world" SINCE 21-Jan-2012`); !reflect.DeepEqual(uids, []int{2}) {
+		t.Errorf("Invalid search: %v", uids)
+	}
+
+	// Reading a body doesn't set \Seen: the server does
+	fetched, err := ms.Fetch(mbox.Id, "1", []fetchArgument{{text: "RFC822.TEXT"}}, false)
+	if err != nil || len(fetched) != 1 {
+		t.Fatalf("Couldn't fetch: %v (%v)", fetched, err)
+	}
+	expected := []fetchItem{
+		{key: "RFC822.TEXT", value: "{14}\r\nHow are you ?\n"},
+	}
+	if !reflect.DeepEqual(fetched[0].items, expected) {
+		t.Errorf("Invalid fetch: %q", fetched[0].items)
+	}
+	if first, _ := ms.FirstUnseen(mbox.Id); first != 1 {
+		t.Errorf("Invalid first unseen: %d", first)
+	}
+
+	_, err = ms.Flag(ADD, mbox.Id, "2,4", false, []string{"\\Deleted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expunged, err := ms.Expunge(mbox.Id)
+	if err != nil || !reflect.DeepEqual(expunged, []int{4, 2}) {
+		t.Errorf("Invalid expunge: %v (%v)", expunged, err)
+	}
+	if uids := memorySearch(t, ms, mbox.Id, "ALL"); !reflect.DeepEqual(uids, []int{1, 3, 5}) {
+		t.Errorf("Invalid messages after expunge: %v", uids)
+	}
+	if next, _ := ms.NextUid(mbox.Id); next != 6 {
+		t.Errorf("Invalid next UID: %d", next)
+	}
+}
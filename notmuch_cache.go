@@ -0,0 +1,153 @@
+package unpeu
+
+import (
+	"fmt"
+)
+
+// Every change to a notmuch database, be it a new message or a tag
+// change, bumps its revision; the revision of the last change of each
+// message is available through the lastmod: prefix. Caches are thus
+// refreshed by only looking at the messages that changed since the last
+// known revision.
+//
+// Messages removed from the database don't show up in lastmod: queries.
+// They are detected by comparing counts, and the affected entries are
+// rebuilt from scratch.
+
+// cachedThreads is the result of a threads query, along with the number
+// of messages that matched it
+type cachedThreads struct {
+	threads []Message
+	matches int
+}
+
+// checkChanges makes the caches consistent with the current revision of
+// the database
+func (nm *NotmuchMailstore) checkChanges() error {
+	uuid, lastmod, err := nm.transport.revision()
+	if err != nil {
+		return err
+	}
+
+	nm.cache.Lock()
+	defer nm.cache.Unlock()
+
+	switch {
+	case uuid != nm.uuid:
+		// First use, or a different database altogether
+		nm.threadsCache = nil
+		nm.uidsCache = nil
+	case lastmod != nm.lastmod:
+		nm.refresh(fmt.Sprintf("lastmod:%d..%d", nm.lastmod+1, lastmod))
+	}
+	nm.uuid = uuid
+	nm.lastmod = lastmod
+	return nil
+}
+
+// refresh updates the caches with the messages matching the lastmod query.
+// Entries that can't be refreshed are dropped, to be rebuilt on next use.
+// The cache lock must be held.
+func (nm *NotmuchMailstore) refresh(lastmodQuery string) {
+	changed, err := nm.transport.messageIds(lastmodQuery, 0)
+	if err != nil {
+		nm.threadsCache = nil
+		nm.uidsCache = nil
+		return
+	}
+	changedSet := make(map[string]struct{}, len(changed))
+	for _, mid := range changed {
+		changedSet[mid] = struct{}{}
+	}
+
+	for query, cached := range nm.threadsCache {
+		if !nm.threadsUnchanged(query, cached, lastmodQuery, changedSet) {
+			delete(nm.threadsCache, query)
+		}
+	}
+
+	for mbox, u := range nm.uidsCache {
+		refreshed, err := nm.refreshUids(mbox, u, lastmodQuery, changedSet)
+		if err != nil {
+			delete(nm.uidsCache, mbox)
+			continue
+		}
+		nm.uidsCache[mbox] = refreshed
+	}
+}
+
+// threadsUnchanged returns true if the cached threads are still valid:
+// none of the messages they hold changed, no changed message matches the
+// query, and no message was removed
+func (nm *NotmuchMailstore) threadsUnchanged(query string, cached cachedThreads, lastmodQuery string, changed map[string]struct{}) bool {
+	for _, msg := range flatten(cached.threads) {
+		if _, ok := changed[msg.Id]; ok {
+			return false
+		}
+	}
+
+	changedMatches, err := nm.transport.messageIds(lastmodQuery+" and ("+query+")", 1)
+	if err != nil || len(changedMatches) > 0 {
+		return false
+	}
+
+	count, err := nm.transport.count(query)
+	return err == nil && count == cached.matches
+}
+
+// refreshUids brings the UID mapping of the mailbox up to date with the
+// changed messages, without listing the whole mailbox again
+func (nm *NotmuchMailstore) refreshUids(mbox Id, u *mailboxUids, lastmodQuery string, changed map[string]struct{}) (*mailboxUids, error) {
+	query, err := nm.cachedMailboxQuery(mbox)
+	if err != nil {
+		return nil, err
+	}
+	inMailbox, err := nm.transport.messageIds(lastmodQuery+" and "+query, 0)
+	if err != nil {
+		return nil, err
+	}
+	current := mergeChanges(u.mids, changed, inMailbox)
+
+	count, err := nm.transport.count(query)
+	if err != nil {
+		return nil, err
+	}
+	if count != len(current) {
+		return nil, fmt.Errorf("Messages were removed from %s", mbox)
+	}
+
+	db, err := nm.uidDB()
+	if err != nil {
+		return nil, err
+	}
+	return syncUids(db, mbox, current)
+}
+
+// mergeChanges returns the new content of a mailbox: the previous content
+// minus the changed messages that left it, followed by the changed
+// messages that weren't in it before. changedInMailbox are the changed
+// messages that are now in the mailbox.
+func mergeChanges(previous []string, changed map[string]struct{}, changedInMailbox []string) []string {
+	stillIn := make(map[string]struct{}, len(changedInMailbox))
+	for _, mid := range changedInMailbox {
+		stillIn[mid] = struct{}{}
+	}
+
+	current := make([]string, 0, len(previous)+len(changedInMailbox))
+	known := make(map[string]struct{}, len(previous))
+	for _, mid := range previous {
+		known[mid] = struct{}{}
+		if _, ok := changed[mid]; ok {
+			if _, ok := stillIn[mid]; !ok {
+				continue
+			}
+		}
+		current = append(current, mid)
+	}
+	for _, mid := range changedInMailbox {
+		if _, ok := known[mid]; !ok {
+			current = append(current, mid)
+		}
+	}
+	return current
+}
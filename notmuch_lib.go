@@ -0,0 +1,608 @@
+//go:build libnotmuch
+// +build libnotmuch
+
+package unpeu
+
+// #cgo LDFLAGS: -lnotmuch
+// #include <stdlib.h>
+// #include <notmuch.h>
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// Building with the libnotmuch tag makes libnotmuch the default transport.
+// The CLI is still used if the database can't be opened.
+func init() {
+	notmuchTransports["libnotmuch"] = newLibTransport
+	defaultNotmuchTransport = "libnotmuch"
+}
+
+// libTransport talks to libnotmuch directly. A handle can't be used by
+// two goroutines at once, so each read takes one of the read-only handles
+// kept open for the life of the transport, and opens a new one if they
+// are all in use. Handles are reopened before being used if the database
+// changed since they last were: that is noticed when the revision is
+// read, and after each write.
+//
+// Writes open their own read-write handle, for as short a time as
+// possible, so that notmuch new and others can still run.
+type libTransport struct {
+	opts NotmuchOptions
+
+	// Reads share the lock, writes take it alone
+	l sync.RWMutex
+
+	// The handles not in use, and how many times the database was seen
+	// changing. Protected by the pool lock.
+	pool       sync.Mutex
+	handles    []*libHandle
+	generation uint64
+	lastmod    uint64
+}
+
+// libHandle is a read-only handle, along with the generation of the
+// transport it was last reopened at
+type libHandle struct {
+	db         *C.notmuch_database_t
+	generation uint64
+}
+
+func newLibTransport(opts NotmuchOptions) (notmuchTransport, error) {
+	db, err := openNotmuchDatabase(C.NOTMUCH_DATABASE_MODE_READ_ONLY, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &libTransport{
+		opts:    opts,
+		handles: []*libHandle{{db: db}},
+	}, nil
+}
+
+// openNotmuchDatabase opens the database the same way the CLI does, with
+// the configuration and database of the options. Empty ones are found
+// from NOTMUCH_CONFIG and NOTMUCH_DATABASE, or at their default location.
+func openNotmuchDatabase(mode C.notmuch_database_mode_t, opts NotmuchOptions) (*C.notmuch_database_t, error) {
+	var config, database *C.char
+	if opts.ConfigPath != "" {
+		config = C.CString(opts.ConfigPath)
+		defer C.free(unsafe.Pointer(config))
+	}
+	if opts.DatabasePath != "" {
+		database = C.CString(opts.DatabasePath)
+		defer C.free(unsafe.Pointer(database))
+	}
+	var db *C.notmuch_database_t
+	var msg *C.char
+	st := C.notmuch_database_open_with_config(database, mode, config, nil, &db, &msg)
+	if msg != nil {
+		defer C.free(unsafe.Pointer(msg))
+	}
+	if st != C.NOTMUCH_STATUS_SUCCESS {
+		if msg != nil {
+			return nil, fmt.Errorf("Couldn't open notmuch database: %s", strings.TrimSpace(C.GoString(msg)))
+		}
+		return nil, notmuchError(st)
+	}
+	return db, nil
+}
+
+func notmuchError(st C.notmuch_status_t) error {
+	return fmt.Errorf("notmuch: %s", C.GoString(C.notmuch_status_to_string(st)))
+}
+
+// reopen makes a read-only handle see the latest changes
+func reopen(db *C.notmuch_database_t) error {
+	st := C.notmuch_database_reopen(db, C.NOTMUCH_DATABASE_MODE_READ_ONLY)
+	if st != C.NOTMUCH_STATUS_SUCCESS {
+		return notmuchError(st)
+	}
+	return nil
+}
+
+// read runs fn with a read-only handle. fn is run again with a reopened
+// handle if it fails, the usual cause being a handle too old to read what
+// was modified since, so it must not keep anything from a failed run.
+func (t *libTransport) read(fn func(db *C.notmuch_database_t) error) error {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	h, err := t.take()
+	if err != nil {
+		return err
+	}
+	defer t.release(h)
+
+	err = fn(h.db)
+	if err != nil && reopen(h.db) == nil {
+		err = fn(h.db)
+	}
+	return err
+}
+
+// take returns a handle up to date with the last known changes, for the
+// caller alone until it is released
+func (t *libTransport) take() (*libHandle, error) {
+	t.pool.Lock()
+	generation := t.generation
+	var h *libHandle
+	if n := len(t.handles); n > 0 {
+		h = t.handles[n-1]
+		t.handles = t.handles[:n-1]
+	}
+	t.pool.Unlock()
+
+	if h == nil {
+		db, err := openNotmuchDatabase(C.NOTMUCH_DATABASE_MODE_READ_ONLY, t.opts)
+		if err != nil {
+			return nil, err
+		}
+		return &libHandle{db: db, generation: generation}, nil
+	}
+	if h.generation != generation {
+		err := reopen(h.db)
+		if err != nil {
+			C.notmuch_database_destroy(h.db)
+			return nil, err
+		}
+		h.generation = generation
+	}
+	return h, nil
+}
+
+func (t *libTransport) release(h *libHandle) {
+	t.pool.Lock()
+	t.handles = append(t.handles, h)
+	t.pool.Unlock()
+}
+
+// write runs fn with a read-write handle, alone, and commits its changes
+func (t *libTransport) write(fn func(db *C.notmuch_database_t) error) error {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	db, err := openNotmuchDatabase(C.NOTMUCH_DATABASE_MODE_READ_WRITE, t.opts)
+	if err != nil {
+		return err
+	}
+	err = fn(db)
+
+	// Destroying the handle commits the changes
+	st := C.notmuch_database_destroy(db)
+	if err == nil && st != C.NOTMUCH_STATUS_SUCCESS {
+		err = notmuchError(st)
+	}
+
+	t.pool.Lock()
+	t.generation++
+	t.pool.Unlock()
+	return err
+}
+
+func (t *libTransport) revision() (uuid string, lastmod uint64, err error) {
+	err = t.read(func(db *C.notmuch_database_t) error {
+		// This is how changes made by others are noticed, make sure this
+		// handle sees them
+		err := reopen(db)
+		if err != nil {
+			return err
+		}
+		var cUuid *C.char
+		lastmod = uint64(C.notmuch_database_get_revision(db, &cUuid))
+		uuid = C.GoString(cUuid)
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	t.pool.Lock()
+	if lastmod != t.lastmod {
+		t.lastmod = lastmod
+		t.generation++
+	}
+	t.pool.Unlock()
+	return uuid, lastmod, nil
+}
+
+// newQuery creates a query, excluding the tags of search.exclude_tags like
+// the CLI does. The query must be destroyed.
+func newQuery(db *C.notmuch_database_t, q string, order C.notmuch_sort_t) (*C.notmuch_query_t, error) {
+	if q == "" {
+		q = "*"
+	}
+	cq := C.CString(q)
+	defer C.free(unsafe.Pointer(cq))
+	query := C.notmuch_query_create(db, cq)
+	if query == nil {
+		return nil, fmt.Errorf("Couldn't create query %q", q)
+	}
+	C.notmuch_query_set_sort(query, order)
+
+	excludes := C.notmuch_config_get_values(db, C.NOTMUCH_CONFIG_EXCLUDE_TAGS)
+	if excludes != nil {
+		for ; C.notmuch_config_values_valid(excludes) != 0; C.notmuch_config_values_move_to_next(excludes) {
+			C.notmuch_query_add_tag_exclude(query, C.notmuch_config_values_get(excludes))
+		}
+		C.notmuch_config_values_destroy(excludes)
+	}
+	C.notmuch_query_set_omit_excluded(query, C.NOTMUCH_EXCLUDE_TRUE)
+	return query, nil
+}
+
+// searchMessages calls fn on each message matching the query, in order,
+// until it returns an error. errLimit stops the search without failing
+// it.
+func searchMessages(db *C.notmuch_database_t, q string, order C.notmuch_sort_t, fn func(*C.notmuch_message_t) error) error {
+	query, err := newQuery(db, q, order)
+	if err != nil {
+		return err
+	}
+	defer C.notmuch_query_destroy(query)
+
+	var messages *C.notmuch_messages_t
+	st := C.notmuch_query_search_messages(query, &messages)
+	if st != C.NOTMUCH_STATUS_SUCCESS {
+		return notmuchError(st)
+	}
+	for ; C.notmuch_messages_valid(messages) != 0; C.notmuch_messages_move_to_next(messages) {
+		// Messages belong to the query, but they are many: free them as
+		// soon as possible
+		message := C.notmuch_messages_get(messages)
+		err := fn(message)
+		C.notmuch_message_destroy(message)
+		if err == errLimit {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errLimit stops an iteration early
+var errLimit = fmt.Errorf("Limit reached")
+
+func (t *libTransport) count(q string) (count int, err error) {
+	err = t.read(func(db *C.notmuch_database_t) error {
+		query, err := newQuery(db, q, C.NOTMUCH_SORT_UNSORTED)
+		if err != nil {
+			return err
+		}
+		defer C.notmuch_query_destroy(query)
+
+		var n C.uint
+		st := C.notmuch_query_count_messages(query, &n)
+		if st != C.NOTMUCH_STATUS_SUCCESS {
+			return notmuchError(st)
+		}
+		count = int(n)
+		return nil
+	})
+	return count, err
+}
+
+func (t *libTransport) messageIds(q string, limit int) (mids []string, err error) {
+	err = t.read(func(db *C.notmuch_database_t) error {
+		mids = make([]string, 0)
+		return searchMessages(db, q, C.NOTMUCH_SORT_OLDEST_FIRST, func(message *C.notmuch_message_t) error {
+			mids = append(mids, C.GoString(C.notmuch_message_get_message_id(message)))
+			if len(mids) == limit {
+				return errLimit
+			}
+			return nil
+		})
+	})
+	return mids, err
+}
+
+func (t *libTransport) messages(q string) (messages []Message, err error) {
+	err = t.read(func(db *C.notmuch_database_t) error {
+		messages = nil
+		return searchMessages(db, q, C.NOTMUCH_SORT_OLDEST_FIRST, func(message *C.notmuch_message_t) error {
+			msg := libMessage(message)
+			msg.Match = true
+			messages = append(messages, msg)
+			return nil
+		})
+	})
+	return messages, err
+}
+
+func (t *libTransport) threads(q string) (threads [][]Message, err error) {
+	err = t.read(func(db *C.notmuch_database_t) error {
+		query, err := newQuery(db, q, C.NOTMUCH_SORT_OLDEST_FIRST)
+		if err != nil {
+			return err
+		}
+		defer C.notmuch_query_destroy(query)
+
+		var cThreads *C.notmuch_threads_t
+		st := C.notmuch_query_search_threads(query, &cThreads)
+		if st != C.NOTMUCH_STATUS_SUCCESS {
+			return notmuchError(st)
+		}
+		threads = make([][]Message, 0)
+		for ; C.notmuch_threads_valid(cThreads) != 0; C.notmuch_threads_move_to_next(cThreads) {
+			thread := C.notmuch_threads_get(cThreads)
+			topLevel, err := threadMessages(C.notmuch_thread_get_toplevel_messages(thread))
+			C.notmuch_thread_destroy(thread)
+			if err != nil {
+				return err
+			}
+			threads = append(threads, topLevel)
+		}
+		return nil
+	})
+	return threads, err
+}
+
+// threadMessages returns the messages of a thread along with their
+// replies. They belong to the thread, which frees them.
+func threadMessages(messages *C.notmuch_messages_t) ([]Message, error) {
+	out := make([]Message, 0)
+	for ; C.notmuch_messages_valid(messages) != 0; C.notmuch_messages_move_to_next(messages) {
+		message := C.notmuch_messages_get(messages)
+
+		var match C.notmuch_bool_t
+		st := C.notmuch_message_get_flag_st(message, C.NOTMUCH_MESSAGE_FLAG_MATCH, &match)
+		if st != C.NOTMUCH_STATUS_SUCCESS {
+			return nil, notmuchError(st)
+		}
+		msg := libMessage(message)
+		msg.Match = match != 0
+
+		var err error
+		msg.Children, err = threadMessages(C.notmuch_message_get_replies(message))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+// libMessage builds a Message, without its children
+func libMessage(message *C.notmuch_message_t) Message {
+	msg := Message{
+		Id:        C.GoString(C.notmuch_message_get_message_id(message)),
+		Timestamp: int64(C.notmuch_message_get_date(message)),
+		Tags:      goTags(C.notmuch_message_get_tags(message)),
+	}
+
+	filenames := C.notmuch_message_get_filenames(message)
+	for ; C.notmuch_filenames_valid(filenames) != 0; C.notmuch_filenames_move_to_next(filenames) {
+		msg.Filenames = append(msg.Filenames, C.GoString(C.notmuch_filenames_get(filenames)))
+	}
+	C.notmuch_filenames_destroy(filenames)
+
+	header := func(name string) string {
+		cName := C.CString(name)
+		defer C.free(unsafe.Pointer(cName))
+		value := C.notmuch_message_get_header(message, cName)
+		if value == nil {
+			return ""
+		}
+		return C.GoString(value)
+	}
+	msg.Header = MessageHeader{
+		Subject: header("subject"),
+		From:    header("from"),
+		To:      header("to"),
+		Cc:      header("cc"),
+		Bcc:     header("bcc"),
+		ReplyTo: header("reply-to"),
+		Date:    header("date"),
+	}
+	return msg
+}
+
+// goTags turns a list of tags into a Go slice, and destroys it
+func goTags(tags *C.notmuch_tags_t) []string {
+	out := make([]string, 0)
+	for ; C.notmuch_tags_valid(tags) != 0; C.notmuch_tags_move_to_next(tags) {
+		out = append(out, C.GoString(C.notmuch_tags_get(tags)))
+	}
+	C.notmuch_tags_destroy(tags)
+	return out
+}
+
+func (t *libTransport) filename(mid string) (filename string, err error) {
+	err = t.read(func(db *C.notmuch_database_t) error {
+		cMid := C.CString(mid)
+		defer C.free(unsafe.Pointer(cMid))
+		var message *C.notmuch_message_t
+		st := C.notmuch_database_find_message(db, cMid, &message)
+		if st != C.NOTMUCH_STATUS_SUCCESS {
+			return notmuchError(st)
+		}
+		if message == nil {
+			return fmt.Errorf("No file for message %s", mid)
+		}
+		filename = C.GoString(C.notmuch_message_get_filename(message))
+		C.notmuch_message_destroy(message)
+		return nil
+	})
+	return filename, err
+}
+
+func (t *libTransport) tags() (tags []string, err error) {
+	err = t.read(func(db *C.notmuch_database_t) error {
+		all := C.notmuch_database_get_all_tags(db)
+		if all == nil {
+			return fmt.Errorf("Couldn't list tags")
+		}
+		tags = goTags(all)
+		return nil
+	})
+	return tags, err
+}
+
+// queries reads the configuration stored in the database, which is where
+// notmuch keeps saved queries
+func (t *libTransport) queries() (queries map[string]string, err error) {
+	err = t.read(func(db *C.notmuch_database_t) error {
+		prefix := C.CString("query.")
+		defer C.free(unsafe.Pointer(prefix))
+		pairs := C.notmuch_config_get_pairs(db, prefix)
+		if pairs == nil {
+			return fmt.Errorf("Couldn't list saved queries")
+		}
+		defer C.notmuch_config_pairs_destroy(pairs)
+
+		queries = make(map[string]string)
+		for ; C.notmuch_config_pairs_valid(pairs) != 0; C.notmuch_config_pairs_move_to_next(pairs) {
+			name := strings.TrimPrefix(C.GoString(C.notmuch_config_pairs_key(pairs)), "query.")
+			query := strings.TrimSpace(C.GoString(C.notmuch_config_pairs_value(pairs)))
+			if name == "" || query == "" {
+				return fmt.Errorf("Invalid query %q", name)
+			}
+			queries[name] = query
+		}
+		return nil
+	})
+	return queries, err
+}
+
+func (t *libTransport) tag(changes []notmuchTagChange) error {
+	return t.write(func(db *C.notmuch_database_t) error {
+		for _, change := range changes {
+			query, err := newQuery(db, change.query, C.NOTMUCH_SORT_UNSORTED)
+			if err != nil {
+				return err
+			}
+			// The CLI tags excluded messages too
+			C.notmuch_query_set_omit_excluded(query, C.NOTMUCH_EXCLUDE_FALSE)
+
+			var messages *C.notmuch_messages_t
+			st := C.notmuch_query_search_messages(query, &messages)
+			if st != C.NOTMUCH_STATUS_SUCCESS {
+				C.notmuch_query_destroy(query)
+				return notmuchError(st)
+			}
+			for ; C.notmuch_messages_valid(messages) != 0; C.notmuch_messages_move_to_next(messages) {
+				err = applyTags(db, C.notmuch_messages_get(messages), change.ops, change.removeAll)
+				if err != nil {
+					break
+				}
+			}
+			C.notmuch_query_destroy(query)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// applyTags runs tag operations on a message, atomically, and
+// synchronizes its maildir flags if configured to
+func applyTags(db *C.notmuch_database_t, message *C.notmuch_message_t, ops []string, removeAll bool) error {
+	st := C.notmuch_message_freeze(message)
+	if st != C.NOTMUCH_STATUS_SUCCESS {
+		return notmuchError(st)
+	}
+	if removeAll {
+		st = C.notmuch_message_remove_all_tags(message)
+	}
+	for _, op := range ops {
+		if st != C.NOTMUCH_STATUS_SUCCESS {
+			break
+		}
+		if len(op) < 2 {
+			continue
+		}
+		tag := C.CString(op[1:])
+		if op[0] == '+' {
+			st = C.notmuch_message_add_tag(message, tag)
+		} else {
+			st = C.notmuch_message_remove_tag(message, tag)
+		}
+		C.free(unsafe.Pointer(tag))
+	}
+	if st != C.NOTMUCH_STATUS_SUCCESS {
+		C.notmuch_message_thaw(message)
+		return notmuchError(st)
+	}
+	st = C.notmuch_message_thaw(message)
+	if st != C.NOTMUCH_STATUS_SUCCESS {
+		return notmuchError(st)
+	}
+
+	var synchronize C.notmuch_bool_t
+	st = C.notmuch_config_get_bool(db, C.NOTMUCH_CONFIG_SYNC_MAILDIR_FLAGS, &synchronize)
+	if st == C.NOTMUCH_STATUS_SUCCESS && synchronize != 0 {
+		st = C.notmuch_message_tags_to_maildir_flags(message)
+		if st != C.NOTMUCH_STATUS_SUCCESS {
+			return notmuchError(st)
+		}
+	}
+	return nil
+}
+
+func (t *libTransport) insert(folder string, input io.Reader, ops []string) error {
+	return t.write(func(db *C.notmuch_database_t) error {
+		root := C.GoString(C.notmuch_config_get(db, C.NOTMUCH_CONFIG_MAIL_ROOT))
+		folder := filepath.Join(root, folder)
+
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "localhost"
+		}
+		now := time.Now()
+		name := fmt.Sprintf("%d.M%dP%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), strings.Replace(hostname, "/", "_", -1))
+
+		// Deliver in tmp/ first, so that nobody sees a partial message
+		tmp := filepath.Join(folder, "tmp", name)
+		f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, input)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		path := filepath.Join(folder, "new", name)
+		err = os.Rename(tmp, path)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+
+		cPath := C.CString(path)
+		defer C.free(unsafe.Pointer(cPath))
+		var message *C.notmuch_message_t
+		st := C.notmuch_database_index_file(db, cPath, nil, &message)
+		if st != C.NOTMUCH_STATUS_SUCCESS && st != C.NOTMUCH_STATUS_DUPLICATE_MESSAGE_ID {
+			os.Remove(path)
+			return notmuchError(st)
+		}
+		defer C.notmuch_message_destroy(message)
+
+		var newOps []string
+		newTags := C.notmuch_config_get_values(db, C.NOTMUCH_CONFIG_NEW_TAGS)
+		if newTags != nil {
+			for ; C.notmuch_config_values_valid(newTags) != 0; C.notmuch_config_values_move_to_next(newTags) {
+				newOps = append(newOps, "+"+C.GoString(C.notmuch_config_values_get(newTags)))
+			}
+			C.notmuch_config_values_destroy(newTags)
+		}
+		return applyTags(db, message, append(newOps, ops...), false)
+	})
+}
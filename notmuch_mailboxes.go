@@ -0,0 +1,119 @@
+package unpeu
+
+import (
+	"sort"
+	"strings"
+)
+
+// Mailboxes of the notmuch mailstore are tags. Tags are made hierarchical
+// by separating levels with tagDelimiter: the tag "lists/golang/dev" is
+// the mailbox dev, in lists/golang. Levels that don't exist as a tag of
+// their own, such as lists here, are \Noselect mailboxes.
+const tagDelimiter = "/"
+
+// mailboxTag returns the tag of a mailbox
+func mailboxTag(path []string) string {
+	tagPath := make([]string, len(path))
+	copy(tagPath, path)
+	if len(tagPath) > 0 && strings.EqualFold(tagPath[0], "INBOX") {
+		tagPath[0] = "inbox"
+	}
+	return strings.Join(tagPath, tagDelimiter)
+}
+
+// tagMailbox returns the path of the mailbox of a tag
+func tagMailbox(tag string) []string {
+	path := strings.Split(tag, tagDelimiter)
+	if path[0] == "inbox" {
+		path[0] = "INBOX"
+	}
+	return path
+}
+
+// newTagMailbox returns the mailbox of the tag at the given path
+func newTagMailbox(path []string, tag string, flags uint8) *Mailbox {
+	return &Mailbox{
+		Name:  strings.Join(path, string(pathDelimiter)),
+		Path:  path,
+		Id:    Id(tag),
+		Flags: flags,
+	}
+}
+
+// lookupTagMailbox returns the mailbox at the given path, or nil if there
+// is none. The INBOX always exists.
+func lookupTagMailbox(tags map[string]struct{}, path []string) *Mailbox {
+	if len(path) == 0 {
+		return nil
+	}
+	tag := mailboxTag(path)
+	path = tagMailbox(tag)
+
+	if _, ok := tags[tag]; ok || tag == "inbox" {
+		return newTagMailbox(path, tag, 0)
+	}
+	for t := range tags {
+		if strings.HasPrefix(t, tag+tagDelimiter) {
+			return newTagMailbox(path, tag, Noselect)
+		}
+	}
+	return nil
+}
+
+// tagMailboxChildren returns the mailboxes directly under the given
+// path, sorted by name
+func tagMailboxChildren(tags map[string]struct{}, path []string) []*Mailbox {
+	prefix := mailboxTag(path)
+	if prefix != "" {
+		prefix += tagDelimiter
+	}
+
+	// Child name -> whether it is a tag of its own
+	children := make(map[string]bool)
+	for tag := range tags {
+		if !strings.HasPrefix(tag, prefix) {
+			continue
+		}
+		levels := strings.SplitN(tag[len(prefix):], tagDelimiter, 2)
+		if levels[0] == "" {
+			continue
+		}
+		children[levels[0]] = children[levels[0]] || len(levels) == 1
+	}
+
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mailboxes := make([]*Mailbox, 0, len(names))
+	for _, name := range names {
+		tag := prefix + name
+		var flags uint8
+		if !children[name] {
+			flags = Noselect
+		}
+		mailboxes = append(mailboxes, newTagMailbox(tagMailbox(tag), tag, flags))
+	}
+	return mailboxes
+}
+
+type mailboxesByName []*Mailbox
+
+func (m mailboxesByName) Len() int           { return len(m) }
+func (m mailboxesByName) Less(i, j int) bool { return m[i].Name < m[j].Name }
+func (m mailboxesByName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// tags returns all the tags in the database
+func (nm *NotmuchMailstore) tags() (map[string]struct{}, error) {
+	list, err := nm.transport.tags()
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]struct{}, len(list))
+	for _, tag := range list {
+		tags[tag] = struct{}{}
+	}
+	return tags, nil
+}
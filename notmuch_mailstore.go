@@ -3,140 +3,135 @@ package unpeu
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"mime"
-	"mime/multipart"
 	"net/mail"
 	"net/textproto"
 	"os"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/vova616/xxhash"
+	"github.com/boltdb/bolt"
 )
 
-var keywordToTag = map[string]string{
-	"ANSWERED": "tag:answered",
-	"DELETED":  "tag:deleted",
-	"FLAGGED":  "tag:starred",
-	"SEEN":     "-tag:unread",
-
-	"UNSANSWERED": "-tag:answered",
-	"UNDELETED":   "-tag:deleted",
-	"UNFLAGGED":   "-tag:starred",
-	"UNSEEN":      "tag:unread",
-}
-
-var mailboxToNotmuchMapping = map[string]string{
-	"INBOX":      "inbox",
-	"\\Flagged":  "starred",
-	"\\Deleted":  "deleted",
-	"\\Draft":    "draft",
-	"\\Answered": "answered",
-}
-
-var tagToKeyword = reverse(mailboxToNotmuchMapping)
-
-func reverse(in map[string]string) map[string]string {
-	out := make(map[string]string)
-	for k, v := range in {
-		out[v] = k
-	}
-	return out
-}
-
 var _ Mailstore = &NotmuchMailstore{}
 
 type NotmuchMailstore struct {
-	l sync.RWMutex
+	transport notmuchTransport
+	flags     *notmuchFlags
 
 	// This cache protects ALL entries beyond. It must be used as soon as
-	// any of them is used or modified, and all entries must be cleared as
-	// soon as a change is detected, so they can be repopulated on the
-	// next call to the relevant function
+	// any of them is used or modified, and entries must be refreshed or
+	// cleared as soon as a change is detected, so they can be repopulated
+	// on the next call to the relevant function. Changes are detected
+	// with the database revision, see checkChanges.
 	cache        sync.RWMutex
-	threadsCache map[string][]Message
-
-	midToUidMap map[string]int
-	uidToMidMap []string
-}
-
+	uuid         string
+	lastmod      uint64
+	threadsCache map[string]cachedThreads
+	uidsCache    map[Id]*mailboxUids
+
+	// UIDs are persisted in a bolt file, opened on first use. The default
+	// location is used if uidsPath is empty.
+	uidsPath string
+	uidsOnce sync.Once
+	uidsDB   *bolt.DB
+	uidsErr  error
+
+	// Saved queries, by name, reloaded whenever mailboxes are listed.
+	// They are also read from queriesPath if it isn't empty. Protected
+	// by the cache lock.
+	queriesPath  string
+	savedQueries map[string]string
+
+	// The folder APPENDed messages are delivered to
+	maildir string
+}
+
+// NewNotmuchMailstore returns a mailstore on the notmuch database of the
+// user running the server. Messages are APPENDed to the folder named by
+// NOTMUCH_MAILDIR, and saved queries are also read from the file named by
+// UNPEU_NOTMUCH_QUERIES.
 func NewNotmuchMailstore() *NotmuchMailstore {
-	nm := &NotmuchMailstore{}
+	return NewNotmuchMailstoreWithOptions(NotmuchOptions{
+		Maildir:     os.Getenv("NOTMUCH_MAILDIR"),
+		QueriesPath: os.Getenv("UNPEU_NOTMUCH_QUERIES"),
+	})
+}
 
-	//nm.threads("*")
-	// Cache those 2 because they're huge
-	//nm.midToUid()
-	//nm.uidToMid()
-	return nm
+// NewNotmuchMailstoreWithOptions returns a mailstore on the notmuch
+// database described by the options
+func NewNotmuchMailstoreWithOptions(opts NotmuchOptions) *NotmuchMailstore {
+	return &NotmuchMailstore{
+		transport:   newNotmuchTransport(opts),
+		flags:       newNotmuchFlags(opts.FlagTags),
+		uidsPath:    opts.UidsPath,
+		queriesPath: opts.QueriesPath,
+		maildir:     opts.Maildir,
+	}
 }
 
 func (nm *NotmuchMailstore) GetMailbox(path []string) (*Mailbox, error) {
-	// Get UUID
-	rd, err := nm.raw("count", "--lastmod")
-	if err != nil {
-		return nil, err
-	}
-	line, err := ioutil.ReadAll(rd)
-	if err != nil {
-		return nil, err
+	var mbox *Mailbox
+	if len(path) > 0 && path[0] == queriesMailbox {
+		queries, err := nm.loadQueries()
+		if err != nil {
+			return nil, err
+		}
+		mbox = lookupQueryMailbox(queries, path)
+	} else {
+		tags, err := nm.tags()
+		if err != nil {
+			return nil, err
+		}
+		mbox = lookupTagMailbox(tags, path)
 	}
-	rd.Close()
-	parts := strings.Split(string(line), "\t")
-	if len(parts) != 3 {
-		return nil, fmt.Errorf("Invalid UIDVALIDITY")
+	if mbox == nil || mbox.Flags&Noselect != 0 {
+		return mbox, nil
 	}
-	uidValidity := xxhash.Checksum32([]byte(parts[1]))
 
-	id := Id(strings.Join(path, "/"))
-	if id == Id("INBOX") {
-		id = Id("inbox")
+	uids, err := nm.mailboxUids(mbox.Id)
+	if err != nil {
+		return nil, err
 	}
-	return &Mailbox{
-		Name:        strings.Join(path, "/"),
-		Path:        path,
-		Id:          id,
-		Flags:       Noinferiors,
-		UidValidity: uidValidity,
-	}, nil
+	mbox.UidValidity = uids.uidValidity
+	return mbox, nil
 }
 
 func (nm *NotmuchMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
-	if len(path) > 0 {
-		return nil, nil
-	}
-	rd, err := nm.raw("search", "--output=tags", "--format=json", "*")
+	queries, err := nm.loadQueries()
 	if err != nil {
 		return nil, err
 	}
-	var mailboxNames []string
-	err = json.NewDecoder(rd).Decode(&mailboxNames)
+	if len(path) > 0 && path[0] == queriesMailbox {
+		return queryMailboxes(queries, path), nil
+	}
+
+	tags, err := nm.tags()
 	if err != nil {
 		return nil, err
 	}
-	rd.Close()
-	sort.Strings(mailboxNames)
+	children := tagMailboxChildren(tags, path)
+	if len(path) > 0 {
+		return children, nil
+	}
 
-	var mailboxes []*Mailbox
-	for _, mb := range mailboxNames {
-		if mb == "inbox" {
-			mb = "INBOX"
+	// The queries shadow any tag of the same name
+	mailboxes := make([]*Mailbox, 0, len(children)+1)
+	for _, mbox := range children {
+		if mbox.Path[0] != queriesMailbox {
+			mailboxes = append(mailboxes, mbox)
 		}
-		mailboxes = append(mailboxes, &Mailbox{
-			Name:  mb,
-			Path:  []string{mb},
-			Id:    Id(mb),
-			Flags: Noinferiors,
-		})
+	}
+	if queriesRoot := lookupQueryMailbox(queries, []string{queriesMailbox}); queriesRoot != nil {
+		mailboxes = append(mailboxes, queriesRoot)
+		sort.Sort(mailboxesByName(mailboxes))
 	}
 	return mailboxes, nil
 }
@@ -148,22 +143,12 @@ func (nm *NotmuchMailstore) FirstUnseen(mbox Id) (int64, error) {
 }
 
 func (nm *NotmuchMailstore) CountUnseen(mbox Id) (int64, error) {
-	threads, err := nm.threads("tag:" + string(mbox))
+	query, err := nm.mailboxQuery(mbox)
 	if err != nil {
 		return 0, err
 	}
-
-	flat := flatten(threads)
-	var count int64
-	for _, message := range flat {
-		for _, tag := range message.Tags {
-			if tag == "unread" {
-				count++
-				break
-			}
-		}
-	}
-	return count, nil
+	count, err := nm.transport.count(query + " and tag:unread")
+	return int64(count), err
 }
 
 func (nm *NotmuchMailstore) TotalMessages(mbox Id) (int64, error) {
@@ -172,30 +157,38 @@ func (nm *NotmuchMailstore) TotalMessages(mbox Id) (int64, error) {
 }
 
 func (nm *NotmuchMailstore) RecentMessages(mbox Id) (int64, error) {
-	// Useless
-	return 0, nil
+	query, err := nm.mailboxQuery(mbox)
+	if err != nil {
+		return 0, err
+	}
+	count, err := nm.transport.count(query + " and tag:" + recentTag)
+	return int64(count), err
 }
 
 func (nm *NotmuchMailstore) NextUid(mbox Id) (int64, error) {
-	// RFC says that UIDNEXT MUST NOT increment if no message was added to
-	// this mailbox, so we can't just use the total number of messages.
-	// Moreover it MUST increment, so we can't just use the number of
-	// messages in this box + 1. Currently we use the index of the message
-	// in the overall list of ALL messages, regardless of the tags it has,
-	// so this means we can't predict what the next one will be...
-	// Fortunately the RFC allows us to not predict a UIDNEXT.
-	return 0, nil
+	// UIDs are only assigned when the mailbox is looked at, so messages
+	// that arrived since then get their UID now: UIDNEXT is then the one
+	// the next message will get
+	uids, err := nm.mailboxUids(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int64(uids.uidNext), nil
 }
 
 func (nm *NotmuchMailstore) AppendMessage(mailbox string, flags []string, dateTime time.Time, message string) error {
+	path := pathToSlice(mailbox)
+	if len(path) > 0 && path[0] == queriesMailbox {
+		// There's no tag to give that would make the message match
+		return ErrCannotAppend
+	}
+
 	// Prepare tags to add
 	tags := make([]string, 0, len(flags))
 	var seen bool
 	for _, t := range flags {
 		if t != "" {
-			if mapping, ok := mailboxToNotmuchMapping[t]; ok {
-				t = mapping
-			}
+			t = nm.flags.tag(t)
 			if t == "\\Seen" {
 				seen = true
 				continue
@@ -206,60 +199,45 @@ func (nm *NotmuchMailstore) AppendMessage(mailbox string, flags []string, dateTi
 	if !seen {
 		tags = append(tags, "+unread")
 	}
-	if mailbox == "INBOX" {
-		tags = append(tags, "+inbox")
-	} else {
-		tags = append(tags, "+"+mailbox)
-	}
+	tags = append(tags, "+"+mailboxTag(path))
 
-	maildir := os.Getenv("NOTMUCH_MAILDIR")
-	if maildir == "" {
-		return fmt.Errorf("Missing maildir, use the NOTMUCH_MAILDIR env variable")
+	if nm.maildir == "" {
+		return fmt.Errorf("Missing maildir, use the NOTMUCH_MAILDIR env variable or NotmuchOptions.Maildir")
 	}
 
-	args := []string{"insert", "--folder=" + maildir, "+new"}
-	args = append(args, tags...)
-	cmd, err := nm.rawWrite(args...)
-	if err != nil {
-		return err
-	}
-	//log.Println("Adding with command:", cmd.cmd.Args)
-	_, err = io.WriteString(cmd, message)
+	ops := append([]string{"+new"}, tags...)
+	return nm.transport.insert(nm.maildir, strings.NewReader(message), ops)
+}
+
+func (nm *NotmuchMailstore) Search(mailbox Id, args []searchArgument, returnUid, returnThreads bool) ([]threadMember, error) {
+	uids, err := nm.mailboxUids(mailbox)
 	if err != nil {
-		log.Println("Error writing message:", err)
+		return nil, err
 	}
-	return cmd.Close()
+	return nm.search(uids, mailbox, args, returnUid, returnThreads)
 }
 
-func (nm *NotmuchMailstore) Search(mailbox Id, args []searchArgument, returnUid, returnThreads bool) (threadMembers []threadMember, err error) {
-	args = append(args, searchArgument{key: "KEYWORD", values: []string{string(mailbox)}})
-	notmuchQuery, mode := parseSearchArguments(args)
-	// Remove top-level parenthesis
-	notmuchQuery = notmuchQuery[1 : len(notmuchQuery)-1]
-
-	var midToUid map[string]int
-	var midToSequenceId map[string]int
-	switch returnUid {
-	case true:
-		midToUid = nm.midToUid()
-	case false:
-		allMessageIds, err := nm.messageIds(mailbox)
-		if err != nil {
-			return nil, err
-		}
-		midToSequenceId = make(map[string]int)
-		for i, messageId := range allMessageIds {
-			midToSequenceId[messageId] = i + 1
-		}
+// search is Search with the given UID mapping of the mailbox
+func (nm *NotmuchMailstore) search(uids *mailboxUids, mailbox Id, args []searchArgument, returnUid, returnThreads bool) (threadMembers []threadMember, err error) {
+	mailboxQuery, err := nm.mailboxQuery(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	notmuchQuery, mode := nm.flags.parseSearchArguments(args)
+	if notmuchQuery == "(*)" {
+		notmuchQuery = mailboxQuery
+	} else {
+		notmuchQuery = mailboxQuery + " and " + notmuchQuery
 	}
 
 	if returnThreads && (mode == "" || mode != "REFS") {
 		return nil, fmt.Errorf("Invalid mode for thread command")
 	}
-	var tids []string
-	err = nm.json(&tids, "search", "--format=json", "--output=threads", "--sort=oldest-first", notmuchQuery)
-	if err != nil {
-		return nil, err
+
+	midToUid := uids.midToUid
+	midToSequenceId := make(map[string]int)
+	for i, messageId := range uids.mids {
+		midToSequenceId[messageId] = i + 1
 	}
 
 	var getIdMapping func(messageId string) int
@@ -282,141 +260,160 @@ func (nm *NotmuchMailstore) Search(mailbox Id, args []searchArgument, returnUid,
 		}
 	}
 
-	threadMembers = make([]threadMember, 0, len(tids))
-	for _, tid := range tids {
-		var result []interface{}
-		err = nm.json(&result, "show", "--format=json", "--body=false", "--", "thread:"+tid)
-		if err != nil {
-			return nil, err
-		}
-		for _, thread := range result {
-			topLevelMessages := thread.([]interface{})
-			threadRoot := transformMessage(topLevelMessages[0], getIdMapping)
-			if len(topLevelMessages) > 1 {
-				for _, topLevelMessage := range topLevelMessages[1:] {
-					directChild := transformMessage(topLevelMessage, getIdMapping)
-					threadRoot.children = append(threadRoot.children, directChild)
-				}
+	// The notmuch query is only a superset of what was asked when some
+	// keys can't be expressed in it; the post-filter then has the final
+	// word on every candidate
+	var mids []string
+	if needsPostFilter(args) {
+		mids, err = nm.postFilter(notmuchQuery, args, midToUid, midToSequenceId)
+	} else {
+		mids, err = nm.transport.messageIds(notmuchQuery, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !returnThreads {
+		flat := make([]threadMember, 0, len(mids))
+		for _, mid := range mids {
+			if _, ok := midToSequenceId[mid]; !ok {
+				continue
 			}
-			threadMembers = append(threadMembers, threadRoot)
+			flat = append(flat, threadMember{id: getIdMapping(mid)})
 		}
+		sort.Sort(byId(flat))
+		return flat, nil
 	}
 
-	if returnThreads {
-		return threadMembers, nil
+	matchingIds := make(map[int]struct{}, len(mids))
+	for _, mid := range mids {
+		matchingIds[getIdMapping(mid)] = struct{}{}
 	}
 
-	// Flatten threadMembers
-	// Sorting by id is the same as sorting by date, because mid->(u)id
-	// mappings are already sorted
-	flat := make([]threadMember, 0)
-	var flatten func(ids []threadMember, id threadMember) []threadMember
-	flatten = func(ids []threadMember, id threadMember) []threadMember {
-		ids = append(ids, id)
-		for _, child := range id.children {
-			ids = flatten(ids, child)
+	threads, err := nm.threads(notmuchQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	threadMembers = make([]threadMember, 0, len(threads))
+	for _, thread := range threads {
+		threadRoot := transformMessage(thread, getIdMapping)
+
+		// Threads found by the notmuch query may have been entirely
+		// discarded by the post-filter
+		if containsAny(threadRoot, matchingIds) {
+			threadMembers = append(threadMembers, threadRoot)
 		}
-		return ids
 	}
-	for _, threadRoot := range threadMembers {
-		flat = flatten(flat, threadRoot)
+
+	return threadMembers, nil
+}
+
+// containsAny returns true if the thread member or any of its children
+// has one of the given ids
+func containsAny(tm threadMember, ids map[int]struct{}) bool {
+	if _, ok := ids[tm.id]; ok {
+		return true
+	}
+	for _, child := range tm.children {
+		if containsAny(child, ids) {
+			return true
+		}
 	}
-	sort.Sort(byId(flat))
-	return flat, nil
+	return false
 }
 
-// We know the notmuch output structure, and it's not going to change,
-// so we can bypass cast verification
-func transformMessage(message interface{}, getIdMapping func(messageId string) int) threadMember {
-	actual := message.([]interface{})
-	header := actual[0].(map[string]interface{})
+func transformMessage(message Message, getIdMapping func(messageId string) int) threadMember {
 	tm := threadMember{
-		id:       getIdMapping(header["id"].(string)),
-		children: make([]threadMember, 0),
+		id:       getIdMapping(message.Id),
+		children: make([]threadMember, 0, len(message.Children)),
 	}
-
-	children := actual[1].([]interface{})
-	for _, child := range children {
-		childMessage := transformMessage(child, getIdMapping)
-		tm.children = append(tm.children, childMessage)
+	for _, child := range message.Children {
+		tm.children = append(tm.children, transformMessage(child, getIdMapping))
 	}
 	return tm
 }
 
-func parseSearchArguments(args []searchArgument) (queryString string, threadMode string) {
+func (f *notmuchFlags) parseSearchArguments(args []searchArgument) (queryString string, threadMode string) {
 	query := make([]string, 0)
 	for _, arg := range args {
+		var term string
 		switch arg.key {
-		case "ALL":
-			// Nothing special here
-			continue
-		case "NEW", "OLD", "RECENT", "HEADER", "SMALLER", "LARGER", "SEQUENCESET", "UID":
-			log.Println(arg.key, "is not supported")
-			// Not supported
-			continue
 		case "ANSWERED", "DELETED", "FLAGGED", "SEEN", "DRAFT",
-			"UNSANSWERED", "UNDELETED", "UNFLAGGED", "UNSEEN", "UNDRAFT":
-			query = append(query, keywordToTag[arg.key])
+			"UNANSWERED", "UNDELETED", "UNFLAGGED", "UNSEEN", "UNDRAFT",
+			"NEW", "OLD", "RECENT":
+			term = f.keywordQueries[arg.key]
 		case "KEYWORD":
-			query = append(query, "tag:"+arg.values[0])
+			term = "tag:" + arg.values[0]
 		case "UNKEYWORD":
-			query = append(query, "-tag:"+arg.values[0])
+			term = "-tag:" + arg.values[0]
 		case "FROM":
-			query = append(query, "from:"+arg.values[0])
+			term = "from:" + arg.values[0]
 		case "TO", "CC", "BCC":
-			// TODO: postprocess on CC and BCC
-			query = append(query, "to:"+arg.values[0])
-
-		// Internal date is the date the server received the message. So
-		// this is technically wrong.
+			// notmuch indexes To, Cc and Bcc under the same prefix, the
+			// post-filter tells them apart
+			term = "to:" + arg.values[0]
+
+		// notmuch compares dates in the server's timezone while IMAP uses
+		// the message's own timezone; widen the range by a day on each
+		// side and let the post-filter be exact. Internal date is the Date
+		// header for this mailstore, so both families are the same.
 		case "SENTON", "ON":
-			query = append(query, "date:"+arg.values[0]+"..!")
+			day := searchDate(arg.values[0])
+			term = "date:" + notmuchDate(day.AddDate(0, 0, -1)) + ".." + notmuchDate(day.AddDate(0, 0, 1))
 		case "SENTSINCE", "SINCE":
-			query = append(query, "date:"+arg.values[0]+"..")
+			day := searchDate(arg.values[0])
+			term = "date:" + notmuchDate(day.AddDate(0, 0, -1)) + ".."
 		case "SENTBEFORE", "BEFORE":
-			query = append(query, "date:.."+arg.values[0])
+			day := searchDate(arg.values[0])
+			term = "date:.." + notmuchDate(day)
 
 		case "SUBJECT":
-			query = append(query, `subject:`+quote(arg.values[0]))
-		case "BODY", "TEXT": // Technically wrong, but matches in most interesting cases
-			query = append(query, quote(arg.values[0]))
+			term = `subject:` + quote(arg.values[0])
+		case "BODY", "TEXT": // Word-based, the post-filter does the substring match
+			term = quote(arg.values[0])
 		case "REFERENCES", "REFS", "ORDEREDSUBJECT":
 			threadMode = arg.key
+
+			// ALL, and HEADER, SMALLER, LARGER, SEQUENCESET and UID which
+			// can only be matched by the post-filter, don't restrict the
+			// query
 		}
 
 		if arg.group {
-			sub, _ := parseSearchArguments(arg.children)
+			sub, _ := f.parseSearchArguments(arg.children)
 			if len(arg.children) == 1 {
 				// elide parenthesis
 				sub = sub[1 : len(sub)-1]
 			}
-			query = append(query, sub)
+			term = sub
 		}
 
 		if arg.or {
-			left, _ := parseSearchArguments([]searchArgument{arg.children[0]})
-			right, _ := parseSearchArguments([]searchArgument{arg.children[1]})
-			full := strings.Join([]string{left, right}, " OR ")
-			query = append(query, full)
+			left, _ := f.parseSearchArguments([]searchArgument{arg.children[0]})
+			right, _ := f.parseSearchArguments([]searchArgument{arg.children[1]})
+			term = strings.Join([]string{left, right}, " OR ")
 		}
 
-		if len(query) == 0 {
+		if term == "" {
 			continue
 		}
-		justAdded := query[len(query)-1]
 		if arg.not {
-			if justAdded[0] == '-' {
-				justAdded = justAdded[1:]
+			if needsPostFilter([]searchArgument{arg}) {
+				// The term is a superset of the real results, so its
+				// negation would be a subset: leave it all to the
+				// post-filter
+				continue
+			}
+			if term[0] == '-' {
+				term = term[1:]
 			} else {
-				justAdded = "-" + justAdded
+				term = "-" + term
 			}
-			query[len(query)-1] = justAdded
 		}
+		query = append(query, term)
 	}
 
-	// TODO: post-process for SMALLER and LARGER
-	// TODO: post-process for sequence set matching
-
 	if len(query) == 0 {
 		query = []string{"*"}
 	}
@@ -424,67 +421,40 @@ func parseSearchArguments(args []searchArgument) (queryString string, threadMode
 }
 
 func (nm *NotmuchMailstore) Fetch(mailbox Id, sequenceSet string, args []fetchArgument, useUids bool) ([]messageFetchResponse, error) {
-	mailboxMessageIds, err := nm.messageIds(mailbox)
+	uids, err := nm.mailboxUids(mailbox)
 	if err != nil {
 		return nil, err
 	}
-
-	// Transform sequence set into usable list of ids
-	var max int
-	var uidToMid []string
-	if useUids {
-		uidToMid = nm.uidToMid()
-		max = len(uidToMid)
-	} else {
-		max64, err := nm.TotalMessages(mailbox)
-		if err != nil {
-			return nil, err
-		}
-		max = int(max64)
+	mids, err := uids.resolve(sequenceSet, useUids)
+	if err != nil {
+		return nil, err
 	}
-	inputAsList, err := toList(sequenceSet, max)
+	return nm.fetchMids(uids, mids, args)
+}
+
+// fetchMids fetches the items of the messages, numbered with the given
+// UID mapping
+func (nm *NotmuchMailstore) fetchMids(uids *mailboxUids, mids []string, args []fetchArgument) ([]messageFetchResponse, error) {
+	messages, err := nm.getMessages(mids)
 	if err != nil {
 		return nil, err
 	}
 
-	allResults := make([]messageFetchResponse, 0, len(inputAsList))
-	if useUids {
-		// Build message-id -> sequence id map
-		midToSeqId := make(map[string]int)
-		for index, mailboxMessageId := range mailboxMessageIds {
-			midToSeqId[mailboxMessageId] = index + 1
+	allResults := make([]messageFetchResponse, 0, len(mids))
+	for _, mid := range mids {
+		msg, ok := messages[mid]
+		if !ok {
+			// Removed from the database since the mailbox was listed
+			msg = Message{Id: mid}
 		}
-
-		for _, uid := range inputAsList {
-			if uid > len(uidToMid)-1 {
-				continue
-			}
-			mid := uidToMid[uid]
-			sequenceId, ok := midToSeqId[mid]
-			if !ok {
-				continue
-			}
-			items, err := nm.fetchMessageItems(mid, args)
-			if err != nil {
-				return nil, fmt.Errorf("Couldn't fetch mid %s: %s", mid, err)
-			}
-			allResults = append(allResults, messageFetchResponse{
-				id:    strconv.Itoa(sequenceId),
-				items: items,
-			})
-		}
-	} else {
-		for _, id := range inputAsList {
-			if id-1 < 0 || id-1 > len(mailboxMessageIds)-1 {
-				return nil, fmt.Errorf("Invalid id %d when we have %d messages", id, len(mailboxMessageIds))
-			}
-			mid := mailboxMessageIds[id-1]
-			items, err := nm.fetchMessageItems(mid, args)
-			if err != nil {
-				return nil, fmt.Errorf("Couldn't fetch mid %s: %s", mid, err)
-			}
-			allResults = append(allResults, messageFetchResponse{id: strconv.Itoa(id), items: items})
+		items, err := nm.fetchMessageItems(msg, uids.midToUid[mid], args)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't fetch mid %s: %s", mid, err)
 		}
+		allResults = append(allResults, messageFetchResponse{
+			id:    strconv.Itoa(uids.sequenceId(mid)),
+			items: items,
+		})
 	}
 
 	return allResults, nil
@@ -495,6 +465,9 @@ func (nm *NotmuchMailstore) Fetch(mailbox Id, sequenceSet string, args []fetchAr
 // http://git.notmuchmail.org/git/notmuch/blob/HEAD:/devel/schemata
 type Message struct {
 	Id           string        `json:"id"`
+	Match        bool          `json:"match"`
+	Filenames    []string      `json:"-"`
+	Timestamp    int64         `json:"timestamp"`
 	DateRelative string        `json:"date_relative"`
 	Tags         []string      `json:"tags"`
 	Header       MessageHeader `json:"headers"`
@@ -536,37 +509,29 @@ notmuch schema of a message
 
 */
 
-func (nm *NotmuchMailstore) fetchMessageItems(mid string, args []fetchArgument) ([]fetchItem, error) {
-	msg, err := nm.getMessage(mid)
-	if err != nil {
-		return nil, err
+func (nm *NotmuchMailstore) fetchMessageItems(msg Message, uid int, args []fetchArgument) ([]fetchItem, error) {
+	// The message file is only read if an item needs it, and only once
+	var raw []byte
+	content := func() (io.Reader, error) {
+		if raw == nil {
+			var err error
+			raw, err = nm.readMessage(msg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return bytes.NewReader(raw), nil
 	}
 
 	result := make([]fetchItem, 0)
 	messageParsers := make([]messageParser, 0)
 
-	midToUid := nm.midToUid()
 	for _, arg := range args {
 		switch arg.text {
 		case "UID":
-			uid := midToUid[msg.Id]
 			result = append(result, fetchItem{key: "UID", value: strconv.Itoa(uid)})
 		case "FLAGS":
-			flags := make([]string, 0, len(msg.Tags))
-			var unread bool
-			for _, tag := range msg.Tags {
-				if keyword, ok := tagToKeyword[tag]; ok {
-					flags = append(flags, keyword)
-				} else if tag == "unread" {
-					unread = true
-					continue
-				} else {
-					flags = append(flags, tag)
-				}
-			}
-			if !unread {
-				flags = append(flags, "\\Seen")
-			}
+			flags := nm.flags.imapFlags(msg.Tags)
 			flagsString := fmt.Sprintf("(%s)", strings.Join(flags, " "))
 			result = append(result, fetchItem{key: "FLAGS", value: flagsString})
 		case "INTERNALDATE":
@@ -581,19 +546,19 @@ func (nm *NotmuchMailstore) fetchMessageItems(mid string, args []fetchArgument)
 		case "ENVELOPE":
 			messageParsers = append(messageParsers, &envelopeParser{})
 		case "BODY", "BODY.PEEK":
-			item, err := nm.fetchBodyArg(arg, msg)
+			item, err := fetchBodyArg(arg, content)
 			if err != nil {
 				log.Println(err)
 				continue
 			}
 			result = append(result, item)
 		case "BODYSTRUCTURE":
-			cmdHeader, err := nm.raw("show", "--format=raw", "--part=0", "--entire-thread=false", "id:"+msg.Id)
+			rd, err := content()
 			if err != nil {
 				return nil, err
 			}
-			hdr, err := textproto.NewReader(bufio.NewReader(cmdHeader)).ReadMIMEHeader()
-			cmdHeader.Close()
+			buf := bufio.NewReader(rd)
+			hdr, err := textproto.NewReader(buf).ReadMIMEHeader()
 			if err != nil {
 				return nil, err
 			}
@@ -608,12 +573,7 @@ func (nm *NotmuchMailstore) fetchMessageItems(mid string, args []fetchArgument)
 				}
 			}
 
-			cmd, err := nm.raw("show", "--format=raw", "--part=1", "--entire-thread=false", "id:"+msg.Id)
-			if err != nil {
-				return nil, err
-			}
-			body, err := parse(cmd, mediaType, params)
-			cmd.Close()
+			body, err := parse(buf, mediaType, params)
 			if err != nil {
 				return nil, err
 			}
@@ -625,7 +585,7 @@ func (nm *NotmuchMailstore) fetchMessageItems(mid string, args []fetchArgument)
 				"RFC822":        "",
 			}
 			if section, ok := mapping[arg.text]; ok {
-				item, err := nm.fetchBodyArg(fetchArgument{section: section}, msg)
+				item, err := fetchBodyArg(fetchArgument{section: section}, content)
 				if err != nil {
 					log.Println(err)
 					continue
@@ -639,291 +599,44 @@ func (nm *NotmuchMailstore) fetchMessageItems(mid string, args []fetchArgument)
 	}
 
 	if len(messageParsers) > 0 {
-		writers := make([]io.Writer, 0, len(messageParsers))
-		dones := make([]chan error, 0, len(messageParsers))
-
-		for _, mp := range messageParsers {
-			pr, pw := io.Pipe()
-			done := make(chan error, 1)
-			dones = append(dones, done)
-			go func(mp messageParser) {
-				done <- mp.read(pr)
-				// A message parser may stop reading before the end, finish it
-				// off
-				io.Copy(ioutil.Discard, pr)
-				close(done)
-			}(mp)
-			writers = append(writers, pw)
-		}
-
-		mw := io.MultiWriter(writers...)
-		cmd, err := nm.raw("show", "--format=raw", "--part=0", "id:"+mid)
+		rd, err := content()
 		if err != nil {
 			return nil, err
 		}
-		_, err = io.Copy(mw, cmd)
-		cmd.Close()
+		items, err := runMessageParsers(rd, messageParsers)
 		if err != nil {
 			return nil, err
 		}
-
-		for i, done := range dones {
-			writers[i].(io.Closer).Close()
-			err := <-done
-			if err != nil {
-				parser := messageParsers[i]
-				return nil, fmt.Errorf("Error extracting field %q: %s", parser.getKey(), err)
-			}
-		}
-
-		for _, mp := range messageParsers {
-			result = append(result, fetchItem{key: mp.getKey(), value: mp.getValue()})
-		}
+		result = append(result, items...)
 	}
 
 	return result, nil
 }
 
-func (nm *NotmuchMailstore) fetchBodyArg(arg fetchArgument, notmuchMsg Message) (fetchItem, error) {
-	cmd, err := nm.raw("show", "--format=raw", "--part=0", "--entire-thread=false", "id:"+notmuchMsg.Id)
+func fetchBodyArg(arg fetchArgument, content func() (io.Reader, error)) (fetchItem, error) {
+	rd, err := content()
 	if err != nil {
 		return fetchItem{}, err
 	}
-	defer cmd.Close()
-
-	var rd io.Reader = bufio.NewReader(cmd)
-
-	// Skip to relevant part
-	if len(arg.part) > 0 {
-		msg, err := mail.ReadMessage(rd)
-		if err != nil {
-			return fetchItem{}, err
-		}
-
-		contentType := msg.Header.Get("Content-Type")
-		for parts := arg.part; len(parts) > 0; parts = parts[1:] {
-			mediaType, params, err := mime.ParseMediaType(contentType)
-			if err != nil {
-				return fetchItem{}, err
-			}
-			if !strings.HasPrefix(mediaType, "multipart/") {
-				// Special-case:
-				// Every message has at least one part, even if it is not multipart/*
-				// We deal with the case where messages are not multipart/*, but a
-				// client still asks for BODY[1], which is valid as per RFC, and
-				// returns the whole text
-				if len(arg.part) == 1 && arg.part[0] == 1 {
-					break
-				}
-				return fetchItem{}, fmt.Errorf("Invalid hierarchy")
-			}
-			partReader := multipart.NewReader(msg.Body, params["boundary"])
-
-			for part := parts[0]; part > 0; part-- {
-				p, err := partReader.NextPart()
-				if err != nil {
-					return fetchItem{}, err
-				}
-				rd = p
-				contentType = p.Header.Get("Content-Type")
-
-				// Same as upstream for quoted-printable, if
-				// Content-Transfer-Encoding is base64 we silently replace the
-				// reader with one that decodes on-the-fly
-				//
-				// See https://golang.org/src/mime/multipart/multipart.go?s=3209:3362#L98
-
-				const cte = "Content-Transfer-Encoding"
-				if p.Header.Get(cte) == "base64" {
-					p.Header.Del(cte)
-					rd = base64.NewDecoder(base64.StdEncoding, rd)
-				}
-			}
-		}
-	}
-
-	/*
-		if arg.section != "" && arg.section != "MIME" {
-			_, ok := container.(Message)
-			if !ok {
-				return fetchItem{}, fmt.Errorf("Invalid fetch of %s on a non-message", arg.section)
-			}
-		}
-	*/
-
-	// Kinda lame
-	// Build a pattern that will be completed later
-	partStrings := make([]string, len(arg.part))
-	for i := range arg.part {
-		partStrings[i] = strconv.Itoa(arg.part[i])
-	}
-	keyPattern := "BODY["
-	if len(partStrings) > 0 {
-		keyPattern += strings.Join(partStrings, ".")
-	}
-	if arg.section == "" || len(partStrings) == 0 {
-		keyPattern += "%s]"
-	} else {
-		keyPattern += ".%s]"
-	}
-	if arg.offset >= 0 {
-		keyPattern += "<" + strconv.Itoa(arg.offset)
-	}
-	if arg.length > 0 {
-		keyPattern += "." + strconv.Itoa(arg.length)
-	}
-	if strings.Contains(keyPattern, "<") {
-		keyPattern += ">"
-	}
-
-	var key string
-	var value string
-	switch arg.section {
-	case "":
-		key = fmt.Sprintf(keyPattern, "")
-
-		fullBody, err := ioutil.ReadAll(rd)
-		if err != nil {
-			return fetchItem{}, err
-		}
-		value = string(fullBody)
-	case "HEADER":
-		key = fmt.Sprintf(keyPattern, "HEADER")
-
-		var hdr bytes.Buffer
-		buf := bufio.NewReader(io.TeeReader(rd, &hdr))
-		headerReader := textproto.NewReader(buf)
-		_, err := headerReader.ReadMIMEHeader()
-		if err != nil {
-			return fetchItem{}, err
-		}
-
-		// Don't forget to elide the last bytes that were read but are not
-		// part of the header
-		value = string(hdr.Bytes()[:hdr.Len()-buf.Buffered()])
-
-	case "HEADER.FIELDS":
-		key = fmt.Sprintf(keyPattern, "HEADER.FIELDS ("+strings.Join(arg.fields, " ")+")")
-
-		// Build a fake header with only the given fields
-		headerReader := textproto.NewReader(bufio.NewReader(rd))
-		hdr, err := headerReader.ReadMIMEHeader()
-		if err != nil {
-			return fetchItem{}, err
-		}
-
-		fakeHeader := make([]string, 0, len(arg.fields)+1)
-		for _, field := range arg.fields {
-			vals := hdr[textproto.CanonicalMIMEHeaderKey(field)]
-			if len(vals) > 0 {
-				fakeHeader = append(fakeHeader, fmt.Sprintf("%s: %s", field, strings.Join(vals, ", ")))
-			}
-		}
-		fakeHeader = append(fakeHeader, "\n")
-		value = strings.Join(fakeHeader, "\n")
-	case "HEADER.FIELDS.NOT":
-		key = fmt.Sprintf(keyPattern, "HEADER.FIELDS.NOT ("+strings.Join(arg.fields, " ")+")")
-
-		// Build a real header and remove the keys we don't want
-		headerReader := textproto.NewReader(bufio.NewReader(rd))
-		hdr, err := headerReader.ReadMIMEHeader()
-		if err != nil {
-			return fetchItem{}, err
-		}
-
-		for _, field := range arg.fields {
-			hdr.Del(field)
-		}
-		serialized := make([]string, 0, len(hdr)+1)
-		for k, values := range hdr {
-			value := strings.Join(values, ", ")
-			serialized = append(serialized, fmt.Sprintf("%s: %s", k, value))
-		}
-		serialized = append(serialized, "\n")
-		value = strings.Join(serialized, "\n")
-	case "TEXT":
-		key = fmt.Sprintf(keyPattern, "TEXT")
-
-		buf := bufio.NewReader(rd)
-		headerReader := textproto.NewReader(buf)
-		_, err := headerReader.ReadMIMEHeader()
-		if err != nil {
-			return fetchItem{}, err
-		}
-
-		// Write the bytes that have been buffered but are not part of the
-		// header
-		var text bytes.Buffer
-		_, err = io.Copy(&text, buf)
-		if err != nil {
-			return fetchItem{}, err
-		}
-		_, err = io.Copy(&text, rd)
-		if err != nil {
-			return fetchItem{}, err
-		}
-		value = string(text.Bytes())
-	case "MIME":
-		return fetchItem{}, fmt.Errorf("MIME is unsupported")
-	}
-
-	// Subset value with offset and length
-	from := 0
-	if arg.offset != -1 {
-		from = arg.offset
-	}
-	to := len(value)
-	if arg.length != 0 {
-		to = from + arg.length
-	}
-	subvalue := value[from:to]
-	if to == from {
-		subvalue = `""`
-	} else {
-		subvalue = literalify(subvalue)
-	}
-
-	item := fetchItem{
-		key:   key,
-		value: subvalue,
-	}
-	return item, nil
+	return fetchBody(arg, rd)
 }
 
 func (nm *NotmuchMailstore) Flag(mode flagMode, mbox Id, sequenceSet string, useUids bool, flags []string) ([]messageFetchResponse, error) {
-	max, err := nm.TotalMessages(mbox)
+	uids, err := nm.mailboxUids(mbox)
 	if err != nil {
 		return nil, err
 	}
-	asList, err := toList(sequenceSet, int(max))
+	return nm.flag(uids, mode, mbox, sequenceSet, useUids, flags)
+}
+
+// flag is Flag with the given UID mapping of the mailbox
+func (nm *NotmuchMailstore) flag(uids *mailboxUids, mode flagMode, mbox Id, sequenceSet string, useUids bool, flags []string) ([]messageFetchResponse, error) {
+	mids, err := uids.resolve(sequenceSet, useUids)
 	if err != nil {
 		return nil, err
 	}
 
-	mids := make([]string, 0, len(asList))
-
-	if useUids {
-		uidToMidList := nm.uidToMid()
-		for _, uid := range asList {
-			if uid > len(uidToMidList) {
-				return nil, fmt.Errorf("Invalid message UID: %d", uid)
-			}
-			mids = append(mids, uidToMidList[uid])
-		}
-	} else {
-		mailboxMessageIds, err := nm.messageIds(mbox)
-		if err != nil {
-			return nil, err
-		}
-		for _, sequenceId := range asList {
-			if sequenceId > len(mailboxMessageIds) {
-				return nil, fmt.Errorf("Invalid sequence id: %d (max is %d)", sequenceId, max)
-			}
-			mids = append(mids, mailboxMessageIds[sequenceId-1])
-		}
-	}
-
-	allArgs := make([][]string, len(mids))
+	changes := make([]notmuchTagChange, len(mids))
 	for i, mid := range mids {
 		msgArgs := make([]string, 0)
 		switch mode {
@@ -949,16 +662,11 @@ func (nm *NotmuchMailstore) Flag(mode flagMode, mbox Id, sequenceSet string, use
 					continue
 				}
 				if flag == "\\Deleted" {
-					msgArgs = append(msgArgs, "-"+string(mbox))
+					msgArgs = append(msgArgs, deletedTagOp(mbox, true))
 					continue
 				}
 
-				var keyword string
-				var ok bool
-				keyword, ok = mailboxToNotmuchMapping[flag]
-				if !ok {
-					keyword = flag
-				}
+				keyword := nm.flags.tag(flag)
 				msgArgs = append(msgArgs, "+"+keyword)
 			}
 		case REMOVE:
@@ -968,121 +676,31 @@ func (nm *NotmuchMailstore) Flag(mode flagMode, mbox Id, sequenceSet string, use
 					continue
 				}
 				if flag == "\\Deleted" {
-					msgArgs = append(msgArgs, "+"+string(mbox))
+					msgArgs = append(msgArgs, deletedTagOp(mbox, false))
 					continue
 				}
 
-				var keyword string
-				var ok bool
-				keyword, ok = mailboxToNotmuchMapping[flag]
-				if !ok {
-					keyword = flag
-				}
+				keyword := nm.flags.tag(flag)
 				msgArgs = append(msgArgs, "-"+keyword)
 			}
 		}
-		msgArgs = append(msgArgs, "--", "id:"+mid)
-
-		allArgs[i] = msgArgs
-	}
-
-	if mode == SET {
-		// No --batch support with --remove-all
-		for _, msgArgs := range allArgs {
-			// Prepend with the command
-			msgArgs = append(msgArgs, "", "")
-			copy(msgArgs[2:], msgArgs[0:])
-			msgArgs[0] = "tag"
-			msgArgs[1] = "--remove-all"
-			cmd, err := nm.rawWrite(msgArgs...)
-			if err != nil {
-				return nil, err
-			}
-			err = cmd.Close()
-			if err != nil {
-				return nil, err
-			}
-		}
-	} else {
-		tagArgs := []string{"tag", "--batch"}
-		cmd, err := nm.rawWrite(tagArgs...)
-		if err != nil {
-			return nil, err
-		}
-
-		for _, msgArgs := range allArgs {
-			io.WriteString(cmd, fmt.Sprintf("%s\n", strings.Join(msgArgs, " ")))
-		}
-		err = cmd.Close()
-		if err != nil {
-			return nil, err
+		changes[i] = notmuchTagChange{
+			query:     "id:" + mid,
+			ops:       msgArgs,
+			removeAll: mode == SET,
 		}
 	}
 
-	return nm.Fetch(mbox, sequenceSet, []fetchArgument{{text: "FLAGS"}}, useUids)
-}
-
-// -----------------
-//  Message parsers
-// -----------------
-
-// A parser that needs the full body of the message to work
-type messageParser interface {
-	read(io.Reader) error
-
-	getKey() string
-
-	// Valid only after the full message has been written
-	getValue() string
-}
-
-// RFC822.SIZE
-type rfc822sizeParser struct {
-	size int
-}
-
-func (sp *rfc822sizeParser) read(r io.Reader) error {
-	n, err := io.Copy(ioutil.Discard, r)
+	err = nm.transport.tag(changes)
 	if err != nil {
-		return err
-	}
-	sp.size = int(n)
-	return nil
-}
-
-func (sp *rfc822sizeParser) getKey() string   { return "RFC822.SIZE" }
-func (sp *rfc822sizeParser) getValue() string { return strconv.Itoa(sp.size) }
-
-// ENVELOPE
-type envelopeParser struct {
-	envelope string
-}
-
-func (ep *envelopeParser) read(r io.Reader) error {
-	tpReader := textproto.NewReader(bufio.NewReader(r))
-	hdr, err := tpReader.ReadMIMEHeader()
-	if err != nil {
-		return err
+		return nil, err
 	}
 
-	messageId := hdr.Get("Message-Id")
-	if messageId[0] == lessThan && messageId[len(messageId)-1] == moreThan {
-		messageId = messageId[1 : len(messageId)-1]
-	}
-	// Technically if a field doesn't exist the corresponding value should
-	// be NIL; only if it exists AND is empty should it be set to "".
-	fields := []string{
-		quote(hdr.Get("Date")), literalify(hdr.Get("Subject")),
-		addresses(hdr, "From"), addresses(hdr, "Sender"), addresses(hdr, "Reply-To"), addresses(hdr, "To"), addresses(hdr, "Cc"), addresses(hdr, "Bcc"),
-		quote(hdr.Get("In-Reply-To")), quote(messageId),
-	}
-	ep.envelope = `(` + strings.Join(fields, " ") + `)`
-	return nil
+	// The messages may have left the mailbox: they are reported as they
+	// were numbered before
+	return nm.fetchMids(uids, mids, []fetchArgument{{text: "FLAGS"}})
 }
 
-func (ep *envelopeParser) getKey() string   { return "ENVELOPE" }
-func (ep *envelopeParser) getValue() string { return ep.envelope }
-
 // ---------------------------
 //          Helpers
 // ---------------------------
@@ -1091,62 +709,14 @@ func literalify(in string) string {
 	return fmt.Sprintf("{%d}\r\n%s", len(in), in)
 }
 
-func (nm *NotmuchMailstore) uidToMid() []string {
-	nm.cache.Lock()
-	defer nm.cache.Unlock()
-	if nm.uidToMidMap != nil {
-		return nm.uidToMidMap
-	}
-
-	var mids []string
-	err := nm.json(&mids, "search", "--format=json", "--output=messages", "--sort=oldest-first", "*")
-	if err != nil {
-		log.Println(err)
-		return nil
-	}
-
-	mids = append(mids, "")
-	copy(mids[1:], mids[0:])
-	nm.uidToMidMap = mids
-	return mids
-}
-
-func (nm *NotmuchMailstore) midToUid() map[string]int {
-	nm.cache.Lock()
-	defer nm.cache.Unlock()
-	if nm.midToUidMap != nil {
-		return nm.midToUidMap
-	}
-
-	var mids []string
-	err := nm.json(&mids, "search", "--format=json", "--output=messages", "--sort=oldest-first", "*")
-	if err != nil {
-		log.Println(err)
-		return nil
-	}
-
-	m := make(map[string]int)
-	for i, mid := range mids {
-		m[mid] = i + 1
-	}
-
-	nm.midToUidMap = m
-	return m
-}
-
+// messageIds returns the message ids of the mailbox, in sequence order,
+// which is also UID order
 func (nm *NotmuchMailstore) messageIds(mailboxId Id) ([]string, error) {
-	threads, err := nm.threads("tag:" + string(mailboxId))
+	uids, err := nm.mailboxUids(mailboxId)
 	if err != nil {
 		return nil, err
 	}
-	flat := flatten(threads)
-	sort.Sort(byDate(flat))
-
-	var ids []string
-	for _, msg := range flat {
-		ids = append(ids, msg.Id)
-	}
-	return ids, nil
+	return uids.mids, nil
 }
 
 func flatten(threads []Message) []Message {
@@ -1178,163 +748,128 @@ func aggregate(flat []Message, threads []Message) []Message {
 	return flat
 }
 
-func (nm *NotmuchMailstore) getMessage(mid string) (Message, error) {
-	threads, err := nm.threads("id:" + mid)
-	if err != nil {
-		return Message{}, err
+// getMessagesBatch is the number of messages getMessages asks notmuch
+// for at once, to keep queries reasonably small
+const getMessagesBatch = 100
+
+// getMessages returns the messages, by message id, with a few queries
+// for all of them
+func (nm *NotmuchMailstore) getMessages(mids []string) (map[string]Message, error) {
+	wanted := make(map[string]struct{}, len(mids))
+	for _, mid := range mids {
+		wanted[mid] = struct{}{}
 	}
-	flat := flatten(threads)
 
-	tags := make(map[string]struct{})
-	var message Message
-	for _, msg := range flat {
-		for _, tag := range msg.Tags {
-			tags[tag] = struct{}{}
+	messages := make(map[string]Message, len(mids))
+	for start := 0; start < len(mids); start += getMessagesBatch {
+		end := start + getMessagesBatch
+		if end > len(mids) {
+			end = len(mids)
 		}
-		if msg.Id == mid {
-			message = msg
+		terms := make([]string, 0, end-start)
+		for _, mid := range mids[start:end] {
+			terms = append(terms, "id:"+mid)
 		}
-	}
+		threads, err := nm.threads(strings.Join(terms, " or "))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, thread := range threads {
+			flat := flatten([]Message{thread})
+			tags := make(map[string]struct{})
+			for _, msg := range flat {
+				for _, tag := range msg.Tags {
+					tags[tag] = struct{}{}
+				}
+			}
 
-	// Fakely add tags as if they were part of the message
-	newTags := make([]string, 0, len(tags))
-	for tag := range tags {
-		newTags = append(newTags, tag)
+			// Fakely add tags as if they were part of the message
+			threadTags := make([]string, 0, len(tags))
+			for tag := range tags {
+				threadTags = append(threadTags, tag)
+			}
+			for _, msg := range flat {
+				if _, ok := wanted[msg.Id]; ok {
+					msg.Tags = threadTags
+					msg.Children = nil
+					messages[msg.Id] = msg
+				}
+			}
+		}
 	}
-	message.Tags = newTags
-	return message, nil
+	return messages, nil
 }
 
-func (nm *NotmuchMailstore) threads(query string) ([]Message, error) {
-	var threads []Message
-
-	var ok bool
-	nm.cache.RLock()
-	threads, ok = nm.threadsCache[query]
-	nm.cache.RUnlock()
-	if ok {
-		return threads, nil
+// readMessage returns the content of the message. Its file may have been
+// renamed since notmuch was asked, by synchronized maildir flags for
+// instance; notmuch is then asked again.
+func (nm *NotmuchMailstore) readMessage(msg Message) ([]byte, error) {
+	for _, filename := range msg.Filenames {
+		raw, err := ioutil.ReadFile(filename)
+		if err == nil {
+			return raw, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
 	}
-
-	var tids []string
-	err := nm.json(&tids, "search", "--format=json", "--output=threads", "--sort=oldest-first", query)
+	filename, err := nm.transport.filename(msg.Id)
 	if err != nil {
 		return nil, err
 	}
+	return ioutil.ReadFile(filename)
+}
 
-	threads = make([]Message, 0)
-	if len(tids) > 1 {
-		log.Println(len(tids), "threads for query", fmt.Sprintf("%q", query))
-	}
-
-	for _, tid := range tids {
-		var result []interface{}
-		err = nm.json(&result, "show", "--format=json", "--body=false", "--", "thread:"+tid)
+func (nm *NotmuchMailstore) threads(query string) ([]Message, error) {
+	// Only cache big queries, such as tag-wide or database-wide
+	cacheable := !strings.Contains(query, " ") && (strings.HasPrefix(query, "tag:") || query == "*")
+	if cacheable {
+		err := nm.checkChanges()
 		if err != nil {
 			return nil, err
 		}
-		for _, thread := range result {
-			topLevelMessages := thread.([]interface{})
-			var threadRoot Message
-			tags := make([]string, 0)
-			threadRoot, tags = newMessage(topLevelMessages[0], tags)
-			if len(topLevelMessages) > 1 {
-				for _, topLevelMessage := range topLevelMessages[1:] {
-					var directChild Message
-					directChild, tags = newMessage(topLevelMessage, tags)
-					threadRoot.Children = append(threadRoot.Children, directChild)
-				}
-			}
-			threads = append(threads, threadRoot)
-
-			/*
-				// Eliminate duplicate in tags
-				sort.Strings(tags)
-				tagsMap := make(map[string]struct{})
-				for _, tag := range tags {
-					tagsMap[tag] = struct{}{}
-					if _, ok := nm.allMessages[tag]; !ok {
-						nm.allMessages[tag] = make(map[string]Message)
-					}
-				}
+		nm.cache.RLock()
+		cached, ok := nm.threadsCache[query]
+		nm.cache.RUnlock()
+		if ok {
+			return cached.threads, nil
+		}
+	}
 
-				// Flatten list of messages
-				flat := make([]Message, 0)
-				var flatten func(messages []Message, message Message) []Message
-				flatten = func(messages []Message, message Message) []Message {
-					messages = append(messages, message)
-					for _, child := range message.Children {
-						messages = flatten(messages, child)
-					}
-					return messages
-				}
-				flat = flatten(flat, threadRoot)
+	found, err := nm.transport.threads(query)
+	if err != nil {
+		return nil, err
+	}
 
-				// Assign messages to all tags
-				for _, message := range flat {
-					for tag := range tagsMap {
-						nm.allMessages[tag][message.Id] = message
-					}
-				}
-			*/
+	threads := make([]Message, 0, len(found))
+	var matches int
+	for _, topLevelMessages := range found {
+		if len(topLevelMessages) == 0 {
+			continue
+		}
+		threadRoot := topLevelMessages[0]
+		threadRoot.Children = append(threadRoot.Children, topLevelMessages[1:]...)
+		threads = append(threads, threadRoot)
+		for _, msg := range flatten([]Message{threadRoot}) {
+			if msg.Match {
+				matches++
+			}
 		}
 	}
 
-	// Only cache big queries, such as tag-wide or database-wide
-	if !strings.Contains(query, " ") && (strings.HasPrefix(query, "tag:") || query == "*") {
+	if cacheable {
 		nm.cache.Lock()
 		if nm.threadsCache == nil {
-			nm.threadsCache = make(map[string][]Message)
+			nm.threadsCache = make(map[string]cachedThreads)
 		}
-		nm.threadsCache[query] = threads
+		nm.threadsCache[query] = cachedThreads{threads: threads, matches: matches}
 		nm.cache.Unlock()
 	}
 
 	return threads, nil
 }
 
-func newMessage(raw interface{}, allTags []string) (Message, []string) {
-	messageAndChildren := raw.([]interface{})
-	message := messageAndChildren[0].(map[string]interface{})
-	children := messageAndChildren[1].([]interface{})
-
-	tags := message["tags"].([]interface{})
-
-	msg := Message{
-		Id:       message["id"].(string),
-		Tags:     make([]string, 0, len(tags)),
-		Children: make([]Message, 0, len(children)),
-	}
-	for _, tag := range tags {
-		msg.Tags = append(msg.Tags, tag.(string))
-	}
-
-	headers := message["headers"].(map[string]interface{})
-	maybe := func(raw interface{}) string {
-		if str, ok := raw.(string); ok {
-			return str
-		}
-		return ""
-	}
-	msg.Header = MessageHeader{
-		Subject: maybe(headers["Subject"]),
-		From:    maybe(headers["From"]),
-		To:      maybe(headers["To"]),
-		Cc:      maybe(headers["Cc"]),
-		Bcc:     maybe(headers["Bcc"]),
-		ReplyTo: maybe(headers["Reply-To"]),
-		Date:    maybe(headers["Date"]),
-	}
-
-	for _, childRaw := range children {
-		var child Message
-		child, allTags = newMessage(childRaw, allTags)
-		msg.Children = append(msg.Children, child)
-	}
-	allTags = append(allTags, msg.Tags...)
-	return msg, allTags
-}
-
 func quote(in string) string {
 	return `"` + in + `"`
 }
@@ -1362,132 +897,3 @@ func addresses(hdr map[string][]string, key string) string {
 	}
 	return `(` + strings.Join(addresses, " ") + `)`
 }
-
-// ---------------------------
-//      Notmuch wrapper
-// ---------------------------
-
-// A wrapper around a shell command that implements io.Read, io.Write and
-// io.Close.
-// io.Read will read from the command's stdoutpipe and io.Write will
-// write to the command's stdinpipe. io.Close will close the command,
-// properly closing all resources. A notmuchCommand  MUST be closed,
-// otherwise resources are leaked
-type writingNotmuchCommand struct {
-	l    *sync.RWMutex
-	args []string
-	cmd  *exec.Cmd
-	io.Reader
-	io.WriteCloser
-
-	// Used for clearing cache
-	nm *NotmuchMailstore
-}
-
-func (c writingNotmuchCommand) Close() error {
-	err := c.WriteCloser.Close()
-	if err == nil {
-		err = c.cmd.Wait()
-	}
-	if err != nil {
-		log.Println("Error closing", c.args, ": ", err)
-	}
-	c.l.Unlock()
-
-	c.nm.cache.Lock()
-	c.nm.uidToMidMap = nil
-	c.nm.midToUidMap = nil
-	c.nm.threadsCache = nil
-	c.nm.cache.Unlock()
-	return err
-}
-
-func (nm *NotmuchMailstore) rawWrite(args ...string) (writingNotmuchCommand, error) {
-	nm.l.Lock()
-	cmd := exec.Command(
-		"notmuch",
-		args...)
-	cmd.Stderr = os.Stderr
-	out, err := cmd.StdoutPipe()
-	if err != nil {
-		return writingNotmuchCommand{}, err
-	}
-	in, err := cmd.StdinPipe()
-	if err != nil {
-		return writingNotmuchCommand{}, err
-	}
-	err = cmd.Start()
-	if err != nil {
-		return writingNotmuchCommand{}, err
-	}
-
-	return writingNotmuchCommand{
-		l:           &nm.l,
-		args:        args,
-		cmd:         cmd,
-		Reader:      out,
-		WriteCloser: in,
-		nm:          nm,
-	}, nil
-
-}
-
-// Same thing without the writing part
-type notmuchCommand struct {
-	l    *sync.RWMutex
-	args []string
-	cmd  *exec.Cmd
-	io.Reader
-}
-
-func (c notmuchCommand) Close() error {
-	io.Copy(ioutil.Discard, c.Reader)
-	err := c.cmd.Wait()
-	if err != nil {
-		log.Println("Error closing", c.args, ": ", err)
-	}
-	c.l.RUnlock()
-	return err
-}
-
-func (nm *NotmuchMailstore) json(out interface{}, args ...string) error {
-	cmd, err := nm.raw(args...)
-	defer cmd.Close()
-	if err != nil {
-		return err
-	}
-	return json.NewDecoder(cmd).Decode(&out)
-}
-
-func (nm *NotmuchMailstore) raw(args ...string) (notmuchCommand, error) {
-	nm.l.RLock()
-	cmd := exec.Command(
-		"notmuch",
-		args...)
-	cmd.Stderr = os.Stderr
-	out, err := cmd.StdoutPipe()
-	if err != nil {
-		return notmuchCommand{}, err
-	}
-	err = cmd.Start()
-	if err != nil {
-		return notmuchCommand{}, err
-	}
-
-	return notmuchCommand{
-		l:      &nm.l,
-		args:   args,
-		cmd:    cmd,
-		Reader: out,
-	}, nil
-}
-
-type byDate []Message
-
-func (b byDate) Len() int { return len(b) }
-func (b byDate) Less(i, j int) bool {
-	left, _ := time.Parse("Mon, 2 Jan 2006 15:04:05 -0700", b[i].Header.Date)
-	right, _ := time.Parse("Mon, 2 Jan 2006 15:04:05 -0700", b[j].Header.Date)
-	return left.Before(right)
-}
-func (b byDate) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
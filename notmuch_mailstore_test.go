@@ -1,6 +1,23 @@
 package unpeu
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestParseSearchArguments(t *testing.T) {
 	// We're using the lexer to parse IMAP input. We'll assume the lexer
@@ -16,7 +33,7 @@ func TestParseSearchArguments(t *testing.T) {
 		{"KEYWORD deleted", "(tag:deleted)"},
 		{"SEEN", "(-tag:unread)"},
 		{"NOT SEEN", "(tag:unread)"},
-		{"SENTSINCE 20-Jan-2012", "(date:20-Jan-2012..)"},
+		{"SENTSINCE 20-Jan-2012", "(date:2012-01-19..)"},
 		{`BODY "How are you ?"`, `("How are you ?")`},
 		{"OR DELETED SEEN", "((tag:deleted) OR (-tag:unread))"},
 		{"OR DELETED NOT SEEN", "((tag:deleted) OR (tag:unread))"},
@@ -29,7 +46,7 @@ func TestParseSearchArguments(t *testing.T) {
 			t.Logf("Invalid input: %q", v.input)
 			t.Fatal(err)
 		}
-		actualOutput := parseSearchArguments(args)
+		actualOutput, _ := newNotmuchFlags(nil).parseSearchArguments(args)
 
 		if v.output != actualOutput {
 			t.Log("Invalid parsing of search arguments for", v.input)
@@ -39,3 +56,959 @@ func TestParseSearchArguments(t *testing.T) {
 		}
 	}
 }
+
+// TestNotmuchFlagTags tests that flags follow the configured tags
+func TestNotmuchFlagTags(t *testing.T) {
+	f := newNotmuchFlags(map[string]string{"\\Flagged": "important"})
+	args, _ := aggregateSearchArguments([]byte("FLAGGED UNDELETED"))
+	if query, _ := f.parseSearchArguments(args); query != "(tag:important -tag:deleted)" {
+		t.Errorf("Invalid query: %s", query)
+	}
+	if f.tag("\\Flagged") != "important" || f.tagFlags["important"] != "\\Flagged" {
+		t.Errorf("Invalid mapping of \\Flagged: %v", f.flagTags)
+	}
+	if f.tag("\\Answered") != "\\Answered" {
+		t.Errorf("Unconfigured flags are mapped: %v", f.flagTags)
+	}
+}
+
+// TestNotmuchOptionsForUser tests that the options of a user are the
+// template with their username
+func TestNotmuchOptionsForUser(t *testing.T) {
+	template := NotmuchOptions{
+		Binary:       "/opt/notmuch-%s/bin/notmuch",
+		ConfigPath:   "/home/%s/.notmuch-config",
+		DatabasePath: "/srv/mail/%s",
+		Maildir:      "%s/new",
+		QueriesPath:  "/etc/unpeu/%s.queries",
+		FlagTags:     map[string]string{"\\Flagged": "important"},
+	}
+	opts, err := template.forUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := NotmuchOptions{
+		Binary:       "/opt/notmuch-alice/bin/notmuch",
+		ConfigPath:   "/home/alice/.notmuch-config",
+		DatabasePath: "/srv/mail/alice",
+		Maildir:      "alice/new",
+		QueriesPath:  "/etc/unpeu/alice.queries",
+		FlagTags:     map[string]string{"\\Flagged": "important"},
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("Invalid options: %+v", opts)
+	}
+	opts.FlagTags["\\Draft"] = "draft"
+	if len(template.FlagTags) != 1 {
+		t.Errorf("Users share the flag tags of the template")
+	}
+
+	// Usernames can't reach out of the paths
+	for _, username := range []string{"", ".", "...", "../bob", "x/../../etc", "a\\b", "a\x00b", "a..b"} {
+		if _, err := template.forUser(username); err == nil {
+			t.Errorf("Invalid username %q is accepted", username)
+		}
+	}
+
+	// Users can't share a UID file
+	if _, err := NotmuchMailstoreFactory(NotmuchOptions{UidsPath: "/var/lib/unpeu/uids.db"}); err == nil {
+		t.Errorf("A UidsPath without %%s is accepted")
+	}
+	if _, err := NotmuchMailstoreFactory(NotmuchOptions{UidsPath: "/var/lib/unpeu/%s.db"}); err != nil {
+		t.Error("Invalid template:", err)
+	}
+}
+
+// notmuchSearchVectors are searches over the INBOX of the fixture in
+// testdata, with the expected sequence ids
+var notmuchSearchVectors = []struct {
+	input  string
+	output []int
+}{
+	{"ALL", []int{1, 2, 3, 4}},
+	{"SEEN", []int{2, 3}},
+	{"UNSEEN", []int{1, 4}},
+	{"UNANSWERED", []int{1, 3, 4}},
+	{"FLAGGED", []int{2}},
+	{"DELETED", []int{3}},
+	{"DRAFT", []int{4}},
+	{"RECENT", []int{4}},
+	{"NEW", []int{4}},
+	{"OLD", []int{1, 2, 3}},
+	{"FROM carol", []int{3}},
+	{"TO bob", []int{1, 4}},
+	{"CC carol", []int{1}},
+	{"BCC dave", []int{2}},
+	{`SUBJECT "hello"`, []int{1, 2}},
+	{`BODY "are you"`, []int{1}},
+	{"TEXT carol", []int{1, 3}},
+	{"HEADER X-Priority 1", []int{2}},
+	{`HEADER X-Priority ""`, []int{2}},
+	{"LARGER 2000", []int{3}},
+	{"SMALLER 2000", []int{1, 2, 4}},
+	{"NOT LARGER 2000", []int{1, 2, 4}},
+	{"OR CC carol LARGER 2000", []int{1, 3}},
+	{"BEFORE 21-Jan-2012", []int{1}},
+	{"ON 21-Jan-2012", []int{2}},
+	{"SENTSINCE 22-Jan-2012", []int{3, 4}},
+	{"NOT SENTBEFORE 21-Jan-2012", []int{2, 3, 4}},
+	{"UID 2:3", []int{2, 3}},
+	{"UID 4:*", []int{4}},
+	{"2,4", []int{2, 4}},
+	{"*", []int{4}},
+	{"SEEN NOT (OR FROM bob HEADER X-Priority 1)", []int{3}},
+}
+
+// fixtureTags reads the tags of the fixture messages, by message id
+func fixtureTags(t *testing.T) map[string][]string {
+	f, err := os.Open(filepath.Join("testdata", "notmuch-tags"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tags := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " -- id:", 2)
+		for _, tag := range strings.Fields(parts[0]) {
+			tags[parts[1]] = append(tags[parts[1]], strings.TrimPrefix(tag, "+"))
+		}
+	}
+	return tags
+}
+
+func TestNotmuchPostFilter(t *testing.T) {
+	// Build the candidates straight from the fixture files, so that the
+	// post-filter can be tested without notmuch
+	files, err := filepath.Glob(filepath.Join("testdata", "maildir", "cur", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	tags := fixtureTags(t)
+
+	// The mailbox is the INBOX: the messages tagged inbox, numbered in it
+	nm := &NotmuchMailstore{flags: newNotmuchFlags(nil)}
+	candidates := make([]*notmuchCandidate, 0, len(files))
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(parsed.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := strings.Trim(parsed.Header.Get("Message-Id"), "<>")
+		inInbox := false
+		for _, tag := range tags[id] {
+			inInbox = inInbox || tag == "inbox"
+		}
+		if !inInbox {
+			continue
+		}
+		candidates = append(candidates, &notmuchCandidate{
+			nm: nm,
+			msg: Message{
+				Id:        id,
+				Filenames: []string{file},
+				Tags:      tags[id],
+				Header: MessageHeader{
+					Subject: parsed.Header.Get("Subject"),
+					From:    parsed.Header.Get("From"),
+					To:      parsed.Header.Get("To"),
+					Cc:      parsed.Header.Get("Cc"),
+					Bcc:     parsed.Header.Get("Bcc"),
+					Date:    parsed.Header.Get("Date"),
+				},
+			},
+			uid:    len(candidates) + 1,
+			seq:    len(candidates) + 1,
+			parsed: parsed,
+			body:   body,
+			size:   int64(len(raw)),
+		})
+	}
+	ctx := newSearchContext(len(candidates), len(candidates))
+
+	for _, v := range notmuchSearchVectors {
+		args, err := aggregateSearchArguments([]byte(v.input))
+		if err != nil {
+			t.Fatalf("Invalid input %q: %s", v.input, err)
+		}
+
+		actual := make([]int, 0)
+		for _, c := range candidates {
+			ok, err := matchSearch(ctx, args, c)
+			if err != nil {
+				t.Fatalf("Error filtering %q: %s", v.input, err)
+			}
+			if ok {
+				actual = append(actual, c.seq)
+			}
+		}
+		if !reflect.DeepEqual(actual, v.output) {
+			t.Errorf("Invalid post-filtering for %q: got %v, expected %v", v.input, actual, v.output)
+		}
+	}
+}
+
+// forEachNotmuchTransport runs the test with a fresh fixture for each
+// available transport, so that they all go through the same tests
+func forEachNotmuchTransport(t *testing.T, test func(t *testing.T, nm *NotmuchMailstore)) {
+	names := make([]string, 0, len(notmuchTransports))
+	for name := range notmuchTransports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			nm, cleanup := setupNotmuchFixture(t, name)
+			defer cleanup()
+			test(t, nm)
+		})
+	}
+}
+
+// setupNotmuchFixture builds a notmuch database from the maildir in
+// testdata, tagged as described in testdata/notmuch-tags, and opens it
+// with the given transport. The test is skipped if notmuch isn't
+// installed, as it is needed to build the database.
+func setupNotmuchFixture(t *testing.T, transport string) (nm *NotmuchMailstore, cleanup func()) {
+	if _, err := exec.LookPath("notmuch"); err != nil {
+		t.Skip("notmuch is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "unpeu-notmuch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	maildir := filepath.Join(dir, "mail")
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		err = os.MkdirAll(filepath.Join(maildir, sub), 0700)
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join("testdata", "maildir", "cur", "*"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(maildir, "cur", filepath.Base(file)), content, 0600)
+		}
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+
+	config := filepath.Join(dir, "notmuch-config")
+	err = ioutil.WriteFile(config, []byte(fmt.Sprintf(
+		"[database]\npath=%s\n[new]\ntags=unread;inbox;\n[maildir]\nsynchronize_flags=false\n",
+		maildir)), 0600)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	os.Setenv("NOTMUCH_CONFIG", config)
+
+	tags, err := filepath.Abs(filepath.Join("testdata", "notmuch-tags"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"new", "--quiet"}, {"restore", "--input=" + tags}} {
+		out, err := exec.Command("notmuch", args...).CombinedOutput()
+		if err != nil {
+			cleanup()
+			t.Fatalf("notmuch %s: %s\n%s", args[0], err, out)
+		}
+	}
+
+	nm = NewNotmuchMailstore()
+	nm.transport, err = notmuchTransports[transport](NotmuchOptions{})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	nm.uidsPath = filepath.Join(dir, "uids.db")
+	cleanup = func() {
+		if nm.uidsDB != nil {
+			nm.uidsDB.Close()
+		}
+		os.RemoveAll(dir)
+	}
+	return nm, cleanup
+}
+
+func TestNotmuchSearch(t *testing.T) {
+	forEachNotmuchTransport(t, testNotmuchSearch)
+}
+
+func testNotmuchSearch(t *testing.T, nm *NotmuchMailstore) {
+	for _, v := range notmuchSearchVectors {
+		args, err := aggregateSearchArguments([]byte(v.input))
+		if err != nil {
+			t.Fatalf("Invalid input %q: %s", v.input, err)
+		}
+		results, err := nm.Search(Id("inbox"), args, false, false)
+		if err != nil {
+			t.Fatalf("Error searching %q: %s", v.input, err)
+		}
+
+		actual := make([]int, 0, len(results))
+		for _, result := range results {
+			actual = append(actual, result.id)
+		}
+		if !reflect.DeepEqual(actual, v.output) {
+			t.Errorf("Invalid search results for %q: got %v, expected %v", v.input, actual, v.output)
+		}
+	}
+}
+
+func TestSyncUids(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unpeu-uids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := openUidDatabase(filepath.Join(dir, "uids.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	steps := []struct {
+		mids    []string
+		uids    []int
+		uidNext int
+	}{
+		{[]string{"a", "b", "c"}, []int{1, 2, 3}, 4},
+		// Nothing changed, nothing moves
+		{[]string{"a", "b", "c"}, []int{1, 2, 3}, 4},
+		// b is gone for good, d is new
+		{[]string{"a", "c", "d"}, []int{1, 3, 4}, 5},
+		// b is back, but as a new message
+		{[]string{"b", "a", "c", "d"}, []int{1, 3, 4, 5}, 6},
+		// Empty mailbox; UIDNEXT must not go back
+		{[]string{}, []int{}, 6},
+		{[]string{"e"}, []int{6}, 7},
+	}
+
+	var uidValidity uint32
+	for i, step := range steps {
+		u, err := syncUids(db, Id("inbox"), step.mids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			uidValidity = u.uidValidity
+		} else if u.uidValidity != uidValidity {
+			t.Errorf("Step %d: UIDVALIDITY changed from %d to %d", i, uidValidity, u.uidValidity)
+		}
+		if u.uidNext != step.uidNext {
+			t.Errorf("Step %d: got UIDNEXT %d, expected %d", i, u.uidNext, step.uidNext)
+		}
+		if len(u.uids) != len(step.uids) {
+			t.Fatalf("Step %d: got UIDs %v, expected %v", i, u.uids, step.uids)
+		}
+		for j, uid := range step.uids {
+			if u.uids[j] != uid {
+				t.Fatalf("Step %d: got UIDs %v, expected %v", i, u.uids, step.uids)
+			}
+			if u.sequenceId(u.mids[j]) != j+1 {
+				t.Errorf("Step %d: %s has sequence id %d, expected %d", i, u.mids[j], u.sequenceId(u.mids[j]), j+1)
+			}
+		}
+	}
+
+	// Other mailboxes have their own numbering
+	u, err := syncUids(db, Id("spam"), []string{"c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.midToUid["c"] != 1 {
+		t.Errorf("Got UID %d in another mailbox, expected 1", u.midToUid["c"])
+	}
+}
+
+func TestMergeChanges(t *testing.T) {
+	previous := []string{"a", "b", "c"}
+	changed := map[string]struct{}{"b": {}, "c": {}, "d": {}, "e": {}}
+	// b left, c got a new tag, d and e arrived
+	actual := mergeChanges(previous, changed, []string{"c", "d", "e"})
+	expected := []string{"a", "c", "d", "e"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got %v, expected %v", actual, expected)
+	}
+}
+
+func TestNotmuchNewMailMidSession(t *testing.T) {
+	forEachNotmuchTransport(t, testNotmuchNewMailMidSession)
+}
+
+func testNotmuchNewMailMidSession(t *testing.T, nm *NotmuchMailstore) {
+	total, err := nm.TotalMessages(Id("inbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unseen, err := nm.CountUnseen(Id("inbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uidNext, err := nm.NextUid(Id("inbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := nm.Fetch(Id("inbox"), "1:*", []fetchArgument{{text: "UID"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deliver a new message behind the server's back
+	out, err := exec.Command("notmuch", "config", "get", "database.path").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	maildir := strings.TrimSpace(string(out))
+	message := "From: carol@example.com\r\n" +
+		"To: me@unpeu.test\r\n" +
+		"Subject: Late news\r\n" +
+		"Date: Mon, 23 Jan 2012 10:00:00 +0000\r\n" +
+		"Message-Id: <m6@unpeu.test>\r\n" +
+		"\r\n" +
+		"Hot off the press.\r\n"
+	err = ioutil.WriteFile(filepath.Join(maildir, "new", "1327312800.M6P1.fixture"), []byte(message), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = exec.Command("notmuch", "new", "--quiet").CombinedOutput()
+	if err != nil {
+		t.Fatalf("notmuch new: %s\n%s", err, out)
+	}
+
+	newTotal, err := nm.TotalMessages(Id("inbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newTotal != total+1 {
+		t.Errorf("Got %d messages after delivery, expected %d", newTotal, total+1)
+	}
+	newUnseen, err := nm.CountUnseen(Id("inbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newUnseen != unseen+1 {
+		t.Errorf("Got %d unseen messages after delivery, expected %d", newUnseen, unseen+1)
+	}
+	newUidNext, err := nm.NextUid(Id("inbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newUidNext != uidNext+1 {
+		t.Errorf("Got UIDNEXT %d after delivery, expected %d", newUidNext, uidNext+1)
+	}
+
+	// Existing messages keep their UID, the new one gets the old UIDNEXT
+	after, err := nm.Fetch(Id("inbox"), "1:*", []fetchArgument{{text: "UID"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before)+1 {
+		t.Fatalf("Got %d messages, expected %d", len(after), len(before)+1)
+	}
+	for i := range before {
+		if !reflect.DeepEqual(before[i], after[i]) {
+			t.Errorf("Message %d changed from %v to %v", i+1, before[i], after[i])
+		}
+	}
+	last := after[len(after)-1]
+	if last.items[0].value != strconv.Itoa(int(uidNext)) {
+		t.Errorf("New message has UID %s, expected %d", last.items[0].value, uidNext)
+	}
+
+	// A tag change outside of the server is seen too
+	out, err = exec.Command("notmuch", "tag", "-inbox", "--", "id:m6@unpeu.test").CombinedOutput()
+	if err != nil {
+		t.Fatalf("notmuch tag: %s\n%s", err, out)
+	}
+	newTotal, err = nm.TotalMessages(Id("inbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newTotal != total {
+		t.Errorf("Got %d messages after untagging, expected %d", newTotal, total)
+	}
+}
+
+// TestNotmuchTransports checks that all transports return what the CLI
+// returns
+func TestNotmuchTransports(t *testing.T) {
+	if len(notmuchTransports) < 2 {
+		t.Skip("The CLI is the only transport in this build")
+	}
+	cli, cleanup := setupNotmuchFixture(t, "cli")
+	defer cleanup()
+
+	// Each call returns what the transport returned, and an error
+	calls := map[string]func(transport notmuchTransport) (interface{}, error){
+		"revision": func(transport notmuchTransport) (interface{}, error) {
+			uuid, lastmod, err := transport.revision()
+			return []interface{}{uuid, lastmod}, err
+		},
+		"count": func(transport notmuchTransport) (interface{}, error) {
+			return transport.count("tag:unread")
+		},
+		"messageIds": func(transport notmuchTransport) (interface{}, error) {
+			return transport.messageIds("*", 0)
+		},
+		"messageIds with limit": func(transport notmuchTransport) (interface{}, error) {
+			return transport.messageIds("tag:inbox", 1)
+		},
+		"messages": func(transport notmuchTransport) (interface{}, error) {
+			messages, err := transport.messages("tag:unread")
+			sort.Slice(messages, func(i, j int) bool { return messages[i].Id < messages[j].Id })
+			return messages, err
+		},
+		"threads": func(transport notmuchTransport) (interface{}, error) {
+			return transport.threads("tag:inbox")
+		},
+		"filename": func(transport notmuchTransport) (interface{}, error) {
+			return transport.filename("m2@unpeu.test")
+		},
+		"tags": func(transport notmuchTransport) (interface{}, error) {
+			return transport.tags()
+		},
+		"queries": func(transport notmuchTransport) (interface{}, error) {
+			return transport.queries()
+		},
+	}
+
+	for name, newTransport := range notmuchTransports {
+		if name == "cli" {
+			continue
+		}
+		transport, err := newTransport(NotmuchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for call, fn := range calls {
+			expected, err := fn(cli.transport)
+			if err != nil {
+				t.Fatalf("cli: %s: %s", call, err)
+			}
+			actual, err := fn(transport)
+			if err != nil {
+				t.Errorf("%s: %s: %s", name, call, err)
+				continue
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("%s: %s: got %+v, expected %+v", name, call, actual, expected)
+			}
+		}
+	}
+}
+
+var testTags = map[string]struct{}{
+	"inbox":             {},
+	"inbox/later":       {},
+	"lists/golang/dev":  {},
+	"lists/golang/nuts": {},
+	"lists/notmuch":     {},
+	"unread":            {},
+}
+
+func TestTagMailboxes(t *testing.T) {
+	vectors := []struct {
+		path     []string
+		children []string
+	}{
+		{[]string{}, []string{"INBOX", "lists (\\Noselect)", "unread"}},
+		{[]string{"INBOX"}, []string{"INBOX/later"}},
+		{[]string{"lists"}, []string{"lists/golang (\\Noselect)", "lists/notmuch"}},
+		{[]string{"lists", "golang"}, []string{"lists/golang/dev", "lists/golang/nuts"}},
+		{[]string{"lists", "golang", "dev"}, []string{}},
+		{[]string{"nothing"}, []string{}},
+	}
+	for _, v := range vectors {
+		actual := make([]string, 0)
+		for _, mbox := range tagMailboxChildren(testTags, v.path) {
+			name := mbox.Name
+			if mbox.Flags != 0 {
+				name += " (" + joinMailboxFlags(mbox) + ")"
+			}
+			actual = append(actual, name)
+		}
+		if !reflect.DeepEqual(actual, v.children) {
+			t.Errorf("Invalid children of %v: got %v, expected %v", v.path, actual, v.children)
+		}
+	}
+
+	lookups := []struct {
+		path  []string
+		id    Id
+		flags uint8
+	}{
+		{[]string{"inbox"}, "inbox", 0},
+		{[]string{"INBOX", "later"}, "inbox/later", 0},
+		{[]string{"lists"}, "lists", Noselect},
+		{[]string{"lists", "golang"}, "lists/golang", Noselect},
+		{[]string{"lists", "golang", "dev"}, "lists/golang/dev", 0},
+		{[]string{"lists", "go"}, "", 0},
+		{[]string{"golang"}, "", 0},
+	}
+	for _, v := range lookups {
+		mbox := lookupTagMailbox(testTags, v.path)
+		if v.id == "" {
+			if mbox != nil {
+				t.Errorf("Unexpected mailbox at %v: %v", v.path, mbox)
+			}
+			continue
+		}
+		if mbox == nil {
+			t.Errorf("No mailbox at %v", v.path)
+			continue
+		}
+		if mbox.Id != v.id || mbox.Flags != v.flags {
+			t.Errorf("Invalid mailbox at %v: got %s with flags %d, expected %s with flags %d", v.path, mbox.Id, mbox.Flags, v.id, v.flags)
+		}
+	}
+}
+
+func TestQueryMailboxes(t *testing.T) {
+	config := "# Saved queries\n" +
+		"database.path=/tmp/mail\n" +
+		"query.recent=tag:inbox and date:7d..\n" +
+		"\n" +
+		"query.lists/golang=tag:lists/golang/dev or tag:lists/golang/nuts\n"
+	queries, err := parseQueries(strings.NewReader(config), true)
+	if err != nil {
+		t.Fatal("Couldn't parse queries:", err)
+	}
+	expected := map[string]string{
+		"recent":       "tag:inbox and date:7d..",
+		"lists/golang": "tag:lists/golang/dev or tag:lists/golang/nuts",
+	}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("Invalid queries: got %v, expected %v", queries, expected)
+	}
+
+	// The queries file doesn't need the prefix
+	fromFile, err := parseQueries(strings.NewReader("boss = from:boss@example.com\n"), false)
+	if err != nil || fromFile["boss"] != "from:boss@example.com" {
+		t.Errorf("Invalid queries from file: %v (%v)", fromFile, err)
+	}
+	if _, err := parseQueries(strings.NewReader("boss\n"), false); err == nil {
+		t.Error("Query without definition was accepted")
+	}
+
+	actual := make([]string, 0)
+	for _, mbox := range queryMailboxes(queries, []string{queriesMailbox}) {
+		actual = append(actual, fmt.Sprintf("%s %s %d", mbox.Name, mbox.Id, mbox.Flags))
+	}
+	children := []string{
+		fmt.Sprintf("Queries/lists %s %d", "query:lists", Noselect),
+		"Queries/recent query:recent 0",
+	}
+	if !reflect.DeepEqual(actual, children) {
+		t.Errorf("Invalid query mailboxes: got %v, expected %v", actual, children)
+	}
+
+	lookups := []struct {
+		path  []string
+		id    Id
+		flags uint8
+	}{
+		{[]string{"Queries"}, "", Noselect},
+		{[]string{"Queries", "recent"}, "query:recent", 0},
+		{[]string{"Queries", "lists", "golang"}, "query:lists/golang", 0},
+		{[]string{"Queries", "INBOX"}, "", 0},
+		{[]string{"Queries", "nothing"}, "", 0},
+	}
+	for _, v := range lookups {
+		mbox := lookupQueryMailbox(queries, v.path)
+		if v.id == "" && v.flags == 0 {
+			if mbox != nil {
+				t.Errorf("Unexpected mailbox at %v: %v", v.path, mbox)
+			}
+			continue
+		}
+		if mbox == nil {
+			t.Errorf("No mailbox at %v", v.path)
+			continue
+		}
+		if mbox.Id != v.id || mbox.Flags != v.flags || mbox.Name != strings.Join(v.path, "/") {
+			t.Errorf("Invalid mailbox at %v: got %s %s with flags %d, expected %s with flags %d", v.path, mbox.Name, mbox.Id, mbox.Flags, v.id, v.flags)
+		}
+	}
+	if lookupQueryMailbox(nil, []string{"Queries"}) != nil {
+		t.Error("Queries exists without any query")
+	}
+
+	nm := &NotmuchMailstore{savedQueries: queries}
+	query, err := nm.cachedMailboxQuery("query:recent")
+	if err != nil || query != "(tag:inbox and date:7d..)" {
+		t.Errorf("Invalid query of query:recent: %q (%v)", query, err)
+	}
+	if deletedTagOp("query:recent", true) != "+deleted" || deletedTagOp("lists/notmuch", true) != "-lists/notmuch" {
+		t.Error("Invalid \\Deleted operations")
+	}
+	if nm.AppendMessage("Queries/recent", nil, time.Now(), "") != ErrCannotAppend {
+		t.Error("APPEND to a query mailbox wasn't refused")
+	}
+}
+
+// fakeNotmuch is a notmuch database in memory, holding message ids and
+// their tags, for the tests that don't need the messages themselves. It
+// only knows the queries the mailstore makes on its own: terms joined
+// with "and" or "or", and tag:, id:, lastmod: and *.
+type fakeNotmuch struct {
+	l        sync.Mutex
+	lastmod  uint64
+	mids     []string
+	tagsOf   map[string][]string
+	modified map[string]uint64
+}
+
+func newFakeNotmuch(tags map[string][]string, mids ...string) *fakeNotmuch {
+	f := &fakeNotmuch{lastmod: 1, mids: mids, tagsOf: tags, modified: make(map[string]uint64)}
+	for _, mid := range mids {
+		f.modified[mid] = 1
+	}
+	return f
+}
+
+// matches tells whether the message matches the query. The lock must be
+// held.
+func (f *fakeNotmuch) matches(query, mid string) bool {
+	for _, conjunct := range strings.Split(query, " and ") {
+		matched := false
+		for _, term := range strings.Split(strings.Trim(conjunct, "()"), " or ") {
+			matched = matched || f.matchesTerm(term, mid)
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeNotmuch) matchesTerm(term, mid string) bool {
+	switch {
+	case term == "*":
+		return true
+	case strings.HasPrefix(term, "id:"):
+		return term[len("id:"):] == mid
+	case strings.HasPrefix(term, "tag:"):
+		for _, tag := range f.tagsOf[mid] {
+			if tag == term[len("tag:"):] {
+				return true
+			}
+		}
+	case strings.HasPrefix(term, "lastmod:"):
+		var from, to uint64
+		fmt.Sscanf(term, "lastmod:%d..%d", &from, &to)
+		return f.modified[mid] >= from && f.modified[mid] <= to
+	}
+	return false
+}
+
+func (f *fakeNotmuch) revision() (string, uint64, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return "fake", f.lastmod, nil
+}
+
+func (f *fakeNotmuch) count(query string) (int, error) {
+	mids, err := f.messageIds(query, 0)
+	return len(mids), err
+}
+
+func (f *fakeNotmuch) messageIds(query string, limit int) ([]string, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	var mids []string
+	for _, mid := range f.mids {
+		if f.matches(query, mid) && (limit == 0 || len(mids) < limit) {
+			mids = append(mids, mid)
+		}
+	}
+	return mids, nil
+}
+
+func (f *fakeNotmuch) messages(query string) ([]Message, error) {
+	mids, _ := f.messageIds(query, 0)
+	f.l.Lock()
+	defer f.l.Unlock()
+	messages := make([]Message, 0, len(mids))
+	for _, mid := range mids {
+		messages = append(messages, Message{Id: mid, Match: true, Tags: append([]string{}, f.tagsOf[mid]...)})
+	}
+	return messages, nil
+}
+
+func (f *fakeNotmuch) threads(query string) ([][]Message, error) {
+	messages, _ := f.messages(query)
+	threads := make([][]Message, 0, len(messages))
+	for _, msg := range messages {
+		threads = append(threads, []Message{msg})
+	}
+	return threads, nil
+}
+
+func (f *fakeNotmuch) filename(mid string) (string, error) {
+	return "", fmt.Errorf("No file for %s", mid)
+}
+
+func (f *fakeNotmuch) tags() ([]string, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	seen := make(map[string]struct{})
+	var tags []string
+	for _, mid := range f.mids {
+		for _, tag := range f.tagsOf[mid] {
+			if _, ok := seen[tag]; !ok {
+				seen[tag] = struct{}{}
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (f *fakeNotmuch) queries() (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (f *fakeNotmuch) tag(changes []notmuchTagChange) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.lastmod++
+	for _, change := range changes {
+		for _, mid := range f.mids {
+			if !f.matches(change.query, mid) {
+				continue
+			}
+			tags := make(map[string]bool)
+			if !change.removeAll {
+				for _, tag := range f.tagsOf[mid] {
+					tags[tag] = true
+				}
+			}
+			for _, op := range change.ops {
+				tags[op[1:]] = op[0] == '+'
+			}
+			f.tagsOf[mid] = nil
+			for tag, set := range tags {
+				if set {
+					f.tagsOf[mid] = append(f.tagsOf[mid], tag)
+				}
+			}
+			sort.Strings(f.tagsOf[mid])
+			f.modified[mid] = f.lastmod
+		}
+	}
+	return nil
+}
+
+func (f *fakeNotmuch) insert(folder string, message io.Reader, ops []string) error {
+	return fmt.Errorf("Can't insert in the fake database")
+}
+
+// TestNotmuchSessionNumbering tests that messages leaving the selected tag
+// mailbox keep their sequence id until it is selected again
+func TestNotmuchSessionNumbering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unpeu-notmuch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := newFakeNotmuch(map[string][]string{
+		"m1": {"work"},
+		"m2": {"work"},
+		"m3": {"work"},
+	}, "m1", "m2", "m3")
+	nm := NewNotmuchMailstoreWithOptions(NotmuchOptions{UidsPath: filepath.Join(dir, "uids.db")})
+	nm.transport = db
+	defer func() {
+		if nm.uidsDB != nil {
+			nm.uidsDB.Close()
+		}
+	}()
+
+	s := NewServer(StoreOption(nm))
+	sess := createSession("1", s.config, s, nil, nil)
+	sess.st = authenticated
+	if resp := (&selectMailbox{tag: "A1", mailbox: "work"}).execute(sess); resp.condition != "OK" {
+		t.Fatalf("Can't select: %s %s", resp.condition, resp.message)
+	}
+
+	// m2 leaves the mailbox, but is still the second message
+	store := &storeCmd{tag: "A2", itemName: "+FLAGS", sequenceSet: "2", flags: []string{"\\Deleted"}}
+	resp := store.execute(sess)
+	if resp.condition != "OK" || len(resp.untagged) != 1 || !strings.HasPrefix(resp.untagged[0], "2 FETCH") {
+		t.Fatalf("Invalid STORE \\Deleted: %s %s %q", resp.condition, resp.message, resp.untagged)
+	}
+	store = &storeCmd{tag: "A3", itemName: "+FLAGS", sequenceSet: "2", flags: []string{"\\Flagged"}}
+	resp = store.execute(sess)
+	if resp.condition != "OK" || len(resp.untagged) != 1 || !strings.HasPrefix(resp.untagged[0], "2 FETCH") {
+		t.Fatalf("Invalid STORE \\Flagged: %s %s %q", resp.condition, resp.message, resp.untagged)
+	}
+	expected := map[string][]string{"m1": {"work"}, "m2": {"starred"}, "m3": {"work"}}
+	if !reflect.DeepEqual(db.tagsOf, expected) {
+		t.Errorf("Invalid tags: got %v, expected %v", db.tagsOf, expected)
+	}
+	if resp := (&fetchCmd{tag: "A4", sequenceSet: "3", args: []fetchArgument{{text: "UID"}}}).execute(sess); resp.condition != "OK" {
+		t.Errorf("Can't fetch the third message: %s %s", resp.condition, resp.message)
+	}
+
+	// Selecting the mailbox again numbers it again
+	if resp := (&selectMailbox{tag: "A5", mailbox: "work"}).execute(sess); resp.condition != "OK" {
+		t.Fatalf("Can't select: %s %s", resp.condition, resp.message)
+	}
+	if total, _ := sess.mailstore.TotalMessages("work"); total != 2 {
+		t.Errorf("Invalid total after selecting again: %d", total)
+	}
+}
+
+// TestNotmuchCandidateFlags tests that post-filtering sees the flags FETCH
+// FLAGS returns: mapped tags only as their system flag
+func TestNotmuchCandidateFlags(t *testing.T) {
+	nm := &NotmuchMailstore{flags: newNotmuchFlags(nil)}
+	c := &notmuchCandidate{nm: nm, msg: Message{Tags: []string{"starred", "unread", "todo", recentTag}}}
+	expected := []string{"\\Flagged", "todo", recentTag, "\\Recent"}
+	if flags := c.Flags(); !reflect.DeepEqual(flags, expected) {
+		t.Errorf("Invalid flags: %v, expected %v", flags, expected)
+	}
+
+	ctx := newSearchContext(1, 1)
+	for input, expected := range map[string]bool{
+		"FLAGGED":         true,
+		"KEYWORD starred": false,
+		"KEYWORD todo":    true,
+		"UNSEEN":          true,
+	} {
+		args, err := aggregateSearchArguments([]byte(input))
+		if err != nil {
+			t.Fatalf("Invalid input %q: %s", input, err)
+		}
+		if ok, err := matchSearch(ctx, args, c); ok != expected || err != nil {
+			t.Errorf("Invalid match of %q: %v (%v)", input, ok, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package unpeu
+
+import (
+	"strings"
+)
+
+// NotmuchOptions configures a NotmuchMailstore. Empty fields take the
+// defaults of notmuch and of the user running the server.
+type NotmuchOptions struct {
+	// Binary is the notmuch binary run by the CLI transport. notmuch is
+	// looked up in the PATH if it is empty.
+	Binary string
+	// ConfigPath is the notmuch configuration file. notmuch finds it by
+	// itself, with NOTMUCH_CONFIG or at its default location, if it is
+	// empty.
+	ConfigPath string
+	// DatabasePath overrides the path of the database given in the
+	// configuration
+	DatabasePath string
+	// Maildir is the folder APPENDed messages are delivered to, relative
+	// to the root of the database. APPEND fails if it is empty.
+	Maildir string
+	// UidsPath is the file where UIDs are kept, by default in
+	// $XDG_DATA_HOME/unpeu
+	UidsPath string
+	// QueriesPath is a file of saved queries, read in addition to those
+	// of the notmuch configuration
+	QueriesPath string
+	// FlagTags maps IMAP flags to the notmuch tags that represent them.
+	// DefaultNotmuchFlagTags is used if it is nil.
+	FlagTags map[string]string
+}
+
+// DefaultNotmuchFlagTags returns the tags that represent IMAP flags when
+// nothing else is configured. The map can be modified. Mailboxes aren't
+// flags: the INBOX is always the inbox tag (see mailboxTag).
+func DefaultNotmuchFlagTags() map[string]string {
+	return map[string]string{
+		"\\Flagged":  "starred",
+		"\\Deleted":  "deleted",
+		"\\Draft":    "draft",
+		"\\Answered": "answered",
+	}
+}
+
+// recentTag is the notmuch tag used to represent the \Recent flag
+const recentTag = "new"
+
+// notmuchFlags translates IMAP flags and flag search keys into notmuch
+// tags and queries, and back
+type notmuchFlags struct {
+	// flagTags maps flags to tags
+	flagTags map[string]string
+	// tagFlags maps tags to flags
+	tagFlags map[string]string
+	// keywordQueries maps the search keys about flags to queries
+	keywordQueries map[string]string
+}
+
+func newNotmuchFlags(flagTags map[string]string) *notmuchFlags {
+	if flagTags == nil {
+		flagTags = DefaultNotmuchFlagTags()
+	}
+	f := &notmuchFlags{
+		flagTags: make(map[string]string),
+		tagFlags: make(map[string]string),
+	}
+	for flag, tag := range flagTags {
+		f.flagTags[flag] = tag
+		f.tagFlags[tag] = flag
+	}
+
+	f.keywordQueries = map[string]string{
+		"SEEN":   "-tag:unread",
+		"UNSEEN": "tag:unread",
+
+		// Messages freshly delivered (by notmuch new or APPEND) carry the
+		// "new" tag, which is the closest thing notmuch has to \Recent
+		"RECENT": "tag:" + recentTag,
+		"OLD":    "-tag:" + recentTag,
+		"NEW":    "(tag:" + recentTag + " tag:unread)",
+	}
+	for _, key := range []string{"ANSWERED", "DELETED", "DRAFT", "FLAGGED"} {
+		flag := "\\" + key[:1] + strings.ToLower(key[1:])
+		tag, ok := f.flagTags[flag]
+		if !ok {
+			tag = strings.ToLower(key)
+		}
+		f.keywordQueries[key] = "tag:" + tag
+		f.keywordQueries["UN"+key] = "-tag:" + tag
+	}
+	return f
+}
+
+// imapFlags returns the flags of a message with the tags: mapped tags as
+// their flag, other tags as keywords, and \Seen unless it is unread
+func (f *notmuchFlags) imapFlags(tags []string) []string {
+	flags := make([]string, 0, len(tags)+1)
+	var unread bool
+	for _, tag := range tags {
+		if flag, ok := f.tagFlags[tag]; ok {
+			flags = append(flags, flag)
+		} else if tag == "unread" {
+			unread = true
+		} else {
+			flags = append(flags, tag)
+		}
+	}
+	if !unread {
+		flags = append(flags, "\\Seen")
+	}
+	return flags
+}
+
+// tag returns the tag representing the flag: the configured one, or the
+// flag itself
+func (f *notmuchFlags) tag(flag string) string {
+	if tag, ok := f.flagTags[flag]; ok {
+		return tag
+	}
+	return flag
+}
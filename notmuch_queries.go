@@ -0,0 +1,191 @@
+package unpeu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Saved notmuch queries are exposed as virtual mailboxes under
+// queriesMailbox. They come from the query.* entries of the notmuch
+// configuration, and from the queries file if there is one. The queries
+// file has the same format as the output of notmuch config list:
+//
+//	# Comments and empty lines are ignored
+//	query.recent=tag:inbox and date:7d..
+//	query.boss=from:boss@example.com
+//
+// The "query." prefix is optional in the queries file. Its queries take
+// precedence over those of the notmuch configuration.
+const queriesMailbox = "Queries"
+
+// queryIdPrefix is the prefix of the Id of query mailboxes; other
+// mailboxes have the tag as their Id
+const queryIdPrefix = "query:"
+
+// parseQueries reads saved queries, one name=query per line
+func parseQueries(rd io.Reader, requirePrefix bool) (map[string]string, error) {
+	queries := make(map[string]string)
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "query.") {
+			line = line[len("query."):]
+		} else if requirePrefix {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid query %q", line)
+		}
+		name := strings.TrimSpace(parts[0])
+		query := strings.TrimSpace(parts[1])
+		if name == "" || query == "" {
+			return nil, fmt.Errorf("Invalid query %q", line)
+		}
+		queries[name] = query
+	}
+	return queries, scanner.Err()
+}
+
+// loadQueries reads the saved queries and makes them the current ones.
+// Mailboxes whose query changed lose their cached UIDs.
+func (nm *NotmuchMailstore) loadQueries() (map[string]string, error) {
+	queries, err := nm.transport.queries()
+	if err != nil {
+		return nil, err
+	}
+
+	if nm.queriesPath != "" {
+		f, err := os.Open(nm.queriesPath)
+		if err != nil {
+			return nil, err
+		}
+		fromFile, err := parseQueries(f, false)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", nm.queriesPath, err)
+		}
+		for name, query := range fromFile {
+			queries[name] = query
+		}
+	}
+
+	nm.cache.Lock()
+	for name, query := range nm.savedQueries {
+		if queries[name] != query {
+			delete(nm.uidsCache, Id(queryIdPrefix+name))
+		}
+	}
+	nm.savedQueries = queries
+	nm.cache.Unlock()
+	return queries, nil
+}
+
+// mailboxQuery returns the notmuch query matching the messages of the
+// mailbox
+func (nm *NotmuchMailstore) mailboxQuery(mbox Id) (string, error) {
+	if isQueryMailbox(mbox) {
+		nm.cache.RLock()
+		loaded := nm.savedQueries != nil
+		nm.cache.RUnlock()
+		if !loaded {
+			_, err := nm.loadQueries()
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	nm.cache.RLock()
+	defer nm.cache.RUnlock()
+	return nm.cachedMailboxQuery(mbox)
+}
+
+// cachedMailboxQuery is mailboxQuery with the saved queries already
+// loaded. The cache lock must be held.
+func (nm *NotmuchMailstore) cachedMailboxQuery(mbox Id) (string, error) {
+	if !isQueryMailbox(mbox) {
+		return "tag:" + string(mbox), nil
+	}
+	name := string(mbox)[len(queryIdPrefix):]
+	query, ok := nm.savedQueries[name]
+	if !ok {
+		return "", fmt.Errorf("No saved query %q", name)
+	}
+	return "(" + query + ")", nil
+}
+
+// isQueryMailbox returns true if the mailbox is a saved query
+func isQueryMailbox(mbox Id) bool {
+	return strings.HasPrefix(string(mbox), queryIdPrefix)
+}
+
+// deletedTagOp returns the tag operation that sets, or clears, \Deleted
+// on a message of the mailbox. Messages leave a tag mailbox when they lose
+// the tag; a query mailbox can't be left, so its messages are tagged as
+// deleted instead.
+func deletedTagOp(mbox Id, set bool) string {
+	if isQueryMailbox(mbox) {
+		if set {
+			return "+deleted"
+		}
+		return "-deleted"
+	}
+	if set {
+		return "-" + string(mbox)
+	}
+	return "+" + string(mbox)
+}
+
+// queryMailboxes returns the query mailboxes directly under the given
+// path, which starts with queriesMailbox
+func queryMailboxes(queries map[string]string, path []string) []*Mailbox {
+	names := make(map[string]struct{}, len(queries))
+	for name := range queries {
+		names[name] = struct{}{}
+	}
+	children := tagMailboxChildren(names, path[1:])
+	for _, mbox := range children {
+		toQueryMailbox(mbox)
+	}
+	return children
+}
+
+// lookupQueryMailbox returns the query mailbox at the given path, which
+// starts with queriesMailbox, or nil if there is none
+func lookupQueryMailbox(queries map[string]string, path []string) *Mailbox {
+	if len(path) == 1 {
+		if len(queries) == 0 {
+			return nil
+		}
+		return newTagMailbox(path, "", Noselect)
+	}
+	names := make(map[string]struct{}, len(queries))
+	for name := range queries {
+		names[name] = struct{}{}
+	}
+	mbox := lookupTagMailbox(names, path[1:])
+	if mbox == nil {
+		return nil
+	}
+	// lookupTagMailbox always finds the INBOX
+	if _, ok := queries[string(mbox.Id)]; !ok && mbox.Flags&Noselect == 0 {
+		return nil
+	}
+	toQueryMailbox(mbox)
+	return mbox
+}
+
+// toQueryMailbox turns a mailbox found among query names into the
+// corresponding query mailbox
+func toQueryMailbox(mbox *Mailbox) {
+	mbox.Path = append([]string{queriesMailbox}, strings.Split(string(mbox.Id), tagDelimiter)...)
+	mbox.Name = strings.Join(mbox.Path, string(pathDelimiter))
+	mbox.Id = Id(queryIdPrefix + string(mbox.Id))
+}
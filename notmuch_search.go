@@ -0,0 +1,179 @@
+package unpeu
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"time"
+)
+
+// exactSearchKeys are the search keys that notmuch can express exactly.
+// Every other key is only approximated by the notmuch query and must go
+// through the post-filter
+var exactSearchKeys = map[string]struct{}{
+	"":               struct{}{}, // groups and ORs
+	"ALL":            struct{}{},
+	"ANSWERED":       struct{}{},
+	"DELETED":        struct{}{},
+	"DRAFT":          struct{}{},
+	"FLAGGED":        struct{}{},
+	"SEEN":           struct{}{},
+	"UNANSWERED":     struct{}{},
+	"UNDELETED":      struct{}{},
+	"UNDRAFT":        struct{}{},
+	"UNFLAGGED":      struct{}{},
+	"UNSEEN":         struct{}{},
+	"NEW":            struct{}{},
+	"OLD":            struct{}{},
+	"RECENT":         struct{}{},
+	"KEYWORD":        struct{}{},
+	"UNKEYWORD":      struct{}{},
+	"REFERENCES":     struct{}{},
+	"REFS":           struct{}{},
+	"ORDEREDSUBJECT": struct{}{},
+}
+
+// needsPostFilter returns true if any of the arguments, at any depth,
+// can't be expressed exactly as a notmuch query
+func needsPostFilter(args []searchArgument) bool {
+	for _, arg := range args {
+		if _, ok := exactSearchKeys[arg.key]; !ok {
+			return true
+		}
+		if needsPostFilter(arg.children) {
+			return true
+		}
+	}
+	return false
+}
+
+// notmuchDate formats a date for the notmuch date: prefix
+func notmuchDate(date time.Time) string {
+	return date.Format("2006-01-02")
+}
+
+// postFilter runs the notmuch query and only keeps the messages that match
+// all the search arguments. It returns the message ids of those messages.
+func (nm *NotmuchMailstore) postFilter(query string, args []searchArgument, midToUid, midToSequenceId map[string]int) ([]string, error) {
+	candidates, err := nm.transport.messages(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var maxUid int
+	for _, uid := range midToUid {
+		if uid > maxUid {
+			maxUid = uid
+		}
+	}
+
+	ctx := newSearchContext(maxUid, len(midToSequenceId))
+	mids := make([]string, 0, len(candidates))
+	for _, msg := range candidates {
+		c := &notmuchCandidate{
+			nm:  nm,
+			msg: msg,
+			uid: midToUid[msg.Id],
+			seq: midToSequenceId[msg.Id],
+		}
+		ok, err := matchSearch(ctx, args, c)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't filter %s: %s", msg.Id, err)
+		}
+		if ok {
+			mids = append(mids, msg.Id)
+		}
+	}
+	return mids, nil
+}
+
+// notmuchCandidate is a message returned by the notmuch query, as seen by
+// the search evaluator
+type notmuchCandidate struct {
+	nm  *NotmuchMailstore
+	msg Message
+
+	uid int
+	seq int
+
+	// Lazily loaded, only for the keys that need the full message
+	parsed *mail.Message
+	body   []byte
+	size   int64
+}
+
+var _ searchableMessage = &notmuchCandidate{}
+
+// Flags are those of FETCH FLAGS, so that both agree, with \Recent for
+// the messages that still have the recent tag
+func (c *notmuchCandidate) Flags() []string {
+	flags := c.nm.flags.imapFlags(c.msg.Tags)
+	for _, tag := range c.msg.Tags {
+		if tag == recentTag {
+			flags = append(flags, "\\Recent")
+		}
+	}
+	return flags
+}
+
+// InternalDate is the Date header for notmuch, in its own timezone
+func (c *notmuchCandidate) InternalDate() time.Time {
+	date, err := mail.ParseDate(c.msg.Header.Date)
+	if err != nil {
+		return time.Unix(c.msg.Timestamp, 0)
+	}
+	return date
+}
+
+// Size returns the size of the message, preferably without reading it
+func (c *notmuchCandidate) Size() (int64, error) {
+	if len(c.msg.Filenames) > 0 {
+		info, err := os.Stat(c.msg.Filenames[0])
+		if err == nil {
+			return info.Size(), nil
+		}
+	}
+	err := c.load()
+	return c.size, err
+}
+
+func (c *notmuchCandidate) Header() (mail.Header, error) {
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return c.parsed.Header, nil
+}
+
+func (c *notmuchCandidate) Body() (io.ReadCloser, error) {
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(c.body)), nil
+}
+
+func (c *notmuchCandidate) Uid() int        { return c.uid }
+func (c *notmuchCandidate) SequenceId() int { return c.seq }
+
+// load reads the full message, once
+func (c *notmuchCandidate) load() error {
+	if c.parsed != nil {
+		return nil
+	}
+	raw, err := c.nm.readMessage(c.msg)
+	if err != nil {
+		return err
+	}
+	c.size = int64(len(raw))
+
+	c.parsed, err = mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	c.body, err = ioutil.ReadAll(c.parsed.Body)
+	return err
+}
@@ -0,0 +1,91 @@
+package unpeu
+
+import (
+	"sync"
+)
+
+// notmuchSession is the notmuch mailstore as one session sees it.
+//
+// A message leaves a tag mailbox as soon as it loses the tag, be it from
+// another client or from STORE +FLAGS \Deleted in this session. Sequence
+// ids can't change without the server sending EXPUNGE, which it can't do
+// yet, so the session keeps the messages of the selected mailbox as they
+// were when it was selected, and only adds the new ones at the end. The
+// mailbox is numbered again when it is selected again.
+type notmuchSession struct {
+	*NotmuchMailstore
+
+	l        sync.Mutex
+	selected Id
+	view     *mailboxUids
+}
+
+// newSession returns the mailstore of a new session
+func (nm *NotmuchMailstore) newSession() Mailstore {
+	return &notmuchSession{NotmuchMailstore: nm}
+}
+
+// selectMailbox forgets the numbering of the previously selected mailbox
+func (s *notmuchSession) selectMailbox(mbox Id) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.selected = mbox
+	s.view = nil
+}
+
+// sessionUids returns the UID mapping of the mailbox as the session sees
+// it: the one of the selected mailbox is kept between commands
+func (s *notmuchSession) sessionUids(mbox Id) (*mailboxUids, error) {
+	current, err := s.mailboxUids(mbox)
+	if err != nil {
+		return nil, err
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	if mbox != s.selected {
+		return current, nil
+	}
+	if s.view == nil {
+		s.view = current
+	} else {
+		s.view = s.view.withNew(current)
+	}
+	return s.view, nil
+}
+
+func (s *notmuchSession) TotalMessages(mbox Id) (int64, error) {
+	uids, err := s.sessionUids(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(uids.mids)), nil
+}
+
+func (s *notmuchSession) Search(mailbox Id, args []searchArgument, returnUid, returnThreads bool) ([]threadMember, error) {
+	uids, err := s.sessionUids(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	return s.search(uids, mailbox, args, returnUid, returnThreads)
+}
+
+func (s *notmuchSession) Fetch(mailbox Id, sequenceSet string, args []fetchArgument, useUids bool) ([]messageFetchResponse, error) {
+	uids, err := s.sessionUids(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	mids, err := uids.resolve(sequenceSet, useUids)
+	if err != nil {
+		return nil, err
+	}
+	return s.fetchMids(uids, mids, args)
+}
+
+func (s *notmuchSession) Flag(mode flagMode, mbox Id, sequenceSet string, useUids bool, flags []string) ([]messageFetchResponse, error) {
+	uids, err := s.sessionUids(mbox)
+	if err != nil {
+		return nil, err
+	}
+	return s.flag(uids, mode, mbox, sequenceSet, useUids, flags)
+}
@@ -0,0 +1,402 @@
+package unpeu
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// notmuchTransport is how the NotmuchMailstore reaches the database.
+// Transports are used concurrently: they must let reads run together,
+// and run each write alone.
+type notmuchTransport interface {
+	// revision returns the uuid and the current revision of the database
+	revision() (uuid string, lastmod uint64, err error)
+	// count returns the number of messages matching the query
+	count(query string) (int, error)
+	// messageIds returns the ids of the messages matching the query,
+	// oldest first. Only the first limit ones are returned, unless limit
+	// is 0.
+	messageIds(query string, limit int) ([]string, error)
+	// messages returns the messages matching the query, without their
+	// replies
+	messages(query string) ([]Message, error)
+	// threads returns the threads of the messages matching the query,
+	// oldest first. A thread is its top-level messages, with all their
+	// replies as children; Match tells which ones matched the query.
+	threads(query string) ([][]Message, error)
+	// filename returns the path of a file of the message
+	filename(mid string) (string, error)
+	// tags returns all the tags in the database
+	tags() ([]string, error)
+	// queries returns the queries saved in the database, by name
+	queries() (map[string]string, error)
+
+	// tag runs the tag changes, in order
+	tag(changes []notmuchTagChange) error
+	// insert delivers the message in the folder, relative to the root of
+	// the database, and indexes it with the tags configured for new
+	// messages and the given tag operations
+	insert(folder string, message io.Reader, ops []string) error
+}
+
+// notmuchTagChange is a list of tag operations, "+tag" or "-tag", on the
+// messages matching a query
+type notmuchTagChange struct {
+	query string
+	ops   []string
+	// removeAll removes all the tags before running the operations
+	removeAll bool
+}
+
+// notmuchTransports are the available transports, by name. They are
+// created with the options of the mailstore, of which they use those
+// telling how to reach the database. Transports that depend on build tags
+// register themselves here.
+var notmuchTransports = map[string]func(opts NotmuchOptions) (notmuchTransport, error){
+	"cli": newCliTransport,
+}
+
+// defaultNotmuchTransport is the name of the transport used by
+// NewNotmuchMailstore
+var defaultNotmuchTransport = "cli"
+
+// newNotmuchTransport returns the default transport, falling back to the
+// CLI if it can't be used
+func newNotmuchTransport(opts NotmuchOptions) notmuchTransport {
+	t, err := notmuchTransports[defaultNotmuchTransport](opts)
+	if err != nil {
+		log.Printf("Couldn't use the %s notmuch transport, falling back to the CLI: %s\n", defaultNotmuchTransport, err)
+		t, _ = newCliTransport(opts)
+	}
+	return t
+}
+
+// cliTransport forks the notmuch binary for each command. notmuch locks
+// the database itself, but a writer failing to get the lock is an error:
+// writes are kept from running concurrently with anything else.
+type cliTransport struct {
+	l      sync.RWMutex
+	binary string
+	// The environment of the commands, or nil for the one of the server
+	env []string
+}
+
+func newCliTransport(opts NotmuchOptions) (notmuchTransport, error) {
+	t := &cliTransport{binary: opts.Binary}
+	if t.binary == "" {
+		t.binary = "notmuch"
+	}
+	if opts.ConfigPath != "" || opts.DatabasePath != "" {
+		t.env = os.Environ()
+	}
+	if opts.ConfigPath != "" {
+		t.env = append(t.env, "NOTMUCH_CONFIG="+opts.ConfigPath)
+	}
+	if opts.DatabasePath != "" {
+		t.env = append(t.env, "NOTMUCH_DATABASE="+opts.DatabasePath)
+	}
+	return t, nil
+}
+
+// output runs a command that doesn't modify the database, and returns
+// what it outputs
+func (t *cliTransport) output(args ...string) ([]byte, error) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	cmd := exec.Command(t.binary, args...)
+	cmd.Env = t.env
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("notmuch %s: %s", strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+func (t *cliTransport) json(out interface{}, args ...string) error {
+	raw, err := t.output(args...)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// run runs a command that modifies the database, with the given input
+func (t *cliTransport) run(input io.Reader, args ...string) error {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	cmd := exec.Command(t.binary, args...)
+	cmd.Env = t.env
+	cmd.Stdin = input
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("notmuch %s: %s", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+func (t *cliTransport) revision() (string, uint64, error) {
+	line, err := t.output("count", "--lastmod")
+	if err != nil {
+		return "", 0, err
+	}
+
+	// <count> TAB <uuid> TAB <lastmod>
+	parts := strings.Split(strings.TrimSpace(string(line)), "\t")
+	if len(parts) != 3 {
+		return "", 0, fmt.Errorf("Invalid revision %q", line)
+	}
+	lastmod, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid revision %q", line)
+	}
+	return parts[1], lastmod, nil
+}
+
+func (t *cliTransport) count(query string) (int, error) {
+	out, err := t.output("count", "--", query)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+func (t *cliTransport) messageIds(query string, limit int) ([]string, error) {
+	args := []string{"search", "--format=json", "--output=messages", "--sort=oldest-first"}
+	if limit > 0 {
+		args = append(args, "--limit="+strconv.Itoa(limit))
+	}
+	var mids []string
+	err := t.json(&mids, append(args, "--", query)...)
+	return mids, err
+}
+
+func (t *cliTransport) messages(query string) ([]Message, error) {
+	var threads []interface{}
+	err := t.json(&threads, "show", "--format=json", "--body=false", "--entire-thread=false", "--", query)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+	for _, thread := range threads {
+		topLevelMessages, _ := thread.([]interface{})
+		for _, topLevelMessage := range topLevelMessages {
+			messages = matchingMessages(messages, topLevelMessage)
+		}
+	}
+	return messages, nil
+}
+
+// threads shows all the threads at once. notmuch show doesn't sort them
+// the way search does, so they are sorted here like notmuch sorts them:
+// by their oldest matching message.
+func (t *cliTransport) threads(query string) ([][]Message, error) {
+	var result []interface{}
+	err := t.json(&result, "show", "--format=json", "--body=false", "--", query)
+	if err != nil {
+		return nil, err
+	}
+
+	threads := make([][]Message, 0, len(result))
+	for _, thread := range result {
+		topLevelMessages := thread.([]interface{})
+		messages := make([]Message, 0, len(topLevelMessages))
+		for _, topLevelMessage := range topLevelMessages {
+			messages = append(messages, newMessage(topLevelMessage))
+		}
+		threads = append(threads, messages)
+	}
+	sort.Stable(threadsByDate(threads))
+	return threads, nil
+}
+
+func (t *cliTransport) filename(mid string) (string, error) {
+	var filenames []string
+	err := t.json(&filenames, "search", "--format=json", "--output=files", "--", "id:"+mid)
+	if err != nil {
+		return "", err
+	}
+	if len(filenames) == 0 {
+		return "", fmt.Errorf("No file for message %s", mid)
+	}
+	return filenames[0], nil
+}
+
+func (t *cliTransport) tags() ([]string, error) {
+	var tags []string
+	err := t.json(&tags, "search", "--output=tags", "--format=json", "*")
+	return tags, err
+}
+
+func (t *cliTransport) queries() (map[string]string, error) {
+	out, err := t.output("config", "list")
+	if err != nil {
+		return nil, err
+	}
+	return parseQueries(bytes.NewReader(out), true)
+}
+
+// tag runs all the changes in a single notmuch tag --batch, except those
+// removing all tags which --batch doesn't support
+func (t *cliTransport) tag(changes []notmuchTagChange) error {
+	var batch bytes.Buffer
+	for _, change := range changes {
+		if change.removeAll {
+			args := append([]string{"tag", "--remove-all"}, change.ops...)
+			err := t.run(nil, append(args, "--", change.query)...)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, op := range change.ops {
+			batch.WriteString(op[:1] + batchEncode(op[1:]) + " ")
+		}
+		batch.WriteString("-- " + batchEncode(change.query) + "\n")
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	return t.run(&batch, "tag", "--batch")
+}
+
+// batchEncode hex-encodes the characters of a tag or a query that can't
+// appear as is in the input of notmuch tag --batch
+func batchEncode(in string) string {
+	var out bytes.Buffer
+	for i := 0; i < len(in); i++ {
+		c := in[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			strings.IndexByte("+-_@=.,:<>/", c) >= 0:
+			out.WriteByte(c)
+		default:
+			fmt.Fprintf(&out, "%%%02x", c)
+		}
+	}
+	return out.String()
+}
+
+func (t *cliTransport) insert(folder string, message io.Reader, ops []string) error {
+	args := append([]string{"insert", "--folder=" + folder}, ops...)
+	return t.run(message, args...)
+}
+
+// threadsByDate sorts threads by the date of their oldest matching
+// message
+type threadsByDate [][]Message
+
+func (t threadsByDate) Len() int           { return len(t) }
+func (t threadsByDate) Less(i, j int) bool { return oldestMatch(t[i]) < oldestMatch(t[j]) }
+func (t threadsByDate) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+func oldestMatch(thread []Message) int64 {
+	var oldest int64
+	var found bool
+	for _, msg := range flatten(thread) {
+		if msg.Match && (!found || msg.Timestamp < oldest) {
+			oldest = msg.Timestamp
+			found = true
+		}
+	}
+	return oldest
+}
+
+// matchingMessages walks a message and its replies as output by notmuch
+// show, and appends those that matched the query. Messages that didn't
+// match are output as null when --entire-thread=false.
+func matchingMessages(out []Message, raw interface{}) []Message {
+	messageAndChildren, ok := raw.([]interface{})
+	if !ok || len(messageAndChildren) != 2 {
+		return out
+	}
+	if message, ok := messageAndChildren[0].(map[string]interface{}); ok {
+		msg := messageFromJSON(message)
+		if msg.Match {
+			out = append(out, msg)
+		}
+	}
+	children, _ := messageAndChildren[1].([]interface{})
+	for _, child := range children {
+		out = matchingMessages(out, child)
+	}
+	return out
+}
+
+// We know the notmuch output structure, and it's not going to change,
+// so we can bypass cast verification
+func newMessage(raw interface{}) Message {
+	messageAndChildren := raw.([]interface{})
+	message := messageAndChildren[0].(map[string]interface{})
+	children := messageAndChildren[1].([]interface{})
+
+	msg := messageFromJSON(message)
+	msg.Children = make([]Message, 0, len(children))
+	for _, child := range children {
+		msg.Children = append(msg.Children, newMessage(child))
+	}
+	return msg
+}
+
+// messageFromJSON builds a Message, without its children, from the
+// decoded JSON output of notmuch show
+func messageFromJSON(message map[string]interface{}) Message {
+	tags := message["tags"].([]interface{})
+
+	msg := Message{
+		Id:   message["id"].(string),
+		Tags: make([]string, 0, len(tags)),
+	}
+	for _, tag := range tags {
+		msg.Tags = append(msg.Tags, tag.(string))
+	}
+	msg.Match, _ = message["match"].(bool)
+	if timestamp, ok := message["timestamp"].(float64); ok {
+		msg.Timestamp = int64(timestamp)
+	}
+
+	// Older versions of notmuch output a single filename, newer ones all
+	// the files of the message
+	switch filenames := message["filename"].(type) {
+	case string:
+		msg.Filenames = []string{filenames}
+	case []interface{}:
+		for _, filename := range filenames {
+			if f, ok := filename.(string); ok {
+				msg.Filenames = append(msg.Filenames, f)
+			}
+		}
+	}
+
+	headers := message["headers"].(map[string]interface{})
+	maybe := func(raw interface{}) string {
+		if str, ok := raw.(string); ok {
+			return str
+		}
+		return ""
+	}
+	msg.Header = MessageHeader{
+		Subject: maybe(headers["Subject"]),
+		From:    maybe(headers["From"]),
+		To:      maybe(headers["To"]),
+		Cc:      maybe(headers["Cc"]),
+		Bcc:     maybe(headers["Bcc"]),
+		ReplyTo: maybe(headers["Reply-To"]),
+		Date:    maybe(headers["Date"]),
+	}
+	return msg
+}
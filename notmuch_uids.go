@@ -0,0 +1,308 @@
+package unpeu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// UIDs of the notmuch mailstore are kept in a bolt file, with one bucket
+// per mailbox. Each bucket holds:
+// - the UIDVALIDITY of the mailbox, set once when the bucket is created
+// - the next UID to assign, which only ever grows
+// - a sub-bucket mapping message ids to their UID
+//
+// Resetting the map, by removing the file or a bucket, is the only thing
+// that changes the UIDVALIDITY of a mailbox.
+var (
+	uidValidityKey = []byte("uidvalidity")
+	uidNextKey     = []byte("uidnext")
+	midToUidBucket = []byte("mids")
+)
+
+// mailboxUids is the UID mapping of a mailbox at a given time. It is
+// shared through the cache and must not be modified.
+type mailboxUids struct {
+	uidValidity uint32
+	uidNext     int
+
+	// mids holds the message ids of the mailbox, in UID order. The index
+	// of a message id in this list is its sequence id minus one.
+	mids     []string
+	uids     []int
+	midToUid map[string]int
+	uidToMid map[int]string
+}
+
+// maxUid returns the highest UID in the mailbox, or 0 if it is empty
+func (u *mailboxUids) maxUid() int {
+	if len(u.uids) == 0 {
+		return 0
+	}
+	return u.uids[len(u.uids)-1]
+}
+
+// sequenceId returns the sequence id of the message, or 0 if it isn't in
+// the mailbox
+func (u *mailboxUids) sequenceId(mid string) int {
+	uid, ok := u.midToUid[mid]
+	if !ok {
+		return 0
+	}
+	return sort.SearchInts(u.uids, uid) + 1
+}
+
+// resolve returns the message ids of the sequence set, in order. UIDs
+// that don't exist anymore are silently ignored, but sequence ids must all
+// be valid.
+func (u *mailboxUids) resolve(sequenceSet string, useUids bool) ([]string, error) {
+	max := len(u.mids)
+	if useUids {
+		max = u.maxUid()
+	}
+	ids, err := toList(sequenceSet, max)
+	if err != nil {
+		return nil, err
+	}
+
+	mids := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if useUids {
+			if mid, ok := u.uidToMid[id]; ok {
+				mids = append(mids, mid)
+			}
+			continue
+		}
+		if id < 1 || id > len(u.mids) {
+			return nil, fmt.Errorf("Invalid sequence id: %d (max is %d)", id, max)
+		}
+		mids = append(mids, u.mids[id-1])
+	}
+	return mids, nil
+}
+
+// withNew returns the mapping with the messages of current it doesn't
+// have added at the end. Messages that left the mailbox keep their
+// sequence id and UID. If the UIDVALIDITY changed, nothing can be kept.
+func (u *mailboxUids) withNew(current *mailboxUids) *mailboxUids {
+	if u.uidValidity != current.uidValidity {
+		return current
+	}
+	var added []string
+	for _, mid := range current.mids {
+		if _, ok := u.midToUid[mid]; !ok {
+			added = append(added, mid)
+		}
+	}
+	if len(added) == 0 {
+		return u
+	}
+	if current.midToUid[added[0]] <= u.maxUid() {
+		// Not a new message: the order can't be kept
+		return current
+	}
+
+	merged := &mailboxUids{
+		uidValidity: u.uidValidity,
+		uidNext:     current.uidNext,
+		mids:        make([]string, len(u.mids), len(u.mids)+len(added)),
+		uids:        make([]int, len(u.uids), len(u.uids)+len(added)),
+		midToUid:    make(map[string]int, len(u.mids)+len(added)),
+		uidToMid:    make(map[int]string, len(u.mids)+len(added)),
+	}
+	copy(merged.mids, u.mids)
+	copy(merged.uids, u.uids)
+	for mid, uid := range u.midToUid {
+		merged.midToUid[mid] = uid
+		merged.uidToMid[uid] = mid
+	}
+	for _, mid := range added {
+		uid := current.midToUid[mid]
+		merged.mids = append(merged.mids, mid)
+		merged.uids = append(merged.uids, uid)
+		merged.midToUid[mid] = uid
+		merged.uidToMid[uid] = mid
+	}
+	return merged
+}
+
+// defaultUidDatabase returns the default location of the UID file
+func defaultUidDatabase() string {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		dataHome = filepath.Join(os.Getenv("HOME"), ".local", "share")
+	}
+	return filepath.Join(dataHome, "unpeu", "notmuch-uids.db")
+}
+
+// openUidDatabase opens, or creates, the UID file
+func openUidDatabase(path string) (*bolt.DB, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+}
+
+// uidDB returns the UID database, opening it on first use
+func (nm *NotmuchMailstore) uidDB() (*bolt.DB, error) {
+	nm.uidsOnce.Do(func() {
+		path := nm.uidsPath
+		if path == "" {
+			path = defaultUidDatabase()
+		}
+		nm.uidsDB, nm.uidsErr = openUidDatabase(path)
+	})
+	return nm.uidsDB, nm.uidsErr
+}
+
+// mailboxUids returns the UID mapping of the mailbox, assigning UIDs to
+// the messages that arrived since last time
+func (nm *NotmuchMailstore) mailboxUids(mbox Id) (*mailboxUids, error) {
+	err := nm.checkChanges()
+	if err != nil {
+		return nil, err
+	}
+	nm.cache.RLock()
+	u, ok := nm.uidsCache[mbox]
+	nm.cache.RUnlock()
+	if ok {
+		return u, nil
+	}
+
+	query, err := nm.mailboxQuery(mbox)
+	if err != nil {
+		return nil, err
+	}
+	mids, err := nm.transport.messageIds(query, 0)
+	if err != nil {
+		return nil, err
+	}
+	db, err := nm.uidDB()
+	if err != nil {
+		return nil, err
+	}
+	u, err = syncUids(db, mbox, mids)
+	if err != nil {
+		return nil, err
+	}
+
+	nm.cache.Lock()
+	if nm.uidsCache == nil {
+		nm.uidsCache = make(map[Id]*mailboxUids)
+	}
+	nm.uidsCache[mbox] = u
+	nm.cache.Unlock()
+	return u, nil
+}
+
+// syncUids brings the UID mapping of the mailbox in line with its current
+// content: messages that left the mailbox lose their UID and new messages
+// get the next ones, in the given order.
+func syncUids(db *bolt.DB, mbox Id, current []string) (*mailboxUids, error) {
+	u := &mailboxUids{
+		midToUid: make(map[string]int, len(current)),
+		uidToMid: make(map[int]string, len(current)),
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(mbox))
+		if buck == nil {
+			var err error
+			buck, err = tx.CreateBucket([]byte(mbox))
+			if err != nil {
+				return err
+			}
+			err = buck.Put(uidValidityKey, uint64ToBytes(uint64(time.Now().Unix())))
+			if err != nil {
+				return err
+			}
+			err = buck.Put(uidNextKey, uint64ToBytes(1))
+			if err != nil {
+				return err
+			}
+		}
+		mapping, err := buck.CreateBucketIfNotExists(midToUidBucket)
+		if err != nil {
+			return err
+		}
+
+		u.uidValidity = uint32(bytesToUint64(buck.Get(uidValidityKey)))
+		u.uidNext = int(bytesToUint64(buck.Get(uidNextKey)))
+
+		isCurrent := make(map[string]struct{}, len(current))
+		for _, mid := range current {
+			isCurrent[mid] = struct{}{}
+		}
+
+		// Forget the messages that are gone. Deleting while iterating a
+		// cursor skips keys in bolt, so collect them first.
+		var gone [][]byte
+		err = mapping.ForEach(func(k, v []byte) error {
+			if _, ok := isCurrent[string(k)]; !ok {
+				gone = append(gone, k)
+				return nil
+			}
+			uid := int(bytesToUint64(v))
+			u.midToUid[string(k)] = uid
+			u.uidToMid[uid] = string(k)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range gone {
+			err = mapping.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Number the new ones
+		for _, mid := range current {
+			if _, ok := u.midToUid[mid]; ok {
+				continue
+			}
+			err = mapping.Put([]byte(mid), uint64ToBytes(uint64(u.uidNext)))
+			if err != nil {
+				return err
+			}
+			u.midToUid[mid] = u.uidNext
+			u.uidToMid[u.uidNext] = mid
+			u.uidNext++
+		}
+		return buck.Put(uidNextKey, uint64ToBytes(uint64(u.uidNext)))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't update UIDs of %s: %s", mbox, err)
+	}
+
+	u.uids = make([]int, 0, len(u.uidToMid))
+	for uid := range u.uidToMid {
+		u.uids = append(u.uids, uid)
+	}
+	sort.Ints(u.uids)
+	u.mids = make([]string, len(u.uids))
+	for i, uid := range u.uids {
+		u.mids[i] = u.uidToMid[uid]
+	}
+	return u, nil
+}
+
+func uint64ToBytes(i uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, i)
+	return b
+}
+
+func bytesToUint64(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
@@ -0,0 +1,88 @@
+package unpeu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// NotmuchMailstoreFactory returns a MailstoreFactory that gives each user
+// their own notmuch database, configured by the template options. In all
+// the paths and in the binary, %s is replaced with the username: the
+// ConfigPath of the template may be "/home/%s/.notmuch-config", and its
+// Maildir, relative to the root of each database, "unpeu". Each user gets
+// their own copy of FlagTags. If the template has no UidsPath, each
+// user's UIDs are kept in their own file, next to the default one;
+// otherwise it must contain %s, so that users don't share a file.
+//
+// Mailstores are created on the first login of each user, and shared by
+// all their sessions.
+func NotmuchMailstoreFactory(template NotmuchOptions) (MailstoreFactory, error) {
+	if template.UidsPath != "" && !strings.Contains(template.UidsPath, "%s") {
+		return nil, fmt.Errorf("The UidsPath of the template must contain %%s: %s", template.UidsPath)
+	}
+
+	var l sync.Mutex
+	mailstores := make(map[string]*NotmuchMailstore)
+
+	return func(username string) (Mailstore, error) {
+		l.Lock()
+		defer l.Unlock()
+		if nm, ok := mailstores[username]; ok {
+			return nm, nil
+		}
+
+		opts, err := template.forUser(username)
+		if err != nil {
+			return nil, err
+		}
+		if opts.ConfigPath != "" {
+			if _, err := os.Stat(opts.ConfigPath); err != nil {
+				return nil, err
+			}
+		}
+		if opts.UidsPath == "" {
+			opts.UidsPath = filepath.Join(filepath.Dir(defaultUidDatabase()), "notmuch-uids-"+username+".db")
+		}
+		nm := NewNotmuchMailstoreWithOptions(opts)
+		mailstores[username] = nm
+		return nm, nil
+	}, nil
+}
+
+// validPathUsername returns an error if the username can't be used in a
+// path: it must be a single path element, that isn't . or ..
+func validPathUsername(username string) error {
+	if strings.Trim(username, ".") == "" || strings.Contains(username, "..") || strings.ContainsAny(username, "/\\\x00") {
+		return fmt.Errorf("Invalid username %q", username)
+	}
+	return nil
+}
+
+// forUser returns the options with %s replaced with the username. The
+// username ends up in paths: it fails if it could reach out of them.
+func (o NotmuchOptions) forUser(username string) (NotmuchOptions, error) {
+	if err := validPathUsername(username); err != nil {
+		return NotmuchOptions{}, err
+	}
+	expand := func(s string) string {
+		return strings.Replace(s, "%s", username, -1)
+	}
+	opts := NotmuchOptions{
+		Binary:       expand(o.Binary),
+		ConfigPath:   expand(o.ConfigPath),
+		DatabasePath: expand(o.DatabasePath),
+		Maildir:      expand(o.Maildir),
+		UidsPath:     expand(o.UidsPath),
+		QueriesPath:  expand(o.QueriesPath),
+	}
+	if o.FlagTags != nil {
+		opts.FlagTags = make(map[string]string, len(o.FlagTags))
+		for flag, tag := range o.FlagTags {
+			opts.FlagTags[flag] = tag
+		}
+	}
+	return opts, nil
+}
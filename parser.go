@@ -3,6 +3,7 @@ package unpeu
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"net/textproto"
 	"strconv"
@@ -75,6 +76,8 @@ func (p *parser) next() (command, error) {
 		return p.starttls(tag), nil
 	case "login":
 		return p.login(tag)
+	case "authenticate":
+		return p.authenticate(tag)
 	case "logout":
 		return p.logout(tag), nil
 	case "select":
@@ -128,6 +131,30 @@ func (p *parser) login(tag string) (command, error) {
 	return &login{tag: tag, userId: userId, password: password}, nil
 }
 
+// authenticate creates an AUTHENTICATE command, with its initial response
+// if there is one (RFC 4959)
+func (p *parser) authenticate(tag string) (command, error) {
+	mechanism, err := p.expectStrings(p.lexer.astring)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &authenticate{l: p.lexer, tag: tag, mechanism: mechanism[0]}
+
+	p.lexer.skipSpace()
+	ok, initial := p.lexer.nonquoted("initial response", nil)
+	if !ok {
+		return cmd, nil
+	}
+	cmd.hasResponse = true
+	if initial != "=" {
+		cmd.response, err = base64.StdEncoding.DecodeString(initial)
+		if err != nil {
+			return nil, parseError("Invalid initial response")
+		}
+	}
+	return cmd, nil
+}
+
 // starttls creates a starttls command
 func (p *parser) starttls(tag string) command {
 	return &starttls{tag: tag}
@@ -495,7 +522,8 @@ func aggregateSearchArguments(fullLine []byte) ([]searchArgument, error) {
 			continue
 		case "UID":
 			currentArg.key = next
-			ok, sequenceSet := l.astring()
+			// Not an astring, sequence sets may contain '*'
+			ok, sequenceSet := l.searchString()
 			if !ok {
 				return nil, fmt.Errorf("Couldn't parse sequence set to UID")
 			}
@@ -508,6 +536,16 @@ func aggregateSearchArguments(fullLine []byte) ([]searchArgument, error) {
 		case "REFS":
 			currentArg.key = next
 			args, currentArg = appendArg(args, currentArg)
+		case "CHARSET":
+			ok, name := l.astring()
+			if !ok {
+				return nil, fmt.Errorf("Couldn't parse charset name")
+			}
+			translator, err = charset.TranslatorFrom(name)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid charset (%s): %s", name, err)
+			}
+			continue
 		default:
 			if isValid(next) {
 				currentArg.key = "SEQUENCESET" // Fake key for more consistency
@@ -0,0 +1,690 @@
+package unpeu
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A mailstore that relays everything to an upstream IMAP server, so that
+// unpeu can sit in front of it with its own authentication and logging.
+// Mailbox Ids are the upstream names, and UIDs are the upstream UIDs.
+//
+// Connections are pooled: each call takes an idle connection, or opens a
+// new one, and gives it back when done. Sequence ids are those of the
+// connection that ran the command, which are the same everywhere as long
+// as no other client expunges messages at the same time.
+
+var _ Mailstore = &ProxyMailstore{}
+
+// proxyMaxIdle is the number of idle connections kept open
+const proxyMaxIdle = 4
+
+// proxyTimeout is how long the upstream server has to answer a command
+const proxyTimeout = time.Minute
+
+// ProxyMailstore is a mailstore on an upstream IMAP server
+type ProxyMailstore struct {
+	dial     func() (net.Conn, error)
+	username string
+	password string
+	timeout  time.Duration
+
+	l    sync.Mutex
+	idle []*imapClient
+	// The hierarchy delimiter upstream, once known
+	delimiter string
+}
+
+// NewProxyMailstore returns a mailstore that logs in with the given
+// credentials on the connections returned by dial. dial may return a TLS
+// connection, or anything else that talks IMAP.
+func NewProxyMailstore(dial func() (net.Conn, error), username, password string) *ProxyMailstore {
+	return &ProxyMailstore{
+		dial:     dial,
+		username: username,
+		password: password,
+		timeout:  proxyTimeout,
+	}
+}
+
+// Close closes the idle connections
+func (ps *ProxyMailstore) Close() error {
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	for _, c := range ps.idle {
+		c.close()
+	}
+	ps.idle = nil
+	return nil
+}
+
+// with runs f on a connection from the pool. The connection is closed if
+// f fails with anything but a NO or BAD answer.
+func (ps *ProxyMailstore) with(f func(c *imapClient) error) error {
+	ps.l.Lock()
+	var c *imapClient
+	if len(ps.idle) > 0 {
+		c = ps.idle[len(ps.idle)-1]
+		ps.idle = ps.idle[:len(ps.idle)-1]
+	}
+	ps.l.Unlock()
+
+	pooled := c != nil
+	if !pooled {
+		var err error
+		if c, err = ps.connect(); err != nil {
+			return err
+		}
+	}
+
+	c.answered = false
+	err := f(c)
+	if _, ok := err.(*imapError); err != nil && !ok {
+		c.close()
+		// The server may have closed an idle connection in the meantime:
+		// if it didn't answer anything, f is tried again on a new one
+		if !pooled || c.answered {
+			return err
+		}
+		if c, err = ps.connect(); err != nil {
+			return err
+		}
+		err = f(c)
+		if _, ok := err.(*imapError); err != nil && !ok {
+			c.close()
+			return err
+		}
+	}
+
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	if len(ps.idle) < proxyMaxIdle {
+		ps.idle = append(ps.idle, c)
+	} else {
+		c.close()
+	}
+	return err
+}
+
+// connect dials a new connection and logs in
+func (ps *ProxyMailstore) connect() (*imapClient, error) {
+	conn, err := ps.dial()
+	if err != nil {
+		return nil, err
+	}
+	c, err := newImapClient(conn, ps.timeout, ps.username, ps.password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// hierarchyDelimiter returns the delimiter of the upstream hierarchy
+func (ps *ProxyMailstore) hierarchyDelimiter(c *imapClient) (string, error) {
+	ps.l.Lock()
+	delimiter := ps.delimiter
+	ps.l.Unlock()
+	if delimiter != "" {
+		return delimiter, nil
+	}
+
+	untagged, err := c.execute(`LIST "" ""`)
+	if err != nil {
+		return "", err
+	}
+	delimiter = string(pathDelimiter)
+	for _, data := range untagged {
+		if len(data) >= 3 && isAtom(data[0], "LIST") {
+			if d, ok := imapText(data[2]); ok && d != "" {
+				delimiter = d
+			}
+		}
+	}
+	ps.l.Lock()
+	ps.delimiter = delimiter
+	ps.l.Unlock()
+	return delimiter, nil
+}
+
+// isAtom returns true if the value is the given atom, in any case
+func isAtom(value interface{}, atom string) bool {
+	a, ok := value.(imapAtom)
+	return ok && strings.EqualFold(string(a), atom)
+}
+
+// upstreamName returns the upstream name of the mailbox at the path
+func upstreamName(path []string, delimiter string) string {
+	if len(path) > 0 && strings.EqualFold(path[0], "INBOX") {
+		path = append([]string{"INBOX"}, path[1:]...)
+	}
+	return strings.Join(path, delimiter)
+}
+
+// mailboxName returns the argument for the mailbox name in a command
+func mailboxName(name string) interface{} {
+	return imapLiteralOrQuoted(name)
+}
+
+// list runs a LIST command and returns the mailboxes
+func (ps *ProxyMailstore) list(c *imapClient, pattern string) ([]*Mailbox, error) {
+	delimiter, err := ps.hierarchyDelimiter(c)
+	if err != nil {
+		return nil, err
+	}
+	untagged, err := c.execute(`LIST "" `, mailboxName(pattern))
+	if e, ok := err.(*imapError); ok && e.condition == "NO" {
+		// Some servers, unpeu included, say NO when nothing matches
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mailboxes := make([]*Mailbox, 0, len(untagged))
+	for _, data := range untagged {
+		if len(data) < 4 || !isAtom(data[0], "LIST") {
+			continue
+		}
+		attributes, _ := data[1].(imapList)
+		name, ok := imapText(data[3])
+		if !ok {
+			continue
+		}
+		path := strings.Split(name, delimiter)
+		if strings.EqualFold(path[0], "INBOX") {
+			path[0] = "INBOX"
+		}
+		mbox := &Mailbox{
+			Name: strings.Join(path, string(pathDelimiter)),
+			Path: path,
+			Id:   Id(upstreamName(path, delimiter)),
+		}
+		for _, attribute := range attributes {
+			switch a, _ := imapText(attribute); strings.ToLower(a) {
+			case "\\noselect", "\\nonexistent":
+				mbox.Flags |= Noselect
+			case "\\noinferiors":
+				mbox.Flags |= Noinferiors
+			case "\\marked":
+				mbox.Flags |= Marked
+			case "\\unmarked":
+				mbox.Flags |= Unmarked
+			}
+		}
+		mailboxes = append(mailboxes, mbox)
+	}
+	return mailboxes, nil
+}
+
+// status returns the values of the items of a STATUS command
+func status(c *imapClient, mbox Id, items ...string) (map[string]int64, error) {
+	untagged, err := c.execute("STATUS ", mailboxName(string(mbox)), " ("+strings.Join(items, " ")+")")
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]int64)
+	for _, data := range untagged {
+		if len(data) < 3 || !isAtom(data[0], "STATUS") {
+			continue
+		}
+		list, _ := data[2].(imapList)
+		for i := 0; i+1 < len(list); i += 2 {
+			key, _ := imapText(list[i])
+			value, _ := imapText(list[i+1])
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid STATUS %s: %q", key, value)
+			}
+			values[strings.ToUpper(key)] = n
+		}
+	}
+	return values, nil
+}
+
+// selectUpstream selects the mailbox on the connection, if it isn't
+// already
+func selectUpstream(c *imapClient, mbox Id) error {
+	if c.selected == string(mbox) {
+		return nil
+	}
+	c.selected = ""
+	_, err := c.execute("SELECT ", mailboxName(string(mbox)))
+	if err != nil {
+		return err
+	}
+	c.selected = string(mbox)
+	return nil
+}
+
+func (ps *ProxyMailstore) GetMailbox(path []string) (*Mailbox, error) {
+	var mbox *Mailbox
+	err := ps.with(func(c *imapClient) error {
+		delimiter, err := ps.hierarchyDelimiter(c)
+		if err != nil {
+			return err
+		}
+		mailboxes, err := ps.list(c, upstreamName(path, delimiter))
+		if err != nil || len(mailboxes) == 0 {
+			return err
+		}
+		mbox = mailboxes[0]
+		if mbox.Flags&Noselect != 0 {
+			return nil
+		}
+		values, err := status(c, mbox.Id, "UIDVALIDITY")
+		if err != nil {
+			return err
+		}
+		mbox.UidValidity = uint32(values["UIDVALIDITY"])
+		return nil
+	})
+	return mbox, err
+}
+
+func (ps *ProxyMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
+	var mailboxes []*Mailbox
+	err := ps.with(func(c *imapClient) error {
+		delimiter, err := ps.hierarchyDelimiter(c)
+		if err != nil {
+			return err
+		}
+		pattern := "%"
+		if len(path) > 0 {
+			pattern = upstreamName(path, delimiter) + delimiter + "%"
+		}
+		mailboxes, err = ps.list(c, pattern)
+		return err
+	})
+	return mailboxes, err
+}
+
+func (ps *ProxyMailstore) FirstUnseen(mbox Id) (int64, error) {
+	var first int64
+	err := ps.with(func(c *imapClient) error {
+		if err := selectUpstream(c, mbox); err != nil {
+			return err
+		}
+		untagged, err := c.execute("SEARCH UNSEEN")
+		if err != nil {
+			return err
+		}
+		for _, id := range searchIds(untagged) {
+			if first == 0 || int64(id) < first {
+				first = int64(id)
+			}
+		}
+		return nil
+	})
+	return first, err
+}
+
+// statusItem returns one STATUS item of the mailbox
+func (ps *ProxyMailstore) statusItem(mbox Id, item string) (int64, error) {
+	var value int64
+	err := ps.with(func(c *imapClient) error {
+		values, err := status(c, mbox, item)
+		value = values[item]
+		return err
+	})
+	return value, err
+}
+
+func (ps *ProxyMailstore) TotalMessages(mbox Id) (int64, error) {
+	return ps.statusItem(mbox, "MESSAGES")
+}
+
+func (ps *ProxyMailstore) RecentMessages(mbox Id) (int64, error) {
+	return ps.statusItem(mbox, "RECENT")
+}
+
+func (ps *ProxyMailstore) NextUid(mbox Id) (int64, error) {
+	return ps.statusItem(mbox, "UIDNEXT")
+}
+
+func (ps *ProxyMailstore) CountUnseen(mbox Id) (int64, error) {
+	return ps.statusItem(mbox, "UNSEEN")
+}
+
+func (ps *ProxyMailstore) AppendMessage(mailbox string, flags []string, dateTime time.Time, message string) error {
+	return ps.with(func(c *imapClient) error {
+		delimiter, err := ps.hierarchyDelimiter(c)
+		if err != nil {
+			return err
+		}
+		parts := []interface{}{"APPEND ", mailboxName(upstreamName(pathToSlice(mailbox), delimiter))}
+		if len(flags) > 0 {
+			parts = append(parts, " ("+strings.Join(flags, " ")+")")
+		}
+		if !dateTime.IsZero() {
+			parts = append(parts, " "+quote(dateTime.Format("02-Jan-2006 15:04:05 -0700")))
+		}
+		parts = append(parts, " ", imapLiteral(message))
+		_, err = c.execute(parts...)
+		if e, ok := err.(*imapError); ok && e.hasCode("CANNOT") {
+			return ErrCannotAppend
+		}
+		return err
+	})
+}
+
+// searchIds returns the ids of SEARCH responses
+func searchIds(untagged []imapList) []int {
+	var ids []int
+	for _, data := range untagged {
+		if len(data) == 0 || !isAtom(data[0], "SEARCH") {
+			continue
+		}
+		for _, value := range data[1:] {
+			text, _ := imapText(value)
+			if id, err := strconv.Atoi(text); err == nil {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// threadMembers returns the threads of a THREAD response: each list is a
+// thread, where a message is followed by its only child or by the lists
+// of its children
+func threadMembers(list imapList) ([]threadMember, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	if sub, ok := list[0].(imapList); ok {
+		// A thread without a root: each list is a sibling
+		var members []threadMember
+		for _, value := range list {
+			sub, ok = value.(imapList)
+			if !ok {
+				return nil, fmt.Errorf("Invalid thread %v", list)
+			}
+			children, err := threadMembers(sub)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, children...)
+		}
+		return members, nil
+	}
+
+	text, _ := imapText(list[0])
+	id, err := strconv.Atoi(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid thread member %q", text)
+	}
+	children, err := threadMembers(list[1:])
+	if err != nil {
+		return nil, err
+	}
+	return []threadMember{{id: id, children: children}}, nil
+}
+
+// searchParts returns the search keys in the IMAP syntax, and true if
+// they need a UTF-8 charset
+func searchParts(args []searchArgument) ([]interface{}, bool) {
+	var parts []interface{}
+	utf8 := false
+	for i, arg := range args {
+		if arg.key == "REFS" {
+			// The algorithm of a THREAD, not a search key
+			continue
+		}
+		if i > 0 && len(parts) > 0 {
+			parts = append(parts, " ")
+		}
+		if arg.not {
+			parts = append(parts, "NOT ")
+		}
+		switch {
+		case arg.group:
+			children, u := searchParts(arg.children)
+			parts = append(parts, "(")
+			parts = append(parts, children...)
+			parts = append(parts, ")")
+			utf8 = utf8 || u
+		case arg.or:
+			children, u := searchParts(arg.children)
+			parts = append(parts, "OR ")
+			parts = append(parts, children...)
+			utf8 = utf8 || u
+		case arg.key == "SEQUENCESET":
+			parts = append(parts, arg.values[0])
+		default:
+			parts = append(parts, arg.key)
+			for _, value := range arg.values {
+				switch arg.key {
+				case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE", "LARGER", "SMALLER", "UID":
+					parts = append(parts, " "+value)
+				default:
+					v := imapLiteralOrQuoted(value)
+					if _, ok := v.(imapLiteral); ok {
+						utf8 = true
+					}
+					parts = append(parts, " ", v)
+				}
+			}
+		}
+	}
+	return parts, utf8
+}
+
+func (ps *ProxyMailstore) Search(mbox Id, args []searchArgument, returnUid, returnThreads bool) ([]threadMember, error) {
+	var result []threadMember
+	err := ps.with(func(c *imapClient) error {
+		if err := selectUpstream(c, mbox); err != nil {
+			return err
+		}
+		keys, utf8 := searchParts(args)
+		if len(keys) == 0 {
+			keys = []interface{}{"ALL"}
+		}
+		var parts []interface{}
+		if returnUid {
+			parts = append(parts, "UID ")
+		}
+		if returnThreads {
+			algorithm := "REFERENCES"
+			for _, arg := range args {
+				if arg.key == "REFS" {
+					algorithm = "REFS"
+				}
+			}
+			parts = append(parts, "THREAD "+algorithm+" UTF-8 ")
+		} else if utf8 {
+			parts = append(parts, "SEARCH CHARSET UTF-8 ")
+		} else {
+			parts = append(parts, "SEARCH ")
+		}
+		untagged, err := c.execute(append(parts, keys...)...)
+		if err != nil {
+			return err
+		}
+
+		result = make([]threadMember, 0)
+		if !returnThreads {
+			for _, id := range searchIds(untagged) {
+				result = append(result, threadMember{id: id})
+			}
+			return nil
+		}
+		for _, data := range untagged {
+			if len(data) == 0 || !isAtom(data[0], "THREAD") {
+				continue
+			}
+			for _, value := range data[1:] {
+				thread, ok := value.(imapList)
+				if !ok {
+					return fmt.Errorf("Invalid THREAD response %v", data)
+				}
+				members, err := threadMembers(thread)
+				if err != nil {
+					return err
+				}
+				result = append(result, members...)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// peekAttributes are the attributes that would set \Seen upstream, and
+// the BODY.PEEK attributes they are fetched with instead. The responses
+// are under the key of the BODY.PEEK attribute, without .PEEK.
+var peekAttributes = map[string]string{
+	"RFC822":      "BODY.PEEK[]",
+	"RFC822.TEXT": "BODY.PEEK[TEXT]",
+}
+
+// fetchAttribute returns the argument in the syntax of a FETCH command.
+// Nothing is fetched in a way that sets \Seen upstream: the server sets
+// it itself.
+func fetchAttribute(arg fetchArgument) string {
+	if peek, ok := peekAttributes[arg.text]; ok {
+		return peek
+	}
+	if arg.text != "BODY" && arg.text != "BODY.PEEK" || arg.bare {
+		return arg.text
+	}
+	section := arg.section
+	if len(arg.fields) > 0 {
+		section += " (" + strings.Join(arg.fields, " ") + ")"
+	}
+	attribute := "BODY.PEEK" + strings.TrimPrefix(fmt.Sprintf(bodyKeyPattern(arg), section), "BODY")
+	if arg.offset >= 0 && arg.length == 0 {
+		// A partial fetch always has a length in a command
+		attribute = strings.TrimSuffix(attribute, ">") + "." + strconv.Itoa(1<<31-1) + ">"
+	}
+	return attribute
+}
+
+// fetchResponses returns the FETCH responses, with the responses about
+// the same message merged together
+func fetchResponses(untagged []imapList) []messageFetchResponse {
+	var responses []messageFetchResponse
+	index := make(map[string]int)
+	for _, data := range untagged {
+		if len(data) < 3 || !isAtom(data[1], "FETCH") {
+			continue
+		}
+		id, _ := imapText(data[0])
+		list, _ := data[2].(imapList)
+		i, ok := index[id]
+		if !ok {
+			i = len(responses)
+			index[id] = i
+			responses = append(responses, messageFetchResponse{id: id})
+		}
+		for j := 0; j+1 < len(list); j += 2 {
+			key, _ := imapText(list[j])
+			item := fetchItem{key: key, value: formatImapValue(list[j+1])}
+			replaced := false
+			for k := range responses[i].items {
+				if responses[i].items[k].key == key {
+					responses[i].items[k] = item
+					replaced = true
+				}
+			}
+			if !replaced {
+				responses[i].items = append(responses[i].items, item)
+			}
+		}
+	}
+	return responses
+}
+
+func (ps *ProxyMailstore) Fetch(mbox Id, sequenceSet string, args []fetchArgument, useUids bool) ([]messageFetchResponse, error) {
+	var result []messageFetchResponse
+	err := ps.with(func(c *imapClient) error {
+		if err := selectUpstream(c, mbox); err != nil {
+			return err
+		}
+		attributes := make([]string, 0, len(args))
+		for _, arg := range args {
+			if useUids && arg.text == "UID" {
+				// Always sent back by UID FETCH
+				continue
+			}
+			attributes = append(attributes, fetchAttribute(arg))
+		}
+		if len(attributes) == 0 {
+			attributes = append(attributes, "UID")
+		}
+		command := "FETCH "
+		if useUids {
+			command = "UID FETCH "
+		}
+		untagged, err := c.execute(command + sequenceSet + " (" + strings.Join(attributes, " ") + ")")
+		if err != nil {
+			return err
+		}
+		result = fetchResponses(untagged)
+		renamePeekedItems(result, args)
+		return nil
+	})
+	return result, err
+}
+
+// renamePeekedItems gives the items fetched with peekAttributes the key
+// that was asked for. They are kept under their own key too if it was also
+// asked for.
+func renamePeekedItems(responses []messageFetchResponse, args []fetchArgument) {
+	renamed := make(map[string]string)
+	asked := make(map[string]bool)
+	for _, arg := range args {
+		if peek, ok := peekAttributes[arg.text]; ok {
+			renamed[strings.Replace(peek, ".PEEK", "", 1)] = arg.text
+		} else if arg.text == "BODY" || arg.text == "BODY.PEEK" {
+			asked[strings.Replace(fetchAttribute(arg), ".PEEK", "", 1)] = true
+		}
+	}
+	if len(renamed) == 0 {
+		return
+	}
+	for i := range responses {
+		items := make([]fetchItem, 0, len(responses[i].items))
+		for _, item := range responses[i].items {
+			key, ok := renamed[item.key]
+			if !ok || asked[item.key] {
+				items = append(items, item)
+			}
+			if ok {
+				items = append(items, fetchItem{key: key, value: item.value})
+			}
+		}
+		responses[i].items = items
+	}
+}
+
+func (ps *ProxyMailstore) Flag(mode flagMode, mbox Id, sequenceSet string, useUids bool, flags []string) ([]messageFetchResponse, error) {
+	var result []messageFetchResponse
+	err := ps.with(func(c *imapClient) error {
+		if err := selectUpstream(c, mbox); err != nil {
+			return err
+		}
+		command := "STORE "
+		if useUids {
+			command = "UID STORE "
+		}
+		item := map[flagMode]string{SET: "FLAGS", ADD: "+FLAGS", REMOVE: "-FLAGS"}[mode]
+		untagged, err := c.execute(command + sequenceSet + " " + item + " (" + strings.Join(flags, " ") + ")")
+		if err != nil {
+			return err
+		}
+		for _, response := range fetchResponses(untagged) {
+			for _, item := range response.items {
+				if item.key == "FLAGS" {
+					result = append(result, messageFetchResponse{id: response.id, items: []fetchItem{item}})
+				}
+			}
+		}
+		return nil
+	})
+	return result, err
+}
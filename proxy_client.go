@@ -0,0 +1,441 @@
+package unpeu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal IMAP client, enough for the proxy mailstore: commands are
+// written as they are given and response data is parsed into atoms,
+// strings and lists, so that it can be written back as it was received.
+
+// imapAtom is an atom, a number or NIL in a response
+type imapAtom string
+
+// imapString is a quoted string in a response
+type imapString string
+
+// imapList is a parenthesized list in a response
+type imapList []interface{}
+
+// imapLiteral is a literal, sent in a command or received in a response
+type imapLiteral string
+
+// imapError is a NO or BAD completion of a command
+type imapError struct {
+	condition string
+	text      string
+}
+
+func (e *imapError) Error() string {
+	return "upstream: " + e.condition + " " + e.text
+}
+
+// hasCode returns true if the error has the given response code, such as
+// TRYCREATE
+func (e *imapError) hasCode(code string) bool {
+	return strings.HasPrefix(e.text, "["+code+"]") || strings.HasPrefix(e.text, "["+code+" ")
+}
+
+// imapClient is a connection to an upstream server
+type imapClient struct {
+	conn net.Conn
+	rd   *bufio.Reader
+	w    *bufio.Writer
+	tag  int
+
+	// How long a command, or the greeting, may take
+	timeout time.Duration
+	// Set once the connection failed; nothing can be written to it anymore
+	broken bool
+	// Set once the server answered something other than BYE
+	answered bool
+
+	// The upstream name of the selected mailbox
+	selected string
+}
+
+// newImapClient reads the greeting of the server and logs in
+func newImapClient(conn net.Conn, timeout time.Duration, username, password string) (*imapClient, error) {
+	c := &imapClient{
+		conn:    conn,
+		rd:      bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		timeout: timeout,
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	greeting, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		return nil, fmt.Errorf("Unexpected greeting: %q", greeting)
+	}
+	if strings.HasPrefix(greeting, "* OK") {
+		_, err = c.execute("LOGIN ", imapLiteralOrQuoted(username), " ", imapLiteralOrQuoted(password))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// imapLiteralOrQuoted returns the string as a quoted string if it can be
+// one, or as a literal
+func imapLiteralOrQuoted(s string) interface{} {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return imapLiteral(s)
+		}
+	}
+	return strconv.Quote(s)
+}
+
+// execute sends a command and returns its untagged responses. Parts are
+// either raw text or literals, and are written one after the other. Any
+// error but a NO or BAD answer breaks the connection, as it is left in
+// the middle of the command.
+func (c *imapClient) execute(parts ...interface{}) ([]imapList, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	untagged, err := c.exchange(parts...)
+	if _, ok := err.(*imapError); err != nil && !ok {
+		c.broken = true
+	}
+	return untagged, err
+}
+
+func (c *imapClient) exchange(parts ...interface{}) ([]imapList, error) {
+	c.tag++
+	tag := "P" + strconv.Itoa(c.tag)
+	_, err := c.w.WriteString(tag + " ")
+	if err != nil {
+		return nil, err
+	}
+
+	var untagged []imapList
+	for _, part := range parts {
+		switch p := part.(type) {
+		case string:
+			_, err = c.w.WriteString(p)
+		case imapLiteral:
+			_, err = fmt.Fprintf(c.w, "{%d}\r\n", len(p))
+			if err == nil {
+				err = c.w.Flush()
+			}
+			if err != nil {
+				return nil, err
+			}
+			// Untagged data may come before the continuation
+			for {
+				line, err := c.peekContinuation()
+				if err != nil {
+					return nil, err
+				}
+				if line {
+					break
+				}
+				resp, err := c.readResponse()
+				if err != nil {
+					return nil, err
+				}
+				if resp.tag != "*" {
+					return nil, &imapError{condition: resp.condition, text: resp.text}
+				}
+				untagged = append(untagged, resp.data)
+			}
+			_, err = c.w.WriteString(string(p))
+		default:
+			err = fmt.Errorf("Invalid command part %T", part)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = c.w.WriteString("\r\n")
+	if err == nil {
+		err = c.w.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if resp.tag == "*" {
+			untagged = append(untagged, resp.data)
+			continue
+		}
+		if resp.tag != tag {
+			return nil, fmt.Errorf("Unexpected response tag %q", resp.tag)
+		}
+		if resp.condition != "OK" {
+			return untagged, &imapError{condition: resp.condition, text: resp.text}
+		}
+		return untagged, nil
+	}
+}
+
+// close logs out, without waiting for the answer, and closes the
+// connection. A broken connection is closed right away.
+func (c *imapClient) close() error {
+	if !c.broken {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+		c.w.WriteString("Z LOGOUT\r\n")
+		c.w.Flush()
+	}
+	return c.conn.Close()
+}
+
+// peekContinuation reads a continuation request if there is one
+func (c *imapClient) peekContinuation() (bool, error) {
+	b, err := c.rd.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if b[0] != '+' {
+		return false, nil
+	}
+	c.answered = true
+	_, err = c.readLine()
+	return true, err
+}
+
+// readLine reads a line without its CRLF
+func (c *imapClient) readLine() (string, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// imapResponse is a response line: either untagged data, or the
+// completion of a command
+type imapResponse struct {
+	tag       string
+	data      imapList
+	condition string
+	text      string
+}
+
+// readResponse reads a whole response, with its literals
+func (c *imapClient) readResponse() (*imapResponse, error) {
+	tag, err := c.rd.ReadString(' ')
+	if err != nil {
+		return nil, err
+	}
+	resp := &imapResponse{tag: strings.TrimSuffix(tag, " ")}
+
+	if resp.tag != "*" {
+		c.answered = true
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.SplitN(line, " ", 2)
+		resp.condition = strings.ToUpper(fields[0])
+		if len(fields) > 1 {
+			resp.text = fields[1]
+		}
+		return resp, nil
+	}
+
+	// Status responses have free text that isn't parsed
+	first, err := c.readAtom()
+	if err != nil {
+		return nil, err
+	}
+	// A server that closes an idle connection says BYE beforehand
+	if !strings.EqualFold(string(first), "BYE") {
+		c.answered = true
+	}
+	switch strings.ToUpper(string(first)) {
+	case "OK", "NO", "BAD", "BYE", "PREAUTH":
+		text, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		resp.data = imapList{first, imapAtom(strings.TrimSpace(text))}
+		return resp, nil
+	}
+
+	resp.data = imapList{first}
+	for {
+		err := c.skipSpaces()
+		if err != nil {
+			return nil, err
+		}
+		b, err := c.rd.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == '\r' || b[0] == '\n' {
+			_, err = c.readLine()
+			return resp, err
+		}
+		value, err := c.readValue()
+		if err != nil {
+			return nil, err
+		}
+		resp.data = append(resp.data, value)
+	}
+}
+
+func (c *imapClient) skipSpaces() error {
+	for {
+		b, err := c.rd.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] != ' ' {
+			return nil
+		}
+		c.rd.ReadByte()
+	}
+}
+
+// readValue reads an atom, a string, a literal or a list
+func (c *imapClient) readValue() (interface{}, error) {
+	b, err := c.rd.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case '(':
+		c.rd.ReadByte()
+		list := imapList{}
+		for {
+			if err := c.skipSpaces(); err != nil {
+				return nil, err
+			}
+			b, err := c.rd.Peek(1)
+			if err != nil {
+				return nil, err
+			}
+			if b[0] == ')' {
+				c.rd.ReadByte()
+				return list, nil
+			}
+			if b[0] == '\r' || b[0] == '\n' {
+				return nil, fmt.Errorf("Unterminated list")
+			}
+			value, err := c.readValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+	case '"':
+		c.rd.ReadByte()
+		var s []byte
+		for {
+			b, err := c.rd.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			switch b {
+			case '"':
+				return imapString(s), nil
+			case '\\':
+				b, err = c.rd.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+			case '\r', '\n':
+				return nil, fmt.Errorf("Unterminated string")
+			}
+			s = append(s, b)
+		}
+	case '{':
+		c.rd.ReadByte()
+		size, err := c.rd.ReadString('}')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(size, "}"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid literal size %q", size)
+		}
+		if _, err := c.readLine(); err != nil {
+			return nil, err
+		}
+		s := make([]byte, n)
+		_, err = io.ReadFull(c.rd, s)
+		return imapLiteral(s), err
+	}
+	return c.readAtom()
+}
+
+// readAtom reads an atom. Brackets are part of it, spaces included, so
+// that BODY[HEADER.FIELDS (Subject)]<0> is a single atom.
+func (c *imapClient) readAtom() (imapAtom, error) {
+	var atom []byte
+	depth := 0
+	for {
+		b, err := c.rd.Peek(1)
+		if err != nil {
+			return "", err
+		}
+		switch b[0] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '\r', '\n':
+			return imapAtom(atom), nil
+		case ' ', '(', ')':
+			if depth == 0 {
+				if len(atom) == 0 {
+					return "", fmt.Errorf("Unexpected %q", b[0])
+				}
+				return imapAtom(atom), nil
+			}
+		}
+		c.rd.ReadByte()
+		atom = append(atom, b[0])
+	}
+}
+
+// formatImapValue writes a value back in the IMAP syntax
+func formatImapValue(value interface{}) string {
+	switch v := value.(type) {
+	case imapAtom:
+		return string(v)
+	case imapString:
+		s := string(v)
+		if strings.ContainsAny(s, "\"\\\r\n") {
+			return literalify(s)
+		}
+		return quote(s)
+	case imapLiteral:
+		return literalify(string(v))
+	case imapList:
+		values := make([]string, len(v))
+		for i, value := range v {
+			values[i] = formatImapValue(value)
+		}
+		return "(" + strings.Join(values, " ") + ")"
+	}
+	return "NIL"
+}
+
+// imapText returns the text of an atom or a string
+func imapText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case imapAtom:
+		return string(v), true
+	case imapString:
+		return string(v), true
+	case imapLiteral:
+		return string(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,227 @@
+package unpeu
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupProxy returns a proxy mailstore in front of an unpeu server that
+// serves the memory mailstore on pipes
+func setupProxy(t *testing.T) (*ProxyMailstore, *MemoryMailstore) {
+	upstream := NewMemoryMailstore()
+	files, err := filepath.Glob(filepath.Join("testdata", "maildir", "cur", "*"))
+	if err != nil || len(files) != 5 {
+		t.Fatalf("Invalid fixtures: %v (%v)", files, err)
+	}
+	if err := upstream.SeedFiles("Archive/2012", files...); err != nil {
+		t.Fatal("Couldn't seed:", err)
+	}
+
+	s := NewServer(StoreOption(upstream))
+	dial := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go s.ServeConn(server)
+		return client, nil
+	}
+	return NewProxyMailstore(dial, "alice", "secret"), upstream
+}
+
+func TestProxyMailboxes(t *testing.T) {
+	ps, _ := setupProxy(t)
+	defer ps.Close()
+
+	mailboxes, err := ps.GetMailboxes([]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, mbox := range mailboxes {
+		names = append(names, mbox.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"Archive", "INBOX"}) {
+		t.Errorf("Invalid mailboxes: %v", names)
+	}
+	children, err := ps.GetMailboxes([]string{"Archive"})
+	if err != nil || len(children) != 1 || children[0].Name != "Archive/2012" {
+		t.Errorf("Invalid children of Archive: %v (%v)", children, err)
+	}
+	if none, err := ps.GetMailboxes([]string{"INBOX"}); err != nil || len(none) != 0 {
+		t.Errorf("Invalid children of INBOX: %v (%v)", none, err)
+	}
+
+	mbox, err := ps.GetMailbox([]string{"Archive", "2012"})
+	if err != nil || mbox == nil || mbox.Id != "Archive/2012" || mbox.UidValidity == 0 {
+		t.Fatalf("Invalid Archive/2012: %+v (%v)", mbox, err)
+	}
+	if mbox, err := ps.GetMailbox([]string{"nowhere"}); err != nil || mbox != nil {
+		t.Errorf("Found a mailbox that doesn't exist: %+v (%v)", mbox, err)
+	}
+
+	if total, err := ps.TotalMessages(mbox.Id); err != nil || total != 5 {
+		t.Errorf("Invalid total: %d (%v)", total, err)
+	}
+	if unseen, err := ps.CountUnseen(mbox.Id); err != nil || unseen != 5 {
+		t.Errorf("Invalid unseen count: %d (%v)", unseen, err)
+	}
+	if next, err := ps.NextUid(mbox.Id); err != nil || next != 6 {
+		t.Errorf("Invalid next UID: %d (%v)", next, err)
+	}
+}
+
+func TestProxyMessages(t *testing.T) {
+	ps, upstream := setupProxy(t)
+	defer ps.Close()
+
+	date := time.Date(2015, 3, 2, 14, 0, 0, 0, time.FixedZone("", 3600))
+	if err := ps.AppendMessage("inbox", []string{"\\Flagged"}, date, maildirTestMessage); err != nil {
+		t.Fatal("Couldn't append:", err)
+	}
+	if total, _ := upstream.TotalMessages("INBOX"); total != 1 {
+		t.Errorf("The message wasn't appended upstream: %d", total)
+	}
+
+	// Strings are sent as literals when they need to
+	args, _ := aggregateSearchArguments([]byte("SUBJECT {5}\r\nLunch FLAGGED"))
+	found, err := ps.Search("INBOX", args, true, false)
+	if err != nil || !reflect.DeepEqual(found, []threadMember{{id: 1}}) {
+		t.Errorf("Invalid search: %v (%v)", found, err)
+	}
+	args, _ = aggregateSearchArguments([]byte(`OR SUBJECT "hello world" SUBJECT nothing SINCE 21-Jan-2012`))
+	found, err = ps.Search("Archive/2012", args, true, false)
+	if err != nil || !reflect.DeepEqual(found, []threadMember{{id: 2}}) {
+		t.Errorf("Invalid search: %v (%v)", found, err)
+	}
+
+	fetched, err := ps.Fetch("INBOX", "1", []fetchArgument{
+		{text: "FLAGS"},
+		{text: "INTERNALDATE"},
+		{text: "BODY.PEEK", section: "HEADER.FIELDS", fields: []string{"Subject"}, offset: -1},
+		{text: "UID"},
+	}, true)
+	if err != nil || len(fetched) != 1 {
+		t.Fatalf("Couldn't fetch: %v (%v)", fetched, err)
+	}
+	expected := []fetchItem{
+		// The upstream server cleared \Recent when the search selected INBOX
+		{key: "FLAGS", value: "(\\Flagged)"},
+		{key: "INTERNALDATE", value: `"02-Mar-2015 14:00:00 +0100"`},
+		{key: "BODY[HEADER.FIELDS (Subject)]", value: "{16}\r\nSubject: Lunch\n\n"},
+		{key: "UID", value: "1"},
+	}
+	if fetched[0].id != "1" || !reflect.DeepEqual(fetched[0].items, expected) {
+		t.Errorf("Invalid fetch: %s %q", fetched[0].id, fetched[0].items)
+	}
+
+	// BODY[] is relayed as BODY.PEEK[], and RFC822 as BODY.PEEK[]: the
+	// server sets \Seen itself
+	fetched, err = ps.Fetch("INBOX", "1", []fetchArgument{
+		{text: "BODY", section: "TEXT", fields: []string{}, offset: -1},
+		{text: "RFC822.TEXT"},
+	}, false)
+	if err != nil || len(fetched) != 1 {
+		t.Fatalf("Couldn't fetch: %v (%v)", fetched, err)
+	}
+	if items := fetched[0].items; len(items) != 2 || items[0].key != "BODY[TEXT]" || items[1].key != "RFC822.TEXT" || items[0].value != items[1].value {
+		t.Errorf("Invalid fetch: %q", items)
+	}
+	if unseen, _ := upstream.CountUnseen("INBOX"); unseen != 1 {
+		t.Errorf("Fetching BODY[] set \\Seen upstream")
+	}
+
+	// BODY[]<0.10> starts at the first octet, but it isn't a bare BODY
+	fetched, err = ps.Fetch("INBOX", "1", []fetchArgument{{text: "BODY", length: 10}}, false)
+	if err != nil || len(fetched) != 1 || len(fetched[0].items) != 1 {
+		t.Fatalf("Couldn't fetch: %v (%v)", fetched, err)
+	}
+	if item := fetched[0].items[0]; item.key != "BODY[]<0.10>" || item.value != "{10}\r\n"+maildirTestMessage[:10] {
+		t.Errorf("Invalid partial fetch: %q", item)
+	}
+
+	flagged, err := ps.Flag(ADD, "INBOX", "1", true, []string{"\\Seen"})
+	if err != nil || len(flagged) != 1 || flagged[0].items[0].value != "(\\Flagged \\Seen)" {
+		t.Errorf("Invalid STORE: %v (%v)", flagged, err)
+	}
+	if first, err := ps.FirstUnseen("Archive/2012"); err != nil || first != 1 {
+		t.Errorf("Invalid first unseen: %d (%v)", first, err)
+	}
+	if unseen, _ := ps.CountUnseen("INBOX"); unseen != 0 {
+		t.Errorf("Invalid unseen count after STORE: %d", unseen)
+	}
+}
+
+// TestProxyTimeout tests that a silent upstream server makes commands
+// fail, and that nothing is written on the connection afterwards
+func TestProxyTimeout(t *testing.T) {
+	afterTimeout := make(chan string, 1)
+	dial := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			r := bufio.NewReader(server)
+			server.Write([]byte("* OK ready\r\n"))
+			if line, _ := r.ReadString('\n'); strings.HasPrefix(line, "P1 LOGIN ") {
+				server.Write([]byte("P1 OK LOGIN completed\r\n"))
+			}
+			// Never answer the next command
+			r.ReadString('\n')
+			rest, _ := ioutil.ReadAll(r)
+			afterTimeout <- string(rest)
+		}()
+		return client, nil
+	}
+	ps := NewProxyMailstore(dial, "alice", "secret")
+	ps.timeout = 100 * time.Millisecond
+	defer ps.Close()
+
+	start := time.Now()
+	if _, err := ps.TotalMessages("INBOX"); err == nil {
+		t.Fatal("The command succeeded without an answer")
+	}
+	if elapsed := time.Since(start); elapsed > 5*ps.timeout {
+		t.Errorf("The command failed after %s", elapsed)
+	}
+	select {
+	case rest := <-afterTimeout:
+		if rest != "" {
+			t.Errorf("Wrote %q after the timeout", rest)
+		}
+	case <-time.After(time.Second):
+		t.Error("The connection wasn't closed")
+	}
+}
+
+// TestProxyIdleClosed tests that a command on an idle connection that the
+// server closed in the meantime goes through on a new connection
+func TestProxyIdleClosed(t *testing.T) {
+	var servers []net.Conn
+	s := NewServer(StoreOption(NewMemoryMailstore()))
+	dial := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		servers = append(servers, server)
+		go s.ServeConn(server)
+		return client, nil
+	}
+	ps := NewProxyMailstore(dial, "alice", "secret")
+	defer ps.Close()
+
+	if total, err := ps.TotalMessages("INBOX"); err != nil || total != 0 {
+		t.Fatalf("Invalid total: %d (%v)", total, err)
+	}
+	if len(ps.idle) != 1 || len(servers) != 1 {
+		t.Fatalf("Invalid pool: %d idle, %d dialed", len(ps.idle), len(servers))
+	}
+	servers[0].Close()
+
+	if total, err := ps.TotalMessages("INBOX"); err != nil || total != 0 {
+		t.Errorf("Invalid total after the close: %d (%v)", total, err)
+	}
+	if len(ps.idle) != 1 || len(servers) != 2 {
+		t.Errorf("Invalid pool after the close: %d idle, %d dialed", len(ps.idle), len(servers))
+	}
+}
@@ -53,7 +53,7 @@ func no(tag string, message string) *response {
 
 // empty creates an empty response
 func empty() *response {
-	return &response{}
+	return &response{done: true}
 }
 
 // continuation creates a continuation ('+') response
@@ -99,7 +99,16 @@ func (r *response) write(w *bufio.Writer) error {
 		}
 	}
 
-	_, err := w.WriteString(r.tag + " " + r.condition + " " + r.message + "\r\n")
+	// Empty responses only flush the untagged lines
+	if r.tag == "" {
+		return w.Flush()
+	}
+
+	line := r.tag + " " + r.condition
+	if r.message != "" {
+		line += " " + r.message
+	}
+	_, err := w.WriteString(line + "\r\n")
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,428 @@
+package unpeu
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/paulrosania/go-charset/charset"
+)
+
+// searchableMessage is the view of a message needed to evaluate SEARCH
+// arguments in memory. A Mailstore that can list the messages of a
+// mailbox gets a correct SEARCH by implementing it and calling
+// matchSearch on each message.
+type searchableMessage interface {
+	// Flags returns the IMAP flags of the message: system flags, such as
+	// \Seen or \Recent, and keywords
+	Flags() []string
+	// InternalDate returns the date at which the message was received
+	InternalDate() time.Time
+	// Size returns the size of the message, as in RFC822.SIZE
+	Size() (int64, error)
+	// Header returns the message header
+	Header() (mail.Header, error)
+	// Body returns the raw, undecoded, body of the message. The reader is
+	// closed once the search is done with it.
+	Body() (io.ReadCloser, error)
+	// Uid returns the UID of the message
+	Uid() int
+	// SequenceId returns the sequence id of the message in its mailbox
+	SequenceId() int
+}
+
+// searchContext holds the mailbox information needed to expand sequence
+// sets into actual ids
+type searchContext struct {
+	maxUid        int
+	maxSequenceId int
+
+	// The sequence sets of the search, parsed the first time they are
+	// needed, by key and text
+	ranges map[[2]string][]sequenceRange
+}
+
+// newSearchContext returns the context of a search in a mailbox
+func newSearchContext(maxUid, maxSequenceId int) searchContext {
+	return searchContext{
+		maxUid:        maxUid,
+		maxSequenceId: maxSequenceId,
+		ranges:        make(map[[2]string][]sequenceRange),
+	}
+}
+
+// inSequenceSet returns true if id is in the sequence set of the UID or
+// SEQUENCESET key. The set is only parsed once for the whole search.
+func (ctx searchContext) inSequenceSet(key, sequenceSet string, id int) (bool, error) {
+	ranges, ok := ctx.ranges[[2]string{key, sequenceSet}]
+	if !ok {
+		max := ctx.maxSequenceId
+		if key == "UID" {
+			max = ctx.maxUid
+		}
+		var err error
+		ranges, err = toRanges(sequenceSet, max)
+		if err != nil {
+			return false, err
+		}
+		if ctx.ranges != nil {
+			ctx.ranges[[2]string{key, sequenceSet}] = ranges
+		}
+	}
+	return inRanges(ranges, id), nil
+}
+
+// matchMessages returns the ids, UIDs or sequence ids, of the messages
+// that match the arguments, among count messages in UID order
+func matchMessages(count int, message func(i int) searchableMessage, args []searchArgument, returnUid bool) ([]threadMember, error) {
+	var maxUid int
+	if count > 0 {
+		maxUid = message(count - 1).Uid()
+	}
+	ctx := newSearchContext(maxUid, count)
+	result := make([]threadMember, 0)
+	for i := 0; i < count; i++ {
+		msg := message(i)
+		ok, err := matchSearch(ctx, args, msg)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if returnUid {
+			result = append(result, threadMember{id: msg.Uid()})
+		} else {
+			result = append(result, threadMember{id: msg.SequenceId()})
+		}
+	}
+	return result, nil
+}
+
+// matchSearch returns true if the message matches all the arguments, as
+// produced by aggregateSearchArguments
+func matchSearch(ctx searchContext, args []searchArgument, msg searchableMessage) (bool, error) {
+	for _, arg := range args {
+		ok, err := matchSearchArgument(ctx, arg, msg)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchSearchArgument evaluates a single argument, recursing into ORs and
+// groups
+func matchSearchArgument(ctx searchContext, arg searchArgument, msg searchableMessage) (bool, error) {
+	var ok bool
+	var err error
+
+	switch {
+	case arg.or:
+		ok, err = matchSearchArgument(ctx, arg.children[0], msg)
+		if err == nil && !ok {
+			ok, err = matchSearchArgument(ctx, arg.children[1], msg)
+		}
+	case arg.group:
+		ok, err = matchSearch(ctx, arg.children, msg)
+	default:
+		ok, err = matchSearchKey(ctx, arg, msg)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if arg.not {
+		ok = !ok
+	}
+	return ok, nil
+}
+
+// searchKeyFlags maps the search keys testing a flag to that flag and
+// whether the flag must be set or not
+var searchKeyFlags = map[string]struct {
+	flag string
+	set  bool
+}{
+	"ANSWERED":   {"\\Answered", true},
+	"DELETED":    {"\\Deleted", true},
+	"DRAFT":      {"\\Draft", true},
+	"FLAGGED":    {"\\Flagged", true},
+	"RECENT":     {"\\Recent", true},
+	"SEEN":       {"\\Seen", true},
+	"OLD":        {"\\Recent", false},
+	"UNANSWERED": {"\\Answered", false},
+	"UNDELETED":  {"\\Deleted", false},
+	"UNDRAFT":    {"\\Draft", false},
+	"UNFLAGGED":  {"\\Flagged", false},
+	"UNSEEN":     {"\\Seen", false},
+}
+
+// searchKeyHeaders maps the search keys testing a header to that header
+var searchKeyHeaders = map[string]string{
+	"FROM":    "From",
+	"TO":      "To",
+	"CC":      "Cc",
+	"BCC":     "Bcc",
+	"SUBJECT": "Subject",
+}
+
+func matchSearchKey(ctx searchContext, arg searchArgument, msg searchableMessage) (bool, error) {
+	if f, ok := searchKeyFlags[arg.key]; ok {
+		return hasFlag(msg, f.flag) == f.set, nil
+	}
+	if field, ok := searchKeyHeaders[arg.key]; ok {
+		return matchHeader(msg, field, arg.values[0])
+	}
+
+	switch arg.key {
+	case "NEW":
+		return hasFlag(msg, "\\Recent") && !hasFlag(msg, "\\Seen"), nil
+	case "KEYWORD":
+		return hasFlag(msg, arg.values[0]), nil
+	case "UNKEYWORD":
+		return !hasFlag(msg, arg.values[0]), nil
+
+	case "HEADER":
+		return matchHeader(msg, arg.values[0], arg.values[1])
+	case "BODY":
+		return matchBody(msg, arg.values[0])
+	case "TEXT":
+		ok, err := matchAnyHeader(msg, arg.values[0])
+		if err != nil || ok {
+			return ok, err
+		}
+		return matchBody(msg, arg.values[0])
+
+	case "BEFORE":
+		return searchDay(msg.InternalDate()).Before(searchDate(arg.values[0])), nil
+	case "ON":
+		return searchDay(msg.InternalDate()).Equal(searchDate(arg.values[0])), nil
+	case "SINCE":
+		return !searchDay(msg.InternalDate()).Before(searchDate(arg.values[0])), nil
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		sent, err := sentDate(msg)
+		if err != nil {
+			return false, err
+		}
+		day := searchDate(arg.values[0])
+		switch arg.key {
+		case "SENTBEFORE":
+			return sent.Before(day), nil
+		case "SENTON":
+			return sent.Equal(day), nil
+		default:
+			return !sent.Before(day), nil
+		}
+
+	case "LARGER", "SMALLER":
+		limit, err := strconv.ParseInt(arg.values[0], 10, 64)
+		if err != nil {
+			return false, err
+		}
+		size, err := msg.Size()
+		if err != nil {
+			return false, err
+		}
+		if arg.key == "LARGER" {
+			return size > limit, nil
+		}
+		return size < limit, nil
+
+	case "UID":
+		return ctx.inSequenceSet(arg.key, arg.values[0], msg.Uid())
+	case "SEQUENCESET":
+		return ctx.inSequenceSet(arg.key, arg.values[0], msg.SequenceId())
+	}
+
+	// ALL, and thread modes which aren't criteria
+	return true, nil
+}
+
+// searchDate parses a date as given in a SEARCH command. Dates have
+// already been validated by aggregateSearchArguments.
+func searchDate(value string) time.Time {
+	date, _ := time.Parse("02-Jan-2006", value)
+	return date
+}
+
+// searchDay strips the time of a date, keeping its own timezone, as
+// mandated by RFC 3501 for date comparisons
+func searchDay(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// sentDate returns the day of the Date header, falling back to the
+// internal date if it is missing or invalid
+func sentDate(msg searchableMessage) (time.Time, error) {
+	hdr, err := msg.Header()
+	if err != nil {
+		return time.Time{}, err
+	}
+	date, err := hdr.Date()
+	if err != nil {
+		date = msg.InternalDate()
+	}
+	return searchDay(date), nil
+}
+
+func hasFlag(msg searchableMessage, flag string) bool {
+	for _, f := range msg.Flags() {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchWordDecoder decodes RFC 2047 encoded-words in any known charset
+var searchWordDecoder = &mime.WordDecoder{CharsetReader: charset.NewReader}
+
+// decodeHeader decodes a header value, or returns it untouched if it
+// can't be decoded
+func decodeHeader(value string) string {
+	decoded, err := searchWordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// matchHeader returns true if the given header field exists and contains
+// the value. An empty value matches all messages that have the field.
+func matchHeader(msg searchableMessage, field, value string) (bool, error) {
+	hdr, err := msg.Header()
+	if err != nil {
+		return false, err
+	}
+	for _, v := range hdr[textproto.CanonicalMIMEHeaderKey(field)] {
+		if containsFold(decodeHeader(v), value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchAnyHeader returns true if any header line contains the value
+func matchAnyHeader(msg searchableMessage, value string) (bool, error) {
+	hdr, err := msg.Header()
+	if err != nil {
+		return false, err
+	}
+	for field, values := range hdr {
+		for _, v := range values {
+			if containsFold(field+": "+decodeHeader(v), value) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// matchBody returns true if any text part of the body contains the value,
+// once transfer-decoded and converted to UTF-8
+func matchBody(msg searchableMessage, value string) (bool, error) {
+	hdr, err := msg.Header()
+	if err != nil {
+		return false, err
+	}
+	body, err := msg.Body()
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	return matchPart(body, hdr.Get("Content-Type"), hdr.Get("Content-Transfer-Encoding"), value)
+}
+
+// matchPart looks for the value in a MIME part, recursing into multiparts
+func matchPart(rd io.Reader, contentType, encoding, value string) (bool, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// RFC 2045 default
+		mediaType = "text/plain"
+		params = map[string]string{"charset": "us-ascii"}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(rd, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return false, nil
+			}
+			if err != nil {
+				// Broken MIME structure; nothing more can be found
+				return false, nil
+			}
+			ok, err := matchPart(p, p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), value)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+	}
+
+	switch strings.ToLower(encoding) {
+	case "base64":
+		rd = base64.NewDecoder(base64.StdEncoding, rd)
+	case "quoted-printable":
+		rd = quotedprintable.NewReader(rd)
+	}
+
+	if strings.HasPrefix(mediaType, "text/") || mediaType == "message/rfc822" {
+		if cs := params["charset"]; cs != "" && !strings.EqualFold(cs, "utf-8") && !strings.EqualFold(cs, "us-ascii") {
+			decoded, err := charset.NewReader(cs, rd)
+			if err == nil {
+				rd = decoded
+			}
+		}
+	}
+
+	return streamContainsFold(rd, value), nil
+}
+
+// streamContainsFold looks for substr in the reader, case-insensitively,
+// without reading it all in memory
+func streamContainsFold(rd io.Reader, substr string) bool {
+	needle := strings.ToLower(substr)
+	if needle == "" {
+		return true
+	}
+
+	// Chunks are lowercased with the end of the previous one, so that
+	// matches spanning two chunks are found. The kept end is large enough
+	// for any needle, even if lowercasing changed its length.
+	keep := 2*len(substr) + utf8.UTFMax
+	chunk := make([]byte, 32*1024)
+	var window []byte
+	for {
+		n, err := io.ReadFull(rd, chunk)
+		if n > 0 {
+			window = append(window, chunk[:n]...)
+			if strings.Contains(strings.ToLower(string(window)), needle) {
+				return true
+			}
+			if len(window) > keep {
+				window = append(window[:0], window[len(window)-keep:]...)
+			}
+		}
+		if err != nil {
+			// Either the end of the part, or a part that can't be
+			// decoded, which simply doesn't match
+			return false
+		}
+	}
+}
+
+// containsFold returns true if substr is in s, case-insensitively
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
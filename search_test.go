@@ -0,0 +1,157 @@
+package unpeu
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSearchMessage is a searchableMessage built from a raw message
+type testSearchMessage struct {
+	flags []string
+	date  time.Time
+	raw   string
+	uid   int
+	seq   int
+}
+
+func (m *testSearchMessage) Flags() []string         { return m.flags }
+func (m *testSearchMessage) InternalDate() time.Time { return m.date }
+func (m *testSearchMessage) Size() (int64, error)    { return int64(len(m.raw)), nil }
+func (m *testSearchMessage) Uid() int                { return m.uid }
+func (m *testSearchMessage) SequenceId() int         { return m.seq }
+
+func (m *testSearchMessage) Header() (mail.Header, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(m.raw))
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+func (m *testSearchMessage) Body() (io.ReadCloser, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(m.raw))
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(msg.Body)
+	return ioutil.NopCloser(bytes.NewReader(body)), err
+}
+
+func TestMatchSearch(t *testing.T) {
+	messages := []*testSearchMessage{
+		{
+			flags: []string{"\\Seen", "work"},
+			date:  time.Date(2015, 3, 10, 23, 0, 0, 0, time.FixedZone("", -8*3600)),
+			raw: "From: =?ISO-8859-1?Q?Andr=E9?= <andre@example.com>\r\n" +
+				"To: team@example.com\r\n" +
+				"Subject: =?UTF-8?B?UsOpdW5pb24=?=\r\n" +
+				"Date: Tue, 10 Mar 2015 23:00:00 -0800\r\n" +
+				"Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n" +
+				"\r\n" +
+				"Le caf=E9 est pr=EAt.\r\n",
+			uid: 10,
+			seq: 1,
+		},
+		{
+			flags: []string{"\\Recent", "\\Flagged"},
+			date:  time.Date(2015, 3, 12, 8, 0, 0, 0, time.UTC),
+			raw: "From: bob@example.com\r\n" +
+				"To: andre@example.com\r\n" +
+				"Subject: Report\r\n" +
+				"Date: Wed, 11 Mar 2015 08:00:00 +0000\r\n" +
+				"MIME-Version: 1.0\r\n" +
+				"Content-Type: multipart/mixed; boundary=XX\r\n" +
+				"\r\n" +
+				"--XX\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"See attached.\r\n" +
+				"--XX\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"UXVhcnRlcmx5IG51bWJlcnMK\r\n" +
+				"--XX--\r\n",
+			uid: 12,
+			seq: 2,
+		},
+	}
+	ctx := newSearchContext(12, 2)
+
+	vectors := []struct {
+		input  string
+		output []int
+	}{
+		{"ALL", []int{1, 2}},
+		{"SEEN", []int{1}},
+		{"NEW", []int{2}},
+		{"OLD", []int{1}},
+		{"FLAGGED", []int{2}},
+		{"KEYWORD work", []int{1}},
+		{"UNKEYWORD work", []int{2}},
+		{"CHARSET UTF-8 FROM {6}\r\nandré", []int{1}},
+		{"CHARSET UTF-8 SUBJECT {8}\r\nréunion", []int{1}},
+		{"TO andre", []int{2}},
+		{"CHARSET ISO-8859-1 BODY {4}\r\ncaf\xe9", []int{1}},
+		{"BODY quarterly", []int{2}},
+		{"TEXT quarterly", []int{2}},
+		{"TEXT team@", []int{1}},
+		{"HEADER MIME-Version \"\"", []int{2}},
+		{"ON 10-Mar-2015", []int{1}},
+		{"SINCE 11-Mar-2015", []int{2}},
+		{"SENTON 11-Mar-2015", []int{2}},
+		{"SENTBEFORE 11-Mar-2015", []int{1}},
+		{"UID 11:*", []int{2}},
+		{"2", []int{2}},
+		{"LARGER 300", []int{2}},
+		{"SMALLER 300", []int{1}},
+		{"OR SEEN FLAGGED", []int{1, 2}},
+		{"NOT (SEEN KEYWORD work)", []int{2}},
+		{"OR NOT SEEN BODY est", []int{1, 2}},
+	}
+
+	for _, v := range vectors {
+		args, err := aggregateSearchArguments([]byte(v.input))
+		if err != nil {
+			t.Fatalf("Invalid input %q: %s", v.input, err)
+		}
+
+		actual := make([]int, 0)
+		for _, msg := range messages {
+			ok, err := matchSearch(ctx, args, msg)
+			if err != nil {
+				t.Fatalf("Error matching %q: %s", v.input, err)
+			}
+			if ok {
+				actual = append(actual, msg.seq)
+			}
+		}
+		if len(actual) != len(v.output) {
+			t.Errorf("Invalid results for %q: got %v, expected %v", v.input, actual, v.output)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != v.output[i] {
+				t.Errorf("Invalid results for %q: got %v, expected %v", v.input, actual, v.output)
+				break
+			}
+		}
+	}
+}
+
+func TestStreamContainsFold(t *testing.T) {
+	// The needle spans the boundary between two chunks
+	haystack := strings.Repeat("a", 32*1024-3) + "NeEdLe" + strings.Repeat("b", 10)
+	if !streamContainsFold(strings.NewReader(haystack), "needle") {
+		t.Error("Match across chunks wasn't found")
+	}
+	if streamContainsFold(strings.NewReader(haystack), "needles") {
+		t.Error("Unexpected match")
+	}
+}
@@ -1,6 +1,7 @@
 package unpeu
 
 import (
+	"fmt"
 	"sort"
 	"strconv"
 	"strings"
@@ -36,9 +37,16 @@ func isValid(sequenceSet string) bool {
 	return true
 }
 
-func toList(sequenceSet string, max int) ([]int, error) {
+// sequenceRange is a range of ids of a sequence set, bounds included
+type sequenceRange struct {
+	lo, hi int
+}
+
+// toRanges returns the ranges of the sequence set, where * is max,
+// without expanding them
+func toRanges(sequenceSet string, max int) ([]sequenceRange, error) {
 	parts := strings.Split(sequenceSet, ",")
-	all := make(map[int]struct{})
+	ranges := make([]sequenceRange, 0, len(parts))
 
 	for _, part := range parts {
 		colon := strings.Index(part, ":")
@@ -66,10 +74,10 @@ func toList(sequenceSet string, max int) ([]int, error) {
 
 			// If the non-converted is over max, cap it
 			if left > max && right == max {
-				all[max] = struct{}{}
+				ranges = append(ranges, sequenceRange{max, max})
 				continue
 			} else if right > max && left == max {
-				all[max] = struct{}{}
+				ranges = append(ranges, sequenceRange{max, max})
 				continue
 			}
 
@@ -78,18 +86,12 @@ func toList(sequenceSet string, max int) ([]int, error) {
 				continue
 			}
 
-			from := left
-			to := right
-			if from > right {
-				from = right
-				to = left
-			}
-
-			for i := from; i <= to; i++ {
-				all[i] = struct{}{}
+			if left > right {
+				left, right = right, left
 			}
+			ranges = append(ranges, sequenceRange{left, right})
 		case part == "*":
-			all[max] = struct{}{}
+			ranges = append(ranges, sequenceRange{max, max})
 		case part == "":
 			continue
 		default:
@@ -97,6 +99,64 @@ func toList(sequenceSet string, max int) ([]int, error) {
 			if err != nil {
 				return nil, err
 			}
+			ranges = append(ranges, sequenceRange{i, i})
+		}
+	}
+	return ranges, nil
+}
+
+// inRanges returns true if id is in one of the ranges
+func inRanges(ranges []sequenceRange, id int) bool {
+	for _, r := range ranges {
+		if r.lo <= id && id <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// selectIndexes returns the indexes of the messages of the sequence set,
+// among count messages in UID order. UIDs that don't exist are ignored,
+// but sequence ids must all be valid.
+func selectIndexes(count int, uid func(i int) int, sequenceSet string, useUids bool) ([]int, error) {
+	max := count
+	if useUids && count > 0 {
+		max = uid(count - 1)
+	}
+	ids, err := toList(sequenceSet, max)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := make([]int, 0, len(ids))
+	if !useUids {
+		for _, id := range ids {
+			if id < 1 || id > count {
+				return nil, fmt.Errorf("Invalid sequence id: %d (max is %d)", id, count)
+			}
+			indexes = append(indexes, id-1)
+		}
+		return indexes, nil
+	}
+
+	for _, id := range ids {
+		i := sort.Search(count, func(i int) bool { return uid(i) >= id })
+		if i < count && uid(i) == id {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
+
+func toList(sequenceSet string, max int) ([]int, error) {
+	ranges, err := toRanges(sequenceSet, max)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(map[int]struct{})
+	for _, r := range ranges {
+		for i := r.lo; i <= r.hi; i++ {
 			all[i] = struct{}{}
 		}
 	}
@@ -1,6 +1,9 @@
 package unpeu
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 // https://stackoverflow.com/questions/6878590/the-maximum-value-for-an-int-type-in-go#6878625
 const maxInt = int(^uint(0) >> 1)
@@ -67,3 +70,71 @@ func TestValidSequenceSet(t *testing.T) {
 		}
 	}
 }
+
+func TestSequenceRanges(t *testing.T) {
+	type vector struct {
+		input    string
+		max      int
+		in       []int
+		notIn    []int
+		expected int
+	}
+
+	vectors := []vector{
+		{"", 10, nil, []int{1}, 0},
+		{"4:1", 10, []int{1, 4}, []int{0, 5}, 1},
+		{"2:*,6:4", 7, []int{2, 7}, []int{1, 8}, 2},
+		{"12:*", 10, []int{10}, []int{11, 12}, 1},
+		{"11:12", 10, nil, []int{10, 11, 12}, 0},
+		// Not expanded, however big the mailbox
+		{"1:*", maxInt, []int{1, 100000, maxInt}, []int{0}, 1},
+	}
+
+	for _, v := range vectors {
+		ranges, err := toRanges(v.input, v.max)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %s", v.input, err)
+		}
+		if len(ranges) != v.expected {
+			t.Errorf("Invalid ranges for %q: %v", v.input, ranges)
+		}
+		for _, id := range v.in {
+			if !inRanges(ranges, id) {
+				t.Errorf("%d should be in %q", id, v.input)
+			}
+		}
+		for _, id := range v.notIn {
+			if inRanges(ranges, id) {
+				t.Errorf("%d shouldn't be in %q", id, v.input)
+			}
+		}
+	}
+}
+
+func TestSelectIndexes(t *testing.T) {
+	uids := []int{2, 5, 6, 9}
+	uid := func(i int) int { return uids[i] }
+
+	type vector struct {
+		input    string
+		useUids  bool
+		expected []int
+	}
+	vectors := []vector{
+		{"2:3", false, []int{1, 2}},
+		{"*", false, []int{3}},
+		{"1:5", true, []int{0, 1}},
+		// * is the UID of the last message, not the next one
+		{"10:*", true, []int{3}},
+		{"3:4,7:8", true, []int{}},
+	}
+	for _, v := range vectors {
+		indexes, err := selectIndexes(len(uids), uid, v.input, v.useUids)
+		if err != nil || !reflect.DeepEqual(indexes, v.expected) {
+			t.Errorf("Invalid indexes for %q: %v (%v)", v.input, indexes, err)
+		}
+	}
+	if _, err := selectIndexes(len(uids), uid, "3:5", false); err == nil {
+		t.Error("Selected sequence ids past the end")
+	}
+}
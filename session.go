@@ -1,12 +1,16 @@
 package unpeu
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/rakoo/unpeu/auth"
 )
 
 // state is the IMAP session state
@@ -37,6 +41,8 @@ type session struct {
 	st state
 	// mailbox is the currently selected mailbox (if st == selected)
 	mailbox *Mailbox
+	// mailstore holds the mail of the user
+	mailstore Mailstore
 	// config refers to the IMAP configuration
 	config *config
 	// server refers to the server the session is at
@@ -47,18 +53,130 @@ type session struct {
 	conn net.Conn
 	// tls indicates whether or not the communication is encrypted
 	encryption encryptionLevel
+	// loginFailures is the number of failed logins in this session
+	loginFailures uint
+	// credential is what the user logged in with
+	credential *auth.Credential
+	// username is the user the session is logged in as
+	username string
+	// master is the master user impersonating the user, if any
+	master string
 }
 
 // Create a new IMAP session
 func createSession(id string, config *config, server *Server, listener *listener, conn net.Conn) *session {
-	return &session{
-		id:       id,
-		st:       notAuthenticated,
-		config:   config,
-		server:   server,
-		listener: listener,
-		conn:     conn,
+	s := &session{
+		id:        id,
+		st:        notAuthenticated,
+		config:    config,
+		server:    server,
+		listener:  listener,
+		conn:      conn,
+		mailstore: sessionMailstore(config.mailstore),
+	}
+	if listener != nil && listener.encryption == tlsLevel {
+		s.encryption = tlsLevel
+	}
+	return s
+}
+
+// sessionMailstore returns the mailstore as a session sees it: mailstores
+// that keep a state for each session give a new one
+func sessionMailstore(mailstore Mailstore) Mailstore {
+	if opener, ok := mailstore.(interface {
+		newSession() Mailstore
+	}); ok {
+		return opener.newSession()
+	}
+	return mailstore
+}
+
+// login moves the session to the authenticated state, with the mailstore
+// of the user
+func (s *session) login(username string) error {
+	if err := s.server.acquireUser(username); err != nil {
+		return err
+	}
+	if s.config.mailstoreFactory != nil {
+		mailstore, err := s.config.mailstoreFactory(username)
+		if err != nil {
+			s.server.releaseUser(username)
+			return err
+		}
+		s.mailstore = sessionMailstore(mailstore)
+	}
+	s.st = authenticated
+	s.username = username
+	return nil
+}
+
+// impersonate logs a master user in as another user, and records it in
+// the log
+func (s *session) impersonate(username, master string) error {
+	if err := s.login(username); err != nil {
+		return err
+	}
+	s.master = master
+	s.log("AUDIT master user ", master, " logged in as ", username, " from ", s.remoteIP())
+	return nil
+}
+
+// close ends the session when its connection is closed
+func (s *session) close() {
+	if s.username != "" {
+		s.server.releaseUser(s.username)
+	}
+	if s.master != "" {
+		s.log("AUDIT master user ", s.master, " logged out of ", s.username)
+	}
+}
+
+// peerCertificate returns the verified certificate of the client, or nil
+// if the connection isn't TLS or the client sent none
+func (s *session) peerCertificate() *x509.Certificate {
+	conn, ok := s.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// remoteIP returns the address of the client, or nil if it isn't known
+func (s *session) remoteIP() net.IP {
+	return remoteIP(s.conn)
+}
+
+// authenticate checks the credentials with the auth backend, giving it the
+// address of the client if it uses it. It returns the credential the
+// password is for, or nil if it is wrong.
+func (s *session) authenticate(username, password string) (*auth.Credential, error) {
+	return s.authenticateWith(s.config.authBackend, username, password)
+}
+
+// authenticateMaster checks the credentials of a master user
+func (s *session) authenticateMaster(username, password string) (*auth.Credential, error) {
+	if s.config.masterUsers == nil {
+		return nil, fmt.Errorf("No master users")
+	}
+	return s.authenticateWith(s.config.masterUsers, username, password)
+}
+
+// authenticateWith checks the credentials with the given store
+func (s *session) authenticateWith(store auth.AuthStore, username, password string) (*auth.Credential, error) {
+	if remote, ok := store.(auth.RemoteAuthStore); ok {
+		return remote.AuthenticateRemote(s.remoteIP(), username, password)
 	}
+	return auth.AuthenticateCredential(store, username, password)
+}
+
+// hasScope returns whether the credential of the session has the given
+// scope
+func (s *session) hasScope(scope auth.Scope) bool {
+	return s.credential != nil && s.credential.HasScope(scope)
 }
 
 // log writes the info messages to the logger with session information
@@ -72,19 +190,27 @@ func (s *session) log(info ...interface{}) {
 // selectMailbox selects a mailbox - returns true if the mailbox exists
 func (s *session) selectMailbox(path []string) (bool, error) {
 	// Lookup the mailbox
-	mailstore := s.config.mailstore
+	mailstore := s.mailstore
 	mbox, err := mailstore.GetMailbox(path)
 
 	if err != nil {
 		return false, err
 	}
 
-	if mbox == nil {
+	// Mailboxes that only exist as a level of the hierarchy can't be
+	// selected
+	if mbox == nil || mbox.Flags&Noselect != 0 {
 		return false, nil
 	}
 
-	// Make note of the mailbox
+	// Make note of the mailbox. A mailstore that numbers messages for
+	// each session starts again.
 	s.mailbox = mbox
+	if view, ok := mailstore.(interface {
+		selectMailbox(mbox Id)
+	}); ok {
+		view.selectMailbox(mbox.Id)
+	}
 
 	// Set session state
 	s.st = selected
@@ -94,14 +220,14 @@ func (s *session) selectMailbox(path []string) (bool, error) {
 // statusMailbox displays a mailbox status - returns true if the mailbox exists
 func (s *session) statusMailbox(path []string) (bool, error) {
 	// Lookup the mailbox
-	mailstore := s.config.mailstore
+	mailstore := s.mailstore
 	mbox, err := mailstore.GetMailbox(path)
 
 	if err != nil {
 		return false, err
 	}
 
-	if mbox == nil {
+	if mbox == nil || mbox.Flags&Noselect != 0 {
 		return false, nil
 	}
 
@@ -110,8 +236,8 @@ func (s *session) statusMailbox(path []string) (bool, error) {
 
 // addStatusMailboxInfo adds mailbox information in the STATUS format to the given response
 func (s *session) addStatusMailboxInfo(resp *response, mboxName string, params []string) error {
-	mailstore := s.config.mailstore
-	mbox, err := mailstore.GetMailbox([]string{mboxName})
+	mailstore := s.mailstore
+	mbox, err := mailstore.GetMailbox(pathToSlice(mboxName))
 	if err != nil {
 		return err
 	}
@@ -136,8 +262,7 @@ func (s *session) addStatusMailboxInfo(resp *response, mboxName string, params [
 			if err != nil {
 				return err
 			}
-			// For notmuch nextUid is always 0; maybe we should just remove this
-			// line
+			// A mailstore that can't predict the next UID returns 0
 			if nextUid != 0 {
 				paramResponses = append(paramResponses, "UIDNEXT "+strconv.Itoa(int(nextUid)))
 			}
@@ -178,8 +303,8 @@ func (s *session) list(reference []string, pattern []string) ([]*Mailbox, error)
 
 	// Just return a single mailbox if there are no wildcards
 	if wildcard == -1 {
-		mbox, err := s.config.mailstore.GetMailbox(path)
-		if err != nil {
+		mbox, err := s.mailstore.GetMailbox(path)
+		if err != nil || mbox == nil {
 			return ret, err
 		}
 		ret = append(ret, mbox)
@@ -192,7 +317,7 @@ func (s *session) list(reference []string, pattern []string) ([]*Mailbox, error)
 
 // addMailboxInfo adds mailbox information to the given response
 func (s *session) addMailboxInfo(resp *response) error {
-	mailstore := s.config.mailstore
+	mailstore := s.mailstore
 
 	// Get the mailbox information from the mailstore
 	firstUnseen, err := mailstore.FirstUnseen(s.mailbox.Id)
@@ -218,8 +343,7 @@ func (s *session) addMailboxInfo(resp *response) error {
 	resp.extra(fmt.Sprintf("OK [UNSEEN %d] Message %d is first unseen", firstUnseen, firstUnseen))
 	resp.extra(fmt.Sprintf("OK [UIDVALIDITY %d] UIDs valid", s.mailbox.UidValidity))
 
-	// For notmuch nextUid is always 0; maybe we should just remove this
-	// line
+	// A mailstore that can't predict the next UID returns 0
 	if nextUid != 0 {
 		resp.extra(fmt.Sprintf("OK [UIDNEXT %d] Predicted next UID", nextUid))
 	}
@@ -238,7 +362,7 @@ func copySlice(s []string) []string {
 func (s *session) depthFirstMailboxes(
 	results []*Mailbox, path []string, pattern []string) ([]*Mailbox, error) {
 
-	mailstore := s.config.mailstore
+	mailstore := s.mailstore
 
 	// Stop recursing if the pattern is empty or if the path is too long
 	if len(pattern) == 0 || len(path) > 20 {
@@ -247,59 +371,62 @@ func (s *session) depthFirstMailboxes(
 
 	// Consider the next part of the pattern
 	ret := results
-	var err error
 	pat := pattern[0]
+	last := len(pattern) == 1
 
 	switch pat {
-	case "%":
+	case "%", "*":
 		// Get all the mailboxes at the current path
 		all, err := mailstore.GetMailboxes(path)
-		if err == nil {
-			for _, mbox := range all {
-				// Consider the next pattern
+		if err != nil {
+			return ret, err
+		}
+		for _, mbox := range all {
+			if last {
 				ret = append(ret, mbox)
+			} else {
+				// Consider the next pattern
 				ret, err = s.depthFirstMailboxes(ret, mbox.Path, pattern[1:])
 				if err != nil {
-					break
+					return ret, err
 				}
 			}
-		}
-
-	case "*":
-		// Get all the mailboxes at the current path
-		all, err := mailstore.GetMailboxes(path)
-		if err == nil {
-			for _, mbox := range all {
-				// Keep using this pattern
-				ret = append(ret, mbox)
+			if pat == "*" {
+				// Keep using this pattern, * matches any number of levels
 				ret, err = s.depthFirstMailboxes(ret, mbox.Path, pattern)
 				if err != nil {
-					break
+					return ret, err
 				}
 			}
 		}
 
 	default:
 		// Not a wildcard pattern
-		mbox, err := mailstore.GetMailbox(path)
-		if err == nil {
-			ret = append(results, mbox)
-			ret, err = s.depthFirstMailboxes(ret, mbox.Path, pattern)
+		next := append(copySlice(path), pat)
+		if !last {
+			return s.depthFirstMailboxes(ret, next, pattern[1:])
+		}
+		mbox, err := mailstore.GetMailbox(next)
+		if err != nil {
+			return ret, err
+		}
+		if mbox != nil {
+			ret = append(ret, mbox)
 		}
 	}
 
-	return ret, err
+	return ret, nil
 }
 
 func (s *session) append(mailbox string, flags []string, dateTime time.Time, message string) error {
-	mailstore := s.config.mailstore
+	mailstore := s.mailstore
 	return mailstore.AppendMessage(mailbox, flags, dateTime, message)
 }
 
 func (s *session) search(args []searchArgument, returnUid bool, returnThreads bool) (ids []threadMember, err error) {
-	return s.config.mailstore.Search(s.mailbox.Id, args, returnUid, returnThreads)
+	return s.mailstore.Search(s.mailbox.Id, args, returnUid, returnThreads)
 }
 
 func (s *session) fetch(sequenceSet string, args []fetchArgument, returnUid bool) ([]messageFetchResponse, error) {
-	return s.config.mailstore.Fetch(s.mailbox.Id, sequenceSet, args, returnUid)
+	return s.mailstore.Fetch(s.mailbox.Id, sequenceSet, args, returnUid)
 }
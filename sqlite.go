@@ -0,0 +1,545 @@
+package unpeu
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A whole mailstore in a single SQLite database. Mailboxes, UIDs, flags
+// and dates are rows; messages are stored once per content, keyed by
+// their SHA-256, so that the same message in several mailboxes only takes
+// space once. The envelope and the body structure are computed when a
+// message is stored, and FETCH reads them as they are.
+//
+// Mailbox names are stored as a tree of tags, "inbox" or "lists/golang",
+// and Ids are the same names with the INBOX in upper case.
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS mailboxes (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	uid_validity INTEGER NOT NULL,
+	uid_next INTEGER NOT NULL DEFAULT 1,
+	highest_modseq INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS blobs (
+	hash TEXT PRIMARY KEY,
+	content BLOB NOT NULL,
+	size INTEGER NOT NULL,
+	envelope TEXT NOT NULL,
+	bodystructure TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS messages (
+	mailbox INTEGER NOT NULL REFERENCES mailboxes(id),
+	uid INTEGER NOT NULL,
+	hash TEXT NOT NULL REFERENCES blobs(hash),
+	internal_date TEXT NOT NULL,
+	flags TEXT NOT NULL,
+	modseq INTEGER NOT NULL,
+	PRIMARY KEY (mailbox, uid)
+);
+`
+
+var _ Mailstore = &SqliteMailstore{}
+
+// SqliteMailstore keeps everything in a SQLite database
+type SqliteMailstore struct {
+	db *sql.DB
+
+	// UIDs of the messages appended through this mailstore, which are
+	// recent to its sessions only
+	l      sync.Mutex
+	recent map[Id]map[int]struct{}
+}
+
+// NewSqliteMailstore returns a mailstore in db, which must be a SQLite
+// database opened with the driver of the caller's choice. The tables and
+// the INBOX are created if needed.
+func NewSqliteMailstore(db *sql.DB) (*SqliteMailstore, error) {
+	_, err := db.Exec(sqliteSchema)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`INSERT OR IGNORE INTO mailboxes (name, uid_validity) VALUES ('inbox', ?)`, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteMailstore{
+		db:     db,
+		recent: make(map[Id]map[int]struct{}),
+	}, nil
+}
+
+// sqlQueryer is either the database or a transaction
+type sqlQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// sqliteName returns the name of the mailbox in the database
+func sqliteName(mbox Id) string {
+	if strings.EqualFold(string(mbox), "INBOX") {
+		return "inbox"
+	}
+	return string(mbox)
+}
+
+// sqliteId returns the Id of the mailbox with the given name
+func sqliteId(name string) Id {
+	if name == "inbox" {
+		return "INBOX"
+	}
+	return Id(name)
+}
+
+// CreateMailbox creates a mailbox at the given path
+func (ms *SqliteMailstore) CreateMailbox(path []string) error {
+	name := mailboxTag(path)
+	for _, level := range strings.Split(name, tagDelimiter) {
+		if level == "" {
+			return fmt.Errorf("Invalid mailbox name %q", name)
+		}
+	}
+	res, err := ms.db.Exec(`INSERT OR IGNORE INTO mailboxes (name, uid_validity) VALUES (?, ?)`, name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("Mailbox %s already exists", strings.Join(path, string(pathDelimiter)))
+	}
+	return nil
+}
+
+// mailboxNames returns the names of all the mailboxes
+func (ms *SqliteMailstore) mailboxNames() (map[string]struct{}, error) {
+	rows, err := ms.db.Query(`SELECT name FROM mailboxes`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make(map[string]struct{})
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = struct{}{}
+	}
+	return names, rows.Err()
+}
+
+// mailboxRow returns the row id of the mailbox
+func mailboxRow(q sqlQueryer, mbox Id) (int64, error) {
+	var id int64
+	err := q.QueryRow(`SELECT id FROM mailboxes WHERE name = ?`, sqliteName(mbox)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("No mailbox %s", mbox)
+	}
+	return id, err
+}
+
+func (ms *SqliteMailstore) GetMailbox(path []string) (*Mailbox, error) {
+	names, err := ms.mailboxNames()
+	if err != nil {
+		return nil, err
+	}
+	mbox := lookupTagMailbox(names, path)
+	if mbox == nil || mbox.Flags&Noselect != 0 {
+		return mbox, nil
+	}
+	mbox.Id = sqliteId(string(mbox.Id))
+
+	err = ms.db.QueryRow(`SELECT uid_validity FROM mailboxes WHERE name = ?`, sqliteName(mbox.Id)).Scan(&mbox.UidValidity)
+	if err != nil {
+		return nil, err
+	}
+	return mbox, nil
+}
+
+func (ms *SqliteMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
+	names, err := ms.mailboxNames()
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := tagMailboxChildren(names, path)
+	for _, mbox := range mailboxes {
+		mbox.Id = sqliteId(string(mbox.Id))
+	}
+	return mailboxes, nil
+}
+
+// Flags are stored separated by spaces, with a space before the first and
+// after the last, so that a flag is matched with LIKE '% flag %'. LIKE
+// ignores the case of ASCII letters, like IMAP does for flags.
+const sqliteUnseen = `flags NOT LIKE '% \Seen %'`
+
+func (ms *SqliteMailstore) FirstUnseen(mbox Id) (int64, error) {
+	id, err := mailboxRow(ms.db, mbox)
+	if err != nil {
+		return 0, err
+	}
+	var first sql.NullInt64
+	err = ms.db.QueryRow(`SELECT MIN(uid) FROM messages WHERE mailbox = ? AND `+sqliteUnseen, id).Scan(&first)
+	if err != nil || !first.Valid {
+		return 0, err
+	}
+	var seq int64
+	err = ms.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE mailbox = ? AND uid <= ?`, id, first.Int64).Scan(&seq)
+	return seq, err
+}
+
+func (ms *SqliteMailstore) TotalMessages(mbox Id) (int64, error) {
+	id, err := mailboxRow(ms.db, mbox)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	err = ms.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE mailbox = ?`, id).Scan(&total)
+	return total, err
+}
+
+func (ms *SqliteMailstore) RecentMessages(mbox Id) (int64, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	return int64(len(ms.recent[sqliteId(sqliteName(mbox))])), nil
+}
+
+// ClearRecent forgets that the messages of the mailbox are recent, once a
+// session was told about them
+func (ms *SqliteMailstore) ClearRecent(mbox Id) error {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	delete(ms.recent, sqliteId(sqliteName(mbox)))
+	return nil
+}
+
+func (ms *SqliteMailstore) NextUid(mbox Id) (int64, error) {
+	var uidNext int64
+	err := ms.db.QueryRow(`SELECT uid_next FROM mailboxes WHERE name = ?`, sqliteName(mbox)).Scan(&uidNext)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("No mailbox %s", mbox)
+	}
+	return uidNext, err
+}
+
+func (ms *SqliteMailstore) CountUnseen(mbox Id) (int64, error) {
+	id, err := mailboxRow(ms.db, mbox)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	err = ms.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE mailbox = ? AND `+sqliteUnseen, id).Scan(&count)
+	return count, err
+}
+
+// joinFlags returns the flags as stored in the database
+func joinFlags(flags []string) string {
+	if len(flags) == 0 {
+		return " "
+	}
+	return " " + strings.Join(flags, " ") + " "
+}
+
+func (ms *SqliteMailstore) AppendMessage(mailbox string, flags []string, dateTime time.Time, message string) error {
+	names, err := ms.mailboxNames()
+	if err != nil {
+		return err
+	}
+	mbox := lookupTagMailbox(names, pathToSlice(mailbox))
+	if mbox == nil || mbox.Flags&Noselect != 0 {
+		return fmt.Errorf("No mailbox %s", mailbox)
+	}
+	id := sqliteId(string(mbox.Id))
+	if dateTime.IsZero() {
+		dateTime = time.Now()
+	}
+
+	// Parse the message before taking the write lock
+	sum := sha256.Sum256([]byte(message))
+	hash := hex.EncodeToString(sum[:])
+	ep := &envelopeParser{}
+	if err := ep.read(strings.NewReader(message)); err != nil {
+		// Computed again at each FETCH, which will report the error
+		ep.envelope = ""
+	}
+	structure, err := messageStructure(strings.NewReader(message))
+	if err != nil {
+		structure = ""
+	}
+
+	stored := updatedFlags(SET, nil, flags)
+
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Allocate the UID first: the update takes the write lock, so that
+	// concurrent appends are serialized instead of failing to upgrade
+	res, err := tx.Exec(`UPDATE mailboxes SET uid_next = uid_next + 1, highest_modseq = highest_modseq + 1 WHERE name = ?`, sqliteName(id))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No mailbox %s", mailbox)
+	}
+	var row, uid, modseq int64
+	err = tx.QueryRow(`SELECT id, uid_next - 1, highest_modseq FROM mailboxes WHERE name = ?`, sqliteName(id)).Scan(&row, &uid, &modseq)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO blobs (hash, content, size, envelope, bodystructure) VALUES (?, ?, ?, ?, ?)`,
+		hash, []byte(message), len(message), ep.envelope, structure)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO messages (mailbox, uid, hash, internal_date, flags, modseq) VALUES (?, ?, ?, ?, ?, ?)`,
+		row, uid, hash, dateTime.Format(time.RFC3339), joinFlags(stored), modseq)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	recent := ms.recent[id]
+	if recent == nil {
+		recent = make(map[int]struct{})
+		ms.recent[id] = recent
+	}
+	recent[int(uid)] = struct{}{}
+	return nil
+}
+
+func (ms *SqliteMailstore) Search(mbox Id, args []searchArgument, returnUid, returnThreads bool) ([]threadMember, error) {
+	if returnThreads {
+		return nil, fmt.Errorf("THREAD is not supported by the SQLite mailstore")
+	}
+	messages, err := ms.messages(ms.db, mbox)
+	if err != nil {
+		return nil, err
+	}
+
+	message := func(i int) searchableMessage { return messages[i] }
+	return matchMessages(len(messages), message, args, returnUid)
+}
+
+func (ms *SqliteMailstore) Fetch(mbox Id, sequenceSet string, args []fetchArgument, useUids bool) ([]messageFetchResponse, error) {
+	messages, err := ms.messages(ms.db, mbox)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selectSqliteMessages(messages, sequenceSet, useUids)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]messageFetchResponse, 0, len(selected))
+	for _, i := range selected {
+		msg := messages[i]
+		items := make([]fetchItem, 0, len(args))
+		var others []fetchArgument
+		for _, arg := range args {
+			switch {
+			case arg.text == "RFC822.SIZE":
+				items = append(items, fetchItem{key: arg.text, value: strconv.FormatInt(msg.size, 10)})
+			case arg.text == "ENVELOPE" && msg.envelope != "":
+				items = append(items, fetchItem{key: arg.text, value: msg.envelope})
+			case arg.text == "BODYSTRUCTURE" && msg.structure != "":
+				items = append(items, fetchItem{key: arg.text, value: msg.structure})
+			default:
+				others = append(others, arg)
+			}
+		}
+		if len(others) > 0 {
+			otherItems, err := fetchMessage(msg, others)
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't fetch message %d: %s", msg.uid, err)
+			}
+			items = append(items, otherItems...)
+		}
+		results = append(results, messageFetchResponse{id: strconv.Itoa(msg.seq), items: items})
+	}
+	return results, nil
+}
+
+func (ms *SqliteMailstore) Flag(mode flagMode, mbox Id, sequenceSet string, useUids bool, flags []string) ([]messageFetchResponse, error) {
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// As in AppendMessage, write first to hold the write lock until the
+	// end
+	res, err := tx.Exec(`UPDATE mailboxes SET highest_modseq = highest_modseq + 1 WHERE name = ?`, sqliteName(mbox))
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, fmt.Errorf("No mailbox %s", mbox)
+	}
+	var row, modseq int64
+	err = tx.QueryRow(`SELECT id, highest_modseq FROM mailboxes WHERE name = ?`, sqliteName(mbox)).Scan(&row, &modseq)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := ms.messages(tx, mbox)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selectSqliteMessages(messages, sequenceSet, useUids)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]messageFetchResponse, 0, len(selected))
+	for _, i := range selected {
+		msg := messages[i]
+		msg.flags = updatedFlags(mode, msg.flags, flags)
+		_, err = tx.Exec(`UPDATE messages SET flags = ?, modseq = ? WHERE mailbox = ? AND uid = ?`,
+			joinFlags(msg.flags), modseq, row, msg.uid)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, flagsResponse(msg.seq, msg.Flags()))
+	}
+	return results, tx.Commit()
+}
+
+// messages returns the messages of the mailbox, in UID order, without
+// their content
+func (ms *SqliteMailstore) messages(q sqlQueryer, mbox Id) ([]*sqliteMessage, error) {
+	id, err := mailboxRow(q, mbox)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(`SELECT m.uid, m.hash, m.internal_date, m.flags, b.size, b.envelope, b.bodystructure
+		FROM messages m JOIN blobs b ON b.hash = m.hash
+		WHERE m.mailbox = ? ORDER BY m.uid`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ms.l.Lock()
+	recent := make(map[int]struct{}, len(ms.recent[sqliteId(sqliteName(mbox))]))
+	for uid := range ms.recent[sqliteId(sqliteName(mbox))] {
+		recent[uid] = struct{}{}
+	}
+	ms.l.Unlock()
+
+	var messages []*sqliteMessage
+	for rows.Next() {
+		msg := &sqliteMessage{db: ms.db, seq: len(messages) + 1}
+		var date, flags string
+		err := rows.Scan(&msg.uid, &msg.hash, &date, &flags, &msg.size, &msg.envelope, &msg.structure)
+		if err != nil {
+			return nil, err
+		}
+		msg.date, err = time.Parse(time.RFC3339, date)
+		if err != nil {
+			return nil, err
+		}
+		msg.flags = strings.Fields(flags)
+		_, msg.recent = recent[msg.uid]
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// selectSqliteMessages returns the indexes of the messages of the
+// sequence set
+func selectSqliteMessages(messages []*sqliteMessage, sequenceSet string, useUids bool) ([]int, error) {
+	uid := func(i int) int { return messages[i].uid }
+	return selectIndexes(len(messages), uid, sequenceSet, useUids)
+}
+
+// sqliteMessage is a message of the database, as a searchableMessage and
+// a fetchableMessage. Its content is only read when needed.
+type sqliteMessage struct {
+	db      *sql.DB
+	uid     int
+	seq     int
+	hash    string
+	date    time.Time
+	flags   []string
+	recent  bool
+	size    int64
+	content []byte
+
+	// Cached when the message was stored, empty if it couldn't be parsed
+	envelope  string
+	structure string
+}
+
+// load reads the content of the message
+func (msg *sqliteMessage) load() ([]byte, error) {
+	if msg.content != nil {
+		return msg.content, nil
+	}
+	err := msg.db.QueryRow(`SELECT content FROM blobs WHERE hash = ?`, msg.hash).Scan(&msg.content)
+	return msg.content, err
+}
+
+func (msg *sqliteMessage) Flags() []string {
+	flags := append([]string{}, msg.flags...)
+	if msg.recent {
+		flags = append(flags, "\\Recent")
+	}
+	return flags
+}
+
+func (msg *sqliteMessage) InternalDate() time.Time { return msg.date }
+
+func (msg *sqliteMessage) Size() (int64, error) { return msg.size, nil }
+
+func (msg *sqliteMessage) Raw() (io.ReadCloser, error) {
+	content, err := msg.load()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (msg *sqliteMessage) Header() (mail.Header, error) {
+	content, err := msg.load()
+	if err != nil {
+		return nil, err
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	return m.Header, nil
+}
+
+func (msg *sqliteMessage) Body() (io.ReadCloser, error) {
+	content, err := msg.load()
+	if err != nil {
+		return nil, err
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(m.Body), nil
+}
+
+func (msg *sqliteMessage) Uid() int        { return msg.uid }
+func (msg *sqliteMessage) SequenceId() int { return msg.seq }
@@ -0,0 +1,142 @@
+package unpeu
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func setupSqlite(t *testing.T) (*SqliteMailstore, func()) {
+	dir, err := ioutil.TempDir("", "unpeu-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "mail.db")+"?_busy_timeout=10000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := NewSqliteMailstore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ms, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func sqliteFetch(t *testing.T, ms *SqliteMailstore, mbox Id, sequenceSet string, args ...fetchArgument) []string {
+	fetched, err := ms.Fetch(mbox, sequenceSet, args, true)
+	if err != nil {
+		t.Fatal("Couldn't fetch:", err)
+	}
+	items := make([]string, 0)
+	for _, response := range fetched {
+		for _, item := range response.items {
+			items = append(items, item.key+" "+item.value)
+		}
+	}
+	return items
+}
+
+func TestSqliteMailstore(t *testing.T) {
+	ms, cleanup := setupSqlite(t)
+	defer cleanup()
+
+	if err := ms.CreateMailbox([]string{"lists", "golang"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.CreateMailbox([]string{"lists", "golang"}); err == nil {
+		t.Error("Created the same mailbox twice")
+	}
+	mbox, err := ms.GetMailbox([]string{"lists"})
+	if err != nil || mbox == nil || mbox.Flags != Noselect {
+		t.Errorf("Invalid lists: %+v (%v)", mbox, err)
+	}
+	inbox, err := ms.GetMailbox([]string{"inbox"})
+	if err != nil || inbox == nil || inbox.Id != "INBOX" || inbox.UidValidity == 0 {
+		t.Fatalf("Invalid INBOX: %+v (%v)", inbox, err)
+	}
+
+	date := time.Date(2015, 3, 2, 14, 0, 0, 0, time.FixedZone("", 3600))
+	for _, mailbox := range []string{"INBOX", "lists/golang", "INBOX"} {
+		err = ms.AppendMessage(mailbox, []string{"work"}, date, maildirTestMessage)
+		if err != nil {
+			t.Fatal("Couldn't append:", err)
+		}
+	}
+	var blobs int
+	ms.db.QueryRow(`SELECT COUNT(*) FROM blobs`).Scan(&blobs)
+	if blobs != 1 {
+		t.Errorf("The same message was stored %d times", blobs)
+	}
+
+	flagged, err := ms.Flag(ADD, "INBOX", "1", false, []string{"\\Seen", "\\Recent"})
+	if err != nil || len(flagged) != 1 || flagged[0].items[0].value != "(work \\Seen \\Recent)" {
+		t.Errorf("Invalid STORE: %v (%v)", flagged, err)
+	}
+	if first, _ := ms.FirstUnseen("INBOX"); first != 2 {
+		t.Errorf("Invalid first unseen: %d", first)
+	}
+	if unseen, _ := ms.CountUnseen("INBOX"); unseen != 1 {
+		t.Errorf("Invalid unseen count: %d", unseen)
+	}
+	if next, _ := ms.NextUid("INBOX"); next != 3 {
+		t.Errorf("Invalid next UID: %d", next)
+	}
+
+	// Cached items come first
+	items := sqliteFetch(t, ms, "INBOX", "1", fetchArgument{text: "FLAGS"}, fetchArgument{text: "INTERNALDATE"},
+		fetchArgument{text: "RFC822.SIZE"}, fetchArgument{text: "ENVELOPE"},
+		fetchArgument{text: "BODY.PEEK", section: "TEXT", offset: 0, length: 4})
+	expected := []string{
+		"RFC822.SIZE 128",
+		`ENVELOPE ("Mon, 2 Mar 2015 12:00:00 +0000" {5}` + "\r\nLunch" + ` ((NIL NIL "alice" "example.com")) NIL NIL ((NIL NIL "bob" "example.com")) NIL NIL "" "")`,
+		"FLAGS (work \\Seen \\Recent)",
+		`INTERNALDATE "02-Mar-2015 14:00:00 +0100"`,
+		"BODY[TEXT]<0.4> {4}\r\nNoon",
+	}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("Invalid items: got %q, expected %q", items, expected)
+	}
+
+	args, _ := aggregateSearchArguments([]byte("UNSEEN SUBJECT lunch"))
+	found, err := ms.Search("INBOX", args, true, false)
+	if err != nil || len(found) != 1 || found[0].id != 2 {
+		t.Errorf("Invalid search: %v (%v)", found, err)
+	}
+}
+
+func TestSqliteConcurrentAppends(t *testing.T) {
+	ms, cleanup := setupSqlite(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ms.AppendMessage("INBOX", nil, time.Time{}, maildirTestMessage); err != nil {
+				t.Error("Couldn't append:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	messages, err := ms.messages(ms.db, "INBOX")
+	if err != nil || len(messages) != 20 {
+		t.Fatalf("Invalid messages: %d (%v)", len(messages), err)
+	}
+	for i, msg := range messages {
+		if msg.uid != i+1 {
+			t.Errorf("Invalid UID for message %d: %d", i+1, msg.uid)
+		}
+	}
+}
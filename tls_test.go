@@ -0,0 +1,215 @@
+package unpeu
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA, a server certificate for 127.0.0.1 in PEM files, and a
+// client certificate for alice@example.org
+type testPKI struct {
+	dir      string
+	certFile string
+	keyFile  string
+	pool     *x509.CertPool
+	client   tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	dir, err := ioutil.TempDir("", "unpeu-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPKI{dir: dir, pool: x509.NewCertPool()}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "unpeu test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	p.pool.AddCert(ca)
+
+	issue := func(serial int64, template *x509.Certificate) ([]byte, *ecdsa.PrivateKey) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der, key
+	}
+
+	serverDER, serverKey := issue(2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	keyDER, err := x509.MarshalECPrivateKey(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.certFile = filepath.Join(dir, "cert.pem")
+	p.keyFile = filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(p.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverDER}), 0600)
+	ioutil.WriteFile(p.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	clientDER, clientKey := issue(3, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "Alice"},
+		EmailAddresses: []string{"alice@example.org"},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	p.client = tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+	return p
+}
+
+// clientConfig returns the configuration of a client trusting the server,
+// with the client certificate if withCert
+func (p *testPKI) clientConfig(withCert bool) *tls.Config {
+	config := &tls.Config{RootCAs: p.pool, ServerName: "127.0.0.1"}
+	if withCert {
+		config.Certificates = []tls.Certificate{p.client}
+	}
+	return config
+}
+
+// startServer starts a server with the given listener and options, and
+// returns its address and the users who opened a mailstore
+func startServer(t *testing.T, options ...Option) (string, chan string) {
+	users := make(chan string, 4)
+	options = append(options, MailstoreFactoryOption(func(username string) (Mailstore, error) {
+		users <- username
+		return NewMemoryMailstore(), nil
+	}))
+	s := NewServer(options...)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s.config.listeners[0].listener.Addr().String(), users
+}
+
+// exchange sends a line, and reads lines until the one starting with
+// the prefix
+func exchange(t *testing.T, r *bufio.Reader, w net.Conn, line, prefix string) string {
+	if line != "" {
+		if _, err := w.Write([]byte(line + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Waiting for %q after %q: %v", prefix, line, err)
+		}
+		if strings.HasPrefix(got, prefix) {
+			return strings.TrimRight(got, "\r\n")
+		}
+	}
+}
+
+// TestAuthenticateExternalTLS tests logging in with a client certificate
+// on an implicit TLS listener
+func TestAuthenticateExternalTLS(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+	addr, users := startServer(t, ListenTLSOption("127.0.0.1:0", p.certFile, p.keyFile,
+		ClientCertificateOption(p.pool, tls.VerifyClientCertIfGiven)))
+
+	conn, err := tls.Dial("tcp", addr, p.clientConfig(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	exchange(t, r, conn, "", "* OK")
+	if got := exchange(t, r, conn, "A1 CAPABILITY", "* CAPABILITY"); !strings.Contains(got, "AUTH=EXTERNAL") {
+		t.Errorf("EXTERNAL isn't advertised: %s", got)
+	}
+	if got := exchange(t, r, conn, "A2 AUTHENTICATE EXTERNAL "+base64.StdEncoding.EncodeToString([]byte("bob@example.org")), "A2"); !strings.HasPrefix(got, "A2 NO") {
+		t.Errorf("Logged in as someone else: %s", got)
+	}
+	if got := exchange(t, r, conn, "A3 AUTHENTICATE EXTERNAL =", "A3"); got != "A3 OK AUTHENTICATE completed" {
+		t.Fatalf("Can't log in: %s", got)
+	}
+	if user := <-users; user != "alice@example.org" {
+		t.Errorf("Logged in as %s", user)
+	}
+
+	// Without a certificate, only passwords
+	conn, err = tls.Dial("tcp", addr, p.clientConfig(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	exchange(t, r, conn, "", "* OK")
+	if got := exchange(t, r, conn, "A1 AUTHENTICATE EXTERNAL =", "A1"); !strings.HasPrefix(got, "A1 NO") {
+		t.Errorf("Logged in without a certificate: %s", got)
+	}
+}
+
+// TestAuthenticateExternalSTARTTLS tests logging in with a client
+// certificate after STARTTLS, with the response after a continuation
+func TestAuthenticateExternalSTARTTLS(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+	addr, users := startServer(t, ListenSTARTTLSOption("127.0.0.1:0", p.certFile, p.keyFile,
+		ClientCertificateOption(p.pool, tls.RequireAndVerifyClientCert)))
+
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	r := bufio.NewReader(plain)
+	exchange(t, r, plain, "", "* OK")
+	if got := exchange(t, r, plain, "A1 STARTTLS", "A1"); got != "A1 OK Begin TLS negotiation now" {
+		t.Fatalf("Invalid STARTTLS response: %s", got)
+	}
+
+	conn := tls.Client(plain, p.clientConfig(true))
+	r = bufio.NewReader(conn)
+	if got := exchange(t, r, conn, "A2 AUTHENTICATE EXTERNAL", "+"); got != "+ " {
+		t.Errorf("Invalid continuation: %q", got)
+	}
+	// An empty line is an empty response
+	if _, err := conn.Write([]byte("\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := exchange(t, r, conn, "", "A2"); got != "A2 OK AUTHENTICATE completed" {
+		t.Fatalf("Can't log in: %s", got)
+	}
+	if user := <-users; user != "alice@example.org" {
+		t.Errorf("Logged in as %s", user)
+	}
+	if got := exchange(t, r, conn, "A3 AUTHENTICATE EXTERNAL =", "A3"); !strings.HasPrefix(got, "A3 BAD") {
+		t.Errorf("Logged in twice: %s", got)
+	}
+}